@@ -0,0 +1,162 @@
+package aws
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Credentials are AWS access keys, with a session token for temporary credentials.
+type Credentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	SessionToken    string `json:"Token"`
+}
+
+// Region returns the region from the AWS_REGION or AWS_DEFAULT_REGION env variables.
+func Region() string {
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return region
+	}
+	return os.Getenv("AWS_DEFAULT_REGION")
+}
+
+// LoadCredentials finds credentials the way the AWS SDKs do, trying in order:
+// the AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY/AWS_SESSION_TOKEN env variables, the AWS_PROFILE
+// profile of the shared credentials file, ECS container credentials and finally EC2 instance
+// profile credentials.
+func LoadCredentials(ctx context.Context, client *http.Client) (Credentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return Credentials{
+			AccessKeyID:     id,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+	if creds, err := sharedCredentials(); err == nil {
+		return creds, nil
+	}
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		return fetchCredentials(ctx, client, "http://169.254.170.2"+uri, nil)
+	}
+	if creds, err := instanceCredentials(ctx, client); err == nil {
+		return creds, nil
+	}
+	return Credentials{}, errors.New("no AWS credentials found")
+}
+
+// sharedCredentials reads the AWS_PROFILE (or default) profile from the shared credentials file.
+func sharedCredentials() (Credentials, error) {
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return Credentials{}, err
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return Credentials{}, err
+	}
+	defer f.Close()
+
+	creds := Credentials{}
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if section != profile || len(kv) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(kv[1])
+		switch strings.TrimSpace(kv[0]) {
+		case "aws_access_key_id":
+			creds.AccessKeyID = value
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = value
+		case "aws_session_token":
+			creds.SessionToken = value
+		}
+	}
+	if creds.AccessKeyID == "" {
+		return Credentials{}, fmt.Errorf("no credentials for profile %s in %s", profile, path)
+	}
+	return creds, scanner.Err()
+}
+
+// instanceCredentials gets the instance profile credentials from the EC2 instance metadata service (IMDSv2).
+func instanceCredentials(ctx context.Context, client *http.Client) (Credentials, error) {
+	const imds = "http://169.254.169.254/latest"
+	req, err := http.NewRequest(http.MethodPut, imds+"/api/token", nil)
+	if err != nil {
+		return Credentials{}, err
+	}
+	req.Header.Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "300")
+	token, err := readAll(client, req.WithContext(ctx))
+	if err != nil {
+		return Credentials{}, err
+	}
+	header := http.Header{"X-Aws-Ec2-Metadata-Token": {string(token)}}
+	req, err = http.NewRequest(http.MethodGet, imds+"/meta-data/iam/security-credentials/", nil)
+	if err != nil {
+		return Credentials{}, err
+	}
+	req.Header = header
+	role, err := readAll(client, req.WithContext(ctx))
+	if err != nil {
+		return Credentials{}, err
+	}
+	name := strings.TrimSpace(strings.SplitN(string(role), "\n", 2)[0])
+	return fetchCredentials(ctx, client, imds+"/meta-data/iam/security-credentials/"+name, header)
+}
+
+// fetchCredentials gets JSON credentials from a metadata endpoint.
+func fetchCredentials(ctx context.Context, client *http.Client, url string, header http.Header) (Credentials, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return Credentials{}, err
+	}
+	if header != nil {
+		req.Header = header
+	}
+	b, err := readAll(client, req.WithContext(ctx))
+	if err != nil {
+		return Credentials{}, err
+	}
+	creds := Credentials{}
+	err = json.Unmarshal(b, &creds)
+	return creds, err
+}
+
+func readAll(client *http.Client, req *http.Request) ([]byte, error) {
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %s", req.Method, req.URL, res.Status)
+	}
+	return b, nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+)
+
+// daemonRole is a role of DAEMON_ROLES_FILE: who has it, by API token, OIDC subject or OIDC group, and
+// the environments and services they may upgrade by ID patterns, e.g. 1a5 and 1s*, all of them when
+// left out. ReadOnly roles may only look at the upgrades.
+type daemonRole struct {
+	Name     string   `yaml:"name"`
+	Token    string   `yaml:"token"`
+	Subject  string   `yaml:"subject"`
+	Group    string   `yaml:"group"`
+	Envs     []string `yaml:"envs"`
+	Services []string `yaml:"services"`
+	ReadOnly bool     `yaml:"readOnly"`
+}
+
+// readDaemonRoles returns the roles listed in the YAML (or JSON) file.
+func readDaemonRoles(file string) ([]daemonRole, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var roles []daemonRole
+	if err := yaml.UnmarshalStrict(b, &roles); err != nil {
+		return nil, fmt.Errorf("invalid daemon roles %s: %s", file, err)
+	}
+	tokens := map[string]bool{}
+	for _, role := range roles {
+		if role.Name == "" {
+			return nil, fmt.Errorf("a daemon role of %s has no name", file)
+		}
+		holders := 0
+		for _, holder := range []string{role.Token, role.Subject, role.Group} {
+			if holder != "" {
+				holders++
+			}
+		}
+		if holders != 1 {
+			return nil, fmt.Errorf("daemon role %q of %s needs exactly one of token, subject and group", role.Name, file)
+		}
+		if tokens[role.Token] {
+			return nil, fmt.Errorf("daemon role %q of %s has the token of another role", role.Name, file)
+		}
+		if role.Token != "" {
+			tokens[role.Token] = true
+		}
+		for _, pattern := range append(append([]string{}, role.Envs...), role.Services...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("daemon role %q of %s has the invalid pattern %q: %s", role.Name, file, pattern, err)
+			}
+		}
+	}
+	return roles, nil
+}
+
+// matchesAny returns whether s matches one of patterns, or there are none.
+func matchesAny(patterns []string, s string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// caller is who made a request to the daemon API and the roles they have.
+type caller struct {
+	name  string
+	roles []daemonRole
+}
+
+// may returns whether the caller may look at the upgrades of the service serviceID of the environment
+// envID or, with write, also make, finish and pause them. Without DAEMON_ROLES_FILE there is no caller and
+// anyone may.
+func (c *caller) may(envID, serviceID string, write bool) bool {
+	if c == nil {
+		return true
+	}
+	for _, role := range c.roles {
+		if write && role.ReadOnly {
+			continue
+		}
+		if matchesAny(role.Envs, envID) && matchesAny(role.Services, serviceID) {
+			return true
+		}
+	}
+	return false
+}
+
+// unrestricted returns whether the caller may upgrade every service of every environment, as what
+// concerns all of them needs, e.g. freezing upgrades.
+func (c *caller) unrestricted() bool {
+	if c == nil {
+		return true
+	}
+	for _, role := range c.roles {
+		if !role.ReadOnly && (len(role.Envs) == 0 || contains(role.Envs, "*")) && (len(role.Services) == 0 || contains(role.Services, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticator authenticates the callers of the daemon API by their bearer tokens.
+type authenticator struct {
+	roles []daemonRole
+	// oidc verifies the ID tokens of the OIDC provider, nil without DAEMON_OIDC_ISSUER.
+	oidc *oidcVerifier
+}
+
+// newAuthenticator returns the authenticator of the roles of DAEMON_ROLES_FILE, nil without one.
+func newAuthenticator(cfg rancher.Config) (*authenticator, error) {
+	if cfg.DaemonRolesFile == "" {
+		if cfg.DaemonOIDCIssuer != "" {
+			return nil, fmt.Errorf("DAEMON_OIDC_ISSUER needs DAEMON_ROLES_FILE to scope its callers")
+		}
+		return nil, nil
+	}
+	roles, err := readDaemonRoles(cfg.DaemonRolesFile)
+	if err != nil {
+		return nil, err
+	}
+	a := &authenticator{roles: roles}
+	if cfg.DaemonOIDCIssuer != "" {
+		if cfg.DaemonOIDCAudience == "" {
+			return nil, fmt.Errorf("DAEMON_OIDC_ISSUER needs DAEMON_OIDC_AUDIENCE, the client ID its tokens are issued to")
+		}
+		a.oidc = newOIDCVerifier(cfg.DaemonOIDCIssuer, cfg.DaemonOIDCAudience, cfg.DaemonOIDCGroupsClaim)
+	}
+	return a, nil
+}
+
+// errUnauthenticated is the error of requests without a bearer token the daemon accepts.
+var errUnauthenticated = errors.New("a valid bearer token is needed")
+
+// authenticate returns the caller of r, by the API token or ID token it has as a bearer token. The caller
+// of a valid ID token whose subject and groups have no role has no roles.
+func (a *authenticator) authenticate(r *http.Request) (*caller, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil, errUnauthenticated
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	for _, role := range a.roles {
+		if role.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(role.Token)) == 1 {
+			return &caller{name: role.Name, roles: []daemonRole{role}}, nil
+		}
+	}
+	// API tokens aren't JWTs, which have three parts.
+	if a.oidc == nil || strings.Count(token, ".") != 2 {
+		return nil, errUnauthenticated
+	}
+	subject, groups, err := a.oidc.verify(r.Context(), token)
+	if err != nil {
+		log.Printf("Refused an ID token: %s\n", err)
+		return nil, errUnauthenticated
+	}
+	c := &caller{name: subject}
+	for _, role := range a.roles {
+		if role.Subject != "" && role.Subject == subject || role.Group != "" && contains(groups, role.Group) {
+			c.roles = append(c.roles, role)
+		}
+	}
+	return c, nil
+}
+
+// callerKey is the key of the caller of a request in its context.
+type callerKey struct{}
+
+// callerOf returns the caller of r, nil when the daemon API doesn't authenticate its callers.
+func callerOf(r *http.Request) *caller {
+	c, _ := r.Context().Value(callerKey{}).(*caller)
+	return c
+}
+
+// authenticated wraps h so it only serves requests with a bearer token the daemon accepts, when it has
+// DAEMON_ROLES_FILE, with their caller in their context.
+func (d *daemon) authenticated(h http.HandlerFunc) http.HandlerFunc {
+	if d.auth == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := d.auth.authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="rancher-upgrader"`)
+			writeError(w, http.StatusUnauthorized, err)
+			return
+		}
+		if len(c.roles) == 0 {
+			writeError(w, http.StatusForbidden, fmt.Errorf("%s has no daemon role", c.name))
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), callerKey{}, c)))
+	}
+}
+
+// forbidden responds 403 to the caller of r, who may not see, or with write change, the upgrades of the
+// service serviceID of the environment envID.
+func forbidden(w http.ResponseWriter, r *http.Request, envID, serviceID string, write bool) {
+	doing := "see the upgrades of"
+	if write {
+		doing = "upgrade"
+	}
+	writeError(w, http.StatusForbidden, fmt.Errorf("%s may not %s service %s of environment %s", callerOf(r).name, doing, serviceID, envID))
+}
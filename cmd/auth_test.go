@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCallerMay(t *testing.T) {
+	c := &caller{name: "ci", roles: []daemonRole{
+		{Name: "web", Envs: []string{"1a5"}, Services: []string{"1s1*"}},
+		{Name: "viewer", Envs: []string{"1a7"}, ReadOnly: true},
+	}}
+	tests := []struct {
+		envID, serviceID string
+		write            bool
+		may              bool
+	}{
+		{"1a5", "1s1", true, true},
+		{"1a5", "1s12", true, true},
+		{"1a5", "1s2", false, false},
+		{"1a6", "1s1", false, false},
+		{"1a7", "1s9", false, true},
+		{"1a7", "1s9", true, false},
+	}
+	for _, test := range tests {
+		if may := c.may(test.envID, test.serviceID, test.write); may != test.may {
+			t.Errorf("may(%s, %s, %t) = %t, expected %t", test.envID, test.serviceID, test.write, may, test.may)
+		}
+	}
+	var nobody *caller
+	if !nobody.may("1a5", "1s1", true) {
+		t.Error("expected anyone to upgrade without DAEMON_ROLES_FILE")
+	}
+}
+
+func TestCallerUnrestricted(t *testing.T) {
+	tests := []struct {
+		role         daemonRole
+		unrestricted bool
+	}{
+		{daemonRole{Name: "admin"}, true},
+		{daemonRole{Name: "admin", Envs: []string{"*"}, Services: []string{"*"}}, true},
+		{daemonRole{Name: "viewer", ReadOnly: true}, false},
+		{daemonRole{Name: "web", Envs: []string{"1a5"}}, false},
+		{daemonRole{Name: "web", Services: []string{"1s*"}}, false},
+	}
+	for _, test := range tests {
+		c := &caller{name: "ci", roles: []daemonRole{test.role}}
+		if unrestricted := c.unrestricted(); unrestricted != test.unrestricted {
+			t.Errorf("%+v: unrestricted() = %t, expected %t", test.role, unrestricted, test.unrestricted)
+		}
+	}
+}
+
+func TestReadDaemonRoles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		yaml string
+		err  string
+	}{
+		{"- {name: ci, token: s3cret, envs: [1a5], services: [1s*]}\n- {name: ops, group: ops}", ""},
+		{"- {token: s3cret}", "has no name"},
+		{"- {name: ci}", "exactly one of token, subject and group"},
+		{"- {name: ci, token: s3cret, subject: alice}", "exactly one of token, subject and group"},
+		{"- {name: ci, token: s3cret}\n- {name: cd, token: s3cret}", "the token of another role"},
+		{"- {name: ci, token: s3cret, services: ['1s[']}", "invalid pattern"},
+		{"- {name: ci, token: s3cret, admin: true}", "invalid daemon roles"},
+	}
+	for _, test := range tests {
+		file := filepath.Join(dir, "roles.yaml")
+		if err := ioutil.WriteFile(file, []byte(test.yaml), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := readDaemonRoles(file)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%q: unexpected error %s", test.yaml, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%q: expected an error with %q, got %v", test.yaml, test.err, err)
+		}
+	}
+}
+
+func TestAuthenticateToken(t *testing.T) {
+	a := &authenticator{roles: []daemonRole{
+		{Name: "ci", Token: "s3cret-ci"},
+		{Name: "cd", Token: "s3cret-cd"},
+		{Name: "ops", Group: "ops"},
+	}}
+	tests := []struct {
+		header string
+		caller string
+	}{
+		{"Bearer s3cret-ci", "ci"},
+		{"Bearer s3cret-cd ", "cd"},
+		{"Bearer s3cret", ""},
+		{"Bearer s3cret-ci2", ""},
+		{"Bearer ", ""},
+		{"s3cret-ci", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/upgrades", nil)
+		r.Header.Set("Authorization", test.header)
+		c, err := a.authenticate(r)
+		switch {
+		case test.caller == "" && err != errUnauthenticated:
+			t.Errorf("%q: expected it to be refused, got %v, %v", test.header, c, err)
+		case test.caller != "" && (err != nil || c.name != test.caller):
+			t.Errorf("%q: expected caller %s, got %v, %v", test.header, test.caller, c, err)
+		}
+	}
+}
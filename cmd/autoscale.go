@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+	"github.com/richardbolt/rancher-upgrader/upgrader"
+)
+
+// autoscalerEvent is posted to AUTOSCALER_PAUSE_URL and AUTOSCALER_RESUME_URL.
+type autoscalerEvent struct {
+	Action      string   `json:"action"`
+	EnvID       string   `json:"envId"`
+	ServiceID   string   `json:"serviceId"`
+	ServiceName string   `json:"serviceName"`
+	Scale       int      `json:"scale"`
+	Labels      []string `json:"labels"`
+}
+
+// scaleGuard keeps a service scaled by an external autoscaler at its scale during an upgrade.
+type scaleGuard struct {
+	cfg    rancher.Config
+	event  autoscalerEvent
+	cancel context.CancelFunc
+	done   chan struct{}
+	once   sync.Once
+}
+
+// guardAutoscaler does what AUTOSCALER_GUARD says about an external autoscaler of svc, found by
+// AUTOSCALER_LABELS, before it is upgraded. When pinning its scale it returns the guard to release once
+// the upgrade ended, nil otherwise.
+func guardAutoscaler(ctx context.Context, ru upgrader.Upgrader, cfg rancher.Config, svc *rancher.Service) (*scaleGuard, error) {
+	labels := upgrader.AutoscalerLabels(svc, cfg.AutoscalerLabels)
+	if len(labels) == 0 {
+		return nil, nil
+	}
+	switch cfg.AutoscalerGuard {
+	case rancher.AutoscalerFail:
+		return nil, fmt.Errorf("%s is scaled by an autoscaler (%s), not upgrading it", svc.Name, strings.Join(labels, ", "))
+	case rancher.AutoscalerWarn:
+		log.Printf("Warning: %s is scaled by an autoscaler (%s), its scale may change during the upgrade\n", svc.Name, strings.Join(labels, ", "))
+		return nil, nil
+	}
+	// Global services run a container on every host rather than to a scale.
+	if svc.LaunchConfig.Labels["io.rancher.scheduler.global"] == "true" {
+		return nil, nil
+	}
+
+	g := &scaleGuard{
+		cfg: cfg,
+		event: autoscalerEvent{
+			Action:      "pause",
+			EnvID:       cfg.RancherEnvID,
+			ServiceID:   svc.ID,
+			ServiceName: svc.Name,
+			Scale:       svc.Scale,
+			Labels:      labels,
+		},
+		done: make(chan struct{}),
+	}
+	if cfg.AutoscalerPauseURL != "" {
+		if err := postJSON(cfg.AutoscalerPauseURL, g.event); err != nil {
+			return nil, fmt.Errorf("could not pause the autoscaler of %s: %s", svc.Name, err)
+		}
+		log.Printf("Paused the autoscaler of %s\n", svc.Name)
+	}
+	log.Printf("%s is scaled by an autoscaler (%s), pinning it at %d during the upgrade\n", svc.Name, strings.Join(labels, ", "), svc.Scale)
+
+	// Pinning carries on through a cancel or rollback once the overall deadline has passed, until released.
+	var pinCtx context.Context
+	pinCtx, g.cancel = context.WithCancel(context.Background())
+	go g.pin(pinCtx, ru)
+	return g, nil
+}
+
+// pin scales the service back to its scale whenever it changed, every CHECK_INTERVAL, until ctx is done.
+func (g *scaleGuard) pin(ctx context.Context, ru upgrader.Upgrader) {
+	defer close(g.done)
+	interval := time.Duration(g.cfg.CheckInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := ru.PinScale(ctx, g.event.ServiceID, g.event.Scale); err != nil && ctx.Err() == nil {
+			log.Printf("Could not check the scale of %s: %s\n", g.event.ServiceName, err)
+		}
+	}
+}
+
+// release stops pinning the scale and resumes the autoscaler. It may be called more than once and on a
+// nil guard.
+func (g *scaleGuard) release() {
+	if g == nil {
+		return
+	}
+	g.once.Do(func() {
+		g.cancel()
+		<-g.done
+		if g.cfg.AutoscalerResumeURL == "" {
+			return
+		}
+		event := g.event
+		event.Action = "resume"
+		if err := postJSON(g.cfg.AutoscalerResumeURL, event); err != nil {
+			log.Printf("Could not resume the autoscaler of %s: %s\n", event.ServiceName, err)
+			return
+		}
+		log.Printf("Resumed the autoscaler of %s\n", event.ServiceName)
+	})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+	"github.com/richardbolt/rancher-upgrader/upgrader"
+)
+
+// nextBatch holds a batched upgrade before its next batch, next, once done batches were made: while
+// upgrades are paused, and then while BATCH_CMD runs. The upgrade halts when BATCH_CMD fails.
+func nextBatch(ctx context.Context, cfg rancher.Config, done int, next string) error {
+	if err := waitWhilePaused(ctx, cfg, next); err != nil {
+		return err
+	}
+	if cfg.BatchCmd == "" {
+		return nil
+	}
+	log.Printf("Running the batch command after batch %d, before %s\n", done, next)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(cfg.BatchCmdTimeout)*time.Second)
+	defer cancel()
+	// The batch command runs as UPGRADE_TEST_CMD does, told which batch it follows.
+	opts := upgrader.CmdOptions{
+		Dir:        cfg.CmdDir,
+		EnvFile:    cfg.CmdEnvFile,
+		Env:        append(append([]string{}, cfg.CmdEnv...), "BATCH_NUMBER="+strconv.Itoa(done), "BATCH_NEXT="+next),
+		User:       cfg.CmdUser,
+		Shell:      string(cfg.CmdShell),
+		Image:      cfg.CmdImage,
+		Workspace:  cfg.CmdWorkspace,
+		DockerArgs: strings.Fields(cfg.CmdDockerArgs),
+	}
+	if err := upgrader.RunCommandLine(ctx, opts, cfg.BatchCmd); err != nil {
+		return &batchCmdError{fmt.Errorf("the batch command failed after batch %d, halting before %s: %s", done, next, err)}
+	}
+	return nil
+}
+
+// batchCmdError is the failure of BATCH_CMD, which is handled like a failed verification.
+type batchCmdError struct {
+	error
+}
+
+// waitForUpgrade waits for Rancher to make the upgrade u of the service of ru, holding it between its
+// container batches as waitForBatches does, and returns what is done with the service when it fails,
+// and why.
+func waitForUpgrade(ctx context.Context, ru upgrader.Upgrader, cfg rancher.Config, u startedUpgrade) (rancher.FailurePolicy, string, error) {
+	if err := waitForBatches(ctx, ru, cfg, u); err != nil {
+		if _, ok := err.(*batchCmdError); ok {
+			return cfg.OnVerifyFail, "Batch command failed", err
+		}
+		policy, reason := waitFailure(cfg, err)
+		return policy, reason, err
+	}
+	// Block until the service "state" goes from "active" to "upgrading" and finally to "upgraded".
+	// WAIT_FOR_STATES can wait for other states as well, e.g. "healthy", and WAIT_ABORT_STATES stop waiting early.
+	if _, err := ru.WaitForStates(ctx, cfg.WaitForStates, cfg.WaitAbortStates); err != nil {
+		policy, reason := waitFailure(cfg, err)
+		return policy, reason, err
+	}
+	return "", "", nil
+}
+
+// waitForBatches follows Rancher replacing the containers of the upgrade u in batches of the service's
+// batch size, and holds the upgrade after each batch but the last while upgrades are paused and while
+// BATCH_CMD runs, cancelling it and continuing it afterwards. Each batch is waited for for at most
+// UPGRADE_WAIT_TIMEOUT. Without BATCH_CMD or a way to pause upgrades there is nothing to hold them for.
+func waitForBatches(ctx context.Context, ru upgrader.Upgrader, cfg rancher.Config, u startedUpgrade) error {
+	if cfg.BatchCmd == "" && cfg.PauseFile == "" && cfg.Paused == nil {
+		return nil
+	}
+	size := u.BatchSize
+	if size <= 0 {
+		size = 1
+	}
+	batches := (u.Scale + size - 1) / size
+	for done := 1; done < batches; done++ {
+		waitCtx, cancel := context.WithTimeout(ctx, time.Duration(cfg.UpgradeWaitTimeout)*time.Second)
+		_, err := ru.WaitForInstances(waitCtx, upgrader.Replaced(u.ImageUUID, done*size, u.Scale))
+		cancel()
+		if err != nil {
+			return fmt.Errorf("batch %d of %d of %s was not made: %s", done, batches, u.ServiceName, err)
+		}
+		next := fmt.Sprintf("container batch %d of %d of %s", done+1, batches, u.ServiceName)
+		// Batches that weren't paused go on without being held, unless BATCH_CMD runs between them.
+		if isPaused, _ := paused(cfg); !isPaused && cfg.BatchCmd == "" {
+			continue
+		}
+		held, err := ru.HoldUpgrade(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to hold %s before %s: %s", u.ServiceName, next, err)
+		}
+		if !held {
+			log.Printf("Rancher made the last batches of %s before it could be held\n", u.ServiceName)
+			return nil
+		}
+		if err := nextBatch(ctx, cfg, done, next); err != nil {
+			return err
+		}
+		if err := ru.ContinueUpgrade(ctx); err != nil {
+			return fmt.Errorf("failed to continue with %s: %s", next, err)
+		}
+	}
+	return nil
+}
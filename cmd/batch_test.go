@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+	"github.com/richardbolt/rancher-upgrader/upgrader"
+)
+
+// batchUpgrader replaces a container of the service each time its containers are polled, unless its
+// upgrade is held, and records how many were replaced whenever it was held.
+type batchUpgrader struct {
+	upgrader.Upgrader
+	image, old string
+	scale      int
+	replaced   int
+	upgrading  bool
+	holds      []int
+}
+
+func (b *batchUpgrader) containers() []rancher.Container {
+	containers := []rancher.Container{}
+	for i := 0; i < b.scale; i++ {
+		image := b.old
+		if i < b.replaced {
+			image = b.image
+		}
+		containers = append(containers, rancher.Container{State: "running", ImageUUID: image})
+	}
+	return containers
+}
+
+func (b *batchUpgrader) WaitForInstances(ctx context.Context, predicate upgrader.ContainerPredicate) ([]rancher.Container, error) {
+	for !predicate(b.containers()) {
+		if !b.upgrading || b.replaced == b.scale {
+			return b.containers(), context.DeadlineExceeded
+		}
+		b.replaced++
+	}
+	return b.containers(), nil
+}
+
+func (b *batchUpgrader) HoldUpgrade(ctx context.Context) (bool, error) {
+	b.upgrading = false
+	b.holds = append(b.holds, b.replaced)
+	return true, nil
+}
+
+func (b *batchUpgrader) ContinueUpgrade(ctx context.Context) error {
+	b.upgrading = true
+	return nil
+}
+
+func TestWaitForBatches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "batches")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ran := filepath.Join(dir, "ran")
+	tests := []struct {
+		name             string
+		scale, batchSize int
+		cmd              string
+		paused           int
+		holds            []int
+		ran              string
+		err              bool
+	}{
+		{"batches of 5", 12, 5, "echo $BATCH_NUMBER >> " + ran, 0, []int{5, 10}, "1\n2\n", false},
+		{"batches of 1", 3, 0, "echo $BATCH_NUMBER >> " + ran, 0, []int{1, 2}, "1\n2\n", false},
+		{"one batch", 5, 5, "echo $BATCH_NUMBER >> " + ran, 0, nil, "", false},
+		{"failed command", 12, 5, "echo $BATCH_NUMBER >> " + ran + "; false", 0, []int{5}, "1\n", true},
+		{"not paused", 12, 5, "", 0, nil, "", false},
+		{"paused", 12, 5, "", 1, []int{5}, "", false},
+	}
+	for _, test := range tests {
+		os.Remove(ran)
+		ru := &batchUpgrader{image: "docker:org/app:2", old: "docker:org/app:1", scale: test.scale, upgrading: true}
+		cfg := rancher.Config{BatchCmd: test.cmd, BatchCmdTimeout: 10, CmdShell: "sh", UpgradeWaitTimeout: 10}
+		// The upgrade is paused for the first test.paused times it is checked.
+		checked := 0
+		cfg.Paused = func() bool {
+			checked++
+			return checked <= test.paused
+		}
+		u := startedUpgrade{ServiceName: "app", Scale: test.scale, BatchSize: test.batchSize, ImageUUID: ru.image}
+		err := waitForBatches(context.Background(), ru, cfg, u)
+		if _, failed := err.(*batchCmdError); failed != test.err {
+			t.Errorf("%s: expected the batch command to fail: %t, got %v", test.name, test.err, err)
+		}
+		if !reflect.DeepEqual(ru.holds, test.holds) {
+			t.Errorf("%s: expected it to be held after %v containers, got %v", test.name, test.holds, ru.holds)
+		}
+		b, _ := ioutil.ReadFile(ran)
+		if string(b) != test.ran {
+			t.Errorf("%s: expected the batch command to run after batches %q, got %q", test.name, strings.Fields(test.ran), strings.Fields(string(b)))
+		}
+	}
+}
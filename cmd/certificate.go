@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/history"
+	"github.com/richardbolt/rancher-upgrader/rancher"
+	"github.com/richardbolt/rancher-upgrader/upgrader"
+	"github.com/richardbolt/rancher-upgrader/verify"
+)
+
+// certificateResult is the result of the certificate command written to stdout as JSON for scripts.
+type certificateResult struct {
+	LBServiceID   string `json:"lbServiceId"`
+	CertificateID string `json:"certificateId,omitempty"`
+	Replaced      string `json:"replaced,omitempty"`
+	Status        string `json:"status"`
+	Error         string `json:"error,omitempty"`
+}
+
+// rotateCertificate uploads the certificate of CERT_FILE and points the load balancer LB_SERVICE_ID at
+// it instead of CERT_REPLACE_ID, verifying the load balancer serves it, as one deploy. The load balancer
+// is pointed back at the old certificate and the new one removed when that fails.
+func rotateCertificate(ctx context.Context, ru upgrader.Upgrader, cfg rancher.Config) (certificateResult, error) {
+	result := certificateResult{LBServiceID: cfg.LBServiceID, Status: history.Failed}
+	if cfg.LBServiceID == "" || cfg.CertFile == "" || cfg.CertKeyFile == "" {
+		return result, fmt.Errorf("certificate needs LB_SERVICE_ID, CERT_FILE and CERT_KEY_FILE")
+	}
+	files := map[string]string{}
+	for _, path := range []string{cfg.CertFile, cfg.CertKeyFile, cfg.CertChainFile} {
+		if path == "" {
+			continue
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return result, err
+		}
+		files[path] = string(b)
+	}
+	block, _ := pem.Decode([]byte(files[cfg.CertFile]))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return result, fmt.Errorf("%s is not a PEM certificate", cfg.CertFile)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return result, fmt.Errorf("%s: %s", cfg.CertFile, err)
+	}
+	name := cfg.CertName
+	if name == "" {
+		name = fmt.Sprintf("%s-%s", cert.Subject.CommonName, cert.NotAfter.Format("20060102"))
+	}
+
+	defaultID, ids, err := ru.LoadBalancerCertificates(ctx, cfg.LBServiceID)
+	if err != nil {
+		return result, err
+	}
+	result.Replaced = cfg.CertReplaceID
+	if result.Replaced == "" {
+		result.Replaced = defaultID
+	}
+	if result.Replaced != "" && result.Replaced != defaultID && !contains(ids, result.Replaced) {
+		return result, fmt.Errorf("load balancer %s doesn't serve certificate %s", cfg.LBServiceID, result.Replaced)
+	}
+
+	result.CertificateID, err = ru.CreateCertificate(ctx, name, files[cfg.CertFile], files[cfg.CertKeyFile], files[cfg.CertChainFile])
+	if err != nil {
+		return result, err
+	}
+	newDefault, newIDs := defaultID, make([]string, 0, len(ids))
+	if result.Replaced == defaultID {
+		newDefault = result.CertificateID
+	}
+	for _, id := range ids {
+		if id == result.Replaced {
+			id = result.CertificateID
+		}
+		newIDs = append(newIDs, id)
+	}
+	err = ru.SetLoadBalancerCertificates(ctx, cfg.LBServiceID, newDefault, newIDs)
+	if err == nil {
+		err = verifyCertificate(ctx, cfg, block.Bytes)
+	}
+	if err != nil {
+		log.Println(err.Error())
+		return result, rollbackCertificate(ru, cfg, &result, defaultID, ids, err)
+	}
+	result.Status = history.Succeeded
+	log.Printf("Load balancer %s serves certificate %s instead of %s\n", cfg.LBServiceID, result.CertificateID, result.Replaced)
+	return result, nil
+}
+
+// verifyCertificate checks the load balancer serves the certificate cert (DER) at CERT_VERIFY_ADDRS
+// and UPGRADE_TEST_CMD passes.
+func verifyCertificate(ctx context.Context, cfg rancher.Config, cert []byte) error {
+	if len(cfg.CertVerifyAddrs) > 0 {
+		v := verify.Certificate{
+			Addresses:  cfg.CertVerifyAddrs,
+			ServerName: cfg.CertVerifyServerName,
+			Cert:       cert,
+			Timeout:    time.Duration(cfg.LBWaitTimeout) * time.Second,
+			Interval:   time.Duration(cfg.CheckInterval) * time.Second,
+		}
+		if err := v.Verify(ctx); err != nil {
+			return err
+		}
+	}
+	if cfg.Cmd != "" {
+		return runTestCmd(ctx, cfg, &upgradeReport{})
+	}
+	return nil
+}
+
+// rollbackCertificate points the load balancer back at the certificates defaultID and ids and removes the
+// new certificate of result, recording it in result, and returns an error saying so with reason. It gets
+// a fresh context so it still runs once the overall deadline has passed.
+func rollbackCertificate(ru upgrader.Upgrader, cfg rancher.Config, result *certificateResult, defaultID string, ids []string, reason error) error {
+	ctx := context.Background()
+	log.Printf("Pointing load balancer %s back at certificate %s\n", cfg.LBServiceID, result.Replaced)
+	if err := ru.SetLoadBalancerCertificates(ctx, cfg.LBServiceID, defaultID, ids); err != nil {
+		return fmt.Errorf("%s, and failed to point the load balancer back at the old certificate: %s", reason, err)
+	}
+	result.Status = history.RolledBack
+	if err := ru.RemoveCertificate(ctx, result.CertificateID); err != nil {
+		log.Printf("Could not remove the new certificate %s: %s\n", result.CertificateID, err)
+	}
+	return fmt.Errorf("%s, rolled back to the old certificate", reason)
+}
+
+// contains returns true if s is one of ss.
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/richardbolt/rancher-upgrader/upgrader"
+)
+
+// concourseRequest is what Concourse sends a resource on stdin. The source and params are env variables
+// of the config, e.g. {"RANCHER_SERVICE_ID": "1s123"}, params taking precedence.
+type concourseRequest struct {
+	Source  map[string]interface{} `yaml:"source"`
+	Version map[string]string      `yaml:"version"`
+	Params  map[string]interface{} `yaml:"params"`
+}
+
+// concourseResponse is what a resource writes to stdout from in and out.
+type concourseResponse struct {
+	Version  map[string]string   `json:"version"`
+	Metadata []concourseMetadata `json:"metadata,omitempty"`
+}
+
+type concourseMetadata struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// concourseResource runs op (check, in or out) of the Concourse resource protocol, where the versions are
+// the tags deployed to the service: check returns the deployed tag, in writes the deployed tag, image and
+// status to the directory args[0], and out upgrades the service with BUILD_TAG_FILE relative to args[0].
+func concourseResource(op string, args []string) {
+	var req concourseRequest
+	b, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	// YAML is a superset of JSON that decodes objects the way envValue expects.
+	if err := yaml.Unmarshal(b, &req); err != nil {
+		log.Fatalf("invalid %s request: %s", op, err)
+	}
+	for _, values := range []map[string]interface{}{req.Source, req.Params} {
+		for name, v := range values {
+			value, err := envValue(v)
+			if err != nil {
+				log.Fatalf("invalid config value for %s: %s", name, err)
+			}
+			os.Setenv(name, value)
+		}
+	}
+	if op != "check" {
+		if len(args) < 1 {
+			log.Fatalf("usage: %s <directory>", op)
+		}
+		// Files given in the params are relative to the directory of the inputs.
+		if err := os.Chdir(args[0]); err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if cfg.RancherServiceID == "" {
+		log.Fatal("required key RANCHER_SERVICE_ID missing value")
+	}
+	ctx := context.Background()
+	if cfg.TotalDeadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(cfg.TotalDeadline)*time.Second)
+		defer cancel()
+	}
+	ru := upgrader.New(&http.Client{}, cfg)
+
+	var response interface{}
+	switch op {
+	case "check":
+		svc, err := ru.GetServiceConfig(ctx)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		image := svc.LaunchConfig.ImageUUID
+		response = []map[string]string{{"tag": imageTag(image)}}
+	case "in":
+		s, err := getServiceStatus(ctx, ru)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		tag := imageTag(s.Image)
+		if req.Version["tag"] != "" && req.Version["tag"] != tag {
+			log.Printf("%s is running %s now, not %s\n", s.Name, tag, req.Version["tag"])
+		}
+		status, err := json.MarshalIndent(s, "", "  ")
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		// The working directory is the destination directory.
+		for name, content := range map[string][]byte{"tag": []byte(tag), "image": []byte(s.Image), "status.json": status} {
+			if err := ioutil.WriteFile(name, content, 0644); err != nil {
+				log.Fatal(err.Error())
+			}
+		}
+		if req.Version == nil {
+			req.Version = map[string]string{"tag": tag}
+		}
+		response = concourseResponse{
+			Version:  req.Version,
+			Metadata: []concourseMetadata{{"service", s.Name}, {"image", s.Image}, {"state", s.State}},
+		}
+	case "out":
+		report := &upgradeReport{}
+		if err := upgradeService(ctx, ru, cfg, nil, report); err != nil {
+			logDeadline(ctx)
+			log.Fatal(err.Error())
+		}
+		response = concourseResponse{
+			Version: map[string]string{"tag": imageTag(report.To)},
+			Metadata: []concourseMetadata{
+				{"service", report.ServiceName},
+				{"from", report.From},
+				{"to", report.To},
+				{"status", report.status(cfg, nil)},
+			},
+		}
+	}
+	if err := json.NewEncoder(os.Stdout).Encode(response); err != nil {
+		log.Fatal(err.Error())
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/kelseyhightower/envconfig"
+	"gopkg.in/yaml.v2"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+)
+
+// loadConfigFile reads a JSON or YAML object of env variable names to values from path ("-" for stdin)
+// and sets them in the environment so they are picked up by envconfig. Variables already present in
+// the environment take precedence over the file.
+//
+// Lists are joined with commas and objects are encoded as JSON, e.g.
+//
+//	RANCHER_SERVICE_ID: 1s123
+//	BUILD_TAG: "1.2.3"
+//	PORTS: ["8080:80/tcp"]
+//	HEALTH_CHECK: {port: 80, requestLine: "GET /health HTTP/1.0"}
+func loadConfigFile(path string) error {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	values := map[string]interface{}{}
+	if err := yaml.Unmarshal(b, &values); err != nil {
+		return fmt.Errorf("invalid config %s: %s", path, err)
+	}
+	for name, v := range values {
+		if _, ok := os.LookupEnv(name); ok {
+			continue
+		}
+		value, err := envValue(v)
+		if err != nil {
+			return fmt.Errorf("invalid config value for %s: %s", name, err)
+		}
+		os.Setenv(name, value)
+	}
+	return nil
+}
+
+// envValue formats a decoded config value the way it would be written as an env variable.
+func envValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i, item := range v {
+			s, err := envValue(item)
+			if err != nil {
+				return "", err
+			}
+			parts[i] = s
+		}
+		return strings.Join(parts, ","), nil
+	case map[interface{}]interface{}, map[string]interface{}:
+		b, err := json.Marshal(jsonCompatible(v))
+		return string(b), err
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+// overrideConfig sets the fields of cfg named by the env variable names in values, the way envconfig
+// would if they were set in the environment.
+func overrideConfig(cfg *rancher.Config, values map[string]interface{}) error {
+	v := reflect.ValueOf(cfg).Elem()
+	fields := map[string]reflect.Value{}
+	for i := 0; i < v.NumField(); i++ {
+		if name := v.Type().Field(i).Tag.Get("envconfig"); name != "" {
+			fields[name] = v.Field(i)
+		}
+	}
+	for name, value := range values {
+		f, ok := fields[name]
+		if !ok {
+			return fmt.Errorf("unknown config value %s", name)
+		}
+		s, err := envValue(value)
+		if err != nil {
+			return fmt.Errorf("invalid config value for %s: %s", name, err)
+		}
+		if err := setField(f, s); err != nil {
+			return fmt.Errorf("invalid config value for %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// setField decodes s into the config field f.
+func setField(f reflect.Value, s string) error {
+	if d, ok := f.Addr().Interface().(envconfig.Decoder); ok {
+		return d.Decode(s)
+	}
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(s)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 0, 64)
+		if err != nil {
+			return err
+		}
+		f.SetInt(n)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		f.SetFloat(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case reflect.Slice:
+		parts := strings.Split(s, ",")
+		l := reflect.MakeSlice(f.Type(), len(parts), len(parts))
+		for i, part := range parts {
+			if err := setField(l.Index(i), part); err != nil {
+				return err
+			}
+		}
+		f.Set(l)
+	default:
+		return fmt.Errorf("unsupported type %s", f.Type())
+	}
+	return nil
+}
+
+// jsonCompatible converts the map[interface{}]interface{} values produced by YAML decoding
+// into map[string]interface{} so they can be encoded as JSON.
+func jsonCompatible(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			m[fmt.Sprint(k)] = jsonCompatible(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range v {
+			v[i] = jsonCompatible(item)
+		}
+		return v
+	default:
+		return v
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+)
+
+// keyFiles are the Rancher API keys read from RANCHER_ACCESS_KEY_FILE and RANCHER_SECRET_KEY_FILE. The
+// files are read again whenever they change, so a daemon or a long upgrade carries on with rotated keys.
+// A key without a file is the one of the config.
+type keyFiles struct {
+	accessKeyFile string
+	secretKeyFile string
+
+	mu        sync.Mutex
+	accessKey fileKey
+	secretKey fileKey
+}
+
+// fileKey is a key as it was last read from its file.
+type fileKey struct {
+	value   string
+	modTime time.Time
+}
+
+// newKeyFiles returns the key files of cfg.
+func newKeyFiles(cfg rancher.Config) *keyFiles {
+	return &keyFiles{
+		accessKeyFile: cfg.RancherAccessKeyFile,
+		secretKeyFile: cfg.RancherSecretKeyFile,
+		accessKey:     fileKey{value: cfg.RancherAccessKey},
+		secretKey:     fileKey{value: cfg.RancherSecretKey},
+	}
+}
+
+// credentials implements rancher.Credentials.
+func (k *keyFiles) credentials() (string, string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err := k.accessKey.refresh(k.accessKeyFile); err != nil {
+		return "", "", err
+	}
+	if err := k.secretKey.refresh(k.secretKeyFile); err != nil {
+		return "", "", err
+	}
+	return k.accessKey.value, k.secretKey.value, nil
+}
+
+// refresh reads the key from path again if the file changed since it was last read.
+func (key *fileKey) refresh(path string) error {
+	if path == "" {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(key.modTime) {
+		return nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	value := strings.TrimSpace(string(b))
+	if value == "" {
+		return fmt.Errorf("%s is empty", path)
+	}
+	if !key.modTime.IsZero() && value != key.value {
+		log.Printf("Read the rotated Rancher API key from %s\n", path)
+	}
+	key.value, key.modTime = value, info.ModTime()
+	return nil
+}
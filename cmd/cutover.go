@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/aws"
+	"github.com/richardbolt/rancher-upgrader/cutover"
+	"github.com/richardbolt/rancher-upgrader/rancher"
+	"github.com/richardbolt/rancher-upgrader/upgrader"
+	"github.com/richardbolt/rancher-upgrader/verify"
+)
+
+// cutoverSteps returns the cutover steps configured in cfg, in the order they are applied.
+// Traffic shifts are verified with vs at every step.
+func cutoverSteps(ctx context.Context, ru upgrader.Upgrader, cfg rancher.Config, data templateData, vs []verify.Verifier) ([]cutover.Step, error) {
+	var steps []cutover.Step
+	if cfg.TrafficShiftFromServiceID != "" {
+		if cfg.LBServiceID == "" {
+			return nil, fmt.Errorf("TRAFFIC_SHIFT_FROM_SERVICE_ID needs LB_SERVICE_ID")
+		}
+		shifted := 0
+		steps = append(steps, &cutover.TrafficShift{
+			Upgrader:      ru,
+			LBServiceID:   cfg.LBServiceID,
+			FromServiceID: cfg.TrafficShiftFromServiceID,
+			ToServiceID:   cfg.RancherServiceID,
+			Percents:      cfg.TrafficShiftSteps,
+			Verify: func(ctx context.Context) error {
+				return runVerifiers(ctx, vs)
+			},
+			BeforeStep: func(ctx context.Context, percent int) error {
+				shifted++
+				return nextBatch(ctx, cfg, shifted, fmt.Sprintf("shifting %d%% of the traffic", percent))
+			},
+		})
+	}
+	if cfg.DNSRecordName != "" {
+		creds, err := aws.LoadCredentials(ctx, &http.Client{Timeout: 5 * time.Second})
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, &cutover.Route53{
+			Client:       &http.Client{Timeout: 30 * time.Second},
+			Credentials:  creds,
+			HostedZoneID: cfg.Route53HostedZoneID,
+			Name:         cfg.DNSRecordName,
+			Type:         cfg.DNSRecordType,
+			Value:        cfg.DNSRecordValue,
+			TTL:          cfg.DNSRecordTTL,
+		})
+	}
+	if cfg.ConsulServiceID != "" {
+		tags, err := data.renderSlice("CONSUL_TAGS", cfg.ConsulTags)
+		if err != nil {
+			return nil, err
+		}
+		meta, err := data.renderMap("CONSUL_META", cfg.ConsulMeta)
+		if err != nil {
+			return nil, err
+		}
+		name := cfg.ConsulServiceName
+		if name == "" {
+			name = cfg.ConsulServiceID
+		}
+		steps = append(steps, &cutover.Consul{
+			Client:     &http.Client{Timeout: 30 * time.Second},
+			Addr:       cfg.ConsulAddr,
+			Token:      cfg.ConsulToken,
+			ServiceID:  cfg.ConsulServiceID,
+			Name:       name,
+			Tags:       tags,
+			Meta:       meta,
+			Address:    cfg.ConsulServiceAddress,
+			Port:       cfg.ConsulServicePort,
+			Deregister: cfg.ConsulDeregister,
+		})
+	}
+	if cfg.KongAdminURL != "" && (cfg.KongUpstream != "" || cfg.KongRoute != "") {
+		kong := &cutover.Kong{
+			Client:   &http.Client{Timeout: 30 * time.Second},
+			AdminURL: cfg.KongAdminURL,
+			Token:    cfg.KongAdminToken,
+			Upstream: cfg.KongUpstream,
+			Weight:   cfg.KongTargetWeight,
+			Route:    cfg.KongRoute,
+			Service:  cfg.KongService,
+		}
+		if cfg.KongUpstream != "" {
+			if cfg.KongTargetPort <= 0 {
+				return nil, fmt.Errorf("KONG_UPSTREAM needs KONG_TARGET_PORT")
+			}
+			containers, err := newContainers(ctx, ru, "KONG_UPSTREAM")
+			if err != nil {
+				return nil, err
+			}
+			for _, c := range containers {
+				kong.Targets = append(kong.Targets, net.JoinHostPort(c.PrimaryIPAddress, strconv.Itoa(cfg.KongTargetPort)))
+			}
+		}
+		if cfg.KongRoute != "" && cfg.KongService == "" {
+			return nil, fmt.Errorf("KONG_ROUTE needs KONG_SERVICE")
+		}
+		steps = append(steps, kong)
+	}
+	return steps, nil
+}
+
+// applySteps applies steps in order, stopping at the first failure.
+// It returns the steps that were applied.
+func applySteps(ctx context.Context, steps []cutover.Step) ([]cutover.Step, error) {
+	for i, step := range steps {
+		log.Printf("Applying %s\n", step)
+		if err := step.Apply(ctx); err != nil {
+			return steps[:i], err
+		}
+	}
+	return steps, nil
+}
+
+// revertSteps reverts applied steps in reverse order, logging any that fail.
+// It gets a fresh context so it still runs once the overall deadline has passed.
+func revertSteps(applied []cutover.Step) {
+	for i := len(applied) - 1; i >= 0; i-- {
+		log.Printf("Reverting %s\n", applied[i])
+		if err := applied[i].Revert(context.Background()); err != nil {
+			log.Printf("Failed to revert %s: %s\n", applied[i], err)
+		}
+	}
+}
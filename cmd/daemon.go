@@ -0,0 +1,588 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/richardbolt/rancher-upgrader/history"
+	"github.com/richardbolt/rancher-upgrader/rancher"
+	"github.com/richardbolt/rancher-upgrader/registry"
+	"github.com/richardbolt/rancher-upgrader/upgrader"
+)
+
+// daemonRequestable are the settings upgrade requests may set, each only concerning the upgrade of the
+// service they name. The daemon's own settings stand for all others, as they could point the daemon's
+// credentials at another host, read its files, run commands on it or lift its guardrails, which only an
+// explicit FORCE does.
+var daemonRequestable = map[string]struct{}{
+	// What is upgraded to what.
+	"RANCHER_ENV_ID":     {},
+	"RANCHER_SERVICE_ID": {},
+	"BUILD_TAG":          {},
+	"GIT_SHA":            {},
+	"RUN_ID":             {},
+	"IMAGE":              {},
+	"IMAGE_UUID":         {},
+	// The launchConfig of the service.
+	"RANCHER_SERVICE_START_FIRST": {},
+	"HEALTH_CHECK":                {},
+	"MEMORY":                      {},
+	"MEMORY_RESERVATION":          {},
+	"CPU_SHARES":                  {},
+	"MILLI_CPU_RESERVATION":       {},
+	"PORTS":                       {},
+	"ENVIRONMENT":                 {},
+	"COMMAND":                     {},
+	// Only to the files of DAEMON_SECRETS_DIR.
+	"ROTATE_SECRETS": {},
+	// Timing.
+	"UPGRADE_WAIT_TIMEOUT":        {},
+	"CHECK_INTERVAL":              {},
+	"CHECK_BACKOFF_AFTER":         {},
+	"CHECK_INTERVAL_MAX":          {},
+	"CHECK_JITTER":                {},
+	"MAX_CONSECUTIVE_POLL_ERRORS": {},
+	"RANCHER_EVENTS_INTERVAL":     {},
+	"TOTAL_DEADLINE":              {},
+	"SAFE_ACTION_TIMEOUT":         {},
+	"HEALTHY_WAIT_TIMEOUT":        {},
+	"START_WAIT_TIMEOUT":          {},
+	"MIN_SOAK_SECONDS":            {},
+	"STUCK_UPGRADE_THRESHOLD":     {},
+	"ROLLBACK_RETRIES":            {},
+	"ROLLBACK_RETRY_BACKOFF":      {},
+	"RANCHER_BREAKER_SECONDS":     {},
+	"LB_WAIT_TIMEOUT":             {},
+	// Verification against the service's own containers.
+	"REQUIRE_HEALTHY":         {},
+	"VERIFY_ALLOWED_FAILURES": {},
+	"VERIFY_PASS_RATE":        {},
+	"VERIFY_HTTP_STATUS":      {},
+	"VERIFY_HTTP_BODY_REGEX":  {},
+	"VERIFY_HTTP_REQUESTS":    {},
+	"VERIFY_HTTP_THRESHOLD":   {},
+	"VERIFY_HTTP_INTERVAL":    {},
+	"VERIFY_TCP_PORTS":        {},
+	"VERIFY_TCP_TIMEOUT":      {},
+	"VERIFY_GRPC_PORT":        {},
+	"VERIFY_GRPC_SERVICE":     {},
+	"VERIFY_GRPC_TIMEOUT":     {},
+	"VERIFY_METRICS_WINDOW":   {},
+	// Finishing and failure policies.
+	"RANCHER_FINISH_UPGRADE": {},
+	"WAIT_FOR_STATES":        {},
+	"WAIT_ABORT_STATES":      {},
+	"ON_TIMEOUT":             {},
+	"ON_VERIFY_FAIL":         {},
+	"ON_RANCHER_UNREACHABLE": {},
+	"NOTIFY_STATUSES":        {},
+	"FORCE":                  {},
+	"ALLOW_DOWNGRADE":        {},
+}
+
+// daemonFiles are the settings naming files of the daemon's host, which upgrade requests are told they
+// can't read, e.g. a SERVICE_TEMPLATE rendered into the service would be mounted into it.
+var daemonFiles = map[string]struct{}{
+	"SERVICE_TEMPLATE":          {},
+	"VALUES_FILES":              {},
+	"BUILD_TAG_FILE":            {},
+	"RANCHER_ACCESS_KEY_FILE":   {},
+	"RANCHER_SECRET_KEY_FILE":   {},
+	"UPGRADE_TEST_ENV_FILE":     {},
+	"UPGRADE_TEST_RESULTS_FILE": {},
+	"CERT_FILE":                 {},
+	"CERT_KEY_FILE":             {},
+	"CERT_CHAIN_FILE":           {},
+}
+
+// daemon is the HTTP API of `rancher-upgrader serve`.
+type daemon struct {
+	cfg     rancher.Config
+	history *history.Store
+	// leader is the leader election between the daemons sharing the history, nil without LEADER_ELECTION.
+	leader *leader
+	// receivers are the Rancher webhook receivers of WEBHOOK_RECEIVERS_FILE by their keys.
+	receivers map[string]webhookReceiver
+	// auth authenticates the callers of the API, nil without DAEMON_ROLES_FILE.
+	auth    *authenticator
+	metrics *daemonMetrics
+	health  health
+	queue   *upgradeQueue
+	// paused are whether the upgrades being made are paused through the API, by the IDs of their attempts.
+	pausedMu sync.Mutex
+	paused   map[string]bool
+}
+
+// serve runs the daemon until it fails: an HTTP API on DAEMON_ADDR that upgrades services and
+// records every attempt in the deployment history.
+func serve(cfg rancher.Config) {
+	// Each upgrade names its environment, so the keys are only checked to be accepted.
+	if cfg.CheckAPIKeys {
+		if err := checkKeys(cfg, nil); err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+	store, err := history.Open(cfg.HistoryDBDriver, cfg.HistoryDBDSN)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	defer store.Close()
+	d := &daemon{cfg: cfg, history: store, metrics: newDaemonMetrics(), paused: map[string]bool{}, queue: newUpgradeQueue(cfg)}
+	d.cfg.ObserveRequest = d.metrics.observeRequest
+	d.cfg.ObserveRateLimit = d.metrics.observeRateLimit
+	if cfg.WebhookReceiversFile != "" {
+		if d.receivers, err = readWebhookReceivers(cfg.WebhookReceiversFile); err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+	if d.auth, err = newAuthenticator(cfg); err != nil {
+		log.Fatal(err.Error())
+	}
+	if d.auth == nil {
+		log.Println("The API takes upgrades from anyone who can reach it, set DAEMON_ROLES_FILE to require tokens")
+	}
+	if cfg.LeaderElection {
+		d.leader = newLeader(store, time.Duration(cfg.LeaderLeaseSeconds)*time.Second)
+		go d.leader.run()
+	}
+	go d.drainOnStop()
+
+	mux := http.NewServeMux()
+	// Rancher webhooks are authenticated by the keys of their receivers, and the health checks, the
+	// metrics and the leader by nothing, so probes and scrapes need no token.
+	mux.HandleFunc("/upgrades", d.authenticated(d.upgrades))
+	mux.HandleFunc("/upgrades/", d.authenticated(d.upgrade))
+	mux.HandleFunc("/spinnaker/upgrades", d.authenticated(d.spinnakerUpgrades))
+	mux.HandleFunc("/spinnaker/upgrades/", d.authenticated(d.spinnakerUpgrade))
+	mux.HandleFunc("/freeze", d.authenticated(d.freeze))
+	mux.HandleFunc("/leader", d.leaderStatus)
+	mux.HandleFunc("/v1-webhooks/endpoint", d.rancherWebhook)
+	mux.HandleFunc("/metrics", d.metrics.serve)
+	mux.HandleFunc("/healthz", d.healthz)
+	mux.HandleFunc("/readyz", d.readyz)
+	log.Printf("Listening on %s\n", cfg.DaemonAddr)
+	log.Fatal(http.ListenAndServe(cfg.DaemonAddr, mux))
+}
+
+// errStandingBy is the error of requests to make upgrades sent to a daemon that isn't the leader.
+var errStandingBy = errors.New("this daemon is standing by, send upgrades to the leader")
+
+// leading returns true if this daemon makes upgrades: it is the leader or there is no leader election.
+func (d *daemon) leading() bool {
+	return d.leader == nil || d.leader.isLeader()
+}
+
+// leaderStatus responds whether this daemon is the leader, with 503 when it is standing by so a load
+// balancer health checking it only sends requests to the leader.
+func (d *daemon) leaderStatus(w http.ResponseWriter, r *http.Request) {
+	status := map[string]interface{}{"leader": d.leading()}
+	if d.leader != nil {
+		status["id"] = d.leader.id
+	}
+	if !d.leading() {
+		writeJSON(w, http.StatusServiceUnavailable, status)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// upgrades starts an upgrade on POST and queries the history on GET.
+//
+// The body of a POST is a JSON object of the env variables of the upgrade, overriding the daemon's
+// own, e.g. {"RANCHER_SERVICE_ID": "1s123", "BUILD_TAG": "1.2.3"}. GET takes the query parameters
+// env, service, status and limit.
+func (d *daemon) upgrades(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		d.startUpgrade(w, r)
+	case http.MethodGet:
+		q := r.URL.Query()
+		limit, _ := strconv.Atoi(q.Get("limit"))
+		if limit <= 0 {
+			limit = 100
+		}
+		attempts, err := d.visibleAttempts(r, history.Filter{
+			EnvID:     q.Get("env"),
+			ServiceID: q.Get("service"),
+			Status:    q.Get("status"),
+			Limit:     limit,
+		})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, attempts)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s isn't allowed", r.Method))
+	}
+}
+
+// visibleAttempts returns the attempts matching f that the caller of r may see, paging through the
+// history until it has f.Limit of them or there are no more.
+func (d *daemon) visibleAttempts(r *http.Request, f history.Filter) ([]history.Attempt, error) {
+	c := callerOf(r)
+	if c == nil {
+		return d.history.List(r.Context(), f)
+	}
+	visible := []history.Attempt{}
+	page := f
+	for {
+		attempts, err := d.history.List(r.Context(), page)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range attempts {
+			if c.may(a.EnvID, a.ServiceID, false) && len(visible) < f.Limit {
+				visible = append(visible, a)
+			}
+		}
+		if len(visible) == f.Limit || len(attempts) < page.Limit {
+			return visible, nil
+		}
+		page.Offset += page.Limit
+	}
+}
+
+// upgrade returns the upgrade attempt /upgrades/<id>. POST /upgrades/<id>/finish finishes the upgrade
+// when it was deferred with RANCHER_FINISH_UPGRADE=deferred, and POST /upgrades/<id>/pause and
+// /upgrades/<id>/resume hold a running or queued upgrade before its next batch and let it carry on.
+func (d *daemon) upgrade(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/upgrades/")
+	action := ""
+	if i := strings.Index(id, "/"); i >= 0 {
+		id, action = id[:i], id[i+1:]
+	}
+	switch action {
+	case "finish", "pause", "resume":
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s isn't allowed", r.Method))
+			return
+		}
+		if !d.mayChange(w, r, id) {
+			return
+		}
+		if action == "finish" {
+			d.finishUpgrade(w, r, id)
+		} else {
+			d.pauseUpgrade(w, id, action == "pause")
+		}
+		return
+	case "":
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown action %s", action))
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s isn't allowed", r.Method))
+		return
+	}
+	a, err := d.history.Get(r.Context(), id)
+	if err == history.ErrNotFound {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !callerOf(r).may(a.EnvID, a.ServiceID, false) {
+		forbidden(w, r, a.EnvID, a.ServiceID, false)
+		return
+	}
+	writeJSON(w, http.StatusOK, a)
+}
+
+// mayChange returns whether the caller of r may finish, pause and resume the upgrade of the attempt id,
+// responding why not when they may not.
+func (d *daemon) mayChange(w http.ResponseWriter, r *http.Request, id string) bool {
+	c := callerOf(r)
+	if c == nil {
+		return true
+	}
+	a, err := d.history.Get(r.Context(), id)
+	if err == history.ErrNotFound {
+		writeError(w, http.StatusNotFound, err)
+		return false
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return false
+	}
+	if !c.may(a.EnvID, a.ServiceID, true) {
+		forbidden(w, r, a.EnvID, a.ServiceID, true)
+		return false
+	}
+	return true
+}
+
+// finishUpgrade finishes the deferred or held upgrade of the attempt id, responding with the attempt.
+func (d *daemon) finishUpgrade(w http.ResponseWriter, r *http.Request, id string) {
+	if err := d.accepting(); err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	a, err := d.history.Get(r.Context(), id)
+	if err == history.ErrNotFound {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if a.Status != history.Upgraded && a.Status != history.Held {
+		writeError(w, http.StatusConflict, fmt.Errorf("upgrade %s is %s, not waiting to be finished", a.ID, a.Status))
+		return
+	}
+	cfg := d.cfg
+	cfg.RancherEnvID, cfg.RancherServiceID = a.EnvID, a.ServiceID
+	ctx := r.Context()
+	if cfg.TotalDeadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(cfg.TotalDeadline)*time.Second)
+		defer cancel()
+	}
+	start := time.Now()
+	if err := finishUpgrade(ctx, upgrader.New(&http.Client{}, cfg)); err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	if a.Durations == nil {
+		a.Durations = map[string]float64{}
+	}
+	a.Durations["finish"] = time.Since(start).Seconds()
+	a.Status = history.Succeeded
+	log.Printf("Upgrade %s of %s finished\n", a.ID, a.ServiceID)
+	if err := d.history.Finish(context.Background(), a); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, a)
+}
+
+// pauseUpgrade pauses or resumes the running or queued upgrade of the attempt id, responding with whether
+// it is paused. A queued upgrade that is paused is held before it starts.
+func (d *daemon) pauseUpgrade(w http.ResponseWriter, id string, pause bool) {
+	d.pausedMu.Lock()
+	_, made := d.paused[id]
+	if made {
+		d.paused[id] = pause
+	}
+	d.pausedMu.Unlock()
+	if !made {
+		writeError(w, http.StatusConflict, fmt.Errorf("upgrade %s isn't being made or queued by this daemon", id))
+		return
+	}
+	if pause {
+		log.Printf("Upgrade %s paused\n", id)
+	} else {
+		log.Printf("Upgrade %s resumed\n", id)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"id": id, "paused": pause})
+}
+
+// startUpgrade records and starts the upgrade requested by r, responding with the running attempt.
+func (d *daemon) startUpgrade(w http.ResponseWriter, r *http.Request) {
+	a := d.start(w, r)
+	if a == nil {
+		return
+	}
+	w.Header().Set("Location", "/upgrades/"+a.ID)
+	writeJSON(w, http.StatusAccepted, a)
+}
+
+// start records and starts the upgrade requested by r and returns the running attempt. It responds
+// with the error and returns nil if the upgrade couldn't be started.
+func (d *daemon) start(w http.ResponseWriter, r *http.Request) *history.Attempt {
+	if err := d.accepting(); err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return nil
+	}
+	if err := checkFreeze(d.cfg); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return nil
+	}
+	cfg, err := d.requestConfig(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return nil
+	}
+	c := callerOf(r)
+	if !c.may(cfg.RancherEnvID, cfg.RancherServiceID, true) {
+		forbidden(w, r, cfg.RancherEnvID, cfg.RancherServiceID, true)
+		return nil
+	}
+	// Authenticated callers are who they are, whoever X-Requested-By says.
+	requestedBy := r.Header.Get("X-Requested-By")
+	if c != nil {
+		requestedBy = c.name
+	} else if requestedBy == "" {
+		requestedBy = r.RemoteAddr
+	}
+	a, err := d.launch(r.Context(), cfg, requestedBy)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return nil
+	}
+	return a
+}
+
+// launch records the upgrade of cfg requested by requestedBy and queues it behind the upgrades of its
+// service, returning the running or queued attempt.
+func (d *daemon) launch(ctx context.Context, cfg rancher.Config, requestedBy string) (*history.Attempt, error) {
+	a := &history.Attempt{
+		EnvID:       cfg.RancherEnvID,
+		ServiceID:   cfg.RancherServiceID,
+		RequestedBy: requestedBy,
+		BuildTag:    cfg.BuildTag,
+	}
+	if err := d.enqueue(ctx, cfg, a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// requestConfig returns the daemon's config overridden by the body of r.
+func (d *daemon) requestConfig(r *http.Request) (rancher.Config, error) {
+	cfg := d.cfg
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return cfg, err
+	}
+	// YAML is a superset of JSON that keeps integers as integers.
+	values := map[string]interface{}{}
+	if err := yaml.Unmarshal(b, &values); err != nil {
+		return cfg, fmt.Errorf("invalid upgrade request: %s", err)
+	}
+	for name := range values {
+		if _, ok := daemonFiles[name]; ok {
+			return cfg, fmt.Errorf("%s is a file of the daemon's host, which upgrade requests can't read", name)
+		}
+		if _, ok := daemonRequestable[name]; !ok {
+			return cfg, fmt.Errorf("%s can't be set by an upgrade request", name)
+		}
+	}
+	if err := overrideConfig(&cfg, values); err != nil {
+		return cfg, err
+	}
+	if err := d.checkRequestImage(cfg); err != nil {
+		return cfg, err
+	}
+	if _, ok := values["ROTATE_SECRETS"]; ok {
+		if cfg.RotateSecrets, err = d.requestSecrets(cfg.RotateSecrets); err != nil {
+			return cfg, err
+		}
+	}
+	if err := checkGuardConfig(cfg); err != nil {
+		return cfg, err
+	}
+	if err := checkPollConfig(cfg); err != nil {
+		return cfg, err
+	}
+	if cfg.RancherEnvID == "" || cfg.RancherServiceID == "" {
+		return cfg, fmt.Errorf("an upgrade request needs RANCHER_ENV_ID and RANCHER_SERVICE_ID")
+	}
+	// The daemon's upgrades would all listen on HOLD_OPEN_ADDR, and POST /upgrades/<id>/finish finishes
+	// a deferred upgrade anyway.
+	if cfg.RancherFinishUpgrade == rancher.FinishHoldOpen {
+		return cfg, fmt.Errorf("the daemon doesn't hold upgrades open, defer finishing them instead")
+	}
+	return cfg, nil
+}
+
+// checkRequestImage returns an error when the image the request cfg upgrades to is on another registry than
+// the daemon's IMAGE while the daemon has registry credentials, which checking it would send there.
+func (d *daemon) checkRequestImage(cfg rancher.Config) error {
+	if d.cfg.RegistryUsername == "" && d.cfg.RegistryPassword == "" {
+		return nil
+	}
+	own := d.cfg.Image
+	if d.cfg.ImageUUID != "" {
+		own = strings.TrimPrefix(d.cfg.ImageUUID, "docker:")
+	}
+	for _, image := range []string{cfg.Image, strings.TrimPrefix(cfg.ImageUUID, "docker:")} {
+		if image == "" || image == own {
+			continue
+		}
+		if own == "" || registry.Host(image) != registry.Host(own) {
+			return fmt.Errorf("an upgrade request can only upgrade to images on the registry of the daemon's IMAGE, %s isn't", image)
+		}
+	}
+	return nil
+}
+
+// requestSecrets returns the ROTATE_SECRETS of a request, rotations, with their files in
+// DAEMON_SECRETS_DIR.
+func (d *daemon) requestSecrets(rotations []string) ([]string, error) {
+	if d.cfg.DaemonSecretsDir == "" {
+		return nil, fmt.Errorf("ROTATE_SECRETS can't be set by an upgrade request without DAEMON_SECRETS_DIR")
+	}
+	secrets := make([]string, 0, len(rotations))
+	for _, rotation := range rotations {
+		parts := strings.SplitN(rotation, "=", 2)
+		if len(parts) != 2 || parts[1] == "" || parts[1] != filepath.Base(parts[1]) || parts[1] == "." || parts[1] == ".." {
+			return nil, fmt.Errorf("invalid ROTATE_SECRETS %s, expected name=file with a file of DAEMON_SECRETS_DIR", rotation)
+		}
+		secrets = append(secrets, parts[0]+"="+filepath.Join(d.cfg.DaemonSecretsDir, parts[1]))
+	}
+	return secrets, nil
+}
+
+// run makes the upgrade of the attempt a and records its outcome.
+func (d *daemon) run(cfg rancher.Config, a history.Attempt) {
+	defer d.health.running.Done()
+	defer func() {
+		d.pausedMu.Lock()
+		delete(d.paused, a.ID)
+		d.pausedMu.Unlock()
+	}()
+	ctx := context.Background()
+	if cfg.TotalDeadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(cfg.TotalDeadline)*time.Second)
+		defer cancel()
+	}
+	start := time.Now()
+	d.metrics.started()
+	report := upgradeReport{}
+	err := upgradeService(ctx, upgrader.New(&http.Client{}, cfg), cfg, nil, &report)
+
+	a.ServiceName, a.FromImage, a.ToImage = report.ServiceName, report.From, report.To
+	a.RollbackReason = report.RollbackReason
+	a.Durations = report.seconds()
+	a.Status = report.status(cfg, err)
+	if err != nil {
+		a.Error = err.Error()
+	}
+	log.Printf("Upgrade %s of %s %s\n", a.ID, a.ServiceID, a.Status)
+	d.metrics.finished(&report, a.Status, start)
+	notifySummaries(cfg, []upgradeSummary{newUpgradeSummary(cfg, &report, err)})
+	if err := d.history.Finish(context.Background(), &a); err != nil {
+		log.Printf("Failed to record the outcome of upgrade %s: %s\n", a.ID, err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/richardbolt/rancher-upgrader/history"
+	"github.com/richardbolt/rancher-upgrader/rancher"
+)
+
+// newTestHistory returns a history in a temporary SQLite database, and a function removing it.
+func newTestHistory(t *testing.T) (*history.Store, func()) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := history.Open("sqlite3", filepath.Join(dir, "history.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return h, func() {
+		h.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestRequestConfig(t *testing.T) {
+	d := &daemon{cfg: rancher.Config{
+		RancherEnvID:     "1a5",
+		RegistryUsername: "ci",
+		Image:            "registry.example.com/org/app:1.0.0",
+		DaemonSecretsDir: "/run/secrets",
+	}}
+	tests := []struct {
+		body string
+		err  string
+	}{
+		{`{"RANCHER_SERVICE_ID": "1s1", "BUILD_TAG": "1.2.3"}`, ""},
+		{`{"RANCHER_SERVICE_ID": "1s1", "IMAGE": "registry.example.com/org/app:1.2.3"}`, ""},
+		{`{"RANCHER_SERVICE_ID": "1s1", "ROTATE_SECRETS": "db_password=db_password-v2"}`, ""},
+		{`{"BUILD_TAG": "1.2.3"}`, "needs RANCHER_ENV_ID and RANCHER_SERVICE_ID"},
+		// Files of the daemon's host.
+		{`{"RANCHER_SERVICE_ID": "1s1", "SERVICE_TEMPLATE": "/etc/passwd"}`, "SERVICE_TEMPLATE is a file"},
+		{`{"RANCHER_SERVICE_ID": "1s1", "VALUES_FILES": "/etc/passwd"}`, "VALUES_FILES is a file"},
+		{`{"RANCHER_SERVICE_ID": "1s1", "ROTATE_SECRETS": "db_password=/etc/passwd"}`, "invalid ROTATE_SECRETS"},
+		{`{"RANCHER_SERVICE_ID": "1s1", "ROTATE_SECRETS": "db_password=.."}`, "invalid ROTATE_SECRETS"},
+		// The daemon's credentials pointed elsewhere.
+		{`{"RANCHER_SERVICE_ID": "1s1", "RANCHER_URL": "https://attacker.example.com"}`, "RANCHER_URL can't be set"},
+		{`{"RANCHER_SERVICE_ID": "1s1", "KONG_ADMIN_URL": "https://attacker.example.com"}`, "KONG_ADMIN_URL can't be set"},
+		{`{"RANCHER_SERVICE_ID": "1s1", "CONSUL_ADDR": "attacker.example.com:8500"}`, "CONSUL_ADDR can't be set"},
+		{`{"RANCHER_SERVICE_ID": "1s1", "KV_ADDR": "https://attacker.example.com"}`, "KV_ADDR can't be set"},
+		{`{"RANCHER_SERVICE_ID": "1s1", "DATADOG_SITE": "attacker.example.com"}`, "DATADOG_SITE can't be set"},
+		{`{"RANCHER_SERVICE_ID": "1s1", "IMAGE": "attacker.example.com/org/app:1.2.3"}`, "registry of the daemon's IMAGE"},
+		{`{"RANCHER_SERVICE_ID": "1s1", "IMAGE_UUID": "docker:attacker.example.com/org/app:1.2.3"}`, "registry of the daemon's IMAGE"},
+		// Commands and guardrails.
+		{`{"RANCHER_SERVICE_ID": "1s1", "UPGRADE_TEST_CMD": "curl attacker.example.com"}`, "UPGRADE_TEST_CMD can't be set"},
+		{`{"RANCHER_SERVICE_ID": "1s1", "GUARD_DENIED_TAGS": ""}`, "GUARD_DENIED_TAGS can't be set"},
+		// Settings out of range.
+		{`{"RANCHER_SERVICE_ID": "1s1", "CHECK_JITTER": 50}`, ""},
+		{`{"RANCHER_SERVICE_ID": "1s1", "CHECK_JITTER": 500}`, "invalid CHECK_JITTER"},
+		{`{"RANCHER_SERVICE_ID": "1s1", "CHECK_JITTER": -1}`, "invalid CHECK_JITTER"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/upgrades", strings.NewReader(test.body))
+		_, err := d.requestConfig(r)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error %s", test.body, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: expected an error with %q, got %v", test.body, test.err, err)
+		}
+	}
+}
+
+func TestRequestSecrets(t *testing.T) {
+	d := &daemon{cfg: rancher.Config{RancherEnvID: "1a5", DaemonSecretsDir: "/run/secrets"}}
+	r := httptest.NewRequest("POST", "/upgrades", strings.NewReader(`{"RANCHER_SERVICE_ID": "1s1", "ROTATE_SECRETS": "db_password=db_password-v2"}`))
+	cfg, err := d.requestConfig(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.RotateSecrets) != 1 || cfg.RotateSecrets[0] != "db_password=/run/secrets/db_password-v2" {
+		t.Errorf("expected the secret in DAEMON_SECRETS_DIR, got %v", cfg.RotateSecrets)
+	}
+
+	d.cfg.DaemonSecretsDir = ""
+	r = httptest.NewRequest("POST", "/upgrades", strings.NewReader(`{"RANCHER_SERVICE_ID": "1s1", "ROTATE_SECRETS": "db_password=db_password-v2"}`))
+	if _, err := d.requestConfig(r); err == nil {
+		t.Error("expected ROTATE_SECRETS to be refused without DAEMON_SECRETS_DIR")
+	}
+}
+
+func TestVisibleAttempts(t *testing.T) {
+	h, remove := newTestHistory(t)
+	defer remove()
+	for i := 0; i < 5; i++ {
+		for _, serviceID := range []string{"1s1", "1s2", "1s3"} {
+			if err := h.Start(context.Background(), &history.Attempt{EnvID: "1a5", ServiceID: serviceID}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	d := &daemon{history: h}
+	c := &caller{name: "ci", roles: []daemonRole{{Name: "web", Services: []string{"1s1"}}}}
+	for _, limit := range []int{1, 2, 3, 5, 10} {
+		r := httptest.NewRequest("GET", "/upgrades", nil)
+		r = r.WithContext(context.WithValue(r.Context(), callerKey{}, c))
+		attempts, err := d.visibleAttempts(r, history.Filter{Limit: limit})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := limit
+		if expected > 5 {
+			expected = 5
+		}
+		if len(attempts) != expected {
+			t.Errorf("limit %d: expected %d attempts, got %d", limit, expected, len(attempts))
+		}
+		for _, a := range attempts {
+			if a.ServiceID != "1s1" {
+				t.Errorf("limit %d: the caller may not see upgrade %s of %s", limit, a.ID, a.ServiceID)
+			}
+		}
+	}
+}
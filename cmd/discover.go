@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/metadata"
+	"github.com/richardbolt/rancher-upgrader/rancher"
+	"github.com/richardbolt/rancher-upgrader/upgrader"
+)
+
+// discoverConfig fills in what is missing from cfg when running in a container of the Rancher environment.
+// Rancher gives containers with the io.rancher.container.create_agent label an API key of the environment
+// in CATTLE_URL, CATTLE_ACCESS_KEY and CATTLE_SECRET_KEY, and the metadata service tells them which
+// environment and stack they run in, leaving only the service name and the build tag to be set.
+func discoverConfig(cfg *rancher.Config) error {
+	cattleURL := os.Getenv("CATTLE_URL")
+	if cattleURL == "" {
+		return nil
+	}
+	if cfg.RancherURL == "" {
+		// CATTLE_URL includes the API version, e.g. http://rancher:8080/v1, which is the one to use
+		// unless it is set.
+		cattleURL = strings.TrimSuffix(cattleURL, "/")
+		if i := strings.LastIndex(cattleURL, "/"); cfg.RancherAPIVersion == rancher.APIVersionAuto && i >= 0 {
+			cfg.RancherAPIVersion = cattleURL[i+1:]
+		}
+		cfg.RancherURL = strings.TrimSuffix(cattleURL, "/"+cfg.RancherAPIVersion)
+	}
+	if cfg.RancherAccessKey == "" && cfg.RancherSecretKey == "" {
+		cfg.RancherAccessKey, cfg.RancherSecretKey = os.Getenv("CATTLE_ACCESS_KEY"), os.Getenv("CATTLE_SECRET_KEY")
+	}
+	if len(cfg.RancherEnvIDs) > 0 || (cfg.RancherEnvID != "" && (cfg.RancherServiceID != "" || cfg.RancherServiceName == "")) {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	client := &http.Client{}
+	md := &metadata.Client{HTTP: client, URL: cfg.RancherMetadataURL}
+	if cfg.RancherEnvID == "" {
+		uuid, err := md.EnvironmentUUID(ctx)
+		if err != nil {
+			return err
+		}
+		if cfg.RancherEnvID, err = upgrader.ProjectID(ctx, client, *cfg, uuid); err != nil {
+			return err
+		}
+		log.Printf("Discovered env %s from the Rancher metadata service\n", cfg.RancherEnvID)
+	}
+	if cfg.RancherServiceID != "" || cfg.RancherServiceName == "" {
+		return nil
+	}
+	stack := cfg.RancherStackName
+	if stack == "" {
+		var err error
+		if stack, err = md.StackName(ctx); err != nil {
+			return err
+		}
+	}
+	uuid, err := md.ServiceUUID(ctx, stack, cfg.RancherServiceName)
+	if err != nil {
+		return err
+	}
+	if cfg.RancherServiceID, err = upgrader.ServiceID(ctx, client, *cfg, uuid); err != nil {
+		return err
+	}
+	log.Printf("Discovered service %s/%s (%s) from the Rancher metadata service\n", stack, cfg.RancherServiceName, cfg.RancherServiceID)
+	return nil
+}
+
+// resolveTarget sets the environment and service IDs of cfg from the names in TARGET.
+func resolveTarget(cfg *rancher.Config) error {
+	parts := strings.Split(cfg.Target, "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return fmt.Errorf("TARGET %q is not <environment>/<stack>/<service>", cfg.Target)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	envID, serviceID, err := upgrader.ResolveTarget(ctx, &http.Client{}, *cfg, parts[0], parts[1], parts[2])
+	if err != nil {
+		return fmt.Errorf("could not resolve TARGET %s: %s", cfg.Target, err)
+	}
+	cfg.RancherEnvID, cfg.RancherServiceID = envID, serviceID
+	log.Printf("Resolved %s to env %s service %s\n", cfg.Target, envID, serviceID)
+	return nil
+}
+
+// detectAPIVersion sets the version of the Rancher API of cfg to the one Rancher serves.
+func detectAPIVersion(cfg *rancher.Config) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	version, err := upgrader.DetectAPIVersion(ctx, &http.Client{}, *cfg)
+	if err != nil {
+		return fmt.Errorf("could not detect the Rancher API version: %s", err)
+	}
+	cfg.RancherAPIVersion = version
+	log.Printf("Using version %s of the Rancher API\n", version)
+	return nil
+}
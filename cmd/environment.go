@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/history"
+	"github.com/richardbolt/rancher-upgrader/rancher"
+	"github.com/richardbolt/rancher-upgrader/upgrader"
+)
+
+// plannedUpgrade is a service of the environment and the image it is upgraded to.
+type plannedUpgrade struct {
+	Service rancher.Service
+	From    string
+	To      string
+	// Config is the config of the upgrade of the service, with its overrides.
+	Config rancher.Config
+}
+
+// upgradeEnvironment upgrades every service in the environment running the image repository
+// ENV_UPGRADE_IMAGE to BuildTag, one service at a time, e.g. to roll out a patched base image.
+// The services are always listed first and only upgraded when ENV_UPGRADE_EXECUTE is set.
+func upgradeEnvironment(ctx context.Context, ru upgrader.Upgrader, cfg rancher.Config) {
+	planned, err := planEnvironment(ctx, ru, cfg)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if len(planned) == 0 {
+		log.Printf("No services to upgrade from %s\n", cfg.EnvUpgradeImage)
+		return
+	}
+	if !cfg.EnvUpgradeExecute {
+		log.Println("Dry run, set ENV_UPGRADE_EXECUTE=true to upgrade these services")
+		return
+	}
+	if !confirm(fmt.Sprintf("Upgrade these %d services?", len(planned))) {
+		log.Fatal("Exiting, the environment upgrade was not confirmed")
+	}
+
+	client := upgrader.NewClient(&http.Client{}, cfg)
+	var summaries []upgradeSummary
+	for i, p := range planned {
+		if i > 0 {
+			if err := nextBatch(ctx, cfg, i, "upgrading "+p.Service.Name); err != nil {
+				reportSummaries(cfg, summaries)
+				log.Fatalf("Stopped the environment upgrade at %s (%s), %s", p.Service.Name, p.Service.ID, err)
+			}
+		}
+		start := time.Now()
+		err := inBlock(cfg, "Upgrade "+p.Service.Name, func() error {
+			return upgradeTo(ctx, client.Service(upgrader.ServiceRef{EnvID: cfg.RancherEnvID, ServiceID: p.Service.ID}), p.Config,
+				upgrader.StartFirst(p.Config.RancherStartServiceFirst),
+				upgrader.ImageUUID(p.To),
+			)
+		})
+		summaries = append(summaries, environmentSummary(p.Service.ID, p.Service.Name, p.From, p.To, start, err))
+		if err != nil {
+			logDeadline(ctx)
+			log.Println(err.Error())
+			reportSummaries(cfg, summaries)
+			for _, done := range planned[:i] {
+				log.Printf("Upgraded %s (%s) to %s\n", done.Service.Name, done.Service.ID, done.To)
+			}
+			log.Fatalf("Stopped the environment upgrade at %s (%s)", p.Service.Name, p.Service.ID)
+		}
+	}
+	reportSummaries(cfg, summaries)
+	log.Printf("Upgraded %d services to %s\n", len(planned), cfg.BuildTag)
+}
+
+// applyEnvironmentPlan makes the environment upgrade of p one service at a time. Every service is
+// checked against the plan before any is upgraded, so nothing is upgraded if the environment drifted.
+func applyEnvironmentPlan(ctx context.Context, cfg rancher.Config, p *plan) {
+	client := upgrader.NewClient(&http.Client{}, cfg)
+	upgraders := make([]upgrader.Upgrader, len(p.Changes))
+	svcCfgs := make([]rancher.Config, len(p.Changes))
+	froms := make([]string, len(p.Changes))
+	for i, c := range p.Changes {
+		// The plan has the image of every service, their overrides still apply to the rest of their upgrades.
+		var err error
+		svcCfgs[i], _, err = serviceConfig(cfg, c.Name)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		svcCfgs[i].RancherServiceID = c.ServiceID
+		upgraders[i] = client.Service(upgrader.ServiceRef{EnvID: cfg.RancherEnvID, ServiceID: c.ServiceID})
+		svc, err := upgraders[i].GetServiceConfig(ctx)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		if err := c.check(svc); err != nil {
+			log.Fatal(err.Error())
+		}
+		froms[i] = svc.LaunchConfig.ImageUUID
+	}
+	var summaries []upgradeSummary
+	for i, c := range p.Changes {
+		if i > 0 {
+			if err := nextBatch(ctx, cfg, i, "upgrading "+c.Name); err != nil {
+				reportSummaries(cfg, summaries)
+				log.Fatalf("Stopped the environment upgrade at %s (%s), %s", c.Name, c.ServiceID, err)
+			}
+		}
+		start := time.Now()
+		err := inBlock(cfg, "Upgrade "+c.Name, func() error {
+			return upgradeTo(ctx, upgraders[i], svcCfgs[i], p.options(c)...)
+		})
+		to := c.LaunchConfig.ImageUUID
+		summaries = append(summaries, environmentSummary(c.ServiceID, c.Name, froms[i], to, start, err))
+		if err != nil {
+			logDeadline(ctx)
+			log.Println(err.Error())
+			reportSummaries(cfg, summaries)
+			for _, done := range p.Changes[:i] {
+				log.Printf("Upgraded %s (%s)\n", done.Name, done.ServiceID)
+			}
+			log.Fatalf("Stopped the environment upgrade at %s (%s)", c.Name, c.ServiceID)
+		}
+	}
+	reportSummaries(cfg, summaries)
+	log.Printf("Upgraded %d services to %s\n", len(p.Changes), p.BuildTag)
+}
+
+// environmentSummary returns the summary of the upgrade of a service of an environment upgrade that
+// started at start and ended with err.
+func environmentSummary(id, name, from, to string, start time.Time, err error) upgradeSummary {
+	s := upgradeSummary{
+		ServiceID:   id,
+		ServiceName: name,
+		From:        from,
+		To:          to,
+		Status:      history.Succeeded,
+		Durations:   map[string]float64{"upgrade": time.Since(start).Seconds()},
+	}
+	if err != nil {
+		s.Status, s.Error = history.Failed, err.Error()
+	}
+	return s
+}
+
+// planEnvironment lists and returns the services of the environment that would be upgraded.
+func planEnvironment(ctx context.Context, ru upgrader.Upgrader, cfg rancher.Config) ([]plannedUpgrade, error) {
+	services, err := ru.Services(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return planServices(cfg, services)
+}
+
+// planServices returns the services of services that an environment upgrade would upgrade.
+func planServices(cfg rancher.Config, services []rancher.Service) ([]plannedUpgrade, error) {
+	excluded := map[string]struct{}{}
+	for _, name := range cfg.EnvUpgradeExclude {
+		excluded[name] = struct{}{}
+	}
+
+	var planned []plannedUpgrade
+	for _, svc := range services {
+		from := svc.LaunchConfig.ImageUUID
+		if upgrader.ImageRepository(from) != cfg.EnvUpgradeImage {
+			continue
+		}
+		_, byName := excluded[svc.Name]
+		_, byID := excluded[svc.ID]
+		if byName || byID {
+			log.Printf("Excluded %s (%s) %s\n", svc.Name, svc.ID, from)
+			continue
+		}
+		svcCfg, skip, err := serviceConfig(cfg, svc.Name)
+		if err != nil {
+			return nil, err
+		}
+		if skip {
+			log.Printf("Skipping %s (%s), its %s override is set\n", svc.Name, svc.ID, skipOverride)
+			continue
+		}
+		svcCfg.RancherServiceID = svc.ID
+		to, err := upgrader.ReplaceTag(from, svcCfg.TagRegex, svcCfg.TagTemplate, svcCfg.BuildTag)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case to == from:
+			log.Printf("Skipping %s (%s), already running %s\n", svc.Name, svc.ID, from)
+		case svc.Actions.Upgrade == "":
+			log.Printf("Skipping %s (%s), it can't be upgraded while %s\n", svc.Name, svc.ID, svc.State)
+		default:
+			log.Printf("Will upgrade %s (%s) from %s to %s\n", svc.Name, svc.ID, from, to)
+			planned = append(planned, plannedUpgrade{Service: svc, From: from, To: to, Config: svcCfg})
+		}
+	}
+	return planned, nil
+}
+
+// upgradeTo upgrades the service of ru with options, verifies it with UPGRADE_TEST_CMD and finishes the
+// upgrade, cancelling or rolling it back if it fails.
+func upgradeTo(ctx context.Context, ru upgrader.Upgrader, cfg rancher.Config, options ...upgrader.Option) error {
+	if err := checkFreeze(cfg); err != nil {
+		return err
+	}
+	svc, err := ru.GetServiceConfig(ctx)
+	if err != nil {
+		return err
+	}
+	upgrade, err := upgrader.Preview(svc, options...)
+	if err != nil {
+		return err
+	}
+	u := startedUpgrade{
+		EnvID:       cfg.RancherEnvID,
+		ServiceID:   svc.ID,
+		ServiceName: svc.Name,
+		Scale:       svc.Scale,
+		BatchSize:   upgrade.InServiceStrategy.BatchSize,
+		From:        svc.LaunchConfig.ImageUUID,
+		ImageUUID:   upgrade.InServiceStrategy.LaunchConfig.ImageUUID,
+		StartedAt:   time.Now(),
+	}
+	if err := checkGuardrails(ctx, ru, cfg, svc, u); err != nil {
+		return err
+	}
+	if err := approveUpgrade(ctx, cfg, u); err != nil {
+		return err
+	}
+	guard, err := guardAutoscaler(ctx, ru, cfg, svc)
+	if err != nil {
+		return err
+	}
+	defer guard.release()
+	if err := ru.Upgrade(ctx, options...); err != nil {
+		return err
+	}
+	report := &upgradeReport{}
+	if policy, reason, err := waitForUpgrade(ctx, ru, cfg, u); err != nil {
+		log.Println(err.Error())
+		return onFailure(ru, cfg, report, policy, reason)
+	}
+	if cfg.RequireHealthy {
+		if err := ru.WaitForHealthy(ctx, time.Duration(cfg.HealthyWaitTimeout)*time.Second); err != nil {
+			log.Println(err.Error())
+			return onFailure(ru, cfg, report, cfg.OnVerifyFail, "Containers did not become healthy")
+		}
+	}
+	if cfg.Cmd != "" {
+		if err := runTestCmd(ctx, cfg, report); err != nil {
+			return onFailure(ru, cfg, report, cfg.OnVerifyFail, err.Error())
+		}
+	}
+	if cfg.RancherFinishUpgrade != rancher.FinishNow {
+		return nil
+	}
+	_, err = ru.FinishUpgrade(ctx)
+	return err
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+	"github.com/richardbolt/rancher-upgrader/upgrader"
+)
+
+// eventWatcher polls the Rancher events of the service of an upgrade every RANCHER_EVENTS_INTERVAL
+// seconds, logging the new ones, until it is stopped.
+type eventWatcher struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu     sync.Mutex
+	seen   map[string]bool
+	events []string
+}
+
+// watchEvents watches the events of the service of ru since since, returning nil when
+// RANCHER_EVENTS_INTERVAL is 0.
+func watchEvents(ru upgrader.Upgrader, cfg rancher.Config, since time.Time) *eventWatcher {
+	if cfg.RancherEventsInterval <= 0 {
+		return nil
+	}
+	// The events are polled until the upgrade is done with, however that ends.
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &eventWatcher{cancel: cancel, done: make(chan struct{}), seen: map[string]bool{}}
+	go func() {
+		defer close(w.done)
+		ticker := time.NewTicker(time.Duration(cfg.RancherEventsInterval) * time.Second)
+		defer ticker.Stop()
+		lastErr := ""
+		for {
+			events, err := ru.Events(ctx, since)
+			if err != nil && ctx.Err() == nil && err.Error() != lastErr {
+				log.Printf("Could not get all the Rancher events: %s\n", err)
+			}
+			if err != nil {
+				lastErr = err.Error()
+			}
+			w.add(events)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return w
+}
+
+// add logs and keeps the events that weren't seen before.
+func (w *eventWatcher) add(events []upgrader.Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, e := range events {
+		if w.seen[e.Key] {
+			continue
+		}
+		w.seen[e.Key] = true
+		w.events = append(w.events, e.String())
+		log.Printf("Rancher event: %s\n", e)
+	}
+}
+
+// stop stops watching and returns the events that were seen. It may be called on a nil watcher.
+func (w *eventWatcher) stop() []string {
+	if w == nil {
+		return nil
+	}
+	w.cancel()
+	<-w.done
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.events
+}
+
+// withEvents adds the Rancher events of an upgrade to the error it failed with.
+func withEvents(err error, events []string) error {
+	if err == nil || len(events) == 0 {
+		return err
+	}
+	return fmt.Errorf("%s\nRancher events:\n  %s", err, strings.Join(events, "\n  "))
+}
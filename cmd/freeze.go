@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+)
+
+// freezeCommand runs `rancher-upgrader freeze [reason]` or `rancher-upgrader unfreeze`, which only touch
+// FREEZE_FILE so they don't need Rancher.
+func freezeCommand(command string, args []string) {
+	var cfg rancher.Config
+	if err := envconfig.Process("", &cfg); err != nil {
+		log.Fatal(err.Error())
+	}
+	if cfg.FreezeFile == "" {
+		log.Fatal(command + " needs FREEZE_FILE")
+	}
+	if command == "unfreeze" {
+		lifted, err := unfreeze(cfg)
+		switch {
+		case err != nil:
+			log.Fatal(err.Error())
+		case !lifted:
+			log.Println("Upgrades weren't frozen")
+		default:
+			log.Println("Lifted the deploy freeze")
+		}
+		return
+	}
+	reason := commandReason(args, "frozen")
+	if err := freeze(cfg, reason); err != nil {
+		log.Fatal(err.Error())
+	}
+	log.Printf("Froze upgrades (%s), lift the freeze with `rancher-upgrader unfreeze`\n", reason)
+}
+
+// freeze freezes upgrades for reason.
+func freeze(cfg rancher.Config, reason string) error {
+	if cfg.FreezeFile == "" {
+		return fmt.Errorf("freezing upgrades needs FREEZE_FILE")
+	}
+	return ioutil.WriteFile(cfg.FreezeFile, []byte(reason+"\n"), 0644)
+}
+
+// unfreeze lifts the deploy freeze, returning false when upgrades weren't frozen.
+func unfreeze(cfg rancher.Config) (bool, error) {
+	err := os.Remove(cfg.FreezeFile)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// frozen returns why upgrades are frozen, "" when they aren't.
+func frozen(cfg rancher.Config) string {
+	if cfg.FreezeFile == "" {
+		return ""
+	}
+	b, err := ioutil.ReadFile(cfg.FreezeFile)
+	if err != nil {
+		return ""
+	}
+	reason := strings.TrimSpace(string(b))
+	if reason == "" {
+		reason = cfg.FreezeFile + " exists"
+	}
+	return reason
+}
+
+// checkFreeze returns the error upgrades are refused with during a deploy freeze, nil without one.
+func checkFreeze(cfg rancher.Config) error {
+	if reason := frozen(cfg); reason != "" {
+		return fmt.Errorf("deploy freeze active: %s", reason)
+	}
+	return nil
+}
+
+// freeze shows the deploy freeze on GET /freeze, freezes upgrades on PUT or POST, with why in the
+// optional body, {"reason": "release 1.2 sign-off"}, and lifts the freeze on DELETE. As the freeze
+// concerns every upgrade, only callers that may make all of them may set and lift it.
+func (d *daemon) freeze(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && !callerOf(r).unrestricted() {
+		writeError(w, http.StatusForbidden, fmt.Errorf("%s may not freeze upgrades, it may not make all of them", callerOf(r).name))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var body struct {
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid freeze: %s", err))
+			return
+		}
+		if body.Reason == "" {
+			requestedBy := r.Header.Get("X-Requested-By")
+			if c := callerOf(r); c != nil {
+				requestedBy = c.name
+			} else if requestedBy == "" {
+				requestedBy = r.RemoteAddr
+			}
+			body.Reason = "frozen by " + requestedBy + " at " + time.Now().UTC().Format(time.RFC3339)
+		}
+		if err := freeze(d.cfg, body.Reason); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		log.Printf("Froze upgrades (%s)\n", body.Reason)
+	case http.MethodDelete:
+		lifted, err := unfreeze(d.cfg)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if lifted {
+			log.Println("Lifted the deploy freeze")
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s isn't allowed", r.Method))
+		return
+	}
+	reason := frozen(d.cfg)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"frozen": reason != "", "reason": reason})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/richardbolt/rancher-upgrader/history"
+)
+
+// reportGitHub writes a GitHub Actions workflow annotation for every upgrade to w, so failures show up
+// in the pull request, and appends a Markdown summary of the upgrades to the job summary file when set.
+// The runner reads workflow commands from stderr as well as stdout, which is kept for results.
+func reportGitHub(w io.Writer, jobSummary string, summaries []upgradeSummary) error {
+	for _, s := range summaries {
+		if s.Status == history.Succeeded || s.Status == history.Upgraded {
+			fmt.Fprintf(w, "::notice title=%s::%s\n", githubProperty("Upgraded "+s.name()),
+				githubData(fmt.Sprintf("%s %s in %s, %s", s.name(), imageChange(s.From, s.To), s.duration(), s.Status)))
+			continue
+		}
+		fmt.Fprintf(w, "::error title=%s::%s\n", githubProperty("Upgrade of "+s.name()+" "+s.Status),
+			githubData(s.Error))
+	}
+	if jobSummary == "" {
+		return nil
+	}
+	f, err := os.OpenFile(jobSummary, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fmt.Fprintln(f, "### Rancher upgrade")
+	fmt.Fprintln(f)
+	fmt.Fprintln(f, "| Service | Image | Duration | Result |")
+	fmt.Fprintln(f, "| --- | --- | --- | --- |")
+	for _, s := range summaries {
+		result := s.Status
+		if s.Error != "" {
+			result += ": " + s.Error
+		}
+		fmt.Fprintf(f, "| %s | %s | %s | %s |\n", markdownCell(s.name()),
+			markdownCell(imageChange(s.From, s.To)), s.duration(), markdownCell(result))
+	}
+	_, err = fmt.Fprintln(f)
+	return err
+}
+
+// githubData escapes the message of a workflow command.
+func githubData(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// githubProperty escapes a property of a workflow command.
+func githubProperty(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C").Replace(s)
+}
+
+// markdownCell escapes s for a cell of a Markdown table.
+func markdownCell(s string) string {
+	return strings.NewReplacer("|", `\|`, "\r", "", "\n", "<br>").Replace(s)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+	"github.com/richardbolt/rancher-upgrader/upgrader"
+)
+
+// The guardrails FORCE can name.
+const (
+	guardScaleZero    = "scale-zero"
+	guardDeniedTag    = "denied-tag"
+	guardDowngrade    = "downgrade"
+	guardStackHealth  = "stack-health"
+	guardActiveAlerts = "active-alerts"
+)
+
+// guardrails are the names of the guardrails, in the order they are checked.
+var guardrails = []string{guardScaleZero, guardDeniedTag, guardDowngrade, guardStackHealth, guardActiveAlerts}
+
+// checkGuardConfig returns an error when FORCE names a guardrail that doesn't exist or GUARD_DENIED_TAGS
+// has a malformed pattern, so a typo can't leave a guardrail in place or a tag let through.
+func checkGuardConfig(cfg rancher.Config) error {
+	for _, name := range cfg.Force {
+		if !contains(guardrails, name) {
+			return fmt.Errorf("unknown FORCE %q, expected %s", name, strings.Join(guardrails, ", "))
+		}
+	}
+	for _, pattern := range cfg.GuardDeniedTags {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid GUARD_DENIED_TAGS pattern %q: %s", pattern, err)
+		}
+	}
+	return nil
+}
+
+// checkGuardrails returns why the upgrade u of svc, the service of ru, is refused by the guardrails
+// configured in cfg, nil when it may go ahead. The guardrails named by FORCE are logged instead.
+func checkGuardrails(ctx context.Context, ru upgrader.Upgrader, cfg rancher.Config, svc *rancher.Service, u startedUpgrade) error {
+	for _, name := range guardrails {
+		reason, err := checkGuardrail(ctx, ru, cfg, name, svc, u)
+		if err != nil {
+			reason = fmt.Sprintf("the %s guardrail could not be checked: %s", name, err)
+		}
+		if reason == "" {
+			continue
+		}
+		if contains(cfg.Force, name) || name == guardDowngrade && cfg.AllowDowngrade {
+			log.Printf("Forcing the upgrade of %s although %s\n", u.ServiceName, reason)
+			continue
+		}
+		force := "FORCE=" + name
+		if name == guardDowngrade {
+			force = "ALLOW_DOWNGRADE=true"
+		}
+		return fmt.Errorf("refusing to upgrade %s as %s, %s upgrades it anyway", u.ServiceName, reason, force)
+	}
+	return nil
+}
+
+// checkGuardrail returns why the guardrail name refuses the upgrade u of svc, "" when it doesn't.
+func checkGuardrail(ctx context.Context, ru upgrader.Upgrader, cfg rancher.Config, name string, svc *rancher.Service, u startedUpgrade) (string, error) {
+	switch name {
+	case guardScaleZero:
+		// Global services run on every host whatever their scale.
+		if cfg.GuardScaleZero && svc.Scale == 0 && svc.LaunchConfig.Labels["io.rancher.scheduler.global"] != "true" {
+			return "it is scaled to 0", nil
+		}
+	case guardDeniedTag:
+		tag := imageTag(u.ImageUUID)
+		for _, pattern := range cfg.GuardDeniedTags {
+			if ok, _ := path.Match(pattern, tag); ok {
+				return fmt.Sprintf("the tag %s of %s is denied by %s", tag, u.ImageUUID, pattern), nil
+			}
+		}
+	case guardDowngrade:
+		// Only semantic versions are ordered, so other tags, e.g. Git SHAs, never count as downgrades.
+		from, ok := upgrader.ParseVersion(imageTag(u.From))
+		to, tok := upgrader.ParseVersion(imageTag(u.ImageUUID))
+		if cfg.GuardDowngrade && ok && tok && to.Compare(from) < 0 {
+			return fmt.Sprintf("%s is older than the deployed %s", imageTag(u.ImageUUID), imageTag(u.From)), nil
+		}
+	case guardStackHealth:
+		if cfg.GuardStackHealth {
+			return stackHealth(ctx, ru, cfg, svc)
+		}
+	case guardActiveAlerts:
+		if cfg.GuardAlertsURL == "" {
+			return "", nil
+		}
+		alerts, err := activeAlerts(ctx, cfg.GuardAlertsURL, u)
+		if err != nil || len(alerts) == 0 {
+			return "", err
+		}
+		return fmt.Sprintf("it has alerts firing: %s", strings.Join(alerts, ", ")), nil
+	}
+	return "", nil
+}
+
+// activeAlerts posts the upgrade u to the monitoring hook url and returns the alerts firing for the
+// service that it answers with, {"alerts": ["HighErrorRate"]}.
+func activeAlerts(ctx context.Context, url string, u startedUpgrade) ([]string, error) {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= http.StatusBadRequest {
+		body, _ := ioutil.ReadAll(res.Body)
+		return nil, fmt.Errorf("POST %s: %s: %s", url, res.Status, strings.TrimSpace(string(body)))
+	}
+	var answer struct {
+		Alerts []string `json:"alerts"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&answer); err != nil {
+		return nil, fmt.Errorf("invalid answer of %s: %s", url, err)
+	}
+	return answer.Alerts, nil
+}
+
+// upgradeStates are the states of services that are being upgraded, or rolled back, and haven't been
+// finished or cancelled.
+var upgradeStates = map[string]bool{
+	"upgrading": true, "upgraded": true, "finishing-upgrade": true, "canceling-upgrade": true,
+	"canceled-upgrade": true, "rolling-back": true,
+}
+
+// stackHealth returns which other service of the stack of svc, the service of ru, is being upgraded or
+// isn't active and healthy, "" when none is. The services of GUARD_STACK_IGNORE are left out.
+func stackHealth(ctx context.Context, ru upgrader.Upgrader, cfg rancher.Config, svc *rancher.Service) (string, error) {
+	services, err := ru.StackServices(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, s := range services {
+		if s.ID == svc.ID || contains(cfg.GuardStackIgnore, s.Name) {
+			continue
+		}
+		switch {
+		case upgradeStates[s.State]:
+			return fmt.Sprintf("%s of its stack is mid-upgrade, %s", s.Name, s.State), nil
+		case s.State != "active":
+			return fmt.Sprintf("%s of its stack is %s", s.Name, s.State), nil
+		// Services without health checks have no health state, and one-off ones are started once.
+		case s.HealthState != "" && s.HealthState != "healthy" && s.HealthState != "started-once":
+			return fmt.Sprintf("%s of its stack is %s", s.Name, s.HealthState), nil
+		}
+	}
+	return "", nil
+}
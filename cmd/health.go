@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/upgrader"
+)
+
+// rancherCheckInterval is how long the result of checking Rancher and the API keys for /readyz is used,
+// so frequent readiness probes don't each make a request to Rancher.
+const rancherCheckInterval = 10 * time.Second
+
+// errDraining is the error of requests to make upgrades sent to a daemon that is being stopped.
+var errDraining = errors.New("this daemon is stopping, send upgrades to another one")
+
+// health is what the daemon's health and readiness are made of besides its dependencies.
+type health struct {
+	mu       sync.Mutex
+	draining bool
+	// rancherErr is the result of the last check of Rancher and the API keys, at rancherChecked.
+	rancherErr     error
+	rancherChecked time.Time
+	// running are the upgrades being made, waited for when the daemon is stopped.
+	running sync.WaitGroup
+}
+
+// accepting returns the error to refuse requests to make upgrades with, nil when they are accepted.
+func (d *daemon) accepting() error {
+	d.health.mu.Lock()
+	draining := d.health.draining
+	d.health.mu.Unlock()
+	switch {
+	case draining:
+		return errDraining
+	case !d.leading():
+		return errStandingBy
+	}
+	return nil
+}
+
+// healthz responds 200 while the daemon is alive, for a liveness check.
+func (d *daemon) healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyz responds 200 when the daemon can make upgrades: the history database and Rancher can be
+// reached, Rancher accepts the API keys, it isn't stopping and it isn't making READY_MAX_IN_FLIGHT
+// upgrades already. It responds 503 otherwise, with each check, the upgrades being made and those queued.
+func (d *daemon) readyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{}
+	ready := true
+	fail := func(name string, err error) {
+		if err != nil {
+			checks[name], ready = err.Error(), false
+			return
+		}
+		checks[name] = "ok"
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	fail("history", d.history.Ping(ctx))
+	fail("rancher", d.checkRancher(ctx))
+
+	d.metrics.mu.Lock()
+	inFlight := d.metrics.inFlight
+	d.metrics.mu.Unlock()
+	var err error
+	if d.cfg.ReadyMaxInFlight > 0 && inFlight >= d.cfg.ReadyMaxInFlight {
+		err = fmt.Errorf("making %d upgrades already", inFlight)
+	}
+	fail("inFlight", err)
+	d.health.mu.Lock()
+	if d.health.draining {
+		err = errDraining
+	} else {
+		err = nil
+	}
+	d.health.mu.Unlock()
+	fail("draining", err)
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, map[string]interface{}{"ready": ready, "checks": checks, "inFlight": inFlight, "queued": d.queue.depth()})
+}
+
+// checkRancher returns why Rancher can't be reached or rejects the API keys, checking again once the
+// last result is older than rancherCheckInterval.
+func (d *daemon) checkRancher(ctx context.Context) error {
+	d.health.mu.Lock()
+	defer d.health.mu.Unlock()
+	if time.Since(d.health.rancherChecked) < rancherCheckInterval {
+		return d.health.rancherErr
+	}
+	_, err := upgrader.CheckKeys(ctx, &http.Client{}, d.cfg)
+	d.health.rancherErr, d.health.rancherChecked = err, time.Now()
+	return err
+}
+
+// drainOnStop stops the daemon when it is interrupted or terminated: it stops taking upgrades, so
+// /readyz fails and requests go to another daemon, waits for at most DAEMON_DRAIN_TIMEOUT for the
+// upgrades it is making to end, and hands over the leadership.
+func (d *daemon) drainOnStop() {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	d.health.mu.Lock()
+	d.health.draining = true
+	d.health.mu.Unlock()
+
+	log.Println("Stopping, waiting for the upgrades being made to end")
+	done := make(chan struct{})
+	go func() {
+		d.health.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-stop:
+		log.Println("Stopped again, leaving the upgrades being made")
+	case <-time.After(time.Duration(d.cfg.DaemonDrainTimeout) * time.Second):
+		log.Printf("Gave up waiting for the upgrades being made after %ds\n", d.cfg.DaemonDrainTimeout)
+	}
+	if d.leader != nil {
+		d.leader.release()
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+	"github.com/richardbolt/rancher-upgrader/upgrader"
+)
+
+// holdDecision is how an upgrade held open ends: finished, or what is done with it and why otherwise.
+type holdDecision struct {
+	finish bool
+	policy rancher.FailurePolicy
+	reason string
+}
+
+// holdServer is the HTTP API of an upgrade held open.
+type holdServer struct {
+	token     string
+	decisions chan holdDecision
+
+	mu sync.Mutex
+	// status is what GET / responds with.
+	status holdStatus
+}
+
+// holdStatus is the state of an upgrade held open.
+type holdStatus struct {
+	ServiceID   string    `json:"serviceId"`
+	ServiceName string    `json:"serviceName"`
+	Image       string    `json:"image"`
+	HeldSince   time.Time `json:"heldSince"`
+	// CheckedAt is when the service was last checked to be healthy, zero until it was.
+	CheckedAt time.Time `json:"checkedAt,omitempty"`
+	Healthy   bool      `json:"healthy"`
+	Decision  string    `json:"decision,omitempty"`
+}
+
+// holdOpen holds the verified upgrade u of the service of ru open, checking that the service stays
+// healthy, until it is finished or rolled back through the API on HOLD_OPEN_ADDR or by a signal, and
+// returns the decision. An unhealthy service, HOLD_OPEN_TIMEOUT or the overall deadline decide too.
+func holdOpen(ctx context.Context, ru upgrader.Upgrader, cfg rancher.Config, u startedUpgrade) holdDecision {
+	ln, err := net.Listen("tcp", cfg.HoldOpenAddr)
+	if err != nil {
+		log.Println(err.Error())
+		return holdDecision{policy: cfg.OnTimeout, reason: "Could not hold the upgrade open"}
+	}
+	h := &holdServer{
+		token:     cfg.HoldOpenToken,
+		decisions: make(chan holdDecision, 1),
+		status: holdStatus{
+			ServiceID:   u.ServiceID,
+			ServiceName: u.ServiceName,
+			Image:       u.ImageUUID,
+			HeldSince:   time.Now(),
+		},
+	}
+	srv := &http.Server{Handler: h}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	signals := make(chan os.Signal, 1)
+	if len(holdOpenSignals) > 0 {
+		for sig := range holdOpenSignals {
+			signal.Notify(signals, sig)
+		}
+		defer signal.Stop(signals)
+	}
+	interval := time.Duration(cfg.HoldOpenCheckInterval) * time.Second
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var timeout <-chan time.Time
+	if cfg.HoldOpenTimeout > 0 {
+		timeout = time.After(time.Duration(cfg.HoldOpenTimeout) * time.Second)
+	}
+	log.Printf("Holding the upgrade of %s open, finish it with POST http://%s/finish or SIGUSR1 and roll it back with POST http://%s/rollback or SIGUSR2\n",
+		u.ServiceName, ln.Addr(), ln.Addr())
+
+	// The health of the service is checked in the background so it doesn't hold up a decision.
+	health := make(chan error, 1)
+	checking := false
+	for {
+		select {
+		case d := <-h.decisions:
+			return d
+		case sig := <-signals:
+			h.decide(holdDecision{finish: holdOpenSignals[sig], policy: rancher.FailRollback, reason: "Rolled back by a signal (" + sig.String() + ")"})
+		case <-ticker.C:
+			if !checking {
+				checking = true
+				go func() {
+					health <- ru.WaitForHealthy(ctx, time.Duration(cfg.HealthyWaitTimeout)*time.Second)
+				}()
+			}
+		case err := <-health:
+			checking = false
+			h.mu.Lock()
+			h.status.CheckedAt, h.status.Healthy = time.Now(), err == nil
+			h.mu.Unlock()
+			if err != nil {
+				log.Println(err.Error())
+				return holdDecision{policy: cfg.OnVerifyFail, reason: "Service became unhealthy while held open"}
+			}
+		case <-timeout:
+			return holdDecision{policy: cfg.OnTimeout, reason: "Upgrade was not finished or rolled back within HOLD_OPEN_TIMEOUT"}
+		case <-ctx.Done():
+			return holdDecision{policy: cfg.OnTimeout, reason: "Overall deadline passed while the upgrade was held open"}
+		}
+	}
+}
+
+// decide makes d the decision on the upgrade unless one was made already, returning false if it was.
+func (h *holdServer) decide(d holdDecision) bool {
+	select {
+	case h.decisions <- d:
+	default:
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.status.Decision = "rollback"
+	if d.finish {
+		h.status.Decision = "finish"
+	}
+	return true
+}
+
+// ServeHTTP implements http.Handler: GET / responds with the status of the upgrade held open, and
+// POST /finish and POST /rollback decide it.
+func (h *holdServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var d holdDecision
+	switch r.URL.Path {
+	case "/":
+		h.mu.Lock()
+		status := h.status
+		h.mu.Unlock()
+		writeJSON(w, http.StatusOK, status)
+		return
+	case "/finish":
+		d = holdDecision{finish: true}
+	case "/rollback":
+		d = holdDecision{policy: rancher.FailRollback, reason: "Rolled back through the hold-open API"}
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s not found", r.URL.Path))
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s isn't allowed", r.Method))
+		return
+	}
+	if h.token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+h.token)) != 1 {
+		writeError(w, http.StatusUnauthorized, fmt.Errorf("a valid bearer token is needed"))
+		return
+	}
+	if !h.decide(d) {
+		writeError(w, http.StatusConflict, fmt.Errorf("the upgrade was decided already"))
+		return
+	}
+	log.Printf("Upgrade decided through the hold-open API by %s: %s\n", r.RemoteAddr, r.URL.Path[1:])
+	writeJSON(w, http.StatusAccepted, map[string]string{"decision": r.URL.Path[1:]})
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// holdOpenSignals finish (true) or roll back (false) an upgrade held open.
+var holdOpenSignals = map[os.Signal]bool{
+	syscall.SIGUSR1: true,
+	syscall.SIGUSR2: false,
+}
@@ -0,0 +1,7 @@
+package main
+
+import "os"
+
+// holdOpenSignals finish (true) or roll back (false) an upgrade held open. Windows has no user signals,
+// so it is only decided through the HTTP API.
+var holdOpenSignals = map[os.Signal]bool{}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/richardbolt/rancher-upgrader/history"
+)
+
+// writeResultsFile writes the summaries of the upgrades to path as an artifact for the CI system: Java
+// properties, e.g. for the readProperties step of Jenkins, when it ends in .properties and JSON otherwise.
+func writeResultsFile(path string, summaries []upgradeSummary) error {
+	var b []byte
+	if filepath.Ext(path) == ".properties" {
+		b = resultProperties(summaries)
+	} else {
+		var err error
+		b, err = json.MarshalIndent(summaries, "", "  ")
+		if err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// resultProperties returns the summaries as Java properties: status, the overall result, and every field
+// of every service prefixed by its name, e.g. app.status and app.duration.upgrade.
+func resultProperties(summaries []upgradeSummary) []byte {
+	var b bytes.Buffer
+	status := history.Succeeded
+	for _, s := range summaries {
+		if s.Status != history.Succeeded && status == history.Succeeded {
+			status = s.Status
+		}
+	}
+	writeProperty(&b, "status", status)
+	for _, s := range summaries {
+		prefix := s.name() + "."
+		writeProperty(&b, prefix+"serviceId", s.ServiceID)
+		writeProperty(&b, prefix+"from", s.From)
+		writeProperty(&b, prefix+"to", s.To)
+		writeProperty(&b, prefix+"status", s.Status)
+		writeProperty(&b, prefix+"rollbackReason", s.RollbackReason)
+		writeProperty(&b, prefix+"error", s.Error)
+		phases := make([]string, 0, len(s.Durations))
+		for phase := range s.Durations {
+			phases = append(phases, phase)
+		}
+		sort.Strings(phases)
+		for _, phase := range phases {
+			writeProperty(&b, prefix+"duration."+phase, fmt.Sprintf("%.3f", s.Durations[phase]))
+		}
+	}
+	return b.Bytes()
+}
+
+// writeProperty writes the Java property key=value to b, escaped.
+func writeProperty(b *bytes.Buffer, key, value string) {
+	escape := strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	key = strings.NewReplacer(" ", `\ `, "=", `\=`, ":", `\:`).Replace(escape.Replace(key))
+	fmt.Fprintf(b, "%s=%s\n", key, escape.Replace(value))
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+	"github.com/richardbolt/rancher-upgrader/upgrader"
+)
+
+// checkKeys makes sure the Rancher API keys of cfg can act on each of envIDs before anything is done.
+// Keys of the wrong scope otherwise show up as an empty service that isn't in an upgradeable state.
+func checkKeys(cfg rancher.Config, envIDs []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	scope, err := upgrader.CheckKeys(ctx, &http.Client{}, cfg)
+	if err != nil {
+		return err
+	}
+	desc := keyScopeDescription(cfg, scope)
+	log.Printf("Using %s\n", desc)
+	for _, envID := range envIDs {
+		if scope.CanAccess(envID) {
+			continue
+		}
+		if scope.Environment {
+			return fmt.Errorf("%s can't act on env %s, use an environment API key of %s or an account API key of one of its members", desc, envID, envID)
+		}
+		return fmt.Errorf("%s can't act on env %s, add the account to the environment or use an environment API key of it", desc, envID)
+	}
+	return nil
+}
+
+// keyScopeDescription describes the API key of cfg with scope for people.
+func keyScopeDescription(cfg rancher.Config, scope upgrader.KeyScope) string {
+	switch {
+	case scope.Environment:
+		return fmt.Sprintf("the environment API key %s of env %s", cfg.RancherAccessKey, scope.AccountID)
+	case scope.AccountID != "":
+		return fmt.Sprintf("the account API key %s of account %s with access to envs %v", cfg.RancherAccessKey, scope.AccountID, scope.Projects)
+	default:
+		return fmt.Sprintf("the API key %s with access to envs %v", cfg.RancherAccessKey, scope.Projects)
+	}
+}
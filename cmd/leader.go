@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/history"
+)
+
+// leaderLease is the name of the lease the daemons sharing a history database elect their leader with.
+const leaderLease = "daemon-leader"
+
+// leader elects one of the daemons sharing the history database to make the upgrades while the others
+// stand by, by holding a lease in the database that it renews until it stops.
+type leader struct {
+	store *history.Store
+	id    string
+	ttl   time.Duration
+
+	mu sync.Mutex
+	// until is when the lease held by this daemon expires, it isn't the leader after it.
+	until time.Time
+}
+
+// newLeader returns a leader election for this daemon, with a lease lasting ttl.
+func newLeader(store *history.Store, ttl time.Duration) *leader {
+	host, _ := os.Hostname()
+	b := make([]byte, 4)
+	rand.Read(b)
+	return &leader{store: store, id: host + "-" + hex.EncodeToString(b), ttl: ttl}
+}
+
+// run acquires and renews the lease every third of its ttl, forever.
+func (l *leader) run() {
+	for {
+		start := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), l.ttl/3)
+		acquired, err := l.store.AcquireLease(ctx, leaderLease, l.id, l.ttl)
+		cancel()
+		if err != nil {
+			log.Printf("Failed to renew the leader lease: %s\n", err)
+		}
+		was := l.isLeader()
+		l.mu.Lock()
+		if acquired {
+			l.until = start.Add(l.ttl)
+		} else if err == nil {
+			l.until = time.Time{}
+		}
+		l.mu.Unlock()
+		switch is := l.isLeader(); {
+		case is && !was:
+			log.Printf("%s is the leader, making upgrades\n", l.id)
+		case !is && was:
+			log.Printf("%s is no longer the leader, standing by\n", l.id)
+		}
+		time.Sleep(l.ttl / 3)
+	}
+}
+
+// release releases the lease if this daemon holds it, so another daemon can take over at once rather
+// than once it expires.
+func (l *leader) release() {
+	if l.isLeader() {
+		if err := l.store.ReleaseLease(context.Background(), leaderLease, l.id); err != nil {
+			log.Printf("Failed to release the leader lease: %s\n", err)
+		}
+	}
+}
+
+// isLeader returns true while this daemon holds the lease.
+func (l *leader) isLeader() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return time.Now().Before(l.until)
+}
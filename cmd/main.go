@@ -3,14 +3,24 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
-	"regexp"
+	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/kelseyhightower/envconfig"
 
+	"github.com/richardbolt/rancher-upgrader/history"
+	"github.com/richardbolt/rancher-upgrader/plugins"
 	"github.com/richardbolt/rancher-upgrader/rancher"
+	"github.com/richardbolt/rancher-upgrader/registry"
 	"github.com/richardbolt/rancher-upgrader/upgrader"
 )
 
@@ -35,69 +45,439 @@ type config struct {
 
 func init() {
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+	// Logs are for people, stdout is kept for results such as `status --json`.
+	log.SetOutput(os.Stderr)
 }
 
 func main() {
-	var cfg rancher.Config
-	err := envconfig.Process("", &cfg)
+	// Installed as the check, in and out scripts of a Concourse resource type it speaks the resource protocol.
+	switch op := filepath.Base(os.Args[0]); op {
+	case "check", "in", "out":
+		concourseResource(op, os.Args[1:])
+		return
+	}
+
+	// Pausing and resuming batched upgrades only touch PAUSE_FILE, so they don't need Rancher.
+	if len(os.Args) > 1 && (os.Args[1] == "pause" || os.Args[1] == "resume") {
+		pauseCommand(os.Args[1], os.Args[2:])
+		return
+	}
+
+	// Freezing upgrades and lifting the freeze only touch FREEZE_FILE too.
+	if len(os.Args) > 1 && (os.Args[1] == "freeze" || os.Args[1] == "unfreeze") {
+		freezeCommand(os.Args[1], os.Args[2:])
+		return
+	}
+
+	// Simulating an upgrade against a fixture works without Rancher, e.g. in the builds of pull requests.
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		simulateCommand(os.Args[2:])
+		return
+	}
+
+	cfg, err := loadConfig()
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
+	// `plan [file]` writes the upgrade to a file for review instead of making it, and `apply <file>`
+	// makes exactly the upgrade in a plan file. `reconcile` keeps the environment in line with Git
+	// and `serve` runs a daemon that upgrades services on request. `finish` finishes an upgrade that was
+	// deferred with RANCHER_FINISH_UPGRADE=deferred. `wait` only waits for the service to reach a state,
+	// `rollback` only rolls it back, `cancel` only cancels its upgrade and `status` shows its state. ACTION is the command when
+	// none is given on the command line. `certificate` rotates the certificate of a load balancer instead.
+	// `pause` and `resume` hold batched upgrades before their next batch and let them carry on, and
+	// `freeze` and `unfreeze` refuse every upgrade until the deploy freeze is lifted.
+	// `export [file]` writes the service as a fixture that `simulate <file>` decides on the upgrade for.
+	command, args := cfg.Action, os.Args[1:]
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+	// The new container of a self-upgrade completes it first, only carrying on when it is a daemon.
+	if cfg.SelfUpgradeMarker != "" {
+		resumed, err := resumeSelfUpgrade(context.Background(), cfg)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		if resumed && command != "serve" {
+			return
+		}
+	}
+
+	var planPath, exportPath string
+	var p *plan
+	var so statusOptions
+	switch command {
+	case "":
+	case "plan":
+		planPath = "rancher-upgrader.plan"
+		if len(args) > 0 {
+			planPath = args[0]
+		}
+	case "apply":
+		if len(args) < 1 {
+			log.Fatal("usage: rancher-upgrader apply <planfile>")
+		}
+		p, err = readPlan(args[0], cfg.PlanSigningKey, cfg.RancherEnvID)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		cfg.BuildTag = p.BuildTag
+		cfg.RancherStartServiceFirst = p.StartFirst
+		if !p.Environment {
+			cfg.RancherServiceID = p.Changes[0].ServiceID
+		}
+	case "reconcile":
+		if cfg.GitOpsRepo == "" {
+			log.Fatal("reconcile needs GITOPS_REPO")
+		}
+	case "serve":
+		serve(cfg)
+	case "export":
+		if len(args) > 0 {
+			exportPath = args[0]
+		}
+	case "finish", "rollback", "cancel", "certificate":
+	case "wait":
+		if err := parseWaitFlags(&cfg, args); err != nil {
+			log.Fatal(err.Error())
+		}
+	case "status":
+		so, err = parseStatusFlags(cfg, args)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+	default:
+		log.Fatalf("unknown command %q, expected plan, apply, reconcile, serve, finish, wait, rollback, cancel, status, certificate, export, simulate, pause, resume, freeze or unfreeze", command)
+	}
+
+	if cfg.RancherServiceID == "" && cfg.EnvUpgradeImage == "" && len(cfg.RancherEnvIDs) == 0 && (p == nil || !p.Environment) && command != "reconcile" && command != "certificate" {
+		log.Fatal("required key RANCHER_SERVICE_ID missing value")
+	}
+
+	if cfg.CheckAPIKeys {
+		envIDs := cfg.RancherEnvIDs
+		if len(envIDs) == 0 {
+			envIDs = []string{cfg.RancherEnvID}
+		}
+		if err := checkKeys(cfg, envIDs); err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+
 	ru := upgrader.New(&http.Client{}, cfg)
 
-	// Get the launchConfig for the given service. what we're after is the imageUuid from the launchConfig.
-	svcConfig, err := ru.GetServiceConfig()
-	if svcConfig.Actions.Upgrade == "" {
-		log.Fatal("Exiting, service was not in an upgradeable state, got: ", svcConfig.State)
+	// Reconciling runs until stopped, so it isn't bound by the overall deadline.
+	if command == "reconcile" {
+		reconcile(ru, cfg)
+	}
+
+	// ctx bounds the forward progress of the upgrade. Safe actions (cancel and rollback) are given
+	// a fresh context so they can still run once the overall deadline has passed.
+	ctx := context.Background()
+	if cfg.TotalDeadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(cfg.TotalDeadline)*time.Second)
+		defer cancel()
+	}
+
+	switch {
+	case command == "plan":
+		if err := writePlan(ctx, ru, cfg, planPath); err != nil {
+			log.Fatal(err.Error())
+		}
+		return
+	case command == "export":
+		if err := exportServices(ctx, ru, cfg, exportPath); err != nil {
+			log.Fatal(err.Error())
+		}
+		return
+	case command == "finish":
+		if err := finishUpgrade(ctx, ru); err != nil {
+			logDeadline(ctx)
+			log.Fatal(err.Error())
+		}
+		return
+	case command == "rollback":
+		if err := rollbackService(ctx, ru, cfg); err != nil {
+			logDeadline(ctx)
+			log.Fatal(err.Error())
+		}
+		return
+	case command == "status":
+		if err := status(ctx, ru, so, os.Stdout); err != nil {
+			log.Fatal(err.Error())
+		}
+		return
+	case command == "cancel":
+		if err := cancelService(ctx, ru, cfg); err != nil {
+			logDeadline(ctx)
+			log.Fatal(err.Error())
+		}
+		return
+	case command == "certificate":
+		result, err := rotateCertificate(ctx, ru, cfg)
+		if err != nil {
+			result.Error = err.Error()
+		}
+		if jerr := json.NewEncoder(os.Stdout).Encode(result); jerr != nil {
+			log.Println(jerr.Error())
+		}
+		if err != nil {
+			logDeadline(ctx)
+			log.Fatal(err.Error())
+		}
+		return
+	case command == "wait":
+		if _, err := ru.WaitForStates(ctx, cfg.WaitForStates, cfg.WaitAbortStates); err != nil {
+			logDeadline(ctx)
+			log.Fatal(err.Error())
+		}
+		return
+	case p != nil && p.Environment:
+		applyEnvironmentPlan(ctx, cfg, p)
+		return
+	case p == nil && cfg.EnvUpgradeImage != "":
+		upgradeEnvironment(ctx, ru, cfg)
+		return
+	case p == nil && len(cfg.RancherEnvIDs) > 0:
+		upgradeEnvironments(ctx, cfg)
+		return
+	}
+
+	// Logs go to stderr and the result to stdout, so scripts can consume it.
+	report := &upgradeReport{}
+	err = inBlock(cfg, "Upgrade "+cfg.RancherServiceID, func() error {
+		return upgradeService(ctx, ru, cfg, p, report)
+	})
+	if cfg.Output != "teamcity" {
+		if serr := writeSummary(os.Stdout, cfg, report, err); serr != nil {
+			log.Println(serr.Error())
+		}
+	}
+	reportSummaries(cfg, []upgradeSummary{newUpgradeSummary(cfg, report, err)})
+	if err != nil {
+		logDeadline(ctx)
+		// Jenkins can mark the build unstable rather than failed when the service was safely rolled back.
+		if cfg.Output == "jenkins" && report.status(cfg, err) == history.RolledBack {
+			log.Println(err.Error())
+			os.Exit(cfg.UnstableExitCode)
+		}
+		// A held upgrade waits for a person, which the pipeline can tell from a failure.
+		if report.Held {
+			log.Println(err.Error())
+			os.Exit(cfg.HeldExitCode)
+		}
+		log.Fatal(err.Error())
+	}
+}
+
+// loadConfig returns the config from the env variables.
+func loadConfig() (rancher.Config, error) {
+	var cfg rancher.Config
+	// CONFIG_FILE lets the whole upgrade spec be piped in (CONFIG_FILE=-) instead of exported as env variables.
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		if err := loadConfigFile(path); err != nil {
+			return cfg, err
+		}
+	}
+	if err := envconfig.Process("", &cfg); err != nil {
+		return cfg, err
+	}
+	// Keys read from files are read again for every request, so they can be rotated while running.
+	if cfg.RancherAccessKeyFile != "" || cfg.RancherSecretKeyFile != "" {
+		kf := newKeyFiles(cfg)
+		var err error
+		if cfg.RancherAccessKey, cfg.RancherSecretKey, err = kf.credentials(); err != nil {
+			return cfg, fmt.Errorf("could not read the Rancher API keys: %s", err)
+		}
+		cfg.Credentials = kf.credentials
+	}
+	if cfg.RancherRecordFile != "" && cfg.RancherReplayFile != "" {
+		return cfg, fmt.Errorf("RANCHER_RECORD_FILE and RANCHER_REPLAY_FILE can't both be set")
+	}
+	if err := discoverConfig(&cfg); err != nil {
+		return cfg, fmt.Errorf("could not discover the config from Rancher: %s", err)
+	}
+	for _, required := range []struct{ key, value string }{
+		{"RANCHER_URL", cfg.RancherURL},
+		{"RANCHER_ACCESS_KEY", cfg.RancherAccessKey},
+		{"RANCHER_SECRET_KEY", cfg.RancherSecretKey},
+	} {
+		if required.value == "" {
+			return cfg, fmt.Errorf("required key %s missing value", required.key)
+		}
+	}
+	if cfg.RancherAPIVersion == rancher.APIVersionAuto {
+		if err := detectAPIVersion(&cfg); err != nil {
+			return cfg, err
+		}
+	}
+	if cfg.Target != "" {
+		if err := resolveTarget(&cfg); err != nil {
+			return cfg, err
+		}
+	}
+	// RANCHER_ENV_ID is required unless the service is upgraded in each of RANCHER_ENV_IDS.
+	if cfg.RancherEnvID == "" && len(cfg.RancherEnvIDs) == 0 {
+		return cfg, fmt.Errorf("required key RANCHER_ENV_ID missing value")
+	}
+	if cfg.Output != "json" && cfg.Output != "jenkins" && cfg.Output != "teamcity" {
+		return cfg, fmt.Errorf("unknown OUTPUT %q, expected json, jenkins or teamcity", cfg.Output)
+	}
+	if err := checkGuardConfig(cfg); err != nil {
+		return cfg, err
+	}
+	if err := checkPollConfig(cfg); err != nil {
+		return cfg, err
+	}
+	if cfg.BuildTagFile != "" {
+		var err error
+		cfg.BuildTag, err = readBuildTagFile(cfg.BuildTagFile)
+		if err != nil {
+			return cfg, err
+		}
+	}
+	if cfg.PluginManifest != "" {
+		var err error
+		cfg.Plugins, err = plugins.Load(cfg.PluginDir, cfg.PluginManifest)
+		if err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, nil
+}
+
+// checkPollConfig checks the settings of how often Rancher is polled.
+func checkPollConfig(cfg rancher.Config) error {
+	if cfg.CheckJitter < 0 || cfg.CheckJitter > 100 {
+		return fmt.Errorf("invalid CHECK_JITTER %d, expected a percentage from 0 to 100", cfg.CheckJitter)
 	}
+	return nil
+}
+
+// upgradeOptions returns the new imageUuid of svcConfig and the upgrader options that make the
+// upgrade configured in cfg, on top of the service rendered from SERVICE_TEMPLATE when spec isn't nil.
+func upgradeOptions(cfg rancher.Config, svcConfig *rancher.Service, data templateData, spec *serviceSpec) (string, []upgrader.Option, error) {
 	// get the imageUuid as a string from LaunchConfig
-	imageUUID := svcConfig.LaunchConfig["imageUuid"].(string)
-	// Update the LaunchConfig image tag to the specified BuildTag.
-	imageUUID = regexp.MustCompile(":[a-z0-9]+$").ReplaceAllString(imageUUID, ":"+cfg.BuildTag)
+	imageUUID := svcConfig.LaunchConfig.ImageUUID
+	var specLaunchConfig map[string]interface{}
+	if spec != nil {
+		specLaunchConfig = spec.LaunchConfig
+	}
+	specImageUUID, _ := specLaunchConfig["imageUuid"].(string)
+	switch {
+	case cfg.ImageUUID != "":
+		// Replace the whole image reference, e.g. when moving to a new repository or registry.
+		imageUUID = cfg.ImageUUID
+	case cfg.Image != "":
+		imageUUID = "docker:" + cfg.Image
+	case specImageUUID != "":
+		imageUUID = specImageUUID
+	default:
+		// Update the LaunchConfig image tag to the specified BuildTag.
+		var err error
+		imageUUID, err = upgrader.ReplaceTag(imageUUID, cfg.TagRegex, cfg.TagTemplate, cfg.BuildTag)
+		if err != nil {
+			return "", nil, err
+		}
+	}
 
-	// Make the upgrade request to the Rancher API for the given env and service
-	err = ru.Upgrade(
+	// Render the override values, which may be templates using the build metadata.
+	env, err := data.renderMap("ENVIRONMENT", cfg.Environment)
+	if err != nil {
+		return "", nil, err
+	}
+	labels, err := data.renderMap("LABELS", cfg.Labels)
+	if err != nil {
+		return "", nil, err
+	}
+	command, err := data.renderSlice("COMMAND", strings.Fields(cfg.Command))
+	if err != nil {
+		return "", nil, err
+	}
+
+	return imageUUID, []upgrader.Option{
 		upgrader.StartFirst(cfg.RancherStartServiceFirst),
+		upgrader.Patch(specLaunchConfig),
 		upgrader.ImageUUID(imageUUID),
-	)
+		upgrader.HealthCheck(cfg.HealthCheck),
+		upgrader.Memory(cfg.Memory),
+		upgrader.MemoryReservation(cfg.MemoryReservation),
+		upgrader.CPUShares(cfg.CPUShares),
+		upgrader.MilliCPUReservation(cfg.MilliCPUReservation),
+		upgrader.Ports(cfg.Ports),
+		upgrader.DataVolumes(cfg.DataVolumes),
+		upgrader.VolumeDriver(cfg.VolumeDriver),
+		upgrader.Environment(env),
+		upgrader.Labels(labels),
+		upgrader.Command(command),
+	}, nil
+}
+
+// verifyImageArch returns an error if the registry doesn't have imageUUID for the architecture of
+// every host the service runs on.
+func verifyImageArch(ctx context.Context, ru upgrader.Upgrader, cfg rancher.Config, imageUUID string) error {
+	reg := registry.Client{
+		HTTP:     &http.Client{},
+		Username: cfg.RegistryUsername,
+		Password: cfg.RegistryPassword,
+	}
+	image := strings.TrimPrefix(imageUUID, "docker:")
+	imageArchs, err := reg.Architectures(ctx, image)
 	if err != nil {
-		log.Fatal(err.Error())
+		return err
 	}
-	// Block until the service "state" goes from "active" to "upgrading" and finally to "upgraded".
-	// When we hit "upgraded" we can run external scripts to confirm, and then call ?action=finishupgrade to complete the upgrade.
-	_, err = ru.WaitFor("upgraded")
+	hostArchs, err := ru.HostArchitectures(ctx)
 	if err != nil {
-		log.Println("Cancelling upgrade")
-		ru.Cancel()
-		log.Fatal("Cancelled upgrade")
-	}
-
-	// We blocked above until the service was upgraded, now we can run a script to verify before we finish the upgrade.
-	// We will block on this script until we get the upgrade completed.
-	if cfg.Cmd != "" {
-		cmdParts := strings.Split(cfg.Cmd, " ")
-		if err := upgrader.StreamingExternalCmd(cmdParts[0], cmdParts[1:]...); err != nil {
-			log.Println("External command failed, rolling back the service upgrade")
-			err := ru.Rollback()
-			if err != nil {
-				log.Fatal("Failed to rollback", err.Error())
-			}
-			log.Fatal("Rolled back")
-		}
-	}
-
-	// POST to ?action=finishupgrade will finish the upgrade and ?action=rollback will rollback.
-	// Rolling back is dangerous since it will leave the other containers in a stopped state and they will
-	// need to be started here automatically.
-	if cfg.RancherFinishUpgrade {
-		log.Println("Service upgraded, finishing the upgrade")
-		svc, err := ru.FinishUpgrade()
-		if err != nil {
-			log.Fatal(err.Error())
+		return err
+	}
+	available := map[string]struct{}{}
+	for _, arch := range imageArchs {
+		available[arch] = struct{}{}
+	}
+	for host, arch := range hostArchs {
+		if _, ok := available[arch]; !ok {
+			return fmt.Errorf("image %s is available for %v, host %s is %s", image, imageArchs, host, arch)
 		}
-		log.Printf("Service upgrade successful, finished upgrade of %s\n", svc.Name)
-	} else {
-		log.Println("Service upgrade successful, skipping the finish upgrade step")
+	}
+	log.Printf("Image %s is available for %v\n", image, imageArchs)
+	return nil
+}
+
+// readBuildTagFile returns the trimmed contents of the file an earlier pipeline stage wrote the build tag to.
+func readBuildTagFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	tag := strings.TrimSpace(string(b))
+	if tag == "" {
+		return "", fmt.Errorf("build tag file %s is empty", path)
+	}
+	return tag, nil
+}
+
+// confirm asks the question on the terminal and returns true if the answer was yes.
+// When not running interactively (e.g. in CI) there is nobody to ask and it always returns true.
+func confirm(question string) bool {
+	fi, err := os.Stdin.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return true
+	}
+	// /dev/null is a character device too.
+	if null, err := os.Stat(os.DevNull); err == nil && os.SameFile(fi, null) {
+		return true
+	}
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// logDeadline logs when the failure of a step was caused by the overall deadline (TOTAL_DEADLINE) passing.
+func logDeadline(ctx context.Context) {
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Println("Total deadline exceeded")
 	}
 }
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/upgrader"
+)
+
+// upgradeDurationBuckets are the upper bounds in seconds of the buckets of the upgrade duration histogram.
+var upgradeDurationBuckets = []float64{10, 30, 60, 120, 300, 600, 1800, 3600}
+
+// daemonMetrics are what the daemon did, served on /metrics in the Prometheus text format for the
+// daemon itself to be monitored and alerted on.
+type daemonMetrics struct {
+	mu sync.Mutex
+	// upgrades are the upgrades that ended by their status, and inFlight those running.
+	upgrades map[string]int
+	inFlight int
+	// durationBuckets are the counts of the upgrades that took at most each of upgradeDurationBuckets.
+	durationBuckets []int
+	durationSum     float64
+	durationCount   int
+	// phaseSums and phaseCounts are the total seconds and the number of the phases of the upgrades.
+	phaseSums   map[string]float64
+	phaseCounts map[string]int
+	// rollbacks are the upgrades that were cancelled or rolled back by whether that succeeded.
+	rollbacks map[string]int
+	// apiRequests are the requests to the Rancher API by method and status code, "error" when they
+	// failed, and apiErrors those that failed or were answered with an error status.
+	apiRequests map[[2]string]int
+	apiErrors   map[string]int
+	// rateLimitWaitSum and rateLimitWaitCount are the total seconds and the number of the requests that
+	// waited for RANCHER_RATE_LIMIT.
+	rateLimitWaitSum   float64
+	rateLimitWaitCount int
+}
+
+// newDaemonMetrics returns the metrics of a daemon that did nothing yet.
+func newDaemonMetrics() *daemonMetrics {
+	return &daemonMetrics{
+		upgrades:        map[string]int{},
+		durationBuckets: make([]int, len(upgradeDurationBuckets)),
+		phaseSums:       map[string]float64{},
+		phaseCounts:     map[string]int{},
+		rollbacks:       map[string]int{},
+		apiRequests:     map[[2]string]int{},
+		apiErrors:       map[string]int{},
+	}
+}
+
+// started records an upgrade that started.
+func (m *daemonMetrics) started() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight++
+}
+
+// finished records the upgrade of report that started at start and ended with status.
+func (m *daemonMetrics) finished(report *upgradeReport, status string, start time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight--
+	m.upgrades[status]++
+	seconds := time.Since(start).Seconds()
+	for i, le := range upgradeDurationBuckets {
+		if seconds <= le {
+			m.durationBuckets[i]++
+		}
+	}
+	m.durationSum += seconds
+	m.durationCount++
+	for phase, d := range report.Durations {
+		m.phaseSums[phase] += d.Seconds()
+		m.phaseCounts[phase]++
+	}
+	switch {
+	case report.RollbackFailed:
+		m.rollbacks["failed"]++
+	case report.RollbackReason != "":
+		m.rollbacks["succeeded"]++
+	}
+}
+
+// observeRequest implements rancher.RequestObserver.
+func (m *daemonMetrics) observeRequest(method string, status int, err error, d time.Duration) {
+	code := strconv.Itoa(status)
+	if err != nil {
+		code = "error"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.apiRequests[[2]string{method, code}]++
+	if err != nil || status >= http.StatusBadRequest {
+		m.apiErrors[method]++
+	}
+}
+
+// observeRateLimit records how long a request waited for RANCHER_RATE_LIMIT.
+func (m *daemonMetrics) observeRateLimit(waited time.Duration) {
+	if waited == 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rateLimitWaitSum += waited.Seconds()
+	m.rateLimitWaitCount++
+}
+
+// serve responds with the metrics.
+func (m *daemonMetrics) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.write(w)
+}
+
+// write writes the metrics to w in the Prometheus text format.
+func (m *daemonMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP rancher_upgrader_upgrades_total Upgrades that ended, by status.")
+	fmt.Fprintln(w, "# TYPE rancher_upgrader_upgrades_total counter")
+	for _, status := range sortedKeys(m.upgrades) {
+		fmt.Fprintf(w, "rancher_upgrader_upgrades_total{status=%q} %d\n", status, m.upgrades[status])
+	}
+	fmt.Fprintln(w, "# HELP rancher_upgrader_upgrades_in_flight Upgrades running.")
+	fmt.Fprintln(w, "# TYPE rancher_upgrader_upgrades_in_flight gauge")
+	fmt.Fprintf(w, "rancher_upgrader_upgrades_in_flight %d\n", m.inFlight)
+
+	fmt.Fprintln(w, "# HELP rancher_upgrader_upgrade_duration_seconds How long upgrades took.")
+	fmt.Fprintln(w, "# TYPE rancher_upgrader_upgrade_duration_seconds histogram")
+	for i, le := range upgradeDurationBuckets {
+		fmt.Fprintf(w, "rancher_upgrader_upgrade_duration_seconds_bucket{le=\"%g\"} %d\n", le, m.durationBuckets[i])
+	}
+	fmt.Fprintf(w, "rancher_upgrader_upgrade_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.durationCount)
+	fmt.Fprintf(w, "rancher_upgrader_upgrade_duration_seconds_sum %g\n", m.durationSum)
+	fmt.Fprintf(w, "rancher_upgrader_upgrade_duration_seconds_count %d\n", m.durationCount)
+
+	fmt.Fprintln(w, "# HELP rancher_upgrader_phase_duration_seconds How long the phases of upgrades took.")
+	fmt.Fprintln(w, "# TYPE rancher_upgrader_phase_duration_seconds summary")
+	for _, phase := range sortedKeys(m.phaseCounts) {
+		fmt.Fprintf(w, "rancher_upgrader_phase_duration_seconds_sum{phase=%q} %g\n", phase, m.phaseSums[phase])
+		fmt.Fprintf(w, "rancher_upgrader_phase_duration_seconds_count{phase=%q} %d\n", phase, m.phaseCounts[phase])
+	}
+
+	fmt.Fprintln(w, "# HELP rancher_upgrader_rollbacks_total Upgrades cancelled or rolled back, by whether that succeeded.")
+	fmt.Fprintln(w, "# TYPE rancher_upgrader_rollbacks_total counter")
+	for _, result := range sortedKeys(m.rollbacks) {
+		fmt.Fprintf(w, "rancher_upgrader_rollbacks_total{result=%q} %d\n", result, m.rollbacks[result])
+	}
+
+	fmt.Fprintln(w, "# HELP rancher_upgrader_rancher_api_requests_total Requests to the Rancher API, by method and status code.")
+	fmt.Fprintln(w, "# TYPE rancher_upgrader_rancher_api_requests_total counter")
+	keys := make([][2]string, 0, len(m.apiRequests))
+	for k := range m.apiRequests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || (keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1])
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "rancher_upgrader_rancher_api_requests_total{method=%q,code=%q} %d\n", k[0], k[1], m.apiRequests[k])
+	}
+	fmt.Fprintln(w, "# HELP rancher_upgrader_rancher_api_errors_total Requests to the Rancher API that failed or were answered with an error, by method.")
+	fmt.Fprintln(w, "# TYPE rancher_upgrader_rancher_api_errors_total counter")
+	for _, method := range sortedKeys(m.apiErrors) {
+		fmt.Fprintf(w, "rancher_upgrader_rancher_api_errors_total{method=%q} %d\n", method, m.apiErrors[method])
+	}
+
+	fmt.Fprintln(w, "# HELP rancher_upgrader_rancher_api_rate_limit_wait_seconds How long requests to the Rancher API waited for the rate limit.")
+	fmt.Fprintln(w, "# TYPE rancher_upgrader_rancher_api_rate_limit_wait_seconds summary")
+	fmt.Fprintf(w, "rancher_upgrader_rancher_api_rate_limit_wait_seconds_sum %g\n", m.rateLimitWaitSum)
+	fmt.Fprintf(w, "rancher_upgrader_rancher_api_rate_limit_wait_seconds_count %d\n", m.rateLimitWaitCount)
+	fmt.Fprintln(w, "# HELP rancher_upgrader_rancher_api_rate_limit_queued Requests to the Rancher API waiting for the rate limit.")
+	fmt.Fprintln(w, "# TYPE rancher_upgrader_rancher_api_rate_limit_queued gauge")
+	fmt.Fprintf(w, "rancher_upgrader_rancher_api_rate_limit_queued %d\n", upgrader.RateLimitQueued())
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+	"github.com/richardbolt/rancher-upgrader/upgrader"
+)
+
+// upgradeEnvironments upgrades the service named RANCHER_SERVICE_NAME in each of RANCHER_ENV_IDS, e.g. every
+// regional production environment, ENV_PARALLELISM environments at a time and in order. Once an upgrade
+// fails no more are started, the ones already running are seen through and the run fails.
+func upgradeEnvironments(ctx context.Context, cfg rancher.Config) {
+	if cfg.RancherServiceName == "" {
+		log.Fatal("RANCHER_ENV_IDS needs RANCHER_SERVICE_NAME")
+	}
+	parallelism := cfg.EnvParallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	// The summaries are kept in the order of the environments, nil for those that weren't started.
+	results := make([]*upgradeSummary, len(cfg.RancherEnvIDs))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	failed := false
+	client := upgrader.NewClient(&http.Client{}, cfg)
+	slots := make(chan struct{}, parallelism)
+	for i, envID := range cfg.RancherEnvIDs {
+		slots <- struct{}{}
+		mu.Lock()
+		stop := failed
+		mu.Unlock()
+		if stop {
+			<-slots
+			break
+		}
+		if i > 0 {
+			if err := nextBatch(ctx, cfg, i, "upgrading in env "+envID); err != nil {
+				log.Println(err.Error())
+				<-slots
+				mu.Lock()
+				failed = true
+				mu.Unlock()
+				break
+			}
+		}
+		wg.Add(1)
+		go func(i int, envID string) {
+			defer func() { <-slots }()
+			defer wg.Done()
+			s := upgradeInEnvironment(ctx, client, cfg, envID, parallelism == 1)
+			mu.Lock()
+			defer mu.Unlock()
+			results[i] = &s
+			if s.Error != "" {
+				failed = true
+			}
+		}(i, envID)
+	}
+	wg.Wait()
+
+	var summaries []upgradeSummary
+	for i, s := range results {
+		if s == nil {
+			log.Printf("Skipped %s in env %s\n", cfg.RancherServiceName, cfg.RancherEnvIDs[i])
+			continue
+		}
+		summaries = append(summaries, *s)
+		if cfg.Output != "teamcity" {
+			if err := json.NewEncoder(os.Stdout).Encode(s); err != nil {
+				log.Println(err.Error())
+			}
+		}
+	}
+	reportSummaries(cfg, summaries)
+	if failed {
+		logDeadline(ctx)
+		log.Fatalf("Stopped upgrading %s after a failure, upgraded it in %d of %d environments",
+			cfg.RancherServiceName, succeeded(summaries), len(cfg.RancherEnvIDs))
+	}
+	log.Printf("Upgraded %s in %d environments to %s\n", cfg.RancherServiceName, len(summaries), cfg.BuildTag)
+}
+
+// upgradeInEnvironment upgrades the service named RANCHER_SERVICE_NAME in the environment envID with client
+// and returns the summary of the upgrade. Blocks are only reported to TeamCity when the upgrades run one
+// at a time.
+func upgradeInEnvironment(ctx context.Context, client *upgrader.Client, cfg rancher.Config, envID string, block bool) upgradeSummary {
+	cfg.RancherEnvID = envID
+	report := &upgradeReport{ServiceName: cfg.RancherServiceName}
+	upgrade := func() error {
+		var err error
+		cfg.RancherServiceID, err = serviceIDByName(ctx, client.Service(upgrader.ServiceRef{EnvID: envID}), cfg.RancherServiceName)
+		if err != nil {
+			return err
+		}
+		return upgradeService(ctx, client.Service(upgrader.ServiceRef{EnvID: envID, ServiceID: cfg.RancherServiceID}), cfg, nil, report)
+	}
+	var err error
+	if block {
+		err = inBlock(cfg, "Upgrade "+cfg.RancherServiceName+" in "+envID, upgrade)
+	} else {
+		err = upgrade()
+	}
+	if err != nil {
+		log.Printf("Failed to upgrade %s in env %s: %s\n", cfg.RancherServiceName, envID, err)
+	}
+	s := newUpgradeSummary(cfg, report, err)
+	s.EnvID = envID
+	return s
+}
+
+// serviceIDByName returns the ID of the service of the environment of ru named name.
+func serviceIDByName(ctx context.Context, ru upgrader.Upgrader, name string) (string, error) {
+	services, err := ru.Services(ctx)
+	if err != nil {
+		return "", err
+	}
+	var ids []string
+	for _, svc := range services {
+		if svc.Name == name {
+			ids = append(ids, svc.ID)
+		}
+	}
+	switch len(ids) {
+	case 0:
+		return "", fmt.Errorf("no service named %s", name)
+	case 1:
+		return ids[0], nil
+	default:
+		return "", fmt.Errorf("%d services are named %s: %v", len(ids), name, ids)
+	}
+}
+
+// succeeded returns how many of the upgrades of summaries succeeded.
+func succeeded(summaries []upgradeSummary) int {
+	n := 0
+	for _, s := range summaries {
+		if s.Error == "" {
+			n++
+		}
+	}
+	return n
+}
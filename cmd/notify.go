@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+)
+
+// notification is an upgrade as it is sent to NOTIFY_WEBHOOK_URL. Text is what chat incoming webhooks
+// (Slack, Mattermost) display, the rest is for other receivers.
+type notification struct {
+	Text    string         `json:"text"`
+	Upgrade upgradeSummary `json:"upgrade"`
+}
+
+// notifySummaries sends a notification of every upgrade of summaries that ended with one of NOTIFY_STATUSES,
+// and of every upgrade that could not be rolled back as that leaves the service broken, to NOTIFY_WEBHOOK_URL
+// and the notifier plugins.
+func notifySummaries(cfg rancher.Config, summaries []upgradeSummary) {
+	statuses := map[string]struct{}{}
+	for _, status := range cfg.NotifyStatuses {
+		statuses[status] = struct{}{}
+	}
+	for _, s := range summaries {
+		if _, ok := statuses[s.Status]; !ok && !s.RollbackFailed {
+			continue
+		}
+		if cfg.NotifyWebhookURL != "" {
+			if err := notify(cfg.NotifyWebhookURL, s); err != nil {
+				log.Printf("Failed to notify of the upgrade of %s: %s\n", s.name(), err)
+			}
+		}
+		notifyPlugins(cfg, s)
+	}
+}
+
+// notify posts the notification of the upgrade s to url.
+func notify(url string, s upgradeSummary) error {
+	return postJSON(url, notification{Upgrade: s, Text: notificationText(s)})
+}
+
+// postJSON posts v as JSON to url, failing on an error status.
+func postJSON(url string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= http.StatusBadRequest {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("POST %s: %s: %s", url, res.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// notificationText describes the upgrade s for people.
+func notificationText(s upgradeSummary) string {
+	text := fmt.Sprintf("Upgrade of %s %s: %s", s.name(), imageChange(s.From, s.To), s.Status)
+	if s.RollbackFailed {
+		text = "CRITICAL: " + text + ", it could not be rolled back"
+	}
+	if s.Error != "" {
+		text += ", " + s.Error
+	}
+	if s.TestResults != nil {
+		text += ", " + s.TestResults.String()
+	}
+	if s.CmdOutput != "" {
+		text += "\n```\n" + s.CmdOutput + "\n```"
+	}
+	return text
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oidcKeysRefresh is how often the keys of the OIDC provider are fetched again at most, when a token is
+// signed with a key they don't have, e.g. after the provider rotated them.
+const oidcKeysRefresh = time.Minute
+
+// oidcLeeway is how far the clocks of the daemon and the OIDC provider may be apart.
+const oidcLeeway = time.Minute
+
+// oidcVerifier verifies the ID tokens the OIDC provider issuer issues to the client audience, signed with
+// RS256 by the keys it publishes.
+type oidcVerifier struct {
+	issuer      string
+	audience    string
+	groupsClaim string
+	client      *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+func newOIDCVerifier(issuer, audience, groupsClaim string) *oidcVerifier {
+	return &oidcVerifier{
+		issuer:      strings.TrimSuffix(issuer, "/"),
+		audience:    audience,
+		groupsClaim: groupsClaim,
+		client:      &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// verify returns the subject of the ID token and the groups it has, or why it isn't accepted.
+func (v *oidcVerifier) verify(ctx context.Context, token string) (string, []string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", nil, fmt.Errorf("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return "", nil, fmt.Errorf("malformed token header: %s", err)
+	}
+	if header.Alg != "RS256" {
+		return "", nil, fmt.Errorf("tokens signed with %s aren't accepted, only RS256", header.Alg)
+	}
+	key, err := v.key(ctx, header.Kid)
+	if err != nil {
+		return "", nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", nil, fmt.Errorf("malformed token signature: %s", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return "", nil, fmt.Errorf("invalid token signature")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return "", nil, fmt.Errorf("malformed token claims: %s", err)
+	}
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != v.issuer {
+		return "", nil, fmt.Errorf("token issued by %q, not %s", iss, v.issuer)
+	}
+	if !contains(stringClaim(claims["aud"]), v.audience) {
+		return "", nil, fmt.Errorf("token not issued to %s", v.audience)
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(oidcLeeway)) {
+		return "", nil, fmt.Errorf("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(oidcLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return "", nil, fmt.Errorf("token not valid yet")
+	}
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return "", nil, fmt.Errorf("token has no subject")
+	}
+	return subject, stringClaim(claims[v.groupsClaim]), nil
+}
+
+// decodeSegment decodes the base64url encoded JSON segment s of a token into v.
+func decodeSegment(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// stringClaim returns the strings of a claim that is a string or a list of them.
+func stringClaim(claim interface{}) []string {
+	switch claim := claim.(type) {
+	case string:
+		return []string{claim}
+	case []interface{}:
+		ss := []string{}
+		for _, c := range claim {
+			if s, ok := c.(string); ok {
+				ss = append(ss, s)
+			}
+		}
+		return ss
+	}
+	return nil
+}
+
+// key returns the key of the OIDC provider with the ID kid, fetching its keys when they are unknown.
+func (v *oidcVerifier) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	if v.keys != nil && time.Since(v.fetched) < oidcKeysRefresh {
+		return nil, fmt.Errorf("token signed with the unknown key %q", kid)
+	}
+	keys, err := v.fetchKeys(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch the keys of %s: %s", v.issuer, err)
+	}
+	v.keys, v.fetched = keys, time.Now()
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("token signed with the unknown key %q", kid)
+}
+
+// fetchKeys fetches the RSA keys the OIDC provider publishes at the jwks_uri of its discovery document,
+// by their IDs.
+func (v *oidcVerifier) fetchKeys(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	var discovery struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := v.getJSON(ctx, v.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	if discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("its discovery document has no jwks_uri")
+	}
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := v.getJSON(ctx, discovery.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("malformed key %q: %s", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("malformed key %q: %s", k.Kid, err)
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys, nil
+}
+
+// getJSON gets the JSON document at url into v.
+func (v *oidcVerifier) getJSON(ctx context.Context, url string, doc interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := v.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+	if err := json.NewDecoder(res.Body).Decode(doc); err != nil {
+		return fmt.Errorf("invalid answer of %s: %s", url, err)
+	}
+	return nil
+}
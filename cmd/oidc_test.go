@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testProvider is an OIDC provider publishing the key "k1", whose tokens verify tests.
+type testProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testProvider{key: key}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"jwks_uri": p.URL + "/keys"})
+		case "/keys":
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "k1",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return p
+}
+
+// token returns a token with the claims, signed by key with the header.
+func (p *testProvider) token(t *testing.T, header, claims map[string]interface{}, key *rsa.PrivateKey) string {
+	h, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestOIDCVerify(t *testing.T) {
+	p := newTestProvider(t)
+	defer p.Close()
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	rs256 := map[string]interface{}{"alg": "RS256", "kid": "k1"}
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{"iss": p.URL, "aud": "ru", "sub": "alice", "exp": now + 300, "groups": []string{"ops"}}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+	tests := []struct {
+		name   string
+		header map[string]interface{}
+		claims map[string]interface{}
+		key    *rsa.PrivateKey
+		err    string
+	}{
+		{"valid", rs256, claims(nil), p.key, ""},
+		{"issuer with a slash", rs256, claims(map[string]interface{}{"iss": p.URL + "/"}), p.key, ""},
+		{"audiences", rs256, claims(map[string]interface{}{"aud": []string{"other", "ru"}}), p.key, ""},
+		{"within the leeway", rs256, claims(map[string]interface{}{"exp": now - 30, "nbf": now + 30}), p.key, ""},
+		{"other issuer", rs256, claims(map[string]interface{}{"iss": "https://attacker.example.com"}), p.key, "token issued by"},
+		{"no issuer", rs256, claims(map[string]interface{}{"iss": nil}), p.key, "token issued by"},
+		{"other audience", rs256, claims(map[string]interface{}{"aud": "other"}), p.key, "not issued to ru"},
+		{"other audiences", rs256, claims(map[string]interface{}{"aud": []string{"other"}}), p.key, "not issued to ru"},
+		{"expired", rs256, claims(map[string]interface{}{"exp": now - 300}), p.key, "token expired"},
+		{"no expiry", rs256, claims(map[string]interface{}{"exp": nil}), p.key, "token expired"},
+		{"not valid yet", rs256, claims(map[string]interface{}{"nbf": now + 300}), p.key, "not valid yet"},
+		{"no subject", rs256, claims(map[string]interface{}{"sub": nil}), p.key, "no subject"},
+		{"alg none", map[string]interface{}{"alg": "none", "kid": "k1"}, claims(nil), p.key, "signed with none"},
+		{"alg HS256", map[string]interface{}{"alg": "HS256", "kid": "k1"}, claims(nil), p.key, "signed with HS256"},
+		{"other key", rs256, claims(nil), other, "invalid token signature"},
+		{"unknown key", map[string]interface{}{"alg": "RS256", "kid": "k2"}, claims(nil), p.key, "unknown key"},
+	}
+	for _, test := range tests {
+		v := newOIDCVerifier(p.URL, "ru", "groups")
+		subject, groups, err := v.verify(context.Background(), p.token(t, test.header, test.claims, test.key))
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		case test.err == "" && (subject != "alice" || len(groups) != 1 || groups[0] != "ops"):
+			t.Errorf("%s: expected alice of ops, got %s of %v", test.name, subject, groups)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: expected an error with %q, got %v", test.name, test.err, err)
+		}
+	}
+
+	v := newOIDCVerifier(p.URL, "ru", "groups")
+	token := p.token(t, rs256, claims(nil), p.key)
+	if _, _, err := v.verify(context.Background(), token[:len(token)-4]+"AAAA"); err == nil {
+		t.Error("expected a tampered signature to be refused")
+	}
+}
+
+func TestAuthenticatedOIDC(t *testing.T) {
+	p := newTestProvider(t)
+	defer p.Close()
+	d := &daemon{auth: &authenticator{
+		roles: []daemonRole{{Name: "ops", Group: "ops"}},
+		oidc:  newOIDCVerifier(p.URL, "ru", "groups"),
+	}}
+	h := d.authenticated(func(w http.ResponseWriter, r *http.Request) {})
+	rs256 := map[string]interface{}{"alg": "RS256", "kid": "k1"}
+	exp := time.Now().Unix() + 300
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		status int
+	}{
+		{"with a role", map[string]interface{}{"iss": p.URL, "aud": "ru", "sub": "alice", "exp": exp, "groups": []string{"ops"}}, http.StatusOK},
+		{"without a role", map[string]interface{}{"iss": p.URL, "aud": "ru", "sub": "bob", "exp": exp, "groups": []string{"dev"}}, http.StatusForbidden},
+		{"invalid", map[string]interface{}{"iss": p.URL, "aud": "other", "sub": "alice", "exp": exp, "groups": []string{"ops"}}, http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/upgrades", nil)
+		r.Header.Set("Authorization", "Bearer "+p.token(t, rs256, test.claims, p.key))
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: expected %d, got %d %s", test.name, test.status, w.Code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+)
+
+// skipOverride is the service override that leaves the service out of an environment upgrade.
+const skipOverride = "SKIP"
+
+// serviceConfig returns cfg with the SERVICE_OVERRIDES and SERVICE_<name>_<setting> env variables of
+// the service name applied, and whether it is skipped.
+func serviceConfig(cfg rancher.Config, name string) (rancher.Config, bool, error) {
+	values := map[string]interface{}{}
+	for setting, value := range cfg.ServiceOverrides[name] {
+		values[setting] = value
+	}
+	prefix := "SERVICE_" + serviceEnvName(name) + "_"
+	settings := configSettings()
+	for _, kv := range os.Environ() {
+		parts := strings.SplitN(kv, "=", 2)
+		if !strings.HasPrefix(parts[0], prefix) || len(parts) < 2 {
+			continue
+		}
+		// Only settings are taken, so SERVICE_APP_WORKER_BUILD_TAG of app-worker isn't taken for app.
+		if setting := parts[0][len(prefix):]; setting == skipOverride || settings[setting] {
+			values[setting] = parts[1]
+		}
+	}
+
+	skip := false
+	if v, ok := values[skipOverride]; ok {
+		s, err := envValue(v)
+		if err == nil {
+			skip, err = strconv.ParseBool(s)
+		}
+		if err != nil {
+			return cfg, false, fmt.Errorf("invalid %s override of %s: %s", skipOverride, name, err)
+		}
+		delete(values, skipOverride)
+	}
+	if err := overrideConfig(&cfg, values); err != nil {
+		return cfg, false, fmt.Errorf("invalid overrides of %s: %s", name, err)
+	}
+	if err := checkGuardConfig(cfg); err != nil {
+		return cfg, false, fmt.Errorf("invalid overrides of %s: %s", name, err)
+	}
+	return cfg, skip, nil
+}
+
+// serviceEnvName returns the service name as it is written in env variable names: in upper case with
+// the other characters than letters and digits as _.
+func serviceEnvName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// configSettings returns the env variable names of the settings of the config.
+func configSettings() map[string]bool {
+	t := reflect.TypeOf(rancher.Config{})
+	settings := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		if name := t.Field(i).Tag.Get("envconfig"); name != "" {
+			settings[name] = true
+		}
+	}
+	return settings
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+)
+
+// pauseCommand runs `rancher-upgrader pause [reason]` or `rancher-upgrader resume`, which only touch
+// PAUSE_FILE so they don't need Rancher.
+func pauseCommand(command string, args []string) {
+	var cfg rancher.Config
+	if err := envconfig.Process("", &cfg); err != nil {
+		log.Fatal(err.Error())
+	}
+	if cfg.PauseFile == "" {
+		log.Fatal(command + " needs PAUSE_FILE")
+	}
+	if command == "resume" {
+		err := os.Remove(cfg.PauseFile)
+		switch {
+		case os.IsNotExist(err):
+			log.Println("Upgrades weren't paused")
+		case err != nil:
+			log.Fatal(err.Error())
+		default:
+			log.Println("Resumed the paused upgrades")
+		}
+		return
+	}
+	reason := commandReason(args, "paused")
+	if err := ioutil.WriteFile(cfg.PauseFile, []byte(reason+"\n"), 0644); err != nil {
+		log.Fatal(err.Error())
+	}
+	log.Printf("Paused upgrades before their next batch (%s), resume them with `rancher-upgrader resume`\n", reason)
+}
+
+// commandReason returns the reason given on the command line, args, or what was done, e.g. paused, by
+// whom and when without one.
+func commandReason(args []string, done string) string {
+	reason := strings.Join(args, " ")
+	if reason != "" {
+		return reason
+	}
+	reason = done
+	if u, err := user.Current(); err == nil {
+		reason += " by " + u.Username
+	}
+	return reason + " at " + time.Now().UTC().Format(time.RFC3339)
+}
+
+// paused returns whether batched upgrades are paused and why.
+func paused(cfg rancher.Config) (bool, string) {
+	if cfg.Paused != nil && cfg.Paused() {
+		return true, "paused through the daemon API"
+	}
+	if cfg.PauseFile == "" {
+		return false, ""
+	}
+	b, err := ioutil.ReadFile(cfg.PauseFile)
+	if err != nil {
+		return false, ""
+	}
+	reason := strings.TrimSpace(string(b))
+	if reason == "" {
+		reason = cfg.PauseFile + " exists"
+	}
+	return true, reason
+}
+
+// waitWhilePaused holds a batched upgrade before its next batch, next, while upgrades are paused, until
+// they are resumed or ctx is done.
+func waitWhilePaused(ctx context.Context, cfg rancher.Config, next string) error {
+	interval := time.Duration(cfg.CheckInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Second
+	}
+	held := false
+	for {
+		isPaused, reason := paused(cfg)
+		if !isPaused {
+			if held {
+				log.Printf("Resumed, %s\n", next)
+			}
+			return nil
+		}
+		if !held {
+			log.Printf("Upgrades are paused (%s), holding before %s until they are resumed\n", reason, next)
+			held = true
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("paused before %s: %s", next, ctx.Err())
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+	"github.com/richardbolt/rancher-upgrader/upgrader"
+)
+
+// plan is the upgrade of one service, or of an environment, as reviewed between
+// `rancher-upgrader plan` and `rancher-upgrader apply`.
+type plan struct {
+	EnvID string `json:"envId"`
+	// Environment is set for an environment-wide upgrade (ENV_UPGRADE_IMAGE).
+	Environment bool         `json:"environment,omitempty"`
+	BuildTag    string       `json:"buildTag"`
+	StartFirst  bool         `json:"startFirst"`
+	CreatedAt   string       `json:"createdAt"`
+	Changes     []planChange `json:"changes"`
+}
+
+// planChange is the upgrade of a service.
+type planChange struct {
+	ServiceID string `json:"serviceId"`
+	Name      string `json:"name"`
+	// Fingerprint is a hash of the launchConfig the change was planned against.
+	Fingerprint string `json:"fingerprint"`
+	// Diff lists the launchConfig settings the upgrade changes, for review.
+	Diff         []string             `json:"diff"`
+	LaunchConfig rancher.LaunchConfig `json:"launchConfig"`
+	// Ports are the published ports that are checked to be free before upgrading.
+	Ports []string `json:"ports,omitempty"`
+}
+
+// signedPlan is the plan file, the plan and an HMAC-SHA256 of it keyed with PLAN_SIGNING_KEY.
+type signedPlan struct {
+	Plan      json.RawMessage `json:"plan"`
+	Signature string          `json:"signature"`
+}
+
+// newPlanChange plans the upgrade of svc with options.
+func newPlanChange(svc *rancher.Service, ports []string, options ...upgrader.Option) (planChange, error) {
+	fingerprint, err := launchConfigFingerprint(svc.LaunchConfig)
+	if err != nil {
+		return planChange{}, err
+	}
+	upgrade, err := upgrader.Preview(svc, options...)
+	if err != nil {
+		return planChange{}, err
+	}
+	launchConfig := upgrade.InServiceStrategy.LaunchConfig
+	return planChange{
+		ServiceID:    svc.ID,
+		Name:         svc.Name,
+		Fingerprint:  fingerprint,
+		Diff:         launchConfigDiff(svc.LaunchConfig, launchConfig),
+		LaunchConfig: launchConfig,
+		Ports:        ports,
+	}, nil
+}
+
+// check returns an error if svc has drifted from the state the change was planned against.
+func (c planChange) check(svc *rancher.Service) error {
+	fingerprint, err := launchConfigFingerprint(svc.LaunchConfig)
+	if err != nil {
+		return err
+	}
+	if fingerprint != c.Fingerprint {
+		return fmt.Errorf("the launchConfig of %s (%s) has changed since it was planned, plan again", c.Name, c.ServiceID)
+	}
+	if svc.Actions.Upgrade == "" {
+		return fmt.Errorf("%s (%s) can't be upgraded while %s", c.Name, c.ServiceID, svc.State)
+	}
+	return nil
+}
+
+// options returns the upgrader options that make exactly the planned change.
+func (p *plan) options(c planChange) []upgrader.Option {
+	return []upgrader.Option{
+		upgrader.StartFirst(p.StartFirst),
+		upgrader.LaunchConfig(c.LaunchConfig),
+	}
+}
+
+// launchConfigFingerprint returns a hash of launchConfig.
+func launchConfigFingerprint(launchConfig rancher.LaunchConfig) (string, error) {
+	// launchConfigs encode as maps and encoding/json sorts map keys, so equal launchConfigs have
+	// equal encodings.
+	b, err := json.Marshal(launchConfig)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// launchConfigDiff describes the settings that differ between from and to, sorted by name.
+func launchConfigDiff(fromConfig, toConfig rancher.LaunchConfig) []string {
+	from, to := fromConfig.Map(), toConfig.Map()
+	keys := map[string]struct{}{}
+	for k := range from {
+		keys[k] = struct{}{}
+	}
+	for k := range to {
+		keys[k] = struct{}{}
+	}
+	var diff []string
+	for k := range keys {
+		if reflect.DeepEqual(from[k], to[k]) {
+			continue
+		}
+		was, _ := json.Marshal(from[k])
+		now, _ := json.Marshal(to[k])
+		diff = append(diff, fmt.Sprintf("%s: %s -> %s", k, was, now))
+	}
+	sort.Strings(diff)
+	return diff
+}
+
+// writePlan plans the upgrade configured in cfg without making it, and writes the signed plan to path.
+func writePlan(ctx context.Context, ru upgrader.Upgrader, cfg rancher.Config, path string) error {
+	if cfg.PlanSigningKey == "" {
+		return fmt.Errorf("plan needs PLAN_SIGNING_KEY")
+	}
+	p := plan{
+		EnvID:      cfg.RancherEnvID,
+		BuildTag:   cfg.BuildTag,
+		StartFirst: cfg.RancherStartServiceFirst,
+		CreatedAt:  time.Now().UTC().Format(time.RFC3339),
+	}
+	if cfg.EnvUpgradeImage != "" {
+		p.Environment = true
+		planned, err := planEnvironment(ctx, ru, cfg)
+		if err != nil {
+			return err
+		}
+		for _, u := range planned {
+			svc := u.Service
+			c, err := newPlanChange(&svc, nil, upgrader.ImageUUID(u.To))
+			if err != nil {
+				return err
+			}
+			p.Changes = append(p.Changes, c)
+		}
+	} else {
+		svc, err := ru.GetServiceConfig(ctx)
+		if err != nil {
+			return err
+		}
+		if svc.Actions.Upgrade == "" {
+			return fmt.Errorf("%s can't be upgraded while %s", svc.Name, svc.State)
+		}
+		data := newTemplateData(cfg.BuildTag, cfg.GitSHA)
+		spec, err := renderServiceSpec(cfg, data)
+		if err != nil {
+			return err
+		}
+		_, options, err := upgradeOptions(cfg, svc, data, spec)
+		if err != nil {
+			return err
+		}
+		c, err := newPlanChange(svc, cfg.Ports, options...)
+		if err != nil {
+			return err
+		}
+		p.Changes = append(p.Changes, c)
+	}
+
+	for _, c := range p.Changes {
+		log.Printf("Plan to upgrade %s (%s):\n", c.Name, c.ServiceID)
+		for _, d := range c.Diff {
+			log.Printf("  %s\n", d)
+		}
+	}
+	b, err := encodePlan(p, "")
+	if err != nil {
+		return err
+	}
+	b = bytes.TrimSpace(b)
+	signed, err := encodePlan(signedPlan{Plan: b, Signature: signPlan(b, cfg.PlanSigningKey)}, "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, signed, 0644); err != nil {
+		return err
+	}
+	log.Printf("Wrote the plan of %d upgrade(s) to %s, run `rancher-upgrader apply %s` to make it\n", len(p.Changes), path, path)
+	return nil
+}
+
+// encodePlan encodes v as JSON indented with indent, leaving the "->" of diffs readable.
+func encodePlan(v interface{}, indent string) ([]byte, error) {
+	b := bytes.Buffer{}
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", indent)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// readPlan reads the plan file at path, refusing it unless it was signed with key for the environment envID.
+func readPlan(path, key, envID string) (*plan, error) {
+	if key == "" {
+		return nil, fmt.Errorf("apply needs PLAN_SIGNING_KEY")
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	signed := signedPlan{}
+	if err := json.Unmarshal(b, &signed); err != nil {
+		return nil, fmt.Errorf("invalid plan file %s: %s", path, err)
+	}
+	// The plan is signed as encoding/json writes it, without the indentation of the file.
+	compact := bytes.Buffer{}
+	if err := json.Compact(&compact, signed.Plan); err != nil {
+		return nil, fmt.Errorf("invalid plan file %s: %s", path, err)
+	}
+	if !hmac.Equal([]byte(signPlan(compact.Bytes(), key)), []byte(signed.Signature)) {
+		return nil, fmt.Errorf("the signature of plan file %s doesn't match, it was changed or signed with another key", path)
+	}
+	p := &plan{}
+	if err := json.Unmarshal(signed.Plan, p); err != nil {
+		return nil, fmt.Errorf("invalid plan file %s: %s", path, err)
+	}
+	if p.EnvID != envID {
+		return nil, fmt.Errorf("plan file %s is for environment %s, not %s", path, p.EnvID, envID)
+	}
+	if len(p.Changes) == 0 {
+		return nil, fmt.Errorf("plan file %s has nothing to upgrade", path)
+	}
+	return p, nil
+}
+
+// signPlan returns the hex HMAC-SHA256 of the encoded plan b.
+func signPlan(b []byte, key string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(b)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/plugins"
+	"github.com/richardbolt/rancher-upgrader/rancher"
+	"github.com/richardbolt/rancher-upgrader/verify"
+)
+
+// approveUpgrade runs the approver plugins configured in cfg for the upgrade u, which is about to start,
+// and returns an error if one of them doesn't approve it.
+func approveUpgrade(ctx context.Context, cfg rancher.Config, u startedUpgrade) error {
+	for _, p := range plugins.Of(cfg.Plugins, plugins.KindApprover) {
+		if _, err := p.Run(ctx, u, time.Duration(cfg.PluginTimeout)*time.Second); err != nil {
+			return fmt.Errorf("the upgrade of %s was not approved: %s", u.ServiceName, err)
+		}
+		log.Printf("The upgrade of %s was approved by %s\n", u.ServiceName, p.Name)
+	}
+	return nil
+}
+
+// pluginVerifiers returns the verifier plugins configured in cfg, which verify the upgrade u.
+func pluginVerifiers(cfg rancher.Config, u startedUpgrade) []verify.Verifier {
+	var vs []verify.Verifier
+	for _, p := range plugins.Of(cfg.Plugins, plugins.KindVerifier) {
+		vs = append(vs, plugins.Verifier{Plugin: p, Upgrade: u, Timeout: time.Duration(cfg.PluginTimeout) * time.Second})
+	}
+	return vs
+}
+
+// notifyPlugins sends the upgrade s to the notifier plugins configured in cfg, logging those that fail.
+func notifyPlugins(cfg rancher.Config, s upgradeSummary) {
+	for _, p := range plugins.Of(cfg.Plugins, plugins.KindNotifier) {
+		if _, err := p.Run(context.Background(), s, time.Duration(cfg.PluginTimeout)*time.Second); err != nil {
+			log.Printf("Failed to notify of the upgrade of %s: %s\n", s.name(), err)
+		}
+	}
+}
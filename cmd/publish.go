@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/kv"
+	"github.com/richardbolt/rancher-upgrader/rancher"
+)
+
+// release is the deployed version and its metadata, as published to KV_PATH.
+type release struct {
+	Service  string `json:"service"`
+	Image    string `json:"image"`
+	BuildTag string `json:"buildTag"`
+	GitSHA   string `json:"gitSha,omitempty"`
+	Date     string `json:"date"`
+}
+
+// publishRelease writes r to KV_PATH, when it is set, so config-watching services know the current release.
+func publishRelease(ctx context.Context, cfg rancher.Config, r release) error {
+	if cfg.KVPath == "" {
+		return nil
+	}
+	store, err := kv.New(cfg.KVBackend, cfg.KVAddr, cfg.KVToken, &http.Client{Timeout: 30 * time.Second})
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if err := store.Put(ctx, cfg.KVPath, b); err != nil {
+		return err
+	}
+	log.Printf("Published release %s to %s %s\n", r.BuildTag, cfg.KVBackend, cfg.KVPath)
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/richardbolt/rancher-upgrader/history"
+	"github.com/richardbolt/rancher-upgrader/rancher"
+)
+
+// queuedUpgrade is an upgrade the daemon was asked for and hasn't made yet. Its place in the queue is
+// taken before it is recorded in the history, and recorded is closed once it is, with err why it couldn't
+// be: cfg and attempt are only set then.
+type queuedUpgrade struct {
+	cfg      rancher.Config
+	attempt  history.Attempt
+	recorded chan struct{}
+	err      error
+}
+
+// serviceQueue are the upgrades of a service waiting for the one being made.
+type serviceQueue struct {
+	waiting []*queuedUpgrade
+}
+
+// upgradeQueue makes the upgrades of each service one at a time, and at most DAEMON_CONCURRENCY
+// services at once.
+type upgradeQueue struct {
+	mode rancher.QueueMode
+	// slots has an element for every service being upgraded, nil without DAEMON_CONCURRENCY.
+	slots chan struct{}
+
+	mu sync.Mutex
+	// services are the services being upgraded or waiting for a slot, by environment and service ID.
+	services map[string]*serviceQueue
+}
+
+func newUpgradeQueue(cfg rancher.Config) *upgradeQueue {
+	q := &upgradeQueue{mode: cfg.DaemonQueueMode, services: map[string]*serviceQueue{}}
+	if cfg.DaemonConcurrency > 0 {
+		q.slots = make(chan struct{}, cfg.DaemonConcurrency)
+	}
+	return q
+}
+
+// acquire takes a slot to upgrade a service in, waiting for one to be free when wait is set, and returns
+// whether it got one.
+func (q *upgradeQueue) acquire(wait bool) bool {
+	if q.slots == nil {
+		return true
+	}
+	if wait {
+		q.slots <- struct{}{}
+		return true
+	}
+	select {
+	case q.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// release frees a slot acquire took.
+func (q *upgradeQueue) release() {
+	if q.slots != nil {
+		<-q.slots
+	}
+}
+
+// depth returns how many upgrades are waiting.
+func (q *upgradeQueue) depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for _, sq := range q.services {
+		n += len(sq.waiting)
+	}
+	return n
+}
+
+// enqueue records the attempt a at the upgrade of cfg and queues it behind the upgrades of its service:
+// it is running when it is made right away and queued otherwise. Its slot and place in the queue are
+// taken first, so the history is written without holding up the other requests.
+func (d *daemon) enqueue(ctx context.Context, cfg rancher.Config, a *history.Attempt) error {
+	q := d.queue
+	key := cfg.RancherEnvID + "/" + cfg.RancherServiceID
+	u := &queuedUpgrade{recorded: make(chan struct{})}
+	q.mu.Lock()
+	sq, busy := q.services[key]
+	slot := !busy && q.acquire(false)
+	if !slot {
+		a.Status = history.Queued
+	}
+	if !busy {
+		sq = &serviceQueue{}
+		q.services[key] = sq
+		go d.work(key, sq, slot)
+	}
+	var superseded []*queuedUpgrade
+	if q.mode == rancher.QueueLatest {
+		superseded, sq.waiting = sq.waiting, nil
+	}
+	sq.waiting = append(sq.waiting, u)
+	q.mu.Unlock()
+
+	u.err = d.history.Start(ctx, a)
+	if u.err == nil {
+		if slot {
+			log.Printf("Upgrade %s of %s requested by %s\n", a.ID, a.ServiceID, a.RequestedBy)
+		} else {
+			log.Printf("Upgrade %s of %s requested by %s, queued\n", a.ID, a.ServiceID, a.RequestedBy)
+		}
+		d.pausedMu.Lock()
+		d.paused[a.ID] = false
+		d.pausedMu.Unlock()
+		id := a.ID
+		cfg.Paused = func() bool {
+			d.pausedMu.Lock()
+			defer d.pausedMu.Unlock()
+			return d.paused[id]
+		}
+		d.health.running.Add(1)
+		u.cfg, u.attempt = cfg, *a
+	}
+	close(u.recorded)
+
+	by := "a later upgrade request"
+	if u.err == nil {
+		by = "upgrade " + a.ID
+	}
+	for _, s := range superseded {
+		<-s.recorded
+		if s.err == nil {
+			d.drop(s, history.Superseded, fmt.Errorf("superseded by %s", by))
+		}
+	}
+	return u.err
+}
+
+// work makes the upgrades queued for the service key one after the other, each in a slot, until there
+// are none left. slot is whether it holds a slot for the first one already.
+func (d *daemon) work(key string, sq *serviceQueue, slot bool) {
+	q := d.queue
+	for {
+		q.mu.Lock()
+		if len(sq.waiting) == 0 {
+			delete(q.services, key)
+			q.mu.Unlock()
+			if slot {
+				q.release()
+			}
+			return
+		}
+		q.mu.Unlock()
+		if !slot {
+			slot = q.acquire(true)
+		}
+		// Only this takes upgrades off the queue, and superseding them leaves the latest, so it still
+		// has one.
+		q.mu.Lock()
+		u := sq.waiting[0]
+		sq.waiting = sq.waiting[1:]
+		q.mu.Unlock()
+
+		// Upgrades that couldn't be recorded were refused, and leave the slot to the next one.
+		<-u.recorded
+		if u.err != nil {
+			continue
+		}
+		d.health.mu.Lock()
+		draining := d.health.draining
+		d.health.mu.Unlock()
+		if draining {
+			d.drop(u, history.Failed, errDraining)
+			continue
+		}
+		if u.attempt.Status == history.Queued {
+			if err := d.history.Run(context.Background(), &u.attempt); err != nil {
+				log.Printf("Failed to record that upgrade %s is running: %s\n", u.attempt.ID, err)
+			}
+			log.Printf("Upgrade %s of %s is no longer queued\n", u.attempt.ID, u.attempt.ServiceID)
+		}
+		d.run(u.cfg, u.attempt)
+		q.release()
+		slot = false
+	}
+}
+
+// drop finishes the queued upgrade u without making it, with status and why.
+func (d *daemon) drop(u *queuedUpgrade, status string, err error) {
+	a := u.attempt
+	a.Status, a.Error = status, err.Error()
+	log.Printf("Upgrade %s of %s %s: %s\n", a.ID, a.ServiceID, a.Status, a.Error)
+	if err := d.history.Finish(context.Background(), &a); err != nil {
+		log.Printf("Failed to record the outcome of upgrade %s: %s\n", a.ID, err)
+	}
+	d.pausedMu.Lock()
+	delete(d.paused, a.ID)
+	d.pausedMu.Unlock()
+	d.health.running.Done()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/history"
+	"github.com/richardbolt/rancher-upgrader/rancher"
+)
+
+func TestQueue(t *testing.T) {
+	tests := []struct {
+		mode     rancher.QueueMode
+		statuses []string
+	}{
+		{rancher.QueueFIFO, []string{history.Queued, history.Queued, history.Queued}},
+		{rancher.QueueLatest, []string{history.Superseded, history.Superseded, history.Queued}},
+	}
+	for _, test := range tests {
+		h, remove := newTestHistory(t)
+		defer remove()
+		cfg := rancher.Config{RancherEnvID: "1a5", RancherServiceID: "1s1", DaemonQueueMode: test.mode, DaemonConcurrency: 1}
+		d := &daemon{cfg: cfg, history: h, paused: map[string]bool{}, queue: newUpgradeQueue(cfg)}
+		// With the only slot taken, the upgrades of 1s1 wait for it.
+		if !d.queue.acquire(false) {
+			t.Fatalf("%s: expected a free slot", test.mode)
+		}
+
+		attempts := []*history.Attempt{}
+		for i := 0; i < len(test.statuses); i++ {
+			a := &history.Attempt{EnvID: "1a5", ServiceID: "1s1"}
+			if err := d.enqueue(context.Background(), cfg, a); err != nil {
+				t.Fatal(err)
+			}
+			attempts = append(attempts, a)
+		}
+		waiting := 0
+		for i, a := range attempts {
+			recorded, err := h.Get(context.Background(), a.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if recorded.Status != test.statuses[i] {
+				t.Errorf("%s: expected upgrade %d to be %s, got %s", test.mode, i, test.statuses[i], recorded.Status)
+			}
+			if recorded.Status == history.Superseded && recorded.Error != "superseded by upgrade "+attempts[i+1].ID {
+				t.Errorf("%s: expected upgrade %d to be superseded by the next one, got %q", test.mode, i, recorded.Error)
+			}
+			if recorded.Status == history.Queued {
+				waiting++
+			}
+		}
+		if depth := d.queue.depth(); depth != waiting {
+			t.Errorf("%s: expected %d upgrades waiting, got %d", test.mode, waiting, depth)
+		}
+		// A queued upgrade can be paused before it starts.
+		last := attempts[len(attempts)-1]
+		w := httptest.NewRecorder()
+		d.pauseUpgrade(w, last.ID, true)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected the queued upgrade to be paused, got %d %s", test.mode, w.Code, w.Body)
+		}
+		if u := d.queue.services["1a5/1s1"].waiting; len(u) == 0 || !u[len(u)-1].cfg.Paused() {
+			t.Errorf("%s: expected the queued upgrade to see it was paused", test.mode)
+		}
+
+		// Stopping the daemon fails the upgrades still waiting, and frees the slot they got.
+		d.health.mu.Lock()
+		d.health.draining = true
+		d.health.mu.Unlock()
+		d.queue.release()
+		d.health.running.Wait()
+		for i, a := range attempts {
+			recorded, err := h.Get(context.Background(), a.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.statuses[i] == history.Queued && (recorded.Status != history.Failed || recorded.Error != errDraining.Error()) {
+				t.Errorf("%s: expected upgrade %d to fail as the daemon stopped, got %s %q", test.mode, i, recorded.Status, recorded.Error)
+			}
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for !d.queue.acquire(false) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: the slot wasn't freed after the upgrades waiting for it failed", test.mode)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		d.queue.release()
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/gitops"
+	"github.com/richardbolt/rancher-upgrader/rancher"
+	"github.com/richardbolt/rancher-upgrader/upgrader"
+)
+
+// reconciliation is the result of reconciling a service with its manifest.
+type reconciliation struct {
+	Time      string `json:"time"`
+	Commit    string `json:"commit"`
+	Service   string `json:"service"`
+	ServiceID string `json:"serviceId,omitempty"`
+	From      string `json:"from,omitempty"`
+	To        string `json:"to"`
+	Wave      int    `json:"wave"`
+	// Result is upgraded, failed, skipped or missing.
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// reconcile upgrades the services of the environment whose image differs from the manifests under
+// GITOPS_PATH in GITOPS_REPO, checking every GITOPS_INTERVAL seconds until it is stopped.
+func reconcile(ru upgrader.Upgrader, cfg rancher.Config) {
+	dir := cfg.GitOpsDir
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "rancher-upgrader-"+cfg.RancherEnvID)
+	}
+	repo := gitops.Repo{URL: cfg.GitOpsRepo, Branch: cfg.GitOpsBranch, Dir: dir}
+	log.Printf("Reconciling environment %s with %s %s every %ds\n", cfg.RancherEnvID, cfg.GitOpsRepo, cfg.GitOpsBranch, cfg.GitOpsInterval)
+	for {
+		if err := reconcileOnce(ru, cfg, repo); err != nil {
+			log.Println(err.Error())
+		}
+		time.Sleep(time.Duration(cfg.GitOpsInterval) * time.Second)
+	}
+}
+
+// reconcileOnce upgrades the services that have drifted from the manifests at the tip of repo, wave by
+// wave. A wave with a service that isn't running its desired image stops the later waves.
+func reconcileOnce(ru upgrader.Upgrader, cfg rancher.Config, repo gitops.Repo) error {
+	ctx := context.Background()
+	commit, err := repo.Sync(ctx)
+	if err != nil {
+		return err
+	}
+	desired, err := gitops.Load(filepath.Join(repo.Dir, cfg.GitOpsPath))
+	if err != nil {
+		return err
+	}
+	services, err := ru.Services(ctx)
+	if err != nil {
+		return err
+	}
+	live := map[string]rancher.Service{}
+	for _, svc := range services {
+		live[svc.ID] = svc
+		live[svc.Name] = svc
+	}
+
+	// The wave that didn't complete, stopping the waves after it.
+	incomplete := -1
+	for _, d := range desired {
+		r := reconciliation{Commit: commit, Service: d.Service, To: d.ImageUUID(), Wave: d.Wave}
+		svc, ok := live[d.Service]
+		switch {
+		case ok && svc.LaunchConfig.ImageUUID == d.ImageUUID():
+			continue
+		case incomplete >= 0 && d.Wave > incomplete:
+			r.Result, r.Error = "skipped", fmt.Sprintf("wave %d didn't complete", incomplete)
+		case !ok:
+			r.Result = "missing"
+		case svc.Actions.Upgrade == "":
+			r.Result, r.Error = "skipped", "can't be upgraded while "+svc.State
+		default:
+			r.Result = "upgraded"
+		}
+		if ok {
+			r.ServiceID = svc.ID
+			r.From = svc.LaunchConfig.ImageUUID
+		}
+		if r.Result == "upgraded" {
+			log.Printf("%s (%s) drifted from %s, upgrading from %s to %s\n", svc.Name, svc.ID, d.File, r.From, r.To)
+			if err := reconcileService(cfg, svc.ID, r.To); err != nil {
+				r.Result, r.Error = "failed", err.Error()
+			}
+		}
+		if r.Result != "upgraded" && incomplete < 0 {
+			incomplete = d.Wave
+		}
+		recordReconciliation(cfg, r)
+	}
+	return nil
+}
+
+// reconcileService upgrades the service serviceID to imageUUID, within TOTAL_DEADLINE when it is set.
+func reconcileService(cfg rancher.Config, serviceID, imageUUID string) error {
+	ctx := context.Background()
+	if cfg.TotalDeadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(cfg.TotalDeadline)*time.Second)
+		defer cancel()
+	}
+	svcCfg := cfg
+	svcCfg.RancherServiceID = serviceID
+	return upgradeTo(ctx, upgrader.New(&http.Client{}, svcCfg), svcCfg,
+		upgrader.StartFirst(cfg.RancherStartServiceFirst),
+		upgrader.ImageUUID(imageUUID),
+	)
+}
+
+// recordReconciliation logs r and appends it to GITOPS_RESULTS_FILE as a line of JSON.
+func recordReconciliation(cfg rancher.Config, r reconciliation) {
+	r.Time = time.Now().UTC().Format(time.RFC3339)
+	b, err := json.Marshal(r)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	log.Printf("Reconciliation: %s\n", b)
+	if cfg.GitOpsResultsFile == "" {
+		return
+	}
+	f, err := os.OpenFile(cfg.GitOpsResultsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		log.Println(err.Error())
+	}
+}
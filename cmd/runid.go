@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+	"github.com/richardbolt/rancher-upgrader/upgrader"
+)
+
+// runIDLabel is the label of the launchConfig of an upgrade that records the RUN_ID of the run that started it.
+const runIDLabel = "io.rancher.upgrader.run-id"
+
+// runLaunchConfig returns the launchConfig of svc that the run runID upgraded it to, nil if it didn't.
+func runLaunchConfig(svc *rancher.Service, runID string) *rancher.LaunchConfig {
+	for _, lc := range []*rancher.LaunchConfig{&svc.LaunchConfig, &svc.Upgrade.InServiceStrategy.LaunchConfig} {
+		if lc.Labels[runIDLabel] == runID {
+			return lc
+		}
+	}
+	return nil
+}
+
+// resumeRun completes the upgrade of svc that the run RUN_ID started before it was retried, e.g. by
+// CI after the upgrader was killed, and reports it in report. It returns false, doing nothing, when the
+// run didn't start an upgrade of svc or it was cancelled or rolled back since.
+func resumeRun(ctx context.Context, ru upgrader.Upgrader, cfg rancher.Config, svc *rancher.Service, data templateData, report *upgradeReport) (bool, error) {
+	lc := runLaunchConfig(svc, cfg.RunID)
+	if lc == nil {
+		return false, nil
+	}
+	report.To = lc.ImageUUID
+	if previous := svc.Upgrade.InServiceStrategy.PreviousLaunchConfig; previous != nil {
+		report.From = previous.ImageUUID
+	}
+	switch svc.State {
+	case "active":
+		log.Printf("%s was upgraded to %s by run %s already\n", svc.Name, lc.ImageUUID, cfg.RunID)
+		return true, nil
+	case "upgrading", "upgraded":
+	default:
+		return false, nil
+	}
+	log.Printf("Resuming the upgrade of %s to %s started by run %s\n", svc.Name, lc.ImageUUID, cfg.RunID)
+	u := startedUpgrade{
+		EnvID:       cfg.RancherEnvID,
+		ServiceID:   svc.ID,
+		ServiceName: svc.Name,
+		Scale:       svc.Scale,
+		BatchSize:   svc.Upgrade.InServiceStrategy.BatchSize,
+		From:        report.From,
+		ImageUUID:   lc.ImageUUID,
+		Data:        data,
+		StartedAt:   time.Now(),
+	}
+	var err error
+	u.guard, err = guardAutoscaler(ctx, ru, cfg, svc)
+	if err != nil {
+		return true, err
+	}
+	defer u.guard.release()
+	return true, completeUpgrade(ctx, ru, cfg, u, report)
+}
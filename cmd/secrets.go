@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+	"github.com/richardbolt/rancher-upgrader/upgrader"
+)
+
+// rotateSecrets creates the new secrets of ROTATE_SECRETS for the upgrade of svc, recording them in
+// report, and returns the option pointing the service at them.
+func rotateSecrets(ctx context.Context, ru upgrader.Upgrader, cfg rancher.Config, svc *rancher.Service, report *upgradeReport) (upgrader.Option, error) {
+	refs := upgrader.SecretReferences(svc.LaunchConfig)
+	values := map[string][]byte{}
+	for _, rotation := range cfg.RotateSecrets {
+		parts := strings.SplitN(rotation, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid ROTATE_SECRETS %s, expected <name>=<file>", rotation)
+		}
+		if _, ok := refs[parts[0]]; !ok {
+			return nil, fmt.Errorf("%s has no secret mounted as %s to rotate", svc.Name, parts[0])
+		}
+		value, err := ioutil.ReadFile(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		values[parts[0]] = value
+	}
+
+	suffix := time.Now().UTC().Format("20060102150405")
+	ids := map[string]string{}
+	for name, value := range values {
+		id, err := ru.CreateSecret(ctx, name+"-"+suffix, value)
+		if err != nil {
+			removeSecrets(ru, report)
+			return nil, fmt.Errorf("could not create the new secret %s: %s", name, err)
+		}
+		ids[name] = id
+		if report.NewSecrets == nil {
+			report.NewSecrets = map[string]string{}
+		}
+		report.NewSecrets[name] = id
+	}
+	return upgrader.SecretIDs(ids), nil
+}
+
+// removeSecrets removes the secrets created for the upgrade of report once the service no longer uses
+// them, as it was rolled back or never upgraded. It gets a fresh context so it still runs once the
+// overall deadline has passed.
+func removeSecrets(ru upgrader.Upgrader, report *upgradeReport) {
+	for name, id := range report.NewSecrets {
+		if err := ru.RemoveSecret(context.Background(), id); err != nil {
+			log.Printf("Could not remove the new secret %s (%s): %s\n", name, id, err)
+			continue
+		}
+		delete(report.NewSecrets, name)
+	}
+}
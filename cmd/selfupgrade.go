@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+	"github.com/richardbolt/rancher-upgrader/upgrader"
+)
+
+// startSelfUpgrade requests the upgrade u of the service the upgrader runs in. Rancher replaces this
+// container while the upgrade is made, so the upgrade is written to the SELF_UPGRADE_MARKER first for
+// the new container to complete with resumeSelfUpgrade when it starts.
+func startSelfUpgrade(ctx context.Context, ru upgrader.Upgrader, cfg rancher.Config, u startedUpgrade, options []upgrader.Option, report *upgradeReport) error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(cfg.SelfUpgradeMarker, b, 0600); err != nil {
+		return fmt.Errorf("could not write the self-upgrade marker: %s", err)
+	}
+	if err := ru.Upgrade(ctx, options...); err != nil {
+		os.Remove(cfg.SelfUpgradeMarker)
+		return err
+	}
+	report.HandedOver = true
+	log.Printf("Upgrading %s, the upgrader itself, the new container will complete the upgrade\n", u.ServiceName)
+	return nil
+}
+
+// resumeSelfUpgrade completes the self-upgrade started by the previous container of the upgrader if the
+// SELF_UPGRADE_MARKER says there is one, returning false when there wasn't.
+func resumeSelfUpgrade(ctx context.Context, cfg rancher.Config) (bool, error) {
+	b, err := ioutil.ReadFile(cfg.SelfUpgradeMarker)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	// Whatever happens it is completed only once, so a rolled back container doesn't try again.
+	if err := os.Remove(cfg.SelfUpgradeMarker); err != nil {
+		return false, err
+	}
+	var u startedUpgrade
+	if err := json.Unmarshal(b, &u); err != nil {
+		return true, fmt.Errorf("could not read the self-upgrade marker: %s", err)
+	}
+	// A daemon isn't configured with the service it runs in, the marker says which it is.
+	cfg.RancherEnvID, cfg.RancherServiceID = u.EnvID, u.ServiceID
+	ru := upgrader.New(&http.Client{}, cfg)
+
+	log.Printf("Completing the self-upgrade of %s to %s\n", u.ServiceName, u.ImageUUID)
+	report := &upgradeReport{ServiceName: u.ServiceName, From: u.From, To: u.ImageUUID}
+	err = completeUpgrade(ctx, ru, cfg, u, report)
+	if cfg.Output != "teamcity" {
+		if serr := writeSummary(os.Stdout, cfg, report, err); serr != nil {
+			log.Println(serr.Error())
+		}
+	}
+	reportSummaries(cfg, []upgradeSummary{newUpgradeSummary(cfg, report, err)})
+	return true, err
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/richardbolt/rancher-upgrader/rancher"
+	"github.com/richardbolt/rancher-upgrader/upgrader"
+)
+
+// simulatedUpgrade is the upgrade of a service of a fixture that `simulate` decided on.
+type simulatedUpgrade struct {
+	ServiceID   string `json:"serviceId"`
+	ServiceName string `json:"serviceName"`
+	From        string `json:"from"`
+	To          string `json:"to"`
+	// Diff lists the launchConfig settings the upgrade changes, as in a plan.
+	Diff []string `json:"diff"`
+	// Refused is why the upgrade would not be made, e.g. a guardrail.
+	Refused string `json:"refused,omitempty"`
+}
+
+// simulateCommand runs `rancher-upgrader simulate <fixture>`, which decides on the upgrade configured in
+// the environment for the services of the fixture, as `export` wrote them, without Rancher. The upgrades
+// are written to stdout and it exits with an error status when one of them would be refused.
+func simulateCommand(args []string) {
+	if len(args) < 1 {
+		log.Fatal("usage: rancher-upgrader simulate <fixture>")
+	}
+	cfg, err := loadSimulationConfig()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	services, err := readServiceFixture(args[0])
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	upgrades, err := simulate(cfg, services)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	b, err := encodePlan(upgrades, "  ")
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	os.Stdout.Write(b)
+	for _, u := range upgrades {
+		if u.Refused != "" {
+			os.Exit(1)
+		}
+	}
+}
+
+// loadSimulationConfig loads the config like loadConfig, leaving out everything that needs Rancher.
+func loadSimulationConfig() (rancher.Config, error) {
+	var cfg rancher.Config
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		if err := loadConfigFile(path); err != nil {
+			return cfg, err
+		}
+	}
+	if err := envconfig.Process("", &cfg); err != nil {
+		return cfg, err
+	}
+	if err := checkGuardConfig(cfg); err != nil {
+		return cfg, err
+	}
+	if cfg.BuildTagFile != "" {
+		var err error
+		cfg.BuildTag, err = readBuildTagFile(cfg.BuildTagFile)
+		if err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, nil
+}
+
+// readServiceFixture reads the services of the fixture at path: a service, a list of them, or a
+// collection of them as the Rancher API lists them.
+func readServiceFixture(path string) ([]rancher.Service, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var services []rancher.Service
+	if b = bytes.TrimSpace(b); bytes.HasPrefix(b, []byte("[")) {
+		err = json.Unmarshal(b, &services)
+	} else {
+		collection := struct {
+			Type string            `json:"type"`
+			Data []rancher.Service `json:"data"`
+		}{}
+		if err = json.Unmarshal(b, &collection); err == nil && collection.Type == "collection" {
+			services = collection.Data
+		} else if err == nil {
+			services = make([]rancher.Service, 1)
+			err = json.Unmarshal(b, &services[0])
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid fixture %s: %s", path, err)
+	}
+	return services, nil
+}
+
+// simulate decides on the upgrade configured in cfg for services: the environment upgrade of
+// ENV_UPGRADE_IMAGE, or the upgrade of the service RANCHER_SERVICE_ID, which may be left unset when
+// there is only one.
+func simulate(cfg rancher.Config, services []rancher.Service) ([]simulatedUpgrade, error) {
+	if cfg.EnvUpgradeImage != "" {
+		planned, err := planServices(cfg, services)
+		if err != nil {
+			return nil, err
+		}
+		upgrades := []simulatedUpgrade{}
+		for _, p := range planned {
+			svc := p.Service
+			u, err := simulateUpgrade(p.Config, &svc, nil, upgrader.ImageUUID(p.To))
+			if err != nil {
+				return nil, err
+			}
+			upgrades = append(upgrades, u)
+		}
+		return upgrades, nil
+	}
+
+	var svc *rancher.Service
+	for i := range services {
+		if services[i].ID == cfg.RancherServiceID || cfg.RancherServiceID == "" && len(services) == 1 {
+			svc = &services[i]
+		}
+	}
+	if svc == nil {
+		return nil, fmt.Errorf("the fixture has no service %q, set RANCHER_SERVICE_ID to one of its %d services", cfg.RancherServiceID, len(services))
+	}
+	if svc.Actions.Upgrade == "" {
+		return []simulatedUpgrade{{
+			ServiceID:   svc.ID,
+			ServiceName: svc.Name,
+			From:        svc.LaunchConfig.ImageUUID,
+			Refused:     fmt.Sprintf("service was not in an upgradeable state, got: %s", svc.State),
+		}}, nil
+	}
+	data := newTemplateData(cfg.BuildTag, cfg.GitSHA)
+	spec, err := renderServiceSpec(cfg, data)
+	if err != nil {
+		return nil, err
+	}
+	_, options, err := upgradeOptions(cfg, svc, data, spec)
+	if err != nil {
+		return nil, err
+	}
+	u, err := simulateUpgrade(cfg, svc, cfg.Ports, options...)
+	if err != nil {
+		return nil, err
+	}
+	return []simulatedUpgrade{u}, nil
+}
+
+// simulateUpgrade plans the upgrade of svc with options and checks it against the guardrails of cfg
+// but the stack health and the alerts, logging the outcome.
+func simulateUpgrade(cfg rancher.Config, svc *rancher.Service, ports []string, options ...upgrader.Option) (simulatedUpgrade, error) {
+	c, err := newPlanChange(svc, ports, options...)
+	if err != nil {
+		return simulatedUpgrade{}, err
+	}
+	u := simulatedUpgrade{
+		ServiceID:   svc.ID,
+		ServiceName: svc.Name,
+		From:        svc.LaunchConfig.ImageUUID,
+		To:          c.LaunchConfig.ImageUUID,
+		Diff:        c.Diff,
+	}
+	// The stack of the service and the monitoring hook are as out of reach as Rancher.
+	if cfg.GuardStackHealth {
+		log.Printf("Not checking the stack of %s in a simulation\n", svc.Name)
+		cfg.GuardStackHealth = false
+	}
+	if cfg.GuardAlertsURL != "" {
+		log.Printf("Not checking %s for the alerts of %s in a simulation\n", cfg.GuardAlertsURL, svc.Name)
+		cfg.GuardAlertsURL = ""
+	}
+	err = checkGuardrails(context.Background(), nil, cfg, svc, startedUpgrade{
+		EnvID:       cfg.RancherEnvID,
+		ServiceID:   svc.ID,
+		ServiceName: svc.Name,
+		Scale:       svc.Scale,
+		From:        u.From,
+		ImageUUID:   u.To,
+	})
+	if err != nil {
+		u.Refused = err.Error()
+		log.Printf("Would not upgrade %s (%s): %s\n", svc.Name, svc.ID, u.Refused)
+		return u, nil
+	}
+	log.Printf("Would upgrade %s (%s):\n", svc.Name, svc.ID)
+	for _, d := range u.Diff {
+		log.Printf("  %s\n", d)
+	}
+	return u, nil
+}
+
+// exportServices writes the service of cfg, or the services of the environment for ENV_UPGRADE_IMAGE,
+// to path as a fixture for `simulate`, or to stdout when path is "".
+func exportServices(ctx context.Context, ru upgrader.Upgrader, cfg rancher.Config, path string) error {
+	var v interface{}
+	if cfg.EnvUpgradeImage != "" {
+		services, err := ru.Services(ctx)
+		if err != nil {
+			return err
+		}
+		v = services
+	} else {
+		svc, err := ru.GetServiceConfig(ctx)
+		if err != nil {
+			return err
+		}
+		v = svc
+	}
+	b, err := encodePlan(v, "  ")
+	if err != nil {
+		return err
+	}
+	if path == "" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
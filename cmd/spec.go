@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+)
+
+// serviceSpec is the service rendered from SERVICE_TEMPLATE, e.g.
+//
+//	scale: {{ .Values.scale }}
+//	launchConfig:
+//	  imageUuid: docker:org/app:{{ .BuildTag }}
+//	  memory: {{ .Values.memory }}
+//	  environment:
+//	    LOG_LEVEL: {{ .Values.logLevel }}
+type serviceSpec struct {
+	// Scale is the number of containers, left as it is when 0.
+	Scale int `yaml:"scale"`
+	// LaunchConfig is merged into the service's launchConfig as a JSON merge patch, so it only needs
+	// what differs from the running service.
+	LaunchConfig map[string]interface{} `yaml:"launchConfig"`
+}
+
+// specData is what a service template is rendered with: the build metadata and the merged values files.
+type specData struct {
+	templateData
+	Values map[interface{}]interface{}
+}
+
+// renderServiceSpec renders SERVICE_TEMPLATE with the VALUES_FILES and the build metadata in data,
+// returning nil when there is no template.
+func renderServiceSpec(cfg rancher.Config, data templateData) (*serviceSpec, error) {
+	if cfg.ServiceTemplate == "" {
+		return nil, nil
+	}
+	values := map[interface{}]interface{}{}
+	for _, path := range cfg.ValuesFiles {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		v := map[interface{}]interface{}{}
+		if err := yaml.Unmarshal(b, &v); err != nil {
+			return nil, fmt.Errorf("invalid values file %s: %s", path, err)
+		}
+		mergeValues(values, v)
+	}
+	text, err := ioutil.ReadFile(cfg.ServiceTemplate)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(cfg.ServiceTemplate).Option("missingkey=error").Parse(string(text))
+	if err != nil {
+		return nil, fmt.Errorf("invalid service template %s: %s", cfg.ServiceTemplate, err)
+	}
+	b := bytes.Buffer{}
+	if err := tmpl.Execute(&b, specData{templateData: data, Values: values}); err != nil {
+		return nil, fmt.Errorf("invalid service template %s: %s", cfg.ServiceTemplate, err)
+	}
+	raw := struct {
+		Scale        int                         `yaml:"scale"`
+		LaunchConfig map[interface{}]interface{} `yaml:"launchConfig"`
+	}{}
+	if err := yaml.UnmarshalStrict(b.Bytes(), &raw); err != nil {
+		return nil, fmt.Errorf("invalid service rendered from %s: %s", cfg.ServiceTemplate, err)
+	}
+	lc, _ := jsonCompatible(raw.LaunchConfig).(map[string]interface{})
+	return &serviceSpec{Scale: raw.Scale, LaunchConfig: lc}, nil
+}
+
+// mergeValues merges the values of src into dst, recursively for nested maps, src taking precedence.
+func mergeValues(dst, src map[interface{}]interface{}) {
+	for k, v := range src {
+		srcMap, srcOK := v.(map[interface{}]interface{})
+		dstMap, dstOK := dst[k].(map[interface{}]interface{})
+		if srcOK && dstOK {
+			mergeValues(dstMap, srcMap)
+			continue
+		}
+		dst[k] = v
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/richardbolt/rancher-upgrader/history"
+)
+
+// spinnakerStatus is an upgrade attempt as a Spinnaker webhook stage polls it: status is RUNNING,
+// SUCCEEDED or TERMINAL and statusUrl is where to poll it.
+type spinnakerStatus struct {
+	ID        string `json:"id"`
+	Status    string `json:"status"`
+	StatusURL string `json:"statusUrl"`
+	Message   string `json:"message"`
+}
+
+// spinnakerUpgrades starts an upgrade for a Spinnaker webhook stage, with the same body as POST /upgrades.
+// The status URL is in the Location header and the statusUrl of the response.
+func (d *daemon) spinnakerUpgrades(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s isn't allowed", r.Method))
+		return
+	}
+	a := d.start(w, r)
+	if a == nil {
+		return
+	}
+	s := newSpinnakerStatus(r, a)
+	w.Header().Set("Location", s.StatusURL)
+	writeJSON(w, http.StatusAccepted, s)
+}
+
+// spinnakerUpgrade returns the status of the upgrade /spinnaker/upgrades/<id> for a Spinnaker webhook stage.
+func (d *daemon) spinnakerUpgrade(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s isn't allowed", r.Method))
+		return
+	}
+	a, err := d.history.Get(r.Context(), strings.TrimPrefix(r.URL.Path, "/spinnaker/upgrades/"))
+	if err == history.ErrNotFound {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !callerOf(r).may(a.EnvID, a.ServiceID, false) {
+		forbidden(w, r, a.EnvID, a.ServiceID, false)
+		return
+	}
+	writeJSON(w, http.StatusOK, newSpinnakerStatus(r, a))
+}
+
+// newSpinnakerStatus returns the Spinnaker status of the attempt a, with a status URL on the host r was sent to.
+func newSpinnakerStatus(r *http.Request, a *history.Attempt) spinnakerStatus {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	s := spinnakerStatus{
+		ID:        a.ID,
+		StatusURL: fmt.Sprintf("%s://%s/spinnaker/upgrades/%s", scheme, r.Host, a.ID),
+		Message:   fmt.Sprintf("Upgrade of %s is %s", a.ServiceID, a.Status),
+	}
+	switch a.Status {
+	case history.Running, history.Queued:
+		s.Status = "RUNNING"
+	case history.Succeeded, history.Upgraded:
+		s.Status = "SUCCEEDED"
+	default:
+		s.Status = "TERMINAL"
+	}
+	if a.Error != "" {
+		s.Message += ": " + a.Error
+	}
+	return s
+}
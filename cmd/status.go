@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+	"github.com/richardbolt/rancher-upgrader/upgrader"
+)
+
+// serviceStatus is the operational view of a service printed by `status`.
+type serviceStatus struct {
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	State       string            `json:"state"`
+	HealthState string            `json:"healthState"`
+	Image       string            `json:"image"`
+	Scale       int               `json:"scale"`
+	Containers  []containerStatus `json:"containers"`
+}
+
+type containerStatus struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	State       string `json:"state"`
+	HealthState string `json:"healthState"`
+	Image       string `json:"image"`
+	HostID      string `json:"hostId"`
+	IP          string `json:"ip"`
+}
+
+// statusOptions are the command line flags of `status`.
+type statusOptions struct {
+	watch    bool
+	json     bool
+	interval time.Duration
+}
+
+// parseStatusFlags parses the command line args of `status`, e.g. `--watch --json`.
+func parseStatusFlags(cfg rancher.Config, args []string) (statusOptions, error) {
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	var o statusOptions
+	fs.BoolVar(&o.watch, "watch", false, "keep printing the status until interrupted")
+	fs.BoolVar(&o.json, "json", false, "print the status as JSON, one object per line")
+	fs.DurationVar(&o.interval, "interval", time.Duration(cfg.CheckInterval)*time.Second, "how often to refresh with --watch")
+	err := fs.Parse(args)
+	return o, err
+}
+
+// status prints the status of the service of ru to w, and keeps printing it every interval with watch.
+func status(ctx context.Context, ru upgrader.Upgrader, o statusOptions, w io.Writer) error {
+	for {
+		s, err := getServiceStatus(ctx, ru)
+		if err != nil {
+			return err
+		}
+		if o.json {
+			err = json.NewEncoder(w).Encode(s)
+		} else {
+			err = s.print(w)
+		}
+		if err != nil || !o.watch {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(o.interval):
+		}
+		if !o.json {
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+// getServiceStatus returns the current status of the service of ru and its containers.
+func getServiceStatus(ctx context.Context, ru upgrader.Upgrader) (*serviceStatus, error) {
+	svc, err := ru.GetServiceConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	containers, err := ru.Containers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s := &serviceStatus{
+		ID:          svc.ID,
+		Name:        svc.Name,
+		State:       svc.State,
+		HealthState: svc.HealthState,
+		Scale:       svc.Scale,
+		Containers:  []containerStatus{},
+	}
+	s.Image = svc.LaunchConfig.ImageUUID
+	for _, c := range containers {
+		s.Containers = append(s.Containers, containerStatus{
+			ID:          c.ID,
+			Name:        c.Name,
+			Type:        c.Type,
+			State:       c.State,
+			HealthState: c.HealthState,
+			Image:       c.ImageUUID,
+			HostID:      c.HostID,
+			IP:          c.PrimaryIPAddress,
+		})
+	}
+	return s, nil
+}
+
+// print writes s to w for a person to read.
+func (s *serviceStatus) print(w io.Writer) error {
+	fmt.Fprintf(w, "%s %s (%s): %s, %s\n", time.Now().Format("15:04:05"), s.Name, s.ID, s.State, s.HealthState)
+	fmt.Fprintf(w, "  image: %s\n", s.Image)
+	fmt.Fprintf(w, "  scale: %d\n", s.Scale)
+	for _, c := range s.Containers {
+		name := c.ID
+		if c.Name != "" {
+			name = fmt.Sprintf("%s (%s)", c.Name, c.ID)
+		}
+		_, err := fmt.Fprintf(w, "  %s %s: %s, %s, %s on host %s at %s\n", c.Type, name, c.State, c.HealthState, c.Image, c.HostID, c.IP)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// healthy returns how many containers of s are running its image and healthy, or without a health check.
+func (s *serviceStatus) healthy() int {
+	n := 0
+	for _, c := range s.Containers {
+		if c.Image == s.Image && c.State == "running" && (c.HealthState == "" || c.HealthState == "healthy") {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+	"github.com/richardbolt/rancher-upgrader/upgrader"
+)
+
+// writeSummaryTable writes a compact table of the upgrades to w for people, one row per service with the
+// previous and new tag, how long it took and the result.
+func writeSummaryTable(w io.Writer, summaries []upgradeSummary) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERVICE\tIMAGE\tDURATION\tRESULT")
+	for _, s := range summaries {
+		result := s.Status
+		if s.Error != "" {
+			result += ": " + s.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", s.name(), imageChange(s.From, s.To), s.duration(), result)
+	}
+	return tw.Flush()
+}
+
+// duration returns how long the upgrade took, to the second.
+func (s upgradeSummary) duration() time.Duration {
+	var total float64
+	for _, seconds := range s.Durations {
+		total += seconds
+	}
+	return time.Duration(total * float64(time.Second)).Round(time.Second)
+}
+
+// reportSummaries reports the upgrades of a run to the people and the CI system watching it once it ends.
+func reportSummaries(cfg rancher.Config, summaries []upgradeSummary) {
+	if cfg.Quiet {
+		writeSummaryTable(os.Stderr, summaries)
+	}
+	if cfg.Output == "teamcity" {
+		teamcity{os.Stdout}.report(summaries)
+	}
+	if cfg.ResultsFile != "" {
+		if err := writeResultsFile(cfg.ResultsFile, summaries); err != nil {
+			log.Printf("Failed to write the results to %s: %s\n", cfg.ResultsFile, err)
+		}
+	}
+	notifySummaries(cfg, summaries)
+	if cfg.GitHubActions {
+		if err := reportGitHub(os.Stderr, cfg.GitHubStepSummary, summaries); err != nil {
+			log.Printf("Failed to write the GitHub Actions job summary: %s\n", err)
+		}
+	}
+}
+
+// imageChange describes the change from one image to another, only by tag when the repository is the same.
+func imageChange(from, to string) string {
+	repo := upgrader.ImageRepository(from)
+	if repo == "" || repo != upgrader.ImageRepository(to) {
+		return fmt.Sprintf("%s → %s", from, to)
+	}
+	return fmt.Sprintf("%s → %s", imageTag(from), imageTag(to))
+}
+
+// imageTag returns the tag or digest of imageUUID.
+func imageTag(imageUUID string) string {
+	ref := strings.TrimPrefix(imageUUID, "docker:")
+	tag := strings.TrimPrefix(ref, upgrader.ImageRepository(imageUUID))
+	return strings.TrimPrefix(tag, ":")
+}
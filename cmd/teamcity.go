@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/richardbolt/rancher-upgrader/history"
+	"github.com/richardbolt/rancher-upgrader/rancher"
+)
+
+// teamcity writes TeamCity service messages, https://www.jetbrains.com/help/teamcity/service-messages.html,
+// which TeamCity reads from stdout.
+type teamcity struct {
+	w io.Writer
+}
+
+// blockOpened starts a collapsible block of the build log.
+func (t teamcity) blockOpened(name string) {
+	fmt.Fprintf(t.w, "##teamcity[blockOpened name='%s']\n", teamcityEscape(name))
+}
+
+// blockClosed ends the block started by blockOpened.
+func (t teamcity) blockClosed(name string) {
+	fmt.Fprintf(t.w, "##teamcity[blockClosed name='%s']\n", teamcityEscape(name))
+}
+
+// report fails the build with a problem for every upgrade that failed, and reports the seconds each
+// phase of the upgrades took as build statistics, e.g. rancher.app.upgrade.
+func (t teamcity) report(summaries []upgradeSummary) {
+	for _, s := range summaries {
+		phases := make([]string, 0, len(s.Durations))
+		for phase := range s.Durations {
+			phases = append(phases, phase)
+		}
+		sort.Strings(phases)
+		for _, phase := range phases {
+			fmt.Fprintf(t.w, "##teamcity[buildStatisticValue key='%s' value='%.3f']\n",
+				teamcityEscape("rancher."+s.name()+"."+phase), s.Durations[phase])
+		}
+		if s.Status != history.Succeeded && s.Status != history.Upgraded {
+			fmt.Fprintf(t.w, "##teamcity[buildProblem description='%s' identity='%s']\n",
+				teamcityEscape(fmt.Sprintf("Upgrade of %s %s: %s", s.name(), s.Status, s.Error)),
+				teamcityEscape("rancher-upgrade-"+s.ServiceID))
+		}
+	}
+}
+
+// inBlock runs fn in a block of the TeamCity build log named name when OUTPUT=teamcity.
+func inBlock(cfg rancher.Config, name string, fn func() error) error {
+	if cfg.Output != "teamcity" {
+		return fn()
+	}
+	t := teamcity{os.Stdout}
+	t.blockOpened(name)
+	defer t.blockClosed(name)
+	return fn()
+}
+
+// teamcityEscape escapes a value of a service message.
+func teamcityEscape(s string) string {
+	return strings.NewReplacer("|", "||", "'", "|'", "\n", "|n", "\r", "|r", "[", "|[", "]", "|]").Replace(s)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// templateData is the build metadata available to override values written as Go templates,
+// e.g. LABELS='{"release": "release-{{ .BuildTag }}"}'.
+type templateData struct {
+	BuildTag string
+	GitSHA   string
+	// Date is the UTC time of the upgrade in RFC 3339 format.
+	Date string
+}
+
+// newTemplateData returns the build metadata for an upgrade to buildTag. When gitSHA is empty the
+// commit is taken from the variables common CI systems set.
+func newTemplateData(buildTag, gitSHA string) templateData {
+	for _, name := range []string{"GIT_COMMIT", "GITHUB_SHA", "CI_COMMIT_SHA", "TRAVIS_COMMIT"} {
+		if gitSHA != "" {
+			break
+		}
+		gitSHA = os.Getenv(name)
+	}
+	return templateData{
+		BuildTag: buildTag,
+		GitSHA:   gitSHA,
+		Date:     time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+// render executes text as a Go template with data.
+func (data templateData) render(name, text string) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid template for %s: %s", name, err)
+	}
+	b := bytes.Buffer{}
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("invalid template for %s: %s", name, err)
+	}
+	return b.String(), nil
+}
+
+// renderMap renders every value of m, naming errors after prefix and the key.
+func (data templateData) renderMap(prefix string, m map[string]string) (map[string]string, error) {
+	rendered := make(map[string]string, len(m))
+	for k, v := range m {
+		s, err := data.render(prefix+"."+k, v)
+		if err != nil {
+			return nil, err
+		}
+		rendered[k] = s
+	}
+	return rendered, nil
+}
+
+// renderSlice renders every item of l, naming errors after prefix.
+func (data templateData) renderSlice(prefix string, l []string) ([]string, error) {
+	rendered := make([]string, len(l))
+	for i, v := range l {
+		s, err := data.render(prefix, v)
+		if err != nil {
+			return nil, err
+		}
+		rendered[i] = s
+	}
+	return rendered, nil
+}
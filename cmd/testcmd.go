@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+	"github.com/richardbolt/rancher-upgrader/upgrader"
+	"github.com/richardbolt/rancher-upgrader/verify"
+)
+
+// runTestCmd runs UPGRADE_TEST_CMD and returns why the upgrade failed verification, nil when it passed.
+// With UPGRADE_TEST_RESULTS_FORMAT the test results the command reported decide instead of its exit
+// status, passing within the tolerance of VERIFY_ALLOWED_FAILURES and VERIFY_PASS_RATE, and are recorded
+// in report.
+func runTestCmd(ctx context.Context, cfg rancher.Config, report *upgradeReport) error {
+	tail := &tailBuffer{max: cfg.CmdOutputTail}
+	opts := upgrader.CmdOptions{
+		Dir:        cfg.CmdDir,
+		EnvFile:    cfg.CmdEnvFile,
+		Env:        cfg.CmdEnv,
+		User:       cfg.CmdUser,
+		Shell:      string(cfg.CmdShell),
+		Output:     tail,
+		Image:      cfg.CmdImage,
+		Workspace:  cfg.CmdWorkspace,
+		DockerArgs: strings.Fields(cfg.CmdDockerArgs),
+	}
+	var output bytes.Buffer
+	if cfg.CmdResultsFormat != "" && cfg.CmdResultsFile == "" {
+		opts.Output = io.MultiWriter(tail, &output)
+	}
+	err := upgrader.RunCommandLine(ctx, opts, cfg.Cmd)
+	if err != nil {
+		report.CmdOutput = tail.String()
+	}
+	if cfg.CmdResultsFormat == "" || ctx.Err() != nil {
+		if err != nil {
+			return errors.New("External command failed")
+		}
+		return nil
+	}
+
+	results, rerr := readTestResults(cfg, &output)
+	if rerr != nil {
+		log.Printf("Could not read the test results: %s\n", rerr)
+		if err != nil {
+			return errors.New("External command failed")
+		}
+		return errors.New("Test results could not be read")
+	}
+	report.TestResults = &results
+	log.Printf("Test results: %s\n", results)
+	if results.Total() == 0 && err != nil {
+		return errors.New("External command failed")
+	}
+	tolerance := newVerifyTolerance(cfg, results)
+	report.Tolerance = &tolerance
+	if !tolerance.Passed {
+		report.CmdOutput = tail.String()
+		return fmt.Errorf("%d of %d tests failed", results.Failed, results.Total())
+	}
+	if results.Failed > 0 {
+		log.Printf("Tolerating %d failed tests, a pass rate of %g%%\n", results.Failed, tolerance.PassRate)
+	}
+	report.CmdOutput = ""
+	return nil
+}
+
+// verifyTolerance is how many of the tests of a verification step may fail and how many did. The step
+// passes with at most VERIFY_ALLOWED_FAILURES failed tests or at least a VERIFY_PASS_RATE percent pass rate.
+type verifyTolerance struct {
+	AllowedFailures  int     `json:"allowedFailures"`
+	RequiredPassRate float64 `json:"requiredPassRate"`
+	Failures         int     `json:"failures"`
+	PassRate         float64 `json:"passRate"`
+	Passed           bool    `json:"passed"`
+}
+
+// newVerifyTolerance returns the tolerance of cfg applied to results.
+func newVerifyTolerance(cfg rancher.Config, results verify.TestResults) verifyTolerance {
+	t := verifyTolerance{
+		AllowedFailures:  cfg.VerifyAllowedFailures,
+		RequiredPassRate: cfg.VerifyPassRate,
+		Failures:         results.Failed,
+		PassRate:         100,
+	}
+	if total := results.Total(); total > 0 {
+		t.PassRate = math.Floor(float64(results.Passed)*10000/float64(total)) / 100
+	}
+	t.Passed = t.Failures <= t.AllowedFailures || t.PassRate >= t.RequiredPassRate
+	return t
+}
+
+// readTestResults parses the test results from UPGRADE_TEST_RESULTS_FILE, or else from output.
+func readTestResults(cfg rancher.Config, output io.Reader) (verify.TestResults, error) {
+	if cfg.CmdResultsFile != "" {
+		f, err := os.Open(cfg.CmdResultsFile)
+		if err != nil {
+			return verify.TestResults{}, err
+		}
+		defer f.Close()
+		output = f
+	}
+	return verify.ParseResults(string(cfg.CmdResultsFormat), output)
+}
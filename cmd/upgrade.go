@@ -0,0 +1,654 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/history"
+	"github.com/richardbolt/rancher-upgrader/rancher"
+	"github.com/richardbolt/rancher-upgrader/upgrader"
+	"github.com/richardbolt/rancher-upgrader/verify"
+)
+
+// upgradeReport is what happened during the upgrade of a service, for the deployment history.
+type upgradeReport struct {
+	ServiceName string
+	From        string
+	To          string
+	// Durations of the phases of the upgrade (upgrade, verify, cutover and finish) that completed.
+	Durations map[string]time.Duration
+	// RollbackReason is why the upgrade was cancelled or rolled back, empty if it wasn't.
+	RollbackReason string
+	// RollbackFailed is set when cancelling or rolling back failed too, leaving the service as it was.
+	RollbackFailed bool
+	// Rollback is the state of the service once it was cancelled or rolled back.
+	Rollback *serviceStatus
+	// HandedOver is set when the upgrade was left to the new container of a self-upgrade to complete.
+	HandedOver bool
+	// Held is set when the upgrade failed verification and was left upgraded for a person to inspect.
+	Held bool
+	// CmdOutput is the end of the output of UPGRADE_TEST_CMD when it failed.
+	CmdOutput string
+	// TestResults are the results UPGRADE_TEST_CMD reported with UPGRADE_TEST_RESULTS_FORMAT.
+	TestResults *verify.TestResults
+	// Tolerance is how many of the tests of TestResults could fail and whether verification passed.
+	Tolerance *verifyTolerance
+	// NewSecrets are the IDs of the secrets created for ROTATE_SECRETS by the names they are mounted as.
+	NewSecrets map[string]string
+	// Events are the Rancher events of the service during the upgrade.
+	Events []string
+}
+
+// phase records the duration of the phase name that started at start and returns the time it ended.
+func (r *upgradeReport) phase(name string, start time.Time) time.Time {
+	now := time.Now()
+	if r.Durations == nil {
+		r.Durations = map[string]time.Duration{}
+	}
+	r.Durations[name] = now.Sub(start)
+	return now
+}
+
+// status returns the history status of the upgrade that ended with err.
+func (r *upgradeReport) status(cfg rancher.Config, err error) string {
+	switch {
+	case err == nil && r.HandedOver:
+		return history.Running
+	case r.Held:
+		return history.Held
+	case err == nil && cfg.RancherFinishUpgrade == rancher.FinishDeferred:
+		return history.Upgraded
+	case err == nil:
+		return history.Succeeded
+	case r.RollbackReason != "" && !r.RollbackFailed:
+		return history.RolledBack
+	default:
+		return history.Failed
+	}
+}
+
+// seconds returns the durations of the phases in seconds.
+func (r *upgradeReport) seconds() map[string]float64 {
+	seconds := map[string]float64{}
+	for phase, dur := range r.Durations {
+		seconds[phase] = dur.Seconds()
+	}
+	return seconds
+}
+
+// upgradeSummary is the result of an upgrade written to stdout as JSON for scripts, as the logs go to stderr.
+type upgradeSummary struct {
+	EnvID          string              `json:"envId,omitempty"`
+	ServiceID      string              `json:"serviceId"`
+	ServiceName    string              `json:"serviceName"`
+	From           string              `json:"from"`
+	To             string              `json:"to"`
+	Status         string              `json:"status"`
+	RollbackReason string              `json:"rollbackReason,omitempty"`
+	RollbackFailed bool                `json:"rollbackFailed,omitempty"`
+	Rollback       *serviceStatus      `json:"rollback,omitempty"`
+	Error          string              `json:"error,omitempty"`
+	CmdOutput      string              `json:"cmdOutput,omitempty"`
+	TestResults    *verify.TestResults `json:"testResults,omitempty"`
+	Tolerance      *verifyTolerance    `json:"tolerance,omitempty"`
+	NewSecrets     map[string]string   `json:"newSecrets,omitempty"`
+	Events         []string            `json:"events,omitempty"`
+	Durations      map[string]float64  `json:"durations"`
+}
+
+// newUpgradeSummary returns the summary of the upgrade of report that ended with err.
+func newUpgradeSummary(cfg rancher.Config, report *upgradeReport, err error) upgradeSummary {
+	s := upgradeSummary{
+		ServiceID:      cfg.RancherServiceID,
+		ServiceName:    report.ServiceName,
+		From:           report.From,
+		To:             report.To,
+		Status:         report.status(cfg, err),
+		RollbackReason: report.RollbackReason,
+		RollbackFailed: report.RollbackFailed,
+		Rollback:       report.Rollback,
+		CmdOutput:      report.CmdOutput,
+		TestResults:    report.TestResults,
+		Tolerance:      report.Tolerance,
+		NewSecrets:     report.NewSecrets,
+		Events:         report.Events,
+		Durations:      report.seconds(),
+	}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	return s
+}
+
+// name returns the name of the service, qualified by its environment when upgrading it in several.
+func (s upgradeSummary) name() string {
+	if s.EnvID == "" {
+		return s.ServiceName
+	}
+	return s.EnvID + "/" + s.ServiceName
+}
+
+// writeSummary writes the summary of the upgrade of report that ended with err to w.
+func writeSummary(w io.Writer, cfg rancher.Config, report *upgradeReport, err error) error {
+	return json.NewEncoder(w).Encode(newUpgradeSummary(cfg, report, err))
+}
+
+// upgradeService upgrades the service of ru as configured in cfg, or as planned in p when it isn't nil,
+// verifies it, cuts over to it and finishes the upgrade. A failed upgrade is cancelled or rolled back.
+func upgradeService(ctx context.Context, ru upgrader.Upgrader, cfg rancher.Config, p *plan, report *upgradeReport) error {
+	// Get the launchConfig for the given service. what we're after is the imageUuid from the launchConfig.
+	svcConfig, err := ru.GetServiceConfig(ctx)
+	if err != nil {
+		return err
+	}
+	report.ServiceName = svcConfig.Name
+	report.From = svcConfig.LaunchConfig.ImageUUID
+	// The build metadata is available to the override values as templates.
+	data := newTemplateData(cfg.BuildTag, cfg.GitSHA)
+	// A retried run carries on with the upgrade it started, which left the service upgrading.
+	if cfg.RunID != "" {
+		if resumed, err := resumeRun(ctx, ru, cfg, svcConfig, data, report); resumed {
+			return err
+		}
+	}
+	// A paused upgrade, e.g. one paused while it was queued, is held before it starts, and goes on with
+	// the service as it is by then once it is resumed.
+	if isPaused, _ := paused(cfg); isPaused {
+		if err := waitWhilePaused(ctx, cfg, "upgrading "+svcConfig.Name); err != nil {
+			return err
+		}
+		if svcConfig, err = ru.GetServiceConfig(ctx); err != nil {
+			return err
+		}
+		report.From = svcConfig.LaunchConfig.ImageUUID
+	}
+	// A deploy freeze refuses new upgrades, while the ones it finds under way above are carried on.
+	if err := checkFreeze(cfg); err != nil {
+		return err
+	}
+	if svcConfig.Actions.Upgrade == "" {
+		return fmt.Errorf("service was not in an upgradeable state, got: %s", svcConfig.State)
+	}
+	var imageUUID string
+	var options []upgrader.Option
+	var spec *serviceSpec
+	if p != nil {
+		// Make exactly the reviewed change, as long as the service is still as it was planned against.
+		change := p.Changes[0]
+		if err := change.check(svcConfig); err != nil {
+			return err
+		}
+		imageUUID = change.LaunchConfig.ImageUUID
+		options = p.options(change)
+		cfg.Ports = change.Ports
+	} else {
+		spec, err = renderServiceSpec(cfg, data)
+		if err != nil {
+			return err
+		}
+		imageUUID, options, err = upgradeOptions(cfg, svcConfig, data, spec)
+		if err != nil {
+			return err
+		}
+		// Storage changes can orphan data, so make a person at a terminal confirm them.
+		// A plan was reviewed already.
+		if len(cfg.DataVolumes) > 0 || cfg.VolumeDriver != "" {
+			msg := fmt.Sprintf("Change the volumes of %s from %v (driver '%v') to %v (driver '%s')?",
+				svcConfig.Name, svcConfig.LaunchConfig.Other["dataVolumes"], svcConfig.LaunchConfig.Other["volumeDriver"],
+				cfg.DataVolumes, cfg.VolumeDriver)
+			if !confirm(msg) {
+				return fmt.Errorf("storage changes were not confirmed")
+			}
+		}
+	}
+	report.To = imageUUID
+
+	// Make sure the new image exists and can run on every host the service is scheduled on.
+	if cfg.VerifyImageArch {
+		if err := verifyImageArch(ctx, ru, cfg, imageUUID); err != nil {
+			return err
+		}
+	}
+
+	// Make sure any new published ports are free on the hosts the service runs on.
+	if err := ru.CheckPorts(ctx, cfg.Ports); err != nil {
+		return err
+	}
+
+	u := startedUpgrade{
+		EnvID:       cfg.RancherEnvID,
+		ServiceID:   svcConfig.ID,
+		ServiceName: svcConfig.Name,
+		Scale:       svcConfig.Scale,
+		BatchSize:   svcConfig.Upgrade.InServiceStrategy.BatchSize,
+		From:        report.From,
+		ImageUUID:   imageUUID,
+		Data:        data,
+		StartedAt:   time.Now(),
+	}
+	if spec != nil {
+		u.SpecScale = spec.Scale
+	}
+	if err := checkGuardrails(ctx, ru, cfg, svcConfig, u); err != nil {
+		return err
+	}
+	if err := approveUpgrade(ctx, cfg, u); err != nil {
+		return err
+	}
+	// Keep an external autoscaler from changing the scale under the batches of the upgrade.
+	u.guard, err = guardAutoscaler(ctx, ru, cfg, svcConfig)
+	if err != nil {
+		return err
+	}
+	defer u.guard.release()
+	// Rotate the secrets last, so nothing fails after they were created but the upgrade itself.
+	if len(cfg.RotateSecrets) > 0 {
+		option, err := rotateSecrets(ctx, ru, cfg, svcConfig, report)
+		if err != nil {
+			return err
+		}
+		options = append(options, option)
+	}
+	// Record the run on the service with the upgrade, so a retry of the run resumes it.
+	if cfg.RunID != "" {
+		options = append(options, upgrader.Labels(map[string]string{runIDLabel: cfg.RunID}))
+	}
+	// Upgrading the service the upgrader runs in replaces it, so the new container completes the upgrade.
+	if cfg.SelfUpgrade {
+		return startSelfUpgrade(ctx, ru, cfg, u, options, report)
+	}
+
+	// Make the upgrade request to the Rancher API for the given env and service
+	err = ru.Upgrade(ctx, options...)
+	if err != nil {
+		removeSecrets(ru, report)
+		return err
+	}
+	return completeUpgrade(ctx, ru, cfg, u, report)
+}
+
+// startedUpgrade is an upgrade that was requested from Rancher, with what is needed to complete it.
+type startedUpgrade struct {
+	EnvID       string `json:"envId"`
+	ServiceID   string `json:"serviceId"`
+	ServiceName string `json:"serviceName"`
+	// Scale is the scale of the service before the upgrade and SpecScale the scale of its service
+	// template, 0 without one. BatchSize is how many containers Rancher replaces at a time, 1 when unset.
+	Scale     int          `json:"scale"`
+	SpecScale int          `json:"specScale"`
+	BatchSize int          `json:"batchSize"`
+	From      string       `json:"from"`
+	ImageUUID string       `json:"imageUuid"`
+	Data      templateData `json:"data"`
+	StartedAt time.Time    `json:"startedAt"`
+	// guard pins the scale of a service with an external autoscaler, nil without one.
+	guard *scaleGuard
+}
+
+// completeUpgrade waits for the upgrade u of the service of ru to be made, verifies it, cuts over to it and
+// finishes it. A failed upgrade is cancelled or rolled back. The Rancher events of the service are
+// logged meanwhile and added to the error of a failed upgrade.
+func completeUpgrade(ctx context.Context, ru upgrader.Upgrader, cfg rancher.Config, u startedUpgrade, report *upgradeReport) error {
+	events := watchEvents(ru, cfg, u.StartedAt)
+	err := verifyAndFinish(ctx, ru, cfg, u, report)
+	report.Events = events.stop()
+	return withEvents(err, report.Events)
+}
+
+// verifyAndFinish is completeUpgrade without the events.
+func verifyAndFinish(ctx context.Context, ru upgrader.Upgrader, cfg rancher.Config, u startedUpgrade, report *upgradeReport) error {
+	phase := u.StartedAt
+	// Block until the service is upgraded, holding it between its container batches when asked to.
+	// When we hit "upgraded" we can run external scripts to confirm, and then call ?action=finishupgrade to complete the upgrade.
+	if policy, reason, err := waitForUpgrade(ctx, ru, cfg, u); err != nil {
+		logDeadline(ctx)
+		log.Println(err.Error())
+		return fmt.Errorf("%s: %s", err, onFailure(ru, cfg, report, policy, reason))
+	}
+	upgradedAt := time.Now()
+	phase = report.phase("upgrade", phase)
+
+	// Don't verify against half-started containers.
+	if cfg.RequireHealthy {
+		if err := ru.WaitForHealthy(ctx, time.Duration(cfg.HealthyWaitTimeout)*time.Second); err != nil {
+			logDeadline(ctx)
+			log.Println(err.Error())
+			return onFailure(ru, cfg, report, cfg.OnVerifyFail, "Containers did not become healthy")
+		}
+	}
+
+	// We blocked above until the service was upgraded, now we can run a script to verify before we finish the upgrade.
+	// We will block on this script until we get the upgrade completed.
+	if cfg.Cmd != "" {
+		if err := runTestCmd(ctx, cfg, report); err != nil {
+			logDeadline(ctx)
+			return onFailure(ru, cfg, report, cfg.OnVerifyFail, err.Error())
+		}
+	}
+
+	// Run the built-in verifiers and the verifier plugins.
+	vs, err := verifiers(ctx, ru, cfg)
+	if err != nil {
+		log.Println(err.Error())
+		return onFailure(ru, cfg, report, cfg.OnVerifyFail, "Verification could not be set up")
+	}
+	vs = append(vs, pluginVerifiers(cfg, u)...)
+	if err := runVerifiers(ctx, vs); err != nil {
+		logDeadline(ctx)
+		log.Println(err.Error())
+		return onFailure(ru, cfg, report, cfg.OnVerifyFail, "Verification failed")
+	}
+
+	// Make sure the load balancer is sending traffic to the new containers before the old ones go away.
+	// When shifting traffic from another service the load balancer only routes here during the cutover.
+	if cfg.LBServiceID != "" && cfg.TrafficShiftFromServiceID == "" && cfg.RancherFinishUpgrade != rancher.FinishNever {
+		err := ru.WaitForLoadBalancer(ctx, cfg.LBServiceID, time.Duration(cfg.LBWaitTimeout)*time.Second)
+		if err != nil {
+			logDeadline(ctx)
+			log.Println(err.Error())
+			return onFailure(ru, cfg, report, cfg.OnVerifyFail, "Load balancer did not pick up the new containers")
+		}
+	}
+	phase = report.phase("verify", phase)
+
+	// Switch traffic and service discovery over to the upgraded service.
+	steps, err := cutoverSteps(ctx, ru, cfg, u.Data, vs)
+	if err != nil {
+		log.Println(err.Error())
+		return onFailure(ru, cfg, report, rancher.FailRollback, "Cutover could not be set up")
+	}
+	applied, err := applySteps(ctx, steps)
+	if err != nil {
+		logDeadline(ctx)
+		log.Println(err.Error())
+		revertSteps(applied)
+		return onFailure(ru, cfg, report, rancher.FailRollback, "Cutover failed")
+	}
+	phase = report.phase("cutover", phase)
+
+	// POST to ?action=finishupgrade will finish the upgrade and ?action=rollback will rollback.
+	// Rolling back is dangerous since it will leave the other containers in a stopped state and they will
+	// need to be started here automatically.
+	// Hold the upgrade open until it is decided from outside, finishing it as usual when it is to be finished.
+	if cfg.RancherFinishUpgrade == rancher.FinishHoldOpen {
+		d := holdOpen(ctx, ru, cfg, u)
+		phase = report.phase("hold", phase)
+		if !d.finish {
+			logDeadline(ctx)
+			revertSteps(applied)
+			return onFailure(ru, cfg, report, d.policy, d.reason)
+		}
+	}
+	switch cfg.RancherFinishUpgrade {
+	case rancher.FinishNow, rancher.FinishHoldOpen:
+		// Keep the old containers around for a rollback window, however quickly verification passed.
+		if err := soak(ctx, upgradedAt, time.Duration(cfg.MinSoakSeconds)*time.Second); err != nil {
+			logDeadline(ctx)
+			revertSteps(applied)
+			return onFailure(ru, cfg, report, rancher.FailRollback, "Minimum soak could not be completed")
+		}
+		log.Println("Service upgraded, finishing the upgrade")
+		svc, err := ru.FinishUpgrade(ctx)
+		if err != nil {
+			logDeadline(ctx)
+			// Don't leave traffic and service discovery pointing at a service Rancher failed to finish.
+			revertSteps(applied)
+			return err
+		}
+		report.phase("finish", phase)
+		log.Printf("Service upgrade successful, finished upgrade of %s\n", svc.Name)
+		// The scale of the service template can only change once the upgrade is finished.
+		if u.SpecScale > 0 && u.SpecScale != u.Scale {
+			u.guard.release()
+			if err := ru.SetScale(ctx, u.ServiceID, u.SpecScale); err != nil {
+				return fmt.Errorf("failed to scale %s to %d: %s", svc.Name, u.SpecScale, err)
+			}
+		}
+	case rancher.FinishDeferred:
+		// Leave the old containers around until the upgrade is finished by `rancher-upgrader finish`.
+		log.Println("Service upgrade successful, deferring the finish upgrade step to `rancher-upgrader finish`")
+	default:
+		log.Println("Service upgrade successful, skipping the finish upgrade step")
+	}
+
+	err = publishRelease(ctx, cfg, release{
+		Service:  u.ServiceName,
+		Image:    u.ImageUUID,
+		BuildTag: u.Data.BuildTag,
+		GitSHA:   u.Data.GitSHA,
+		Date:     u.Data.Date,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish the release: %s", err)
+	}
+	return nil
+}
+
+// finishUpgrade finishes the upgrade of the service of ru that was deferred by RANCHER_FINISH_UPGRADE=deferred.
+func finishUpgrade(ctx context.Context, ru upgrader.Upgrader) error {
+	svcConfig, err := ru.GetServiceConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if svcConfig.State != "upgraded" || svcConfig.Actions.FinishUpgrade == "" {
+		return fmt.Errorf("%s has no upgrade to finish, it is %s", svcConfig.Name, svcConfig.State)
+	}
+	svc, err := ru.FinishUpgrade(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("Finished upgrade of %s\n", svc.Name)
+	return nil
+}
+
+// rollbackService rolls the service of ru back on its own, e.g. when a bad release is found after the
+// pipeline finished, restarting its containers and waiting for them to be healthy.
+func rollbackService(ctx context.Context, ru upgrader.Upgrader, cfg rancher.Config) error {
+	report := rollbackReport(ctx, ru, "Rolled back with `rancher-upgrader rollback`")
+	err := ru.Rollback(ctx)
+	if err == nil {
+		err = verifyRollback(ctx, ru, cfg, report)
+	}
+	notifyRollback(cfg, report, err)
+	return err
+}
+
+// cancelService cancels an upgrade of the service of ru that was started elsewhere, e.g. from the Rancher
+// UI, rolling it back and restarting its containers as needed, and waits for them to be healthy.
+func cancelService(ctx context.Context, ru upgrader.Upgrader, cfg rancher.Config) error {
+	report := rollbackReport(ctx, ru, "Cancelled with `rancher-upgrader cancel`")
+	err := ru.Cancel(ctx)
+	if err == nil {
+		err = verifyRollback(ctx, ru, cfg, report)
+	}
+	notifyRollback(cfg, report, err)
+	return err
+}
+
+// rollbackReport returns the report of rolling back or cancelling the upgrade of the service of ru
+// because of reason, from the image it was upgraded from to the one it is on, as far as Rancher has them.
+func rollbackReport(ctx context.Context, ru upgrader.Upgrader, reason string) *upgradeReport {
+	report := &upgradeReport{RollbackReason: reason}
+	svc, err := ru.GetServiceConfig(ctx)
+	if err != nil {
+		return report
+	}
+	report.ServiceName = svc.Name
+	report.To = svc.LaunchConfig.ImageUUID
+	if previous := svc.Upgrade.InServiceStrategy.PreviousLaunchConfig; previous != nil {
+		report.From = previous.ImageUUID
+	}
+	return report
+}
+
+// notifyRollback notifies of the rollback or cancel of report that ended with err as of a failed upgrade:
+// as rolled back, or critically when it failed as that leaves the service broken.
+func notifyRollback(cfg rancher.Config, report *upgradeReport, err error) {
+	report.RollbackFailed = err != nil
+	s := newUpgradeSummary(cfg, report, err)
+	if err == nil {
+		s.Status = history.RolledBack
+	}
+	notifySummaries(cfg, []upgradeSummary{s})
+}
+
+// soak blocks until the service has been upgraded for at least min since upgradedAt.
+func soak(ctx context.Context, upgradedAt time.Time, min time.Duration) error {
+	remaining := min - time.Since(upgradedAt)
+	if remaining <= 0 {
+		return nil
+	}
+	log.Printf("Soaking the upgraded service for another %s before finishing the upgrade\n", remaining.Round(time.Second))
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(remaining):
+		return nil
+	}
+}
+
+// waitFailure returns what is done with the service when waiting for its upgrade failed with err, and why.
+func waitFailure(cfg rancher.Config, err error) (rancher.FailurePolicy, string) {
+	switch err.(type) {
+	case *upgrader.UnreachableError:
+		return cfg.OnRancherUnreachable, "Rancher unreachable"
+	case *upgrader.PollError:
+		return cfg.OnRancherUnreachable, "Could not poll the service"
+	}
+	return cfg.OnTimeout, "Upgrade did not complete"
+}
+
+// safeActionContext returns the context of what is done with a failed upgrade, e.g. cancelling or rolling
+// it back. It isn't done when TOTAL_DEADLINE passes, so the upgrade is still undone then, but with
+// TOTAL_DEADLINE it is bounded by SAFE_ACTION_TIMEOUT so the run still ends soon after.
+func safeActionContext(cfg rancher.Config) (context.Context, context.CancelFunc) {
+	if cfg.TotalDeadline > 0 && cfg.SafeActionTimeout > 0 {
+		return context.WithTimeout(context.Background(), time.Duration(cfg.SafeActionTimeout)*time.Second)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// onFailure handles the failure of the service upgrade because of reason as policy says and returns an
+// error saying so. The service is only recorded as rolled back in report when it was cancelled or rolled back.
+func onFailure(ru upgrader.Upgrader, cfg rancher.Config, report *upgradeReport, policy rancher.FailurePolicy, reason string) error {
+	ctx, cancel := safeActionContext(cfg)
+	defer cancel()
+	switch policy {
+	case rancher.FailCancel:
+		return cancelUpgrade(ctx, ru, cfg, report, reason)
+	case rancher.FailLeaveAsIs:
+		log.Println(reason + ", leaving the service as it is")
+		return fmt.Errorf("%s, left the service as it is", reason)
+	case rancher.FailHold:
+		report.Held = true
+		log.Println(reason + ", holding the upgraded service for inspection, finish it with `rancher-upgrader finish` or roll it back with `rancher-upgrader rollback`")
+		return fmt.Errorf("%s, held the upgraded service for inspection", reason)
+	case rancher.FailFinishAnyway:
+		log.Println(reason + ", finishing the service upgrade anyway")
+		if _, err := ru.FinishUpgrade(ctx); err != nil {
+			return fmt.Errorf("%s, and failed to finish the upgrade anyway: %s", reason, err)
+		}
+		return fmt.Errorf("%s, finished the upgrade anyway", reason)
+	default:
+		return rollback(ctx, ru, cfg, report, reason)
+	}
+}
+
+// cancelUpgrade cancels the service upgrade because of reason within ctx, recording it in report, and
+// returns an error saying so.
+func cancelUpgrade(ctx context.Context, ru upgrader.Upgrader, cfg rancher.Config, report *upgradeReport, reason string) error {
+	report.RollbackReason = reason
+	log.Println(reason + ", cancelling the service upgrade")
+	if err := ru.Cancel(ctx); err != nil {
+		report.RollbackFailed = true
+		return fmt.Errorf("%s, and failed to cancel: %s", reason, err)
+	}
+	if err := verifyRollback(ctx, ru, cfg, report); err != nil {
+		report.RollbackFailed = true
+		return fmt.Errorf("%s, cancelled but %s", reason, err)
+	}
+	removeSecrets(ru, report)
+	return fmt.Errorf("%s, cancelled", reason)
+}
+
+// rollback rolls the service upgrade back because of reason within ctx, recording it in report, and
+// returns an error saying so.
+func rollback(ctx context.Context, ru upgrader.Upgrader, cfg rancher.Config, report *upgradeReport, reason string) error {
+	report.RollbackReason = reason
+	log.Println(reason + ", rolling back the service upgrade")
+	if err := ru.Rollback(ctx); err != nil {
+		report.RollbackFailed = true
+		return fmt.Errorf("%s, and failed to roll back: %s", reason, err)
+	}
+	if err := verifyRollback(ctx, ru, cfg, report); err != nil {
+		report.RollbackFailed = true
+		return fmt.Errorf("%s, rolled back but %s", reason, err)
+	}
+	removeSecrets(ru, report)
+	return fmt.Errorf("%s, rolled back", reason)
+}
+
+// verifyRollback waits for the service of ru to be healthy at its scale once it was cancelled or rolled back,
+// on the image it was upgraded from when report knows it, and records and logs the state it is left in.
+func verifyRollback(ctx context.Context, ru upgrader.Upgrader, cfg rancher.Config, report *upgradeReport) error {
+	err := ru.WaitForHealthy(ctx, time.Duration(cfg.HealthyWaitTimeout)*time.Second)
+	s, serr := getServiceStatus(ctx, ru)
+	if serr != nil {
+		if err == nil {
+			err = serr
+		}
+		return err
+	}
+	report.Rollback = s
+	log.Println("Service after the rollback:")
+	s.print(os.Stderr)
+	if err != nil {
+		return err
+	}
+	if report.From != "" && s.Image != report.From {
+		return fmt.Errorf("%s is on %s rather than %s", s.Name, s.Image, report.From)
+	}
+	if healthy := s.healthy(); s.Scale > 0 && healthy < s.Scale {
+		return fmt.Errorf("only %d of the %d containers of %s are healthy", healthy, s.Scale, s.Name)
+	}
+	log.Printf("Rolled back %s to %s\n", s.Name, s.Image)
+	return nil
+}
+
+// tailBuffer keeps the last max bytes written to it, e.g. the end of the output of a command.
+type tailBuffer struct {
+	max int
+	buf []byte
+	cut bool
+}
+
+// Write implements io.Writer.
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	if b.max <= 0 {
+		return len(p), nil
+	}
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > b.max {
+		b.buf = append([]byte(nil), b.buf[len(b.buf)-b.max:]...)
+		b.cut = true
+	}
+	return len(p), nil
+}
+
+// String returns what was kept, from the first whole line on with "..." before it when the start was cut.
+func (b *tailBuffer) String() string {
+	s := string(b.buf)
+	if b.cut {
+		if i := strings.Index(s, "\n"); i >= 0 && i < len(s)-1 {
+			s = s[i+1:]
+		}
+		s = "...\n" + s
+	}
+	return strings.TrimRight(s, "\n")
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/aws"
+	"github.com/richardbolt/rancher-upgrader/metrics"
+	"github.com/richardbolt/rancher-upgrader/rancher"
+	"github.com/richardbolt/rancher-upgrader/upgrader"
+	"github.com/richardbolt/rancher-upgrader/verify"
+)
+
+// verifiers returns the built-in verifiers configured in cfg.
+func verifiers(ctx context.Context, ru upgrader.Upgrader, cfg rancher.Config) ([]verify.Verifier, error) {
+	var vs []verify.Verifier
+	if cfg.VerifyHTTPURL != "" {
+		urls, err := perContainer(ctx, ru, "VERIFY_HTTP_URL", cfg.VerifyHTTPURL)
+		if err != nil {
+			return nil, err
+		}
+		v := verify.HTTP{
+			Client:    &http.Client{Timeout: 10 * time.Second},
+			URLs:      urls,
+			Status:    cfg.VerifyHTTPStatus,
+			Requests:  cfg.VerifyHTTPRequests,
+			Threshold: cfg.VerifyHTTPThreshold,
+			Interval:  time.Duration(cfg.VerifyHTTPInterval) * time.Millisecond,
+		}
+		if cfg.VerifyHTTPBodyRegex != "" {
+			if v.BodyRegex, err = regexp.Compile(cfg.VerifyHTTPBodyRegex); err != nil {
+				return nil, fmt.Errorf("invalid VERIFY_HTTP_BODY_REGEX: %s", err)
+			}
+		}
+		vs = append(vs, v)
+	}
+	if len(cfg.VerifyTCPPorts) > 0 {
+		containers, err := newContainers(ctx, ru, "VERIFY_TCP_PORTS")
+		if err != nil {
+			return nil, err
+		}
+		v := verify.TCP{
+			Timeout:  time.Duration(cfg.VerifyTCPTimeout) * time.Second,
+			Interval: time.Duration(cfg.CheckInterval) * time.Second,
+		}
+		for _, c := range containers {
+			for _, port := range cfg.VerifyTCPPorts {
+				v.Addresses = append(v.Addresses, net.JoinHostPort(c.PrimaryIPAddress, strconv.Itoa(port)))
+			}
+		}
+		vs = append(vs, v)
+	}
+	if cfg.VerifyGRPCPort > 0 {
+		containers, err := newContainers(ctx, ru, "VERIFY_GRPC_PORT")
+		if err != nil {
+			return nil, err
+		}
+		v := verify.GRPCHealth{
+			Service:  cfg.VerifyGRPCService,
+			Timeout:  time.Duration(cfg.VerifyGRPCTimeout) * time.Second,
+			Interval: time.Duration(cfg.CheckInterval) * time.Second,
+		}
+		for _, c := range containers {
+			v.Addresses = append(v.Addresses, net.JoinHostPort(c.PrimaryIPAddress, strconv.Itoa(cfg.VerifyGRPCPort)))
+		}
+		vs = append(vs, v)
+	}
+	queries := cfg.VerifyMetricsQueries
+	providerName := cfg.VerifyMetricsProvider
+	if queries == "" && cfg.VerifyPrometheusQueries != "" {
+		queries, providerName = cfg.VerifyPrometheusQueries, "prometheus"
+	}
+	if queries != "" {
+		provider, err := metricsProvider(ctx, cfg, providerName)
+		if err != nil {
+			return nil, err
+		}
+		v := verify.Metrics{
+			Provider: provider,
+			Name:     providerName,
+			Window:   time.Duration(cfg.VerifyMetricsWindow) * time.Second,
+		}
+		for _, q := range strings.Split(queries, ";") {
+			if strings.TrimSpace(q) == "" {
+				continue
+			}
+			t, err := verify.ParseThreshold(q)
+			if err != nil {
+				return nil, fmt.Errorf("invalid VERIFY_METRICS_QUERIES: %s", err)
+			}
+			v.Thresholds = append(v.Thresholds, t)
+		}
+		vs = append(vs, v)
+	}
+	if len(cfg.VerifyCloudWatchAlarms) > 0 {
+		region, creds, err := cloudWatchAuth(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		vs = append(vs, verify.CloudWatchAlarms{
+			Client:      &http.Client{Timeout: 30 * time.Second},
+			Region:      region,
+			Credentials: creds,
+			AlarmNames:  cfg.VerifyCloudWatchAlarms,
+			Soak:        time.Duration(cfg.VerifyCloudWatchSoak) * time.Second,
+			Interval:    time.Duration(cfg.CheckInterval) * time.Second,
+		})
+	}
+	return vs, nil
+}
+
+// metricsProvider returns the metrics provider called name configured in cfg.
+func metricsProvider(ctx context.Context, cfg rancher.Config, name string) (metrics.Provider, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	switch name {
+	case "prometheus":
+		if cfg.VerifyPrometheusURL == "" {
+			return nil, fmt.Errorf("the prometheus metrics provider needs VERIFY_PROMETHEUS_URL")
+		}
+		return metrics.Prometheus{Client: client, URL: cfg.VerifyPrometheusURL}, nil
+	case "datadog":
+		if cfg.DatadogAPIKey == "" || cfg.DatadogAppKey == "" {
+			return nil, fmt.Errorf("the datadog metrics provider needs DATADOG_API_KEY and DATADOG_APP_KEY")
+		}
+		return metrics.Datadog{Client: client, Site: cfg.DatadogSite, APIKey: cfg.DatadogAPIKey, AppKey: cfg.DatadogAppKey}, nil
+	case "cloudwatch":
+		region, creds, err := cloudWatchAuth(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return metrics.CloudWatch{Client: client, Region: region, Credentials: creds}, nil
+	}
+	return nil, fmt.Errorf("unknown VERIFY_METRICS_PROVIDER %s", name)
+}
+
+// cloudWatchAuth returns the CloudWatch region and the AWS credentials to use with it.
+func cloudWatchAuth(ctx context.Context, cfg rancher.Config) (string, aws.Credentials, error) {
+	region := cfg.VerifyCloudWatchRegion
+	if region == "" {
+		region = aws.Region()
+	}
+	if region == "" {
+		return "", aws.Credentials{}, fmt.Errorf("CloudWatch needs VERIFY_CLOUDWATCH_REGION or AWS_REGION")
+	}
+	creds, err := aws.LoadCredentials(ctx, &http.Client{Timeout: 5 * time.Second})
+	return region, creds, err
+}
+
+// runVerifiers runs vs in order, stopping at the first that fails.
+func runVerifiers(ctx context.Context, vs []verify.Verifier) error {
+	for _, v := range vs {
+		if err := v.Verify(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newContainers returns the new containers of the upgrade, which the verifier configured by name checks.
+func newContainers(ctx context.Context, ru upgrader.Upgrader, name string) ([]rancher.Container, error) {
+	containers, err := ru.NewContainers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(containers) == 0 {
+		return nil, fmt.Errorf("no new containers to verify for %s", name)
+	}
+	return containers, nil
+}
+
+// perContainer renders text once for each new container when it refers to {{.IP}},
+// otherwise it is returned as is.
+func perContainer(ctx context.Context, ru upgrader.Upgrader, name, text string) ([]string, error) {
+	if !strings.Contains(text, "{{") {
+		return []string{text}, nil
+	}
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template for %s: %s", name, err)
+	}
+	containers, err := newContainers(ctx, ru, name)
+	if err != nil {
+		return nil, err
+	}
+	rendered := make([]string, 0, len(containers))
+	for _, c := range containers {
+		b := bytes.Buffer{}
+		if err := tmpl.Execute(&b, struct{ IP string }{c.PrimaryIPAddress}); err != nil {
+			return nil, fmt.Errorf("invalid template for %s: %s", name, err)
+		}
+		rendered = append(rendered, b.String())
+	}
+	return rendered, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+)
+
+// stateList is a flag of states that can be given more than once or comma separated.
+type stateList []string
+
+func (l *stateList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stateList) Set(value string) error {
+	*l = append(*l, strings.Split(value, ",")...)
+	return nil
+}
+
+// parseWaitFlags sets the states and timeout of `wait` in cfg from the command line args, e.g.
+// `--state active --timeout 10m`. Without flags it waits for WAIT_FOR_STATES for UPGRADE_WAIT_TIMEOUT.
+func parseWaitFlags(cfg *rancher.Config, args []string) error {
+	fs := flag.NewFlagSet("wait", flag.ContinueOnError)
+	var states, abort stateList
+	fs.Var(&states, "state", "a state or healthState to wait for, e.g. active or healthy (repeatable)")
+	fs.Var(&abort, "abort", "a state or healthState to stop waiting at with an error, e.g. error (repeatable)")
+	timeout := fs.Duration("timeout", time.Duration(cfg.UpgradeWaitTimeout)*time.Second, "how long to wait")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(states) > 0 {
+		cfg.WaitForStates = states
+	}
+	if len(abort) > 0 {
+		cfg.WaitAbortStates = abort
+	}
+	if *timeout <= 0 {
+		return fmt.Errorf("invalid --timeout %s, expected a positive duration, e.g. 10m", *timeout)
+	}
+	// UPGRADE_WAIT_TIMEOUT is in seconds, so a part of one is waited for as a whole one.
+	cfg.UpgradeWaitTimeout = int(math.Ceil(timeout.Seconds()))
+	return nil
+}
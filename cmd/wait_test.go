@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+)
+
+func TestParseWaitFlags(t *testing.T) {
+	tests := []struct {
+		args    string
+		timeout int
+		states  string
+		abort   string
+		err     string
+	}{
+		{"", 3600, "active", "", ""},
+		{"--state healthy --timeout 10m", 600, "healthy", "", ""},
+		{"--state active,healthy --abort error --abort degraded", 3600, "active,healthy", "error,degraded", ""},
+		{"--timeout 500ms", 1, "active", "", ""},
+		{"--timeout 1.5s", 2, "active", "", ""},
+		{"--timeout 0s", 0, "", "", "invalid --timeout"},
+		{"--timeout -5m", 0, "", "", "invalid --timeout"},
+		{"--timeout 10", 0, "", "", "invalid value"},
+		{"--states active", 0, "", "", "not defined"},
+	}
+	for _, test := range tests {
+		cfg := rancher.Config{UpgradeWaitTimeout: 3600, WaitForStates: []string{"active"}}
+		err := parseWaitFlags(&cfg, strings.Fields(test.args))
+		switch {
+		case test.err != "":
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: expected an error with %q, got %v", test.args, test.err, err)
+			}
+		case err != nil:
+			t.Errorf("%q: unexpected error %s", test.args, err)
+		case cfg.UpgradeWaitTimeout != test.timeout:
+			t.Errorf("%q: expected a timeout of %ds, got %ds", test.args, test.timeout, cfg.UpgradeWaitTimeout)
+		case strings.Join(cfg.WaitForStates, ",") != test.states || strings.Join(cfg.WaitAbortStates, ",") != test.abort:
+			t.Errorf("%q: expected states %s and abort states %q, got %v and %v", test.args, test.states, test.abort, cfg.WaitForStates, cfg.WaitAbortStates)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/richardbolt/rancher-upgrader/history"
+	"github.com/richardbolt/rancher-upgrader/upgrader"
+)
+
+// webhookReceiver is a receiver of Rancher's webhook-service as its API describes it, with the key of its
+// URL. Like Rancher's serviceUpgrade driver it upgrades the services of the environment matching
+// ServiceSelector and running the pushed image when Tag is pushed.
+type webhookReceiver struct {
+	Key                  string `yaml:"key"`
+	Name                 string `yaml:"name"`
+	ProjectID            string `yaml:"projectId"`
+	Driver               string `yaml:"driver"`
+	ServiceUpgradeConfig struct {
+		ServiceSelector map[string]string `yaml:"serviceSelector"`
+		Tag             string            `yaml:"tag"`
+		PayloadFormat   string            `yaml:"payloadFormat"`
+		StartFirst      bool              `yaml:"startFirst"`
+		// Accepted but ignored, the services' own upgrade strategies are used.
+		BatchSize      int64 `yaml:"batchSize"`
+		IntervalMillis int64 `yaml:"intervalMillis"`
+	} `yaml:"serviceUpgradeConfig"`
+}
+
+// registryPush is the payload of a push webhook of Docker Hub (dockerhub) or Alibaba Cloud Container
+// Registry (alicloud), the payload formats Rancher's serviceUpgrade driver accepts.
+type registryPush struct {
+	PushData struct {
+		Tag string `json:"tag"`
+	} `json:"push_data"`
+	Repository struct {
+		RepoName     string `json:"repo_name"`
+		RepoFullName string `json:"repo_full_name"`
+		Region       string `json:"region"`
+	} `json:"repository"`
+}
+
+// image returns the repository that was pushed to, as it is referenced by the services running it.
+func (p registryPush) image(format string) string {
+	if format == "alicloud" {
+		return fmt.Sprintf("registry.%s.aliyuncs.com/%s", p.Repository.Region, p.Repository.RepoFullName)
+	}
+	return p.Repository.RepoName
+}
+
+// readWebhookReceivers returns the receivers listed in the YAML (or JSON) file path by their keys.
+func readWebhookReceivers(path string) (map[string]webhookReceiver, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []webhookReceiver
+	if err := yaml.UnmarshalStrict(b, &list); err != nil {
+		return nil, fmt.Errorf("invalid webhook receivers %s: %s", path, err)
+	}
+	receivers := map[string]webhookReceiver{}
+	for _, rc := range list {
+		if rc.Key == "" {
+			return nil, fmt.Errorf("webhook receiver %q of %s has no key", rc.Name, path)
+		}
+		if rc.Driver != "serviceUpgrade" {
+			return nil, fmt.Errorf("webhook receiver %q of %s has the %q driver, only serviceUpgrade is supported", rc.Name, path, rc.Driver)
+		}
+		switch rc.ServiceUpgradeConfig.PayloadFormat {
+		case "":
+			rc.ServiceUpgradeConfig.PayloadFormat = "dockerhub"
+		case "dockerhub", "alicloud":
+		default:
+			return nil, fmt.Errorf("webhook receiver %q of %s has the unknown payload format %q", rc.Name, path, rc.ServiceUpgradeConfig.PayloadFormat)
+		}
+		receivers[rc.Key] = rc
+	}
+	return receivers, nil
+}
+
+// rancherWebhook takes the webhooks of Rancher's webhook-service, POST /v1-webhooks/endpoint?key=<key>&projectId=<env>,
+// and upgrades the services matching the receiver with the key to the pushed tag, responding with the
+// running attempts.
+func (d *daemon) rancherWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s isn't allowed", r.Method))
+		return
+	}
+	rc, ok := d.receivers[r.URL.Query().Get("key")]
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no webhook receiver has this key"))
+		return
+	}
+	if err := d.accepting(); err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	if err := checkFreeze(d.cfg); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	envID := rc.ProjectID
+	if envID == "" {
+		envID = r.URL.Query().Get("projectId")
+	}
+	if envID == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("webhook receiver %q has no projectId", rc.Name))
+		return
+	}
+	var push registryPush
+	if err := json.NewDecoder(r.Body).Decode(&push); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid %s payload: %s", rc.ServiceUpgradeConfig.PayloadFormat, err))
+		return
+	}
+	image := push.image(rc.ServiceUpgradeConfig.PayloadFormat)
+	attempts := []*history.Attempt{}
+	if tag := rc.ServiceUpgradeConfig.Tag; tag != "" && push.PushData.Tag != tag {
+		log.Printf("Webhook %s ignored the push of %s:%s, it upgrades to %s\n", rc.Name, image, push.PushData.Tag, tag)
+		writeJSON(w, http.StatusOK, attempts)
+		return
+	}
+
+	cfg := d.cfg
+	cfg.RancherEnvID = envID
+	services, err := upgrader.New(&http.Client{}, cfg).Services(r.Context())
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	for _, svc := range services {
+		from := svc.LaunchConfig.ImageUUID
+		if upgrader.ImageRepository(from) != image || !selected(svc.LaunchConfig.Labels, rc.ServiceUpgradeConfig.ServiceSelector) {
+			continue
+		}
+		svcCfg := cfg
+		svcCfg.RancherServiceID = svc.ID
+		svcCfg.BuildTag = push.PushData.Tag
+		svcCfg.RancherStartServiceFirst = rc.ServiceUpgradeConfig.StartFirst
+		a, err := d.launch(r.Context(), svcCfg, "webhook "+rc.Name)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		attempts = append(attempts, a)
+	}
+	if len(attempts) == 0 {
+		log.Printf("Webhook %s matched no services running %s\n", rc.Name, image)
+		writeJSON(w, http.StatusOK, attempts)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, attempts)
+}
+
+// selected returns true if labels have every label of selector.
+func selected(labels, selector map[string]string) bool {
+	for name, value := range selector {
+		if labels[name] != value {
+			return false
+		}
+	}
+	return true
+}
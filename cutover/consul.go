@@ -0,0 +1,141 @@
+package cutover
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Consul registers the service with the local Consul agent at Addr as ServiceID, tagged with
+// the new version, or deregisters it when Deregister is set.
+type Consul struct {
+	Client     *http.Client
+	Addr       string
+	Token      string
+	ServiceID  string
+	Name       string
+	Tags       []string
+	Meta       map[string]string
+	Address    string
+	Port       int
+	Deregister bool
+
+	// previous is the registration replaced by Apply, nil if there wasn't one.
+	previous *consulService
+}
+
+// consulService is a service registration as the agent API takes it.
+type consulService struct {
+	ID      string            `json:"ID"`
+	Name    string            `json:"Name"`
+	Tags    []string          `json:"Tags,omitempty"`
+	Meta    map[string]string `json:"Meta,omitempty"`
+	Address string            `json:"Address,omitempty"`
+	Port    int               `json:"Port,omitempty"`
+}
+
+// String implements Step.
+func (c *Consul) String() string {
+	if c.Deregister {
+		return fmt.Sprintf("Consul deregistration of %s", c.ServiceID)
+	}
+	return fmt.Sprintf("Consul registration of %s", c.ServiceID)
+}
+
+// Apply implements Step.
+func (c *Consul) Apply(ctx context.Context) error {
+	previous, err := c.current(ctx)
+	if err != nil {
+		return err
+	}
+	c.previous = previous
+	if c.Deregister {
+		if previous == nil {
+			return nil
+		}
+		return c.deregister(ctx)
+	}
+	return c.register(ctx, consulService{
+		ID:      c.ServiceID,
+		Name:    c.Name,
+		Tags:    c.Tags,
+		Meta:    c.Meta,
+		Address: c.Address,
+		Port:    c.Port,
+	})
+}
+
+// Revert implements Step.
+func (c *Consul) Revert(ctx context.Context) error {
+	if c.previous == nil {
+		if c.Deregister {
+			return nil
+		}
+		return c.deregister(ctx)
+	}
+	return c.register(ctx, *c.previous)
+}
+
+// current returns the registration as it is now, nil if the service isn't registered.
+func (c *Consul) current(ctx context.Context) (*consulService, error) {
+	b, status, err := c.do(ctx, http.MethodGet, "/v1/agent/service/"+url.PathEscape(c.ServiceID), nil)
+	if status == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The agent returns the name as Service but takes it as Name.
+	svc := struct {
+		consulService
+		Service string `json:"Service"`
+	}{}
+	if err := json.Unmarshal(b, &svc); err != nil {
+		return nil, err
+	}
+	svc.consulService.Name = svc.Service
+	return &svc.consulService, nil
+}
+
+func (c *Consul) register(ctx context.Context, svc consulService) error {
+	body, err := json.Marshal(svc)
+	if err != nil {
+		return err
+	}
+	_, _, err = c.do(ctx, http.MethodPut, "/v1/agent/service/register", body)
+	return err
+}
+
+func (c *Consul) deregister(ctx context.Context) error {
+	_, _, err := c.do(ctx, http.MethodPut, "/v1/agent/service/deregister/"+url.PathEscape(c.ServiceID), nil)
+	return err
+}
+
+func (c *Consul) do(ctx context.Context, method, path string, body []byte) ([]byte, int, error) {
+	u := strings.TrimSuffix(c.Addr, "/") + path
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	if c.Token != "" {
+		req.Header.Set("X-Consul-Token", c.Token)
+	}
+	res, err := c.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, res.StatusCode, err
+	}
+	if res.StatusCode >= http.StatusBadRequest {
+		return nil, res.StatusCode, fmt.Errorf("Consul %s %s: %s: %s", method, u, res.Status, strings.TrimSpace(string(b)))
+	}
+	return b, res.StatusCode, nil
+}
@@ -0,0 +1,15 @@
+// Package cutover has the steps that move traffic and service discovery over to an upgraded
+// service once it has been verified, and back again if the upgrade is rolled back.
+package cutover
+
+import "context"
+
+// Step is a reversible change made as part of the upgrade.
+type Step interface {
+	// String describes the step in logs.
+	String() string
+	// Apply makes the change, remembering what it replaced.
+	Apply(ctx context.Context) error
+	// Revert restores what Apply replaced.
+	Revert(ctx context.Context) error
+}
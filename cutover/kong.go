@@ -0,0 +1,217 @@
+package cutover
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Kong points an API gateway at the upgraded service through the Kong Admin API at AdminURL.
+// When Upstream is set its targets are replaced with Targets, and when Route is set the route is
+// switched to the Kong service Service.
+type Kong struct {
+	Client   *http.Client
+	AdminURL string
+	Token    string
+
+	Upstream string
+	// Targets are the host:port of the new containers.
+	Targets []string
+	Weight  int
+
+	Route   string
+	Service string
+
+	// previousTargets and previousService are what Apply replaced.
+	previousTargets []kongTarget
+	previousService string
+}
+
+type kongTarget struct {
+	Target string `json:"target"`
+	Weight int    `json:"weight"`
+}
+
+// String implements Step.
+func (k *Kong) String() string {
+	var s []string
+	if k.Upstream != "" {
+		s = append(s, "upstream "+k.Upstream)
+	}
+	if k.Route != "" {
+		s = append(s, "route "+k.Route)
+	}
+	return "Kong " + strings.Join(s, " and ")
+}
+
+// Apply implements Step.
+func (k *Kong) Apply(ctx context.Context) error {
+	if k.Upstream != "" {
+		previous, err := k.targets(ctx)
+		if err != nil {
+			return err
+		}
+		k.previousTargets = previous
+		next := make([]kongTarget, len(k.Targets))
+		for i, t := range k.Targets {
+			next[i] = kongTarget{Target: t, Weight: k.Weight}
+		}
+		if err := k.setTargets(ctx, previous, next); err != nil {
+			return err
+		}
+	}
+	if k.Route != "" {
+		if err := k.applyRoute(ctx); err != nil {
+			// A failed step isn't reverted, so undo the upstream change here.
+			if k.previousTargets != nil {
+				k.Revert(ctx)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (k *Kong) applyRoute(ctx context.Context) error {
+	previous, err := k.routeService(ctx)
+	if err != nil {
+		return err
+	}
+	id, err := k.serviceID(ctx, k.Service)
+	if err != nil {
+		return err
+	}
+	if err := k.setRouteService(ctx, id); err != nil {
+		return err
+	}
+	k.previousService = previous
+	return nil
+}
+
+// Revert implements Step.
+func (k *Kong) Revert(ctx context.Context) error {
+	if k.Route != "" && k.previousService != "" {
+		if err := k.setRouteService(ctx, k.previousService); err != nil {
+			return err
+		}
+	}
+	if k.Upstream != "" && k.previousTargets != nil {
+		current, err := k.targets(ctx)
+		if err != nil {
+			return err
+		}
+		return k.setTargets(ctx, current, k.previousTargets)
+	}
+	return nil
+}
+
+// targets returns the upstream's targets that take traffic.
+func (k *Kong) targets(ctx context.Context) ([]kongTarget, error) {
+	list := struct {
+		Data []kongTarget `json:"data"`
+	}{}
+	if err := k.do(ctx, http.MethodGet, "/upstreams/"+url.PathEscape(k.Upstream)+"/targets?size=1000", nil, &list); err != nil {
+		return nil, err
+	}
+	targets := []kongTarget{}
+	for _, t := range list.Data {
+		if t.Weight > 0 {
+			targets = append(targets, t)
+		}
+	}
+	return targets, nil
+}
+
+// setTargets adds the next targets before removing the current ones that aren't in next,
+// so the upstream is never left without a target.
+func (k *Kong) setTargets(ctx context.Context, current, next []kongTarget) error {
+	path := "/upstreams/" + url.PathEscape(k.Upstream) + "/targets"
+	keep := map[string]struct{}{}
+	for _, t := range next {
+		keep[t.Target] = struct{}{}
+		if err := k.do(ctx, http.MethodPost, path, t, nil); err != nil {
+			return err
+		}
+	}
+	for _, t := range current {
+		if _, ok := keep[t.Target]; ok {
+			continue
+		}
+		if err := k.do(ctx, http.MethodDelete, path+"/"+url.PathEscape(t.Target), nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// routeService returns the ID of the service the route sends traffic to.
+func (k *Kong) routeService(ctx context.Context) (string, error) {
+	route := struct {
+		Service struct {
+			ID string `json:"id"`
+		} `json:"service"`
+	}{}
+	if err := k.do(ctx, http.MethodGet, "/routes/"+url.PathEscape(k.Route), nil, &route); err != nil {
+		return "", err
+	}
+	return route.Service.ID, nil
+}
+
+// serviceID returns the ID of the service with the name or ID nameOrID.
+func (k *Kong) serviceID(ctx context.Context, nameOrID string) (string, error) {
+	svc := struct {
+		ID string `json:"id"`
+	}{}
+	if err := k.do(ctx, http.MethodGet, "/services/"+url.PathEscape(nameOrID), nil, &svc); err != nil {
+		return "", err
+	}
+	return svc.ID, nil
+}
+
+func (k *Kong) setRouteService(ctx context.Context, id string) error {
+	body := map[string]interface{}{"service": map[string]string{"id": id}}
+	return k.do(ctx, http.MethodPatch, "/routes/"+url.PathEscape(k.Route), body, nil)
+}
+
+// do calls the Admin API, sending body and decoding the response into v when they aren't nil.
+func (k *Kong) do(ctx context.Context, method, path string, body, v interface{}) error {
+	var b []byte
+	if body != nil {
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	u := strings.TrimSuffix(k.AdminURL, "/") + path
+	req, err := http.NewRequest(method, u, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if k.Token != "" {
+		req.Header.Set("Kong-Admin-Token", k.Token)
+	}
+	res, err := k.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	rb, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("Kong %s %s: %s: %s", method, u, res.Status, strings.TrimSpace(string(rb)))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(rb, v)
+}
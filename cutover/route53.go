@@ -0,0 +1,141 @@
+package cutover
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/aws"
+)
+
+const route53API = "https://route53.amazonaws.com/2013-04-01/hostedzone/"
+
+// Route53 points the DNS record Name of type Type in HostedZoneID at Value, e.g. the hostname of
+// the load balancer in front of the upgraded service.
+type Route53 struct {
+	Client       *http.Client
+	Credentials  aws.Credentials
+	HostedZoneID string
+	Name         string
+	Type         string
+	Value        string
+	TTL          int
+
+	// previous is the record replaced by Apply, nil if there wasn't one.
+	previous *resourceRecordSet
+}
+
+type resourceRecordSet struct {
+	Name            string   `xml:"Name"`
+	Type            string   `xml:"Type"`
+	TTL             int      `xml:"TTL"`
+	ResourceRecords []string `xml:"ResourceRecords>ResourceRecord>Value"`
+}
+
+type change struct {
+	Action            string            `xml:"Action"`
+	ResourceRecordSet resourceRecordSet `xml:"ResourceRecordSet"`
+}
+
+type changeRequest struct {
+	XMLName xml.Name `xml:"https://route53.amazonaws.com/doc/2013-04-01/ ChangeResourceRecordSetsRequest"`
+	Comment string   `xml:"ChangeBatch>Comment"`
+	Changes []change `xml:"ChangeBatch>Changes>Change"`
+}
+
+// String implements Step.
+func (r *Route53) String() string {
+	return fmt.Sprintf("Route53 %s record %s", r.Type, r.Name)
+}
+
+// Apply implements Step.
+func (r *Route53) Apply(ctx context.Context) error {
+	previous, err := r.current(ctx)
+	if err != nil {
+		return err
+	}
+	r.previous = previous
+	return r.change(ctx, "UPSERT", resourceRecordSet{
+		Name:            r.Name,
+		Type:            r.Type,
+		TTL:             r.TTL,
+		ResourceRecords: []string{r.Value},
+	})
+}
+
+// Revert implements Step.
+func (r *Route53) Revert(ctx context.Context) error {
+	if r.previous == nil {
+		return r.change(ctx, "DELETE", resourceRecordSet{
+			Name:            r.Name,
+			Type:            r.Type,
+			TTL:             r.TTL,
+			ResourceRecords: []string{r.Value},
+		})
+	}
+	return r.change(ctx, "UPSERT", *r.previous)
+}
+
+// current returns the record as it is now, nil if it doesn't exist.
+func (r *Route53) current(ctx context.Context) (*resourceRecordSet, error) {
+	q := url.Values{"name": {r.Name}, "type": {r.Type}, "maxitems": {"1"}}
+	b, err := r.do(ctx, http.MethodGet, route53API+r.HostedZoneID+"/rrset?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	list := struct {
+		ResourceRecordSets []resourceRecordSet `xml:"ResourceRecordSets>ResourceRecordSet"`
+	}{}
+	if err := xml.Unmarshal(b, &list); err != nil {
+		return nil, err
+	}
+	for _, rrs := range list.ResourceRecordSets {
+		if strings.TrimSuffix(rrs.Name, ".") == strings.TrimSuffix(r.Name, ".") && rrs.Type == r.Type {
+			return &rrs, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *Route53) change(ctx context.Context, action string, rrs resourceRecordSet) error {
+	body, err := xml.Marshal(changeRequest{
+		Comment: "rancher-upgrader",
+		Changes: []change{{Action: action, ResourceRecordSet: rrs}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = r.do(ctx, http.MethodPost, route53API+r.HostedZoneID+"/rrset/", append([]byte(xml.Header), body...))
+	return err
+}
+
+func (r *Route53) do(ctx context.Context, method, url string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/xml")
+	}
+	// Route53 is a global service signed for us-east-1.
+	aws.Sign(req, body, r.Credentials, "us-east-1", "route53", time.Now())
+	res, err := r.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= http.StatusBadRequest {
+		return nil, fmt.Errorf("Route53 %s %s: %s: %s", method, url, res.Status, strings.TrimSpace(string(b)))
+	}
+	return b, nil
+}
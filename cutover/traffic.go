@@ -0,0 +1,163 @@
+package cutover
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/richardbolt/rancher-upgrader/upgrader"
+)
+
+// TrafficShift moves the traffic of the load balancer LBServiceID from the service FromServiceID to
+// ToServiceID in steps of Percents, calling Verify after each step and BeforeStep, when set, before each
+// step but the first, e.g. to hold the shift while it is paused.
+//
+// Rancher load balancer rules have no weights, so both services are put behind the same rules and the
+// share of traffic is set by how many containers each runs: at 10% of 10 containers ToServiceID runs
+// 1 and FromServiceID 9. At 100% the rules for FromServiceID are removed, leaving it running so that
+// reverting is quick. Sticky sessions and uneven container capacity skew the split.
+type TrafficShift struct {
+	Upgrader      upgrader.Upgrader
+	LBServiceID   string
+	FromServiceID string
+	ToServiceID   string
+	Percents      []int
+	Verify        func(ctx context.Context) error
+	BeforeStep    func(ctx context.Context, percent int) error
+
+	// previousRules and the previous scales are what Apply replaced, previousRules is nil until then.
+	previousRules     []map[string]interface{}
+	previousFromScale int
+	previousToScale   int
+}
+
+// String implements Step.
+func (t *TrafficShift) String() string {
+	return fmt.Sprintf("traffic shift of load balancer %s from %s to %s", t.LBServiceID, t.FromServiceID, t.ToServiceID)
+}
+
+// Apply implements Step. A failed step is reverted before Apply returns.
+func (t *TrafficShift) Apply(ctx context.Context) error {
+	rules, err := t.Upgrader.LoadBalancerRules(ctx, t.LBServiceID)
+	if err != nil {
+		return err
+	}
+	fromScale, err := t.Upgrader.Scale(ctx, t.FromServiceID)
+	if err != nil {
+		return err
+	}
+	toScale, err := t.Upgrader.Scale(ctx, t.ToServiceID)
+	if err != nil {
+		return err
+	}
+	t.previousRules, t.previousFromScale, t.previousToScale = rules, fromScale, toScale
+	if err := t.shift(ctx, rules, fromScale); err != nil {
+		if rerr := t.Revert(context.Background()); rerr != nil {
+			log.Printf("Failed to revert %s: %s\n", t, rerr)
+		}
+		return err
+	}
+	return nil
+}
+
+func (t *TrafficShift) shift(ctx context.Context, rules []map[string]interface{}, total int) error {
+	if len(withoutTarget(rules, t.FromServiceID)) == len(rules) {
+		return fmt.Errorf("load balancer %s has no rules for %s", t.LBServiceID, t.FromServiceID)
+	}
+	shared := withTarget(rules, t.FromServiceID, t.ToServiceID)
+	if err := t.Upgrader.SetLoadBalancerRules(ctx, t.LBServiceID, shared); err != nil {
+		return err
+	}
+	for i, percent := range t.Percents {
+		if i > 0 && t.BeforeStep != nil {
+			if err := t.BeforeStep(ctx, percent); err != nil {
+				return err
+			}
+		}
+		if percent >= 100 {
+			if err := t.Upgrader.SetScale(ctx, t.ToServiceID, maxInt(total, t.previousToScale)); err != nil {
+				return err
+			}
+			if err := t.Upgrader.SetLoadBalancerRules(ctx, t.LBServiceID, withoutTarget(shared, t.FromServiceID)); err != nil {
+				return err
+			}
+		} else {
+			// Round up so that every step sends some traffic to the new service.
+			to := (total*percent + 99) / 100
+			if err := t.Upgrader.SetScale(ctx, t.ToServiceID, maxInt(to, 1)); err != nil {
+				return err
+			}
+			if err := t.Upgrader.SetScale(ctx, t.FromServiceID, maxInt(total-to, 1)); err != nil {
+				return err
+			}
+		}
+		log.Printf("Shifted %d%% of the traffic of load balancer %s to %s\n", percent, t.LBServiceID, t.ToServiceID)
+		if err := t.Verify(ctx); err != nil {
+			return fmt.Errorf("verification at %d%% failed: %s", percent, err)
+		}
+	}
+	return nil
+}
+
+// Revert implements Step.
+func (t *TrafficShift) Revert(ctx context.Context) error {
+	if t.previousRules == nil {
+		return nil
+	}
+	// Bring the old service back up before it takes all the traffic again.
+	if err := t.Upgrader.SetScale(ctx, t.FromServiceID, t.previousFromScale); err != nil {
+		return err
+	}
+	if err := t.Upgrader.SetLoadBalancerRules(ctx, t.LBServiceID, t.previousRules); err != nil {
+		return err
+	}
+	return t.Upgrader.SetScale(ctx, t.ToServiceID, t.previousToScale)
+}
+
+// withTarget returns rules with a copy of every rule for the service from that routes to the service to,
+// unless rules already has one.
+func withTarget(rules []map[string]interface{}, from, to string) []map[string]interface{} {
+	shared := append([]map[string]interface{}{}, rules...)
+	for _, rule := range rules {
+		if rule["serviceId"] != from || hasRule(rules, rule, to) {
+			continue
+		}
+		copied := map[string]interface{}{}
+		for k, v := range rule {
+			copied[k] = v
+		}
+		copied["serviceId"] = to
+		delete(copied, "id")
+		shared = append(shared, copied)
+	}
+	return shared
+}
+
+// withoutTarget returns rules without the ones for the service id.
+func withoutTarget(rules []map[string]interface{}, id string) []map[string]interface{} {
+	var kept []map[string]interface{}
+	for _, rule := range rules {
+		if rule["serviceId"] != id {
+			kept = append(kept, rule)
+		}
+	}
+	return kept
+}
+
+// hasRule returns true if rules routes the same traffic as rule to the service id.
+func hasRule(rules []map[string]interface{}, rule map[string]interface{}, id string) bool {
+	for _, r := range rules {
+		if r["serviceId"] == id && r["sourcePort"] == rule["sourcePort"] && r["protocol"] == rule["protocol"] &&
+			r["hostname"] == rule["hostname"] && r["path"] == rule["path"] {
+			return true
+		}
+	}
+	return false
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,45 @@
+package gitops
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Repo is a local checkout in Dir of the branch Branch of the Git repository at URL.
+type Repo struct {
+	URL    string
+	Branch string
+	Dir    string
+}
+
+// Sync clones the branch, or resets the checkout to the tip of the branch, and returns its commit.
+func (r Repo) Sync(ctx context.Context) (string, error) {
+	if _, err := os.Stat(filepath.Join(r.Dir, ".git")); os.IsNotExist(err) {
+		if _, err := git(ctx, "", "clone", "--quiet", "--depth", "1", "--single-branch", "--branch", r.Branch, r.URL, r.Dir); err != nil {
+			return "", err
+		}
+	} else {
+		if _, err := git(ctx, r.Dir, "fetch", "--quiet", "--depth", "1", "origin", r.Branch); err != nil {
+			return "", err
+		}
+		if _, err := git(ctx, r.Dir, "reset", "--quiet", "--hard", "FETCH_HEAD"); err != nil {
+			return "", err
+		}
+	}
+	return git(ctx, r.Dir, "rev-parse", "HEAD")
+}
+
+// git runs the git command with args in dir and returns its trimmed output.
+func git(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %s: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
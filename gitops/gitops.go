@@ -0,0 +1,100 @@
+// Package gitops reads the desired versions of services from manifests kept in a Git repository.
+package gitops
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Service is the desired version of a Rancher service.
+type Service struct {
+	// Service is the name or ID of the service in the environment.
+	Service string `yaml:"service"`
+	// Image is the image the service should run, e.g. "org/app:1.2.3".
+	Image string `yaml:"image"`
+	// Wave orders the upgrades: every service of a wave is upgraded and verified before the next wave,
+	// e.g. wave 0 for migrations, 1 for backends and 2 for frontends.
+	Wave int `yaml:"-"`
+	// File is the manifest the service was declared in.
+	File string `yaml:"-"`
+}
+
+// ImageUUID returns the Rancher imageUuid of the desired image.
+func (s Service) ImageUUID() string {
+	if strings.HasPrefix(s.Image, "docker:") {
+		return s.Image
+	}
+	return "docker:" + s.Image
+}
+
+// manifest is a YAML file of desired services, e.g.
+//
+//	wave: 1
+//	services:
+//	  - service: app
+//	    image: org/app:1.2.3
+//	  - service: app-migrations
+//	    image: org/app-migrations:1.2.3
+//	    wave: 0
+//
+// The wave of the manifest applies to the services that don't have their own, 0 by default.
+type manifest struct {
+	Wave     int `yaml:"wave"`
+	Services []struct {
+		Service `yaml:",inline"`
+		Wave    *int `yaml:"wave"`
+	} `yaml:"services"`
+}
+
+// Load reads the desired services from the .yml and .yaml files under dir, ordered by wave.
+func Load(dir string) ([]Service, error) {
+	var services []Service
+	declared := map[string]string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if ext := filepath.Ext(path); ext != ".yml" && ext != ".yaml" {
+			return nil
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		m := manifest{}
+		if err := yaml.UnmarshalStrict(b, &m); err != nil {
+			return fmt.Errorf("invalid manifest %s: %s", path, err)
+		}
+		for _, ms := range m.Services {
+			s := ms.Service
+			s.Wave = m.Wave
+			if ms.Wave != nil {
+				s.Wave = *ms.Wave
+			}
+			if s.Service == "" || s.Image == "" {
+				return fmt.Errorf("invalid manifest %s: every service needs a service and an image", path)
+			}
+			if other, ok := declared[s.Service]; ok {
+				return fmt.Errorf("service %s is declared in both %s and %s", s.Service, other, path)
+			}
+			declared[s.Service] = path
+			s.File = path
+			services = append(services, s)
+		}
+		return nil
+	})
+	sort.SliceStable(services, func(i, j int) bool { return services[i].Wave < services[j].Wave })
+	return services, err
+}
@@ -0,0 +1,242 @@
+// Package history records upgrade attempts in SQLite or Postgres, as an audit of deployments.
+package history
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	// The supported database/sql drivers, "postgres" and "sqlite3".
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Statuses of an attempt.
+const (
+	Running    = "running"
+	Succeeded  = "succeeded"
+	Failed     = "failed"
+	RolledBack = "rolled-back"
+	// Upgraded is an upgrade that was verified and is waiting to be finished.
+	Upgraded = "upgraded"
+	// Held is an upgrade that failed verification and was left upgraded for a person to inspect.
+	Held = "held"
+	// Queued is an upgrade waiting for the upgrades of its service before it, or a free slot, to run.
+	Queued = "queued"
+	// Superseded is a queued upgrade that a later upgrade of its service replaced before it ran.
+	Superseded = "superseded"
+)
+
+// ErrNotFound is returned by Get for an unknown attempt.
+var ErrNotFound = errors.New("upgrade attempt not found")
+
+// Attempt is an attempt at upgrading a service.
+type Attempt struct {
+	ID          string `json:"id"`
+	EnvID       string `json:"envId"`
+	ServiceID   string `json:"serviceId"`
+	ServiceName string `json:"serviceName,omitempty"`
+	// RequestedBy is who asked for the upgrade.
+	RequestedBy string `json:"requestedBy"`
+	FromImage   string `json:"fromImage,omitempty"`
+	ToImage     string `json:"toImage,omitempty"`
+	BuildTag    string `json:"buildTag"`
+	Status      string `json:"status"`
+	// RollbackReason is why the upgrade was cancelled or rolled back.
+	RollbackReason string     `json:"rollbackReason,omitempty"`
+	Error          string     `json:"error,omitempty"`
+	StartedAt      time.Time  `json:"startedAt"`
+	FinishedAt     *time.Time `json:"finishedAt,omitempty"`
+	// Durations are the seconds each phase of the upgrade took.
+	Durations map[string]float64 `json:"durations,omitempty"`
+}
+
+// Filter selects attempts, empty fields match everything.
+type Filter struct {
+	EnvID     string
+	ServiceID string
+	Status    string
+	// Limit is the most attempts returned, newest first, after skipping the Offset newest ones.
+	Limit  int
+	Offset int
+}
+
+// Store is the history of upgrade attempts in a database.
+type Store struct {
+	db *sql.DB
+}
+
+const schema = `CREATE TABLE IF NOT EXISTS upgrade_attempts (
+	id TEXT PRIMARY KEY,
+	env_id TEXT NOT NULL,
+	service_id TEXT NOT NULL,
+	service_name TEXT NOT NULL,
+	requested_by TEXT NOT NULL,
+	from_image TEXT NOT NULL,
+	to_image TEXT NOT NULL,
+	build_tag TEXT NOT NULL,
+	status TEXT NOT NULL,
+	rollback_reason TEXT NOT NULL,
+	error TEXT NOT NULL,
+	started_at TEXT NOT NULL,
+	finished_at TEXT NOT NULL,
+	durations TEXT NOT NULL
+)`
+
+// Open opens the history in the database dsn with driver ("sqlite3" or "postgres"), creating it if needed.
+func Open(driver, dsn string) (*Store, error) {
+	if driver != "sqlite3" && driver != "postgres" {
+		return nil, fmt.Errorf("unknown history database driver %q, expected sqlite3 or postgres", driver)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	for _, table := range []string{schema, leaseSchema} {
+		if _, err := db.Exec(table); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &Store{db: db}, nil
+}
+
+// Close closes the database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Ping checks the database can be reached.
+func (s *Store) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// Start records a as a new attempt, setting its ID, status and start time. It is running unless it is
+// Queued.
+func (s *Store) Start(ctx context.Context, a *Attempt) error {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	a.ID = hex.EncodeToString(id)
+	if a.Status != Queued {
+		a.Status = Running
+	}
+	a.StartedAt = time.Now().UTC()
+	_, err := s.db.ExecContext(ctx, `INSERT INTO upgrade_attempts (id, env_id, service_id, service_name,
+		requested_by, from_image, to_image, build_tag, status, rollback_reason, error, started_at, finished_at, durations)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, '', '', $10, '', '{}')`,
+		a.ID, a.EnvID, a.ServiceID, a.ServiceName, a.RequestedBy, a.FromImage, a.ToImage, a.BuildTag,
+		a.Status, a.StartedAt.Format(time.RFC3339Nano))
+	return err
+}
+
+// Run records that the queued attempt a is running.
+func (s *Store) Run(ctx context.Context, a *Attempt) error {
+	a.Status = Running
+	_, err := s.db.ExecContext(ctx, `UPDATE upgrade_attempts SET status = $1 WHERE id = $2`, a.Status, a.ID)
+	return err
+}
+
+// Finish records the outcome of the attempt a, setting its finish time.
+func (s *Store) Finish(ctx context.Context, a *Attempt) error {
+	finished := time.Now().UTC()
+	a.FinishedAt = &finished
+	durations, err := json.Marshal(a.Durations)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `UPDATE upgrade_attempts SET service_name = $1, from_image = $2, to_image = $3,
+		status = $4, rollback_reason = $5, error = $6, finished_at = $7, durations = $8 WHERE id = $9`,
+		a.ServiceName, a.FromImage, a.ToImage, a.Status, a.RollbackReason, a.Error,
+		finished.Format(time.RFC3339Nano), string(durations), a.ID)
+	return err
+}
+
+const columns = `id, env_id, service_id, service_name, requested_by, from_image, to_image, build_tag,
+	status, rollback_reason, error, started_at, finished_at, durations`
+
+// Get returns the attempt id.
+func (s *Store) Get(ctx context.Context, id string) (*Attempt, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+columns+` FROM upgrade_attempts WHERE id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	attempts, err := scan(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(attempts) == 0 {
+		return nil, ErrNotFound
+	}
+	return &attempts[0], nil
+}
+
+// List returns the attempts matching f, newest first.
+func (s *Store) List(ctx context.Context, f Filter) ([]Attempt, error) {
+	var where []string
+	var args []interface{}
+	for _, c := range []struct{ column, value string }{
+		{"env_id", f.EnvID},
+		{"service_id", f.ServiceID},
+		{"status", f.Status},
+	} {
+		if c.value != "" {
+			args = append(args, c.value)
+			where = append(where, fmt.Sprintf("%s = $%d", c.column, len(args)))
+		}
+	}
+	query := `SELECT ` + columns + ` FROM upgrade_attempts`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	// The ID orders attempts started at once the same way for every page.
+	query += ` ORDER BY started_at DESC, id DESC`
+	if f.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", f.Limit)
+	}
+	if f.Offset > 0 {
+		query += fmt.Sprintf(" OFFSET %d", f.Offset)
+	}
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scan(rows)
+}
+
+// scan reads and closes rows of columns.
+func scan(rows *sql.Rows) ([]Attempt, error) {
+	defer rows.Close()
+	attempts := []Attempt{}
+	for rows.Next() {
+		a := Attempt{}
+		var started, finished, durations string
+		err := rows.Scan(&a.ID, &a.EnvID, &a.ServiceID, &a.ServiceName, &a.RequestedBy, &a.FromImage, &a.ToImage,
+			&a.BuildTag, &a.Status, &a.RollbackReason, &a.Error, &started, &finished, &durations)
+		if err != nil {
+			return nil, err
+		}
+		if a.StartedAt, err = time.Parse(time.RFC3339Nano, started); err != nil {
+			return nil, err
+		}
+		if finished != "" {
+			t, err := time.Parse(time.RFC3339Nano, finished)
+			if err != nil {
+				return nil, err
+			}
+			a.FinishedAt = &t
+		}
+		if err := json.Unmarshal([]byte(durations), &a.Durations); err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
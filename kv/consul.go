@@ -0,0 +1,40 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Consul writes to the Consul KV store through the agent at Addr.
+type Consul struct {
+	Client *http.Client
+	Addr   string
+	Token  string
+}
+
+// Put implements Store.
+func (c *Consul) Put(ctx context.Context, key string, value []byte) error {
+	u := strings.TrimSuffix(c.Addr, "/") + "/v1/kv/" + strings.TrimPrefix(key, "/")
+	req, err := http.NewRequest(http.MethodPut, u, bytes.NewReader(value))
+	if err != nil {
+		return err
+	}
+	if c.Token != "" {
+		req.Header.Set("X-Consul-Token", c.Token)
+	}
+	res, err := c.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	b, _ := ioutil.ReadAll(res.Body)
+	// The agent answers true or false for whether the write happened.
+	if res.StatusCode >= http.StatusBadRequest || strings.TrimSpace(string(b)) != "true" {
+		return fmt.Errorf("Consul PUT %s: %s: %s", u, res.Status, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Etcd writes to etcd v3 through its JSON gRPC gateway at Addr.
+type Etcd struct {
+	Client *http.Client
+	Addr   string
+	// Token is an auth token from /v3/auth/authenticate.
+	Token string
+}
+
+// Put implements Store.
+func (e *Etcd) Put(ctx context.Context, key string, value []byte) error {
+	// The gateway takes keys and values as bytes, which encoding/json base64 encodes.
+	body, err := json.Marshal(struct {
+		Key   []byte `json:"key"`
+		Value []byte `json:"value"`
+	}{[]byte(key), value})
+	if err != nil {
+		return err
+	}
+	u := strings.TrimSuffix(e.Addr, "/") + "/v3/kv/put"
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.Token != "" {
+		req.Header.Set("Authorization", e.Token)
+	}
+	res, err := e.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= http.StatusBadRequest {
+		b, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("etcd POST %s: %s: %s", u, res.Status, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+// Package kv writes to the key/value stores config-watching services read the current release from.
+package kv
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// Store is a key/value store.
+type Store interface {
+	Put(ctx context.Context, key string, value []byte) error
+}
+
+// New returns the Store for backend ("consul" or "etcd") at addr, authenticating with token when it is set.
+func New(backend, addr, token string, client *http.Client) (Store, error) {
+	switch backend {
+	case "consul":
+		return &Consul{Client: client, Addr: addr, Token: token}, nil
+	case "etcd":
+		return &Etcd{Client: client, Addr: addr, Token: token}, nil
+	}
+	return nil, fmt.Errorf("unknown key/value store %q, expected consul or etcd", backend)
+}
@@ -0,0 +1,64 @@
+// Package metadata queries the Rancher metadata service, which answers containers running in a Rancher
+// environment about themselves and the environment they run in.
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DefaultURL is the metadata service every container of a Rancher 1.x environment can reach.
+const DefaultURL = "http://169.254.169.250/latest"
+
+// Client talks to the metadata service at URL, DefaultURL when it is empty.
+type Client struct {
+	HTTP *http.Client
+	URL  string
+}
+
+// EnvironmentUUID returns the UUID of the environment the container runs in.
+func (c *Client) EnvironmentUUID(ctx context.Context) (string, error) {
+	return c.get(ctx, "self/stack/environment_uuid")
+}
+
+// StackName returns the name of the stack the container runs in.
+func (c *Client) StackName(ctx context.Context) (string, error) {
+	return c.get(ctx, "self/stack/name")
+}
+
+// ServiceUUID returns the UUID of the service name of the stack named stack.
+func (c *Client) ServiceUUID(ctx context.Context, stack, name string) (string, error) {
+	return c.get(ctx, "stacks/"+url.PathEscape(stack)+"/services/"+url.PathEscape(name)+"/uuid")
+}
+
+// get returns the plain text value at path.
+func (c *Client) get(ctx context.Context, path string) (string, error) {
+	base := c.URL
+	if base == "" {
+		base = DefaultURL
+	}
+	u := strings.TrimSuffix(base, "/") + "/" + path
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "text/plain")
+	res, err := c.HTTP.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GET %s: %s", u, res.Status)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/aws"
+)
+
+// CloudWatch queries CloudWatch metrics in Region with GetMetricData. Expressions are metric math
+// or Metrics Insights queries, e.g. `SELECT AVG(CPUUtilization) FROM "AWS/EC2"`.
+type CloudWatch struct {
+	Client      *http.Client
+	Region      string
+	Credentials aws.Credentials
+}
+
+// Query implements Provider, using the whole window as the period so a single value is returned.
+func (c CloudWatch) Query(ctx context.Context, expr string, window time.Duration) (float64, error) {
+	now := time.Now().UTC()
+	// Periods must be a multiple of 60 seconds.
+	period := int(window.Seconds()) / 60 * 60
+	if period < 60 {
+		period = 60
+	}
+	form := url.Values{
+		"Action":                                {"GetMetricData"},
+		"Version":                               {"2010-08-01"},
+		"StartTime":                             {now.Add(-time.Duration(period) * time.Second).Format(time.RFC3339)},
+		"EndTime":                               {now.Format(time.RFC3339)},
+		"MetricDataQueries.member.1.Id":         {"q"},
+		"MetricDataQueries.member.1.Expression": {expr},
+		"MetricDataQueries.member.1.Period":     {strconv.Itoa(period)},
+	}
+	body := []byte(form.Encode())
+	req, err := http.NewRequest(http.MethodPost, "https://monitoring."+c.Region+".amazonaws.com/", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	aws.Sign(req, body, c.Credentials, c.Region, "monitoring", time.Now())
+	res, err := c.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return 0, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(b)))
+	}
+	result := struct {
+		Results []struct {
+			Values []float64 `xml:"Values>member"`
+		} `xml:"GetMetricDataResult>MetricDataResults>member"`
+	}{}
+	if err := xml.Unmarshal(b, &result); err != nil {
+		return 0, err
+	}
+	if len(result.Results) == 0 || len(result.Results[0].Values) == 0 {
+		return 0, errors.New("no data")
+	}
+	if len(result.Results) > 1 {
+		return 0, fmt.Errorf("got %d series, aggregate them into one", len(result.Results))
+	}
+	// Values are newest first.
+	return result.Results[0].Values[0], nil
+}
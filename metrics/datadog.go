@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Datadog queries the Datadog metrics API of Site (e.g. datadoghq.com or datadoghq.eu).
+type Datadog struct {
+	Client *http.Client
+	Site   string
+	APIKey string
+	AppKey string
+}
+
+// Query implements Provider, returning the average of the points of the single series expr returns
+// over the window.
+func (d Datadog) Query(ctx context.Context, expr string, window time.Duration) (float64, error) {
+	now := time.Now()
+	q := url.Values{
+		"query": {expr},
+		"from":  {strconv.FormatInt(now.Add(-window).Unix(), 10)},
+		"to":    {strconv.FormatInt(now.Unix(), 10)},
+	}
+	req, err := http.NewRequest(http.MethodGet, "https://api."+d.Site+"/api/v1/query?"+q.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("DD-API-KEY", d.APIKey)
+	req.Header.Set("DD-APPLICATION-KEY", d.AppKey)
+	res, err := d.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	body := struct {
+		Status string   `json:"status"`
+		Errors []string `json:"errors"`
+		Error  string   `json:"error"`
+		Series []struct {
+			// Points are [timestamp, value] pairs, value is null when there is no data.
+			Pointlist [][]*float64 `json:"pointlist"`
+		} `json:"series"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return 0, fmt.Errorf("%s: %s", res.Status, err)
+	}
+	if res.StatusCode != http.StatusOK || body.Status == "error" {
+		return 0, fmt.Errorf("%s: %s %v", res.Status, body.Error, body.Errors)
+	}
+	if len(body.Series) == 0 {
+		return 0, errors.New("no data")
+	}
+	if len(body.Series) > 1 {
+		return 0, fmt.Errorf("got %d series, aggregate them into one", len(body.Series))
+	}
+	sum, n := 0.0, 0
+	for _, point := range body.Series[0].Pointlist {
+		if len(point) == 2 && point[1] != nil {
+			sum += *point[1]
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, errors.New("no data")
+	}
+	return sum / float64(n), nil
+}
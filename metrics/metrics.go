@@ -0,0 +1,15 @@
+// Package metrics queries monitoring systems for the values the upgrade analysis gates check,
+// behind a common Provider interface so new systems can be added without touching the workflow.
+package metrics
+
+import (
+	"context"
+	"time"
+)
+
+// Provider evaluates a query in the language of a monitoring system.
+type Provider interface {
+	// Query returns the value of expr over the window of time leading up to now.
+	// expr must produce a single value, e.g. by aggregating with sum or avg.
+	Query(ctx context.Context, expr string, window time.Duration) (float64, error)
+}
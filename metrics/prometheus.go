@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Prometheus queries the Prometheus server at URL. The $window placeholder in expressions is replaced
+// by the window, e.g. "sum(rate(http_errors_total[$window]))".
+type Prometheus struct {
+	Client *http.Client
+	URL    string
+}
+
+// Query implements Provider with an instant query.
+func (p Prometheus) Query(ctx context.Context, expr string, window time.Duration) (float64, error) {
+	expr = strings.Replace(expr, "$window", fmt.Sprintf("%ds", int(window.Seconds())), -1)
+	u := strings.TrimRight(p.URL, "/") + "/api/v1/query?" + url.Values{"query": {expr}}.Encode()
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return 0, err
+	}
+	res, err := p.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	body := struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+		Data   struct {
+			ResultType string          `json:"resultType"`
+			Result     json.RawMessage `json:"result"`
+		} `json:"data"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return 0, fmt.Errorf("%s: %s", res.Status, err)
+	}
+	if body.Status != "success" {
+		return 0, fmt.Errorf("%s: %s", res.Status, body.Error)
+	}
+
+	// Samples are [timestamp, "value"] pairs.
+	var sample []interface{}
+	switch body.Data.ResultType {
+	case "vector":
+		var vector []struct {
+			Value []interface{} `json:"value"`
+		}
+		if err := json.Unmarshal(body.Data.Result, &vector); err != nil {
+			return 0, err
+		}
+		if len(vector) == 0 {
+			return 0, errors.New("no data")
+		}
+		if len(vector) > 1 {
+			return 0, fmt.Errorf("got %d series, aggregate them into one", len(vector))
+		}
+		sample = vector[0].Value
+	case "scalar":
+		if err := json.Unmarshal(body.Data.Result, &sample); err != nil {
+			return 0, err
+		}
+	default:
+		return 0, fmt.Errorf("unsupported result type %s", body.Data.ResultType)
+	}
+	if len(sample) != 2 {
+		return 0, fmt.Errorf("invalid sample %v", sample)
+	}
+	str, _ := sample[1].(string)
+	value, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid sample value %v", sample[1])
+	}
+	return value, nil
+}
@@ -0,0 +1,218 @@
+// Package plugins runs the notifiers, verifiers and approvers teams add to the upgrader as plugins:
+// executables in a plugins directory that are sent a request as JSON on stdin and answer with a
+// response as JSON on stdout. What they write to stderr goes to the logs, e.g. a plugin
+//
+//	#!/bin/sh
+//	request=$(cat)
+//	curl -sf -d "$request" https://deploys.example.com/ >&2 && echo '{"ok": true}'
+//
+// A plugin that exits with an error or doesn't answer ok fails: a verifier fails the upgrade, an
+// approver refuses it and the failure of a notifier is logged.
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Kind is what a plugin is used as.
+type Kind string
+
+const (
+	// KindNotifier plugins are sent every upgrade that ends as configured in NOTIFY_STATUSES.
+	KindNotifier Kind = "notifier"
+	// KindVerifier plugins check an upgraded service before the upgrade is finished.
+	KindVerifier Kind = "verifier"
+	// KindApprover plugins approve an upgrade before it is started.
+	KindApprover Kind = "approver"
+)
+
+// Plugin is a plugin as it is configured in the manifest.
+type Plugin struct {
+	// Name is the name of the executable in the plugins directory, without its extension on Windows.
+	Name string
+	Kind Kind
+	// Config is sent to the plugin with every request, e.g. the channel a notifier posts to.
+	Config map[string]interface{}
+	// Path is the executable of the plugin.
+	Path string
+}
+
+// manifest is the YAML file that configures the plugins, e.g.
+//
+//	plugins:
+//	  - name: change-calendar
+//	    kind: approver
+//	  - name: pagerduty
+//	    kind: notifier
+//	    config:
+//	      routingKey: 0123456789abcdef
+//
+// A plugin may be configured several times, e.g. as notifiers of different channels.
+type manifest struct {
+	Plugins []struct {
+		Name   string                      `yaml:"name"`
+		Kind   Kind                        `yaml:"kind"`
+		Config map[interface{}]interface{} `yaml:"config"`
+	} `yaml:"plugins"`
+}
+
+// Discover returns the executables of the plugins directory dir by their plugin names.
+func Discover(dir string) (map[string]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	executables := map[string]string{}
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		if name, ok := pluginName(info); ok {
+			executables[name] = filepath.Join(dir, info.Name())
+		}
+	}
+	return executables, nil
+}
+
+// Load returns the plugins configured in the manifest at path, which run the executables of the plugins
+// directory dir.
+func Load(dir, path string) ([]Plugin, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := manifest{}
+	if err := yaml.UnmarshalStrict(b, &m); err != nil {
+		return nil, fmt.Errorf("invalid plugin manifest %s: %s", path, err)
+	}
+	executables, err := Discover(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not discover the plugins: %s", err)
+	}
+	plugins := make([]Plugin, 0, len(m.Plugins))
+	for _, mp := range m.Plugins {
+		switch mp.Kind {
+		case KindNotifier, KindVerifier, KindApprover:
+		default:
+			return nil, fmt.Errorf("invalid plugin manifest %s: unknown kind %q of plugin %s, expected notifier, verifier or approver", path, mp.Kind, mp.Name)
+		}
+		executable, ok := executables[mp.Name]
+		if !ok {
+			return nil, fmt.Errorf("invalid plugin manifest %s: there is no plugin %s in %s", path, mp.Name, dir)
+		}
+		config, _ := jsonValue(mp.Config).(map[string]interface{})
+		plugins = append(plugins, Plugin{Name: mp.Name, Kind: mp.Kind, Config: config, Path: executable})
+	}
+	return plugins, nil
+}
+
+// Of returns the plugins of kind.
+func Of(plugins []Plugin, kind Kind) []Plugin {
+	var of []Plugin
+	for _, p := range plugins {
+		if p.Kind == kind {
+			of = append(of, p)
+		}
+	}
+	return of
+}
+
+// Request is what a plugin is sent on stdin.
+type Request struct {
+	Kind   Kind                   `json:"kind"`
+	Config map[string]interface{} `json:"config,omitempty"`
+	// Upgrade is the upgrade the plugin is run for: the one that ended for notifiers, the one that is
+	// being verified for verifiers and the one that is about to start for approvers.
+	Upgrade interface{} `json:"upgrade"`
+}
+
+// Response is what a plugin answers on stdout.
+type Response struct {
+	OK bool `json:"ok"`
+	// Message is why the plugin failed, or what it did.
+	Message string `json:"message,omitempty"`
+}
+
+// Run runs the plugin for upgrade, for at most timeout when it is positive, and returns an error if it
+// fails or doesn't answer ok.
+func (p Plugin) Run(ctx context.Context, upgrade interface{}, timeout time.Duration) (Response, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	req, err := json.Marshal(Request{Kind: p.Kind, Config: p.Config, Upgrade: upgrade})
+	if err != nil {
+		return Response{}, err
+	}
+	stdout := bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, p.Path)
+	cmd.Stdin = bytes.NewReader(req)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return Response{}, fmt.Errorf("the %s plugin %s timed out", p.Kind, p.Name)
+		}
+		return Response{}, fmt.Errorf("the %s plugin %s failed: %s", p.Kind, p.Name, err)
+	}
+	res := Response{}
+	if err := json.Unmarshal(stdout.Bytes(), &res); err != nil {
+		return Response{}, fmt.Errorf("the %s plugin %s answered %q instead of a JSON response: %s", p.Kind, p.Name,
+			strings.TrimSpace(stdout.String()), err)
+	}
+	if !res.OK {
+		if res.Message == "" {
+			res.Message = "not ok"
+		}
+		return res, fmt.Errorf("%s plugin %s: %s", p.Kind, p.Name, res.Message)
+	}
+	if res.Message != "" {
+		log.Printf("%s plugin %s: %s\n", p.Kind, p.Name, res.Message)
+	}
+	return res, nil
+}
+
+// Verifier is a verifier plugin that verifies the upgrade Upgrade.
+type Verifier struct {
+	Plugin  Plugin
+	Upgrade interface{}
+	Timeout time.Duration
+}
+
+// Verify implements verify.Verifier.
+func (v Verifier) Verify(ctx context.Context) error {
+	_, err := v.Plugin.Run(ctx, v.Upgrade, v.Timeout)
+	return err
+}
+
+// jsonValue converts the maps YAML decodes, with keys of any type, to the maps JSON encodes.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			m[fmt.Sprint(k)] = jsonValue(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range v {
+			v[i] = jsonValue(item)
+		}
+		return v
+	default:
+		return v
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package plugins
+
+import "os"
+
+// pluginName returns the name of the plugin of the file info, false if it isn't executable.
+func pluginName(info os.FileInfo) (string, bool) {
+	return info.Name(), info.Mode()&0111 != 0
+}
@@ -0,0 +1,18 @@
+package plugins
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// pluginName returns the name of the plugin of the file info, its name without its extension, false if
+// it isn't an executable or a batch file.
+func pluginName(info os.FileInfo) (string, bool) {
+	ext := filepath.Ext(info.Name())
+	switch strings.ToLower(ext) {
+	case ".exe", ".bat", ".cmd":
+		return strings.TrimSuffix(info.Name(), ext), true
+	}
+	return "", false
+}
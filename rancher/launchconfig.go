@@ -0,0 +1,189 @@
+package rancher
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// LaunchConfig is the launchConfig of a service, how its containers are created. The settings the
+// upgrader reads and changes have fields of their own and the others are kept in Other as Rancher sent
+// them, so a launchConfig that is decoded, changed and sent back loses nothing. Fields are sent when
+// they were decoded, even when they are zero now, or when they aren't zero.
+type LaunchConfig struct {
+	// ImageUUID is the image of the containers, e.g. "docker:org/app:1.2.3".
+	ImageUUID   string
+	Environment map[string]string
+	Labels      map[string]string
+	// Ports are the ports of the containers, e.g. "8080:80/tcp".
+	Ports       []string
+	HealthCheck *HealthCheck
+	Resources
+	// Other are the settings without a field of their own by their names in the API, e.g. "dataVolumes",
+	// and those whose value doesn't fit their field.
+	Other map[string]interface{}
+	// set are the settings with a field of their own that were decoded.
+	set map[string]bool
+}
+
+// Resources are the resource limits and reservations of the containers of a launchConfig.
+type Resources struct {
+	// Memory is the memory limit in bytes.
+	Memory            int64
+	MemoryReservation int64
+	MemorySwap        int64
+	// CPUShares are the relative CPU shares.
+	CPUShares int64
+	// MilliCPUReservation is the CPU reservation in thousandths of a CPU.
+	MilliCPUReservation int64
+	CPUQuota            int64
+	CPUPeriod           int64
+	// CPUSet are the CPUs the containers may run on, e.g. "0-3".
+	CPUSet string
+}
+
+// HealthCheck is the healthCheck of a launchConfig. Times are in milliseconds.
+type HealthCheck struct {
+	Port                  int
+	RequestLine           string
+	Interval              int
+	ResponseTimeout       int
+	HealthyThreshold      int
+	UnhealthyThreshold    int
+	InitializingTimeout   int
+	ReinitializingTimeout int
+	// Strategy is what Rancher does with unhealthy containers, e.g. "recreate" or "none".
+	Strategy string
+	// Other are the settings without a field of their own by their names in the API.
+	Other map[string]interface{}
+	// set are the settings with a field of their own that were decoded.
+	set map[string]bool
+}
+
+// NewLaunchConfig returns the launchConfig of m, a launchConfig as the API has it.
+func NewLaunchConfig(m map[string]interface{}) LaunchConfig {
+	lc := LaunchConfig{}
+	// m only holds JSON values, so it always encodes, and a launchConfig decodes any JSON object.
+	b, _ := json.Marshal(m)
+	_ = json.Unmarshal(b, &lc)
+	return lc
+}
+
+// Map returns the launchConfig as the API has it, e.g. to compare or patch it.
+func (lc LaunchConfig) Map() map[string]interface{} {
+	m := map[string]interface{}{}
+	// Other only holds JSON values, so the launchConfig always encodes.
+	b, _ := json.Marshal(lc)
+	_ = json.Unmarshal(b, &m)
+	return m
+}
+
+// Copy returns a deep copy of the launchConfig, one that can be changed without changing lc.
+func (lc LaunchConfig) Copy() LaunchConfig {
+	return NewLaunchConfig(lc.Map())
+}
+
+// fields returns the fields of the launchConfig by their names in the API.
+func (lc *LaunchConfig) fields() map[string]interface{} {
+	return map[string]interface{}{
+		"imageUuid":           &lc.ImageUUID,
+		"environment":         &lc.Environment,
+		"labels":              &lc.Labels,
+		"ports":               &lc.Ports,
+		"healthCheck":         &lc.HealthCheck,
+		"memory":              &lc.Memory,
+		"memoryReservation":   &lc.MemoryReservation,
+		"memorySwap":          &lc.MemorySwap,
+		"cpuShares":           &lc.CPUShares,
+		"milliCpuReservation": &lc.MilliCPUReservation,
+		"cpuQuota":            &lc.CPUQuota,
+		"cpuPeriod":           &lc.CPUPeriod,
+		"cpuSet":              &lc.CPUSet,
+	}
+}
+
+// MarshalJSON implements json.Marshaler.
+func (lc LaunchConfig) MarshalJSON() ([]byte, error) {
+	return marshalObject(lc.fields(), lc.set, lc.Other)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (lc *LaunchConfig) UnmarshalJSON(data []byte) error {
+	*lc = LaunchConfig{}
+	var err error
+	lc.Other, lc.set, err = unmarshalObject(data, lc.fields())
+	return err
+}
+
+// fields returns the fields of the healthCheck by their names in the API.
+func (hc *HealthCheck) fields() map[string]interface{} {
+	return map[string]interface{}{
+		"port":                  &hc.Port,
+		"requestLine":           &hc.RequestLine,
+		"interval":              &hc.Interval,
+		"responseTimeout":       &hc.ResponseTimeout,
+		"healthyThreshold":      &hc.HealthyThreshold,
+		"unhealthyThreshold":    &hc.UnhealthyThreshold,
+		"initializingTimeout":   &hc.InitializingTimeout,
+		"reinitializingTimeout": &hc.ReinitializingTimeout,
+		"strategy":              &hc.Strategy,
+	}
+}
+
+// MarshalJSON implements json.Marshaler.
+func (hc HealthCheck) MarshalJSON() ([]byte, error) {
+	return marshalObject(hc.fields(), hc.set, hc.Other)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (hc *HealthCheck) UnmarshalJSON(data []byte) error {
+	*hc = HealthCheck{}
+	var err error
+	hc.Other, hc.set, err = unmarshalObject(data, hc.fields())
+	return err
+}
+
+// marshalObject encodes the fields that were set or aren't zero and other as one JSON object, so a zero
+// that was decoded is sent back. Fields take precedence over settings of other with the same name.
+func marshalObject(fields map[string]interface{}, set map[string]bool, other map[string]interface{}) ([]byte, error) {
+	obj := make(map[string]interface{}, len(fields)+len(other))
+	for k, v := range other {
+		obj[k] = v
+	}
+	for k, field := range fields {
+		if v := reflect.ValueOf(field).Elem(); set[k] || !v.IsZero() {
+			obj[k] = v.Interface()
+		}
+	}
+	return json.Marshal(obj)
+}
+
+// unmarshalObject decodes the JSON object data into fields, pointers by the names of their settings, and
+// returns the other settings of data, those without a field and those whose value doesn't fit theirs,
+// and the names of the fields it set.
+func unmarshalObject(data []byte, fields map[string]interface{}) (map[string]interface{}, map[string]bool, error) {
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, nil, err
+	}
+	var other map[string]interface{}
+	set := map[string]bool{}
+	for k, b := range raw {
+		if field, ok := fields[k]; ok {
+			v := reflect.New(reflect.TypeOf(field).Elem())
+			if json.Unmarshal(b, v.Interface()) == nil {
+				reflect.ValueOf(field).Elem().Set(v.Elem())
+				set[k] = true
+				continue
+			}
+		}
+		var v interface{}
+		if err := json.Unmarshal(b, &v); err != nil {
+			return nil, nil, err
+		}
+		if other == nil {
+			other = map[string]interface{}{}
+		}
+		other[k] = v
+	}
+	return other, set, nil
+}
@@ -0,0 +1,54 @@
+package rancher
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestLaunchConfigRoundTrip(t *testing.T) {
+	tests := []string{
+		`{"imageUuid": "docker:org/app:1.2.3", "memory": 536870912, "memorySwap": 0, "cpuSet": "", "dataVolumes": ["/data:/data"]}`,
+		`{"imageUuid": "docker:org/app:1.2.3", "environment": {}, "labels": {"a": "b"}, "ports": []}`,
+		`{"imageUuid": "docker:org/app:1.2.3", "healthCheck": {"port": 0, "requestLine": "", "interval": 2000, "strategy": "recreate", "recreateOnQuorumStrategyConfig": {"quorum": 1}}}`,
+		`{"imageUuid": "docker:org/app:1.2.3", "healthCheck": null}`,
+		`{"imageUuid": "docker:org/app:1.2.3", "memory": "512m"}`,
+	}
+	for _, test := range tests {
+		var expected map[string]interface{}
+		if err := json.Unmarshal([]byte(test), &expected); err != nil {
+			t.Fatal(err)
+		}
+		lc := NewLaunchConfig(expected)
+		if m := lc.Map(); !reflect.DeepEqual(m, expected) {
+			t.Errorf("%s: expected it back as it was, got %v", test, m)
+		}
+		if m := lc.Copy().Map(); !reflect.DeepEqual(m, expected) {
+			t.Errorf("%s: expected a copy to be the same, got %v", test, m)
+		}
+	}
+}
+
+func TestLaunchConfigEdits(t *testing.T) {
+	lc := NewLaunchConfig(map[string]interface{}{
+		"imageUuid":   "docker:org/app:1.2.3",
+		"memory":      float64(536870912),
+		"cpuSet":      "0-3",
+		"healthCheck": map[string]interface{}{"port": float64(8080), "strategy": "recreate"},
+	})
+	lc.ImageUUID = "docker:org/app:1.2.4"
+	lc.Memory = 0
+	lc.CPUSet = ""
+	lc.HealthCheck.Port = 0
+	lc.CPUShares = 512
+	expected := map[string]interface{}{
+		"imageUuid":   "docker:org/app:1.2.4",
+		"memory":      float64(0),
+		"cpuSet":      "",
+		"cpuShares":   float64(512),
+		"healthCheck": map[string]interface{}{"port": float64(0), "strategy": "recreate"},
+	}
+	if m := lc.Map(); !reflect.DeepEqual(m, expected) {
+		t.Errorf("expected %v, got %v", expected, m)
+	}
+}
@@ -1,30 +1,592 @@
 package rancher
 
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/plugins"
+)
+
 // Config is the struct for holding the env variables passed into the program.
 type Config struct {
-	RancherEnvID             string `required:"true" envconfig:"RANCHER_ENV_ID"`
-	RancherServiceID         string `required:"true" envconfig:"RANCHER_SERVICE_ID"`
+	RancherEnvID             string `default:"" envconfig:"RANCHER_ENV_ID"`
+	RancherServiceID         string `default:"" envconfig:"RANCHER_SERVICE_ID"`
 	BuildTag                 string `default:"latest" envconfig:"BUILD_TAG"`
-	RancherAccessKey         string `required:"true" envconfig:"RANCHER_ACCESS_KEY"`
-	RancherSecretKey         string `required:"true" envconfig:"RANCHER_SECRET_KEY"`
-	RancherURL               string `required:"true" envconfig:"RANCHER_URL"`
-	RancherAPIVersion        string `default:"v1" envconfig:"RANCHER_API_VERSION"`
+	RancherAccessKey         string `default:"" envconfig:"RANCHER_ACCESS_KEY"`
+	RancherSecretKey         string `default:"" envconfig:"RANCHER_SECRET_KEY"`
+	RancherURL               string `default:"" envconfig:"RANCHER_URL"`
+	RancherAPIVersion        string `default:"auto" envconfig:"RANCHER_API_VERSION"`
 	RancherStartServiceFirst bool   `default:"false" envconfig:"RANCHER_SERVICE_START_FIRST"`
-	RancherFinishUpgrade     bool   `default:"true" envconfig:"RANCHER_FINISH_UPGRADE"`
+	RancherFinishUpgrade     Finish `default:"true" envconfig:"RANCHER_FINISH_UPGRADE"`
+	// RunID identifies the run of the pipeline making the upgrade, e.g. $GITHUB_RUN_ID, and is recorded on
+	// the service with the upgrade. A retry of the run resumes the upgrade it started instead of failing as
+	// the service can't be upgraded while it is upgrading.
+	RunID string `default:"" envconfig:"RUN_ID"`
+	// Target is the service to upgrade by name, "<environment>/<stack>/<service>", instead of RancherEnvID
+	// and RancherServiceID.
+	Target string `default:"" envconfig:"TARGET"`
+	// Running in a container of the Rancher environment with an API key (CATTLE_URL, CATTLE_ACCESS_KEY and
+	// CATTLE_SECRET_KEY), the Rancher API and RancherEnvID are discovered from RancherMetadataURL, as is
+	// RancherServiceID from the service named RancherServiceName in RancherStackName (by default the
+	// stack of the container).
+	RancherMetadataURL string `default:"http://169.254.169.250/latest" envconfig:"RANCHER_METADATA_URL"`
+	RancherStackName   string `default:"" envconfig:"RANCHER_STACK_NAME"`
+	// Check that the API keys can act on the environments before anything else, telling account API keys
+	// from environment API keys when they can't.
+	CheckAPIKeys bool `default:"true" envconfig:"CHECK_API_KEYS"`
+	// Read the API keys from these files, e.g. mounted secrets, instead of RancherAccessKey and
+	// RancherSecretKey. They are read again whenever they change, so rotated keys are used without a restart.
+	RancherAccessKeyFile string `default:"" envconfig:"RANCHER_ACCESS_KEY_FILE"`
+	RancherSecretKeyFile string `default:"" envconfig:"RANCHER_SECRET_KEY_FILE"`
+	// Make at most RancherRateLimit requests a second to the Rancher API, in bursts of up to
+	// RancherRateBurst, across every upgrade of the process. 0 (the default) doesn't limit them.
+	RancherRateLimit float64 `default:"0" envconfig:"RANCHER_RATE_LIMIT"`
+	RancherRateBurst int     `default:"5" envconfig:"RANCHER_RATE_BURST"`
+	// RancherRecordFile records every exchange with the Rancher API to a fixture, sanitized of RancherURL,
+	// the API keys, environment variables and secrets, that RancherReplayFile answers the requests of a later
+	// run from instead of Rancher, e.g. to reproduce a bug report.
+	RancherRecordFile string `default:"" envconfig:"RANCHER_RECORD_FILE"`
+	RancherReplayFile string `default:"" envconfig:"RANCHER_REPLAY_FILE"`
+	// Credentials returns the API keys for each request instead of RancherAccessKey and RancherSecretKey
+	// when it is set.
+	Credentials Credentials `ignored:"true"`
+	// ObserveRequest, when set, is told of every request made to the Rancher API, e.g. for metrics.
+	ObserveRequest RequestObserver `ignored:"true"`
+	// ObserveRateLimit, when set, is told how long every request waited for RancherRateLimit.
+	ObserveRateLimit func(waited time.Duration) `ignored:"true"`
+	// Action is the command to run when none is given on the command line, e.g. "cancel".
+	Action string `default:"" envconfig:"ACTION"`
+	// Quiet leaves out the progress of every poll and prints a summary table of the upgrades at the end.
+	Quiet bool `default:"false" envconfig:"QUIET"`
+	// Output is the format of the results written to stdout: json, jenkins (json with Jenkins exit codes), or
+	// teamcity for TeamCity service messages.
+	Output string `default:"json" envconfig:"OUTPUT"`
+	// ResultsFile is written with the results of the upgrades as a CI artifact, Java properties when it ends
+	// in .properties and JSON otherwise. With OUTPUT=jenkins an upgrade that was rolled back cleanly exits
+	// with UnstableExitCode rather than 1, so the build can be marked unstable instead of failed.
+	ResultsFile      string `default:"" envconfig:"RESULTS_FILE"`
+	UnstableExitCode int    `default:"3" envconfig:"UNSTABLE_EXIT_CODE"`
+	// GitHubActions is set by GitHub Actions, which is sent workflow annotations and a Markdown job summary
+	// written to GitHubStepSummary.
+	GitHubActions     bool   `default:"false" envconfig:"GITHUB_ACTIONS"`
+	GitHubStepSummary string `default:"" envconfig:"GITHUB_STEP_SUMMARY"`
+	// BuildTagFile is a file whose trimmed contents are used as the BuildTag.
+	BuildTagFile string `default:"" envconfig:"BUILD_TAG_FILE"`
+	// Image replaces the whole image (repository and tag) instead of only the tag, e.g. "registry.example.com/org/app:1.2.3".
+	Image string `default:"" envconfig:"IMAGE"`
+	// ImageUUID replaces the whole Rancher imageUuid, e.g. "docker:org/app:1.2.3". Takes precedence over Image.
+	ImageUUID string `default:"" envconfig:"IMAGE_UUID"`
+	// TagRegex matches the part of the imageUuid that is replaced by TagTemplate when upgrading to BuildTag.
+	TagRegex string `default:":[a-z0-9]+$" envconfig:"TAG_REGEX"`
+	// TagTemplate renders the replacement for TagRegex, {{.BuildTag}} is the build tag and $1 etc. are submatches.
+	TagTemplate string `default:":{{.BuildTag}}" envconfig:"TAG_TEMPLATE"`
+	// ServiceTemplate is a Go template of the service (its scale and launchConfig) rendered with the build
+	// metadata and the values of ValuesFiles, later files taking precedence, e.g. one per environment.
+	ServiceTemplate string   `default:"" envconfig:"SERVICE_TEMPLATE"`
+	ValuesFiles     []string `envconfig:"VALUES_FILES"`
+	// EnvUpgradeImage upgrades every service in the environment running this image repository to BuildTag
+	// instead of RancherServiceID, except the services named or with the IDs in EnvUpgradeExclude.
+	// The services are only listed unless EnvUpgradeExecute is set.
+	EnvUpgradeImage   string   `default:"" envconfig:"ENV_UPGRADE_IMAGE"`
+	EnvUpgradeExclude []string `envconfig:"ENV_UPGRADE_EXCLUDE"`
+	EnvUpgradeExecute bool     `default:"false" envconfig:"ENV_UPGRADE_EXECUTE"`
+	// ServiceOverrides override the settings of the services of an environment upgrade they are set for, e.g.
+	// their BUILD_TAG or UPGRADE_TEST_CMD, or leave them out with SKIP. SERVICE_<name>_<setting> env variables,
+	// with the name of the service in upper case and other characters than letters and digits as _, take
+	// precedence.
+	ServiceOverrides ServiceOverrides `default:"" envconfig:"SERVICE_OVERRIDES"`
+	// RancherEnvIDs upgrades the service named RancherServiceName in each of these environments instead of
+	// RancherServiceID, EnvParallelism environments at a time, starting no more once one of them fails.
+	RancherEnvIDs      []string `envconfig:"RANCHER_ENV_IDS"`
+	RancherServiceName string   `default:"" envconfig:"RANCHER_SERVICE_NAME"`
+	EnvParallelism     int      `default:"1" envconfig:"ENV_PARALLELISM"`
+	// While PauseFile exists batched upgrades are held before their next batch: the next traffic shift
+	// step, service of an environment upgrade or environment of RancherEnvIDs. `rancher-upgrader pause`
+	// creates it, with why in it, and `rancher-upgrader resume` removes it. Paused, when set, holds them
+	// too while it returns true, e.g. for the daemon API.
+	PauseFile string      `default:"rancher-upgrader.pause" envconfig:"PAUSE_FILE"`
+	Paused    func() bool `ignored:"true"`
+	// While FreezeFile exists every upgrade is refused, with why it is in it, until the deploy freeze is
+	// lifted. `rancher-upgrader freeze` creates it and `rancher-upgrader unfreeze` removes it.
+	FreezeFile string `default:"rancher-upgrader.freeze" envconfig:"FREEZE_FILE"`
+	// SelfUpgrade is set when the service upgraded is the one the upgrader runs in. The upgrade is written to
+	// SelfUpgradeMarker, which must be on a volume the new container mounts too, before it is requested,
+	// and the new container completes it (verification, cutover and finish) when it starts.
+	SelfUpgrade       bool   `default:"false" envconfig:"SELF_UPGRADE"`
+	SelfUpgradeMarker string `default:"rancher-upgrader.self-upgrade" envconfig:"SELF_UPGRADE_MARKER"`
+	// NotifyWebhookURL is sent a JSON notification, which Slack and Mattermost incoming webhooks display, of
+	// every upgrade that ends with one of the NotifyStatuses.
+	NotifyWebhookURL string   `default:"" envconfig:"NOTIFY_WEBHOOK_URL"`
+	NotifyStatuses   []string `default:"held" envconfig:"NOTIFY_STATUSES"`
+	// Plugins are the notifiers, verifiers and approvers configured in the YAML PluginManifest, which run the
+	// executables of PluginDir for at most PluginTimeout seconds. They are loaded with the config.
+	PluginDir      string           `default:"plugins" envconfig:"PLUGIN_DIR"`
+	PluginManifest string           `default:"" envconfig:"PLUGIN_MANIFEST"`
+	PluginTimeout  int              `default:"300" envconfig:"PLUGIN_TIMEOUT"`
+	Plugins        []plugins.Plugin `ignored:"true"`
+	// Guardrails refuse an upgrade before it starts: of a service scaled to 0 with GuardScaleZero, to an
+	// image whose tag matches one of the GuardDeniedTags glob patterns, e.g. "latest" in production, to an
+	// older semantic version than the deployed one with GuardDowngrade, e.g. by a stale rerun of a CI job,
+	// while another service of its stack, but those named in GuardStackIgnore, isn't active and healthy or
+	// is being upgraded with GuardStackHealth, and of a service with alerts firing, which GuardAlertsURL is
+	// posted the upgrade and answers with. Force names the guardrails (scale-zero, denied-tag, downgrade,
+	// stack-health and active-alerts) an upgrade goes ahead despite, and AllowDowngrade forces downgrades.
+	GuardScaleZero   bool     `default:"false" envconfig:"GUARD_SCALE_ZERO"`
+	GuardDeniedTags  []string `envconfig:"GUARD_DENIED_TAGS"`
+	GuardDowngrade   bool     `default:"false" envconfig:"GUARD_DOWNGRADE"`
+	GuardStackHealth bool     `default:"false" envconfig:"GUARD_STACK_HEALTH"`
+	GuardStackIgnore []string `envconfig:"GUARD_STACK_IGNORE"`
+	GuardAlertsURL   string   `default:"" envconfig:"GUARD_ALERTS_URL"`
+	Force            []string `envconfig:"FORCE"`
+	AllowDowngrade   bool     `default:"false" envconfig:"ALLOW_DOWNGRADE"`
+	// PlanSigningKey is the HMAC key plan files are signed with by `plan` and checked with by `apply`.
+	PlanSigningKey string `default:"" envconfig:"PLAN_SIGNING_KEY"`
+	// The reconcile command upgrades the services whose image differs from the manifests under GitOpsPath
+	// in the GitOpsBranch of the Git repository GitOpsRepo, checked out to GitOpsDir, every GitOpsInterval seconds.
+	GitOpsRepo        string `default:"" envconfig:"GITOPS_REPO"`
+	GitOpsBranch      string `default:"master" envconfig:"GITOPS_BRANCH"`
+	GitOpsPath        string `default:"." envconfig:"GITOPS_PATH"`
+	GitOpsDir         string `default:"" envconfig:"GITOPS_DIR"`
+	GitOpsInterval    int    `default:"60" envconfig:"GITOPS_INTERVAL"`
+	GitOpsResultsFile string `default:"" envconfig:"GITOPS_RESULTS_FILE"`
+	// The serve command runs a daemon with an HTTP API on DaemonAddr that upgrades services and records every
+	// attempt in the HistoryDBDriver (sqlite3 or postgres) database HistoryDBDSN.
+	DaemonAddr      string `default:"127.0.0.1:8080" envconfig:"DAEMON_ADDR"`
+	HistoryDBDriver string `default:"sqlite3" envconfig:"HISTORY_DB_DRIVER"`
+	HistoryDBDSN    string `default:"rancher-upgrader.db" envconfig:"HISTORY_DB_DSN"`
+	// WebhookReceiversFile lists the Rancher webhook-service receivers the daemon accepts webhooks for, so
+	// they can be pointed at it instead of Rancher.
+	WebhookReceiversFile string `default:"" envconfig:"WEBHOOK_RECEIVERS_FILE"`
+	// LeaderElection elects one of the daemons sharing the history database to make the upgrades, holding
+	// a lease in the database for LeaderLeaseSeconds, while the others stand by.
+	LeaderElection     bool `default:"false" envconfig:"LEADER_ELECTION"`
+	LeaderLeaseSeconds int  `default:"15" envconfig:"LEADER_LEASE_SECONDS"`
+	// A stopped daemon stops taking upgrades and waits for at most DaemonDrainTimeout seconds for the
+	// upgrades it is making to end. Its /readyz fails while it is making ReadyMaxInFlight upgrades.
+	DaemonDrainTimeout int `default:"600" envconfig:"DAEMON_DRAIN_TIMEOUT"`
+	ReadyMaxInFlight   int `default:"0" envconfig:"READY_MAX_IN_FLIGHT"`
+	// The daemon makes the upgrades of each service one at a time, queueing the others: all of them in the
+	// order they were requested with DaemonQueueMode fifo, or only the latest with latest, which supersedes
+	// those still waiting. It upgrades at most DaemonConcurrency services at once, 0 for no limit.
+	DaemonQueueMode   QueueMode `default:"fifo" envconfig:"DAEMON_QUEUE_MODE"`
+	DaemonConcurrency int       `default:"0" envconfig:"DAEMON_CONCURRENCY"`
+	// Upgrade requests may only rotate secrets to the files in DaemonSecretsDir, named without a path,
+	// and not at all without it, so they can't read the daemon's other files.
+	DaemonSecretsDir string `default:"" envconfig:"DAEMON_SECRETS_DIR"`
+	// With DaemonRolesFile the daemon API needs a bearer token: the API token of one of the roles listed in
+	// it, or an ID token of the OIDC provider DaemonOIDCIssuer for DaemonOIDCAudience whose subject or
+	// groups, in the DaemonOIDCGroupsClaim claim, the roles name. The roles scope which environments and
+	// services each caller may upgrade.
+	DaemonRolesFile       string `default:"" envconfig:"DAEMON_ROLES_FILE"`
+	DaemonOIDCIssuer      string `default:"" envconfig:"DAEMON_OIDC_ISSUER"`
+	DaemonOIDCAudience    string `default:"" envconfig:"DAEMON_OIDC_AUDIENCE"`
+	DaemonOIDCGroupsClaim string `default:"groups" envconfig:"DAEMON_OIDC_GROUPS_CLAIM"`
 	// Cmd is a command that will be run and checked for exit status before moving onto the next stage of the upgrade.
 	Cmd string `default:"" envconfig:"UPGRADE_TEST_CMD"`
+	// CmdShell (sh, bash, cmd, powershell or pwsh) runs Cmd when set. Otherwise Cmd is split into the
+	// command and its arguments as the shell of the OS would and run without one.
+	CmdShell Shell `default:"" envconfig:"UPGRADE_TEST_SHELL"`
+	// Cmd runs in CmdDir (the working directory by default) with the variables of CmdEnvFile and then
+	// CmdEnv (KEY=VALUE) added to its environment, and as CmdUser (a name or uid[:gid]) when set.
+	CmdDir     string   `default:"" envconfig:"UPGRADE_TEST_DIR"`
+	CmdEnvFile string   `default:"" envconfig:"UPGRADE_TEST_ENV_FILE"`
+	CmdEnv     []string `envconfig:"UPGRADE_TEST_ENV"`
+	CmdUser    string   `default:"" envconfig:"UPGRADE_TEST_USER"`
+	// Cmd runs in a container of CmdImage instead when set, with CmdWorkspace (the working directory by
+	// default) mounted at the same path and CmdDockerArgs (space separated) added to `docker run`.
+	CmdImage      string `default:"" envconfig:"UPGRADE_TEST_IMAGE"`
+	CmdWorkspace  string `default:"" envconfig:"UPGRADE_TEST_WORKSPACE"`
+	CmdDockerArgs string `default:"" envconfig:"UPGRADE_TEST_DOCKER_ARGS"`
+	// With CmdResultsFormat (tap or junit) the results of the tests Cmd reports on its output, or in
+	// CmdResultsFile, decide whether verification passed rather than its exit status, passing with at
+	// most VerifyAllowedFailures failed tests, e.g. known flaky ones, or at least a VerifyPassRate percent
+	// pass rate.
+	CmdResultsFormat      ResultsFormat `default:"" envconfig:"UPGRADE_TEST_RESULTS_FORMAT"`
+	CmdResultsFile        string        `default:"" envconfig:"UPGRADE_TEST_RESULTS_FILE"`
+	VerifyAllowedFailures int           `default:"0" envconfig:"VERIFY_ALLOWED_FAILURES"`
+	VerifyPassRate        float64       `default:"100" envconfig:"VERIFY_PASS_RATE"`
+	// When Cmd fails the last CmdOutputTail bytes of its output are added to the results and notifications.
+	CmdOutputTail int `default:"4096" envconfig:"UPGRADE_TEST_OUTPUT_TAIL"`
+	// BatchCmd is run like Cmd after each batch of a batched upgrade, before the next, for at most
+	// BatchCmdTimeout seconds, e.g. a quick health probe. The upgrade halts when it fails, and
+	// OnVerifyFail is done with a service it halted between its container batches.
+	BatchCmd        string `default:"" envconfig:"BATCH_CMD"`
+	BatchCmdTimeout int    `default:"300" envconfig:"BATCH_CMD_TIMEOUT"`
 	// Wait for at least x seconds (3600 by default) before abandoning the upgrade and rolling back automatically.
 	UpgradeWaitTimeout int `default:"3600" envconfig:"UPGRADE_WAIT_TIMEOUT"`
 	// Wait for x seconds in between each status check when waiting for services to transition state.
 	CheckInterval int `default:"1" envconfig:"CHECK_INTERVAL"`
+	// Stop waiting once polling the service failed x times in a row (10 by default), 0 never stops.
+	MaxConsecutivePollErrors int `default:"10" envconfig:"MAX_CONSECUTIVE_POLL_ERRORS"`
+	// Poll the Rancher events of the service (failed processes, containers that could not be allocated or
+	// whose health checks fail) every x seconds during the upgrade, logging them and adding them to the
+	// error of a failed upgrade. 0 doesn't poll them.
+	RancherEventsInterval int `default:"5" envconfig:"RANCHER_EVENTS_INTERVAL"`
+	// The upgrade waits for the service state or healthState to reach one of WaitForStates, failing if
+	// it reaches one of WaitAbortStates first.
+	WaitForStates   []string `default:"upgraded" envconfig:"WAIT_FOR_STATES"`
+	WaitAbortStates []string `envconfig:"WAIT_ABORT_STATES"`
+	// OnTimeout is what is done when the upgrade doesn't reach WaitForStates and OnVerifyFail when it fails
+	// verification: cancel, rollback, leave-as-is, finish-anyway or hold. A held upgrade is left upgraded
+	// for a person to inspect and then finish or roll back, and exits with HeldExitCode.
+	OnTimeout    FailurePolicy `default:"cancel" envconfig:"ON_TIMEOUT"`
+	OnVerifyFail FailurePolicy `default:"rollback" envconfig:"ON_VERIFY_FAIL"`
+	HeldExitCode int           `default:"4" envconfig:"HELD_EXIT_CODE"`
+	// Once every request to the Rancher API failed, not connecting or with a 5xx status, for
+	// RancherBreakerSeconds, the upgrade stops with Rancher unreachable and OnRancherUnreachable is done
+	// with the service. Requests then fail right away but for one every 5 seconds until one succeeds.
+	// 0 never stops.
+	RancherBreakerSeconds int           `default:"120" envconfig:"RANCHER_BREAKER_SECONDS"`
+	OnRancherUnreachable  FailurePolicy `default:"leave-as-is" envconfig:"ON_RANCHER_UNREACHABLE"`
+	// A rollback that fails is retried RollbackRetries times, waiting RollbackRetryBackoff seconds before the
+	// first retry and twice as long before each one after it.
+	RollbackRetries      int `default:"3" envconfig:"ROLLBACK_RETRIES"`
+	RollbackRetryBackoff int `default:"5" envconfig:"ROLLBACK_RETRY_BACKOFF"`
+	// Give up on an upgrade that has been upgrading for x seconds, reporting why its containers are stuck. 0 disables it.
+	StuckUpgradeThreshold int `default:"0" envconfig:"STUCK_UPGRADE_THRESHOLD"`
+	// RequireHealthy waits for every new primary container to be running and healthy before running Cmd.
+	RequireHealthy bool `default:"false" envconfig:"REQUIRE_HEALTHY"`
+	// Wait for at most x seconds for the containers to become healthy before rolling back.
+	HealthyWaitTimeout int `default:"300" envconfig:"HEALTHY_WAIT_TIMEOUT"`
+	// Wait for at most x seconds for the containers started after a cancel or rollback to be running.
+	StartWaitTimeout int `default:"120" envconfig:"START_WAIT_TIMEOUT"`
+	// Don't finish the upgrade until the service has been upgraded for at least x seconds, so there is a
+	// window to roll back in while the old containers still exist.
+	MinSoakSeconds int `default:"0" envconfig:"MIN_SOAK_SECONDS"`
+	// A service with one of AutoscalerLabels ("<key>" or "<key>=<value>") is scaled by an external
+	// autoscaler, and AutoscalerGuard is what is done about it so the scale doesn't change under the
+	// batches of the upgrade: warn, pin (the default) scales the service back to the scale it had before
+	// the upgrade whenever it changes until the upgrade ends, or fail refuses to upgrade it. When pinning,
+	// AutoscalerPauseURL and AutoscalerResumeURL are posted the service as JSON before and after the
+	// upgrade, e.g. to pause the autoscaler.
+	AutoscalerLabels    []string        `envconfig:"AUTOSCALER_LABELS"`
+	AutoscalerGuard     AutoscalerGuard `default:"pin" envconfig:"AUTOSCALER_GUARD"`
+	AutoscalerPauseURL  string          `default:"" envconfig:"AUTOSCALER_PAUSE_URL"`
+	AutoscalerResumeURL string          `default:"" envconfig:"AUTOSCALER_RESUME_URL"`
+	// With RancherFinishUpgrade hold-open the verified upgrade is held open, checking that the service is
+	// healthy every HoldOpenCheckInterval seconds, until it is finished or rolled back through the HTTP API
+	// on HoldOpenAddr, which needs HoldOpenToken as a bearer token when set, or by SIGUSR1 (finish) or
+	// SIGUSR2 (roll back). OnTimeout is done once it was held open for HoldOpenTimeout seconds, 0 never.
+	HoldOpenAddr          string `default:"127.0.0.1:8090" envconfig:"HOLD_OPEN_ADDR"`
+	HoldOpenToken         string `default:"" envconfig:"HOLD_OPEN_TOKEN"`
+	HoldOpenCheckInterval int    `default:"30" envconfig:"HOLD_OPEN_CHECK_INTERVAL"`
+	HoldOpenTimeout       int    `default:"0" envconfig:"HOLD_OPEN_TIMEOUT"`
+	// LBServiceID is a load balancer in front of the service to wait for before finishing the upgrade.
+	LBServiceID string `default:"" envconfig:"LB_SERVICE_ID"`
+	// Wait for at most x seconds for the load balancer to route to the new containers before rolling back.
+	LBWaitTimeout int `default:"300" envconfig:"LB_WAIT_TIMEOUT"`
+	// The certificate command uploads CertFile, with its key CertKeyFile and chain CertChainFile, as the
+	// certificate CertName and points LBServiceID at it instead of CertReplaceID (its default certificate
+	// by default). The load balancer is pointed back at the old certificate unless CertVerifyAddrs
+	// ("host:port") serve the new one to CertVerifyServerName within LBWaitTimeout and Cmd passes.
+	CertFile             string   `default:"" envconfig:"CERT_FILE"`
+	CertKeyFile          string   `default:"" envconfig:"CERT_KEY_FILE"`
+	CertChainFile        string   `default:"" envconfig:"CERT_CHAIN_FILE"`
+	CertName             string   `default:"" envconfig:"CERT_NAME"`
+	CertReplaceID        string   `default:"" envconfig:"CERT_REPLACE_ID"`
+	CertVerifyAddrs      []string `envconfig:"CERT_VERIFY_ADDRS"`
+	CertVerifyServerName string   `default:"" envconfig:"CERT_VERIFY_SERVER_NAME"`
+	// VerifyHTTPURL is requested after the upgrade to verify it, {{.IP}} is replaced by each new container IP.
+	VerifyHTTPURL       string `default:"" envconfig:"VERIFY_HTTP_URL"`
+	VerifyHTTPStatus    int    `default:"200" envconfig:"VERIFY_HTTP_STATUS"`
+	VerifyHTTPBodyRegex string `default:"" envconfig:"VERIFY_HTTP_BODY_REGEX"`
+	VerifyHTTPRequests  int    `default:"10" envconfig:"VERIFY_HTTP_REQUESTS"`
+	// Percentage of the requests that must succeed.
+	VerifyHTTPThreshold int `default:"100" envconfig:"VERIFY_HTTP_THRESHOLD"`
+	// Wait for x milliseconds in between requests.
+	VerifyHTTPInterval int `default:"500" envconfig:"VERIFY_HTTP_INTERVAL"`
+	// VerifyTCPPorts must accept connections on every new container after the upgrade.
+	VerifyTCPPorts []int `envconfig:"VERIFY_TCP_PORTS"`
+	// Wait for at most x seconds for the ports to accept connections.
+	VerifyTCPTimeout int `default:"30" envconfig:"VERIFY_TCP_TIMEOUT"`
+	// VerifyGRPCPort is the port of the grpc.health.v1 health service that must report VerifyGRPCService as
+	// SERVING on every new container after the upgrade. An empty VerifyGRPCService checks the whole server.
+	VerifyGRPCPort    int    `default:"0" envconfig:"VERIFY_GRPC_PORT"`
+	VerifyGRPCService string `default:"" envconfig:"VERIFY_GRPC_SERVICE"`
+	// Wait for at most x seconds for the gRPC health check to pass.
+	VerifyGRPCTimeout int `default:"30" envconfig:"VERIFY_GRPC_TIMEOUT"`
+	// VerifyMetricsQueries are ";" separated "<query> <op> <number>" thresholds evaluated with
+	// VerifyMetricsProvider (prometheus, datadog or cloudwatch) over the last VerifyMetricsWindow seconds after the upgrade.
+	VerifyMetricsProvider string `default:"prometheus" envconfig:"VERIFY_METRICS_PROVIDER"`
+	VerifyMetricsQueries  string `default:"" envconfig:"VERIFY_METRICS_QUERIES"`
+	VerifyMetricsWindow   int    `default:"300" envconfig:"VERIFY_METRICS_WINDOW"`
+	// VerifyPrometheusQueries are VerifyMetricsQueries for the prometheus provider.
+	VerifyPrometheusURL     string `default:"" envconfig:"VERIFY_PROMETHEUS_URL"`
+	VerifyPrometheusQueries string `default:"" envconfig:"VERIFY_PROMETHEUS_QUERIES"`
+	DatadogSite             string `default:"datadoghq.com" envconfig:"DATADOG_SITE"`
+	DatadogAPIKey           string `default:"" envconfig:"DATADOG_API_KEY"`
+	DatadogAppKey           string `default:"" envconfig:"DATADOG_APP_KEY"`
+	// VerifyCloudWatchAlarms must stay in the OK state for VerifyCloudWatchSoak seconds after the upgrade.
+	VerifyCloudWatchAlarms []string `envconfig:"VERIFY_CLOUDWATCH_ALARMS"`
+	VerifyCloudWatchSoak   int      `default:"300" envconfig:"VERIFY_CLOUDWATCH_SOAK"`
+	// VerifyCloudWatchRegion is the region of the CloudWatch alarms and metrics, defaults to AWS_REGION.
+	VerifyCloudWatchRegion string `default:"" envconfig:"VERIFY_CLOUDWATCH_REGION"`
+	// Traffic of the load balancer LBServiceID is shifted from TrafficShiftFromServiceID to the upgraded
+	// service in TrafficShiftSteps percentages, verifying after each step.
+	TrafficShiftFromServiceID string `default:"" envconfig:"TRAFFIC_SHIFT_FROM_SERVICE_ID"`
+	TrafficShiftSteps         []int  `default:"10,50,100" envconfig:"TRAFFIC_SHIFT_STEPS"`
+	// DNSRecordName in Route53HostedZoneID is pointed at DNSRecordValue once the upgrade is verified,
+	// and restored if the upgrade is rolled back.
+	Route53HostedZoneID string `default:"" envconfig:"ROUTE53_HOSTED_ZONE_ID"`
+	DNSRecordName       string `default:"" envconfig:"DNS_RECORD_NAME"`
+	DNSRecordType       string `default:"CNAME" envconfig:"DNS_RECORD_TYPE"`
+	DNSRecordValue      string `default:"" envconfig:"DNS_RECORD_VALUE"`
+	DNSRecordTTL        int    `default:"60" envconfig:"DNS_RECORD_TTL"`
+	// ConsulServiceID is registered with the Consul agent at ConsulAddr once the upgrade is verified,
+	// and the previous registration restored if the upgrade is rolled back. Tags and Meta may be templates.
+	ConsulAddr           string    `default:"http://127.0.0.1:8500" envconfig:"CONSUL_ADDR"`
+	ConsulToken          string    `default:"" envconfig:"CONSUL_TOKEN"`
+	ConsulServiceID      string    `default:"" envconfig:"CONSUL_SERVICE_ID"`
+	ConsulServiceName    string    `default:"" envconfig:"CONSUL_SERVICE_NAME"`
+	ConsulServiceAddress string    `default:"" envconfig:"CONSUL_SERVICE_ADDRESS"`
+	ConsulServicePort    int       `default:"0" envconfig:"CONSUL_SERVICE_PORT"`
+	ConsulTags           []string  `envconfig:"CONSUL_TAGS"`
+	ConsulMeta           StringMap `envconfig:"CONSUL_META"`
+	ConsulDeregister     bool      `default:"false" envconfig:"CONSUL_DEREGISTER"`
+	// Through the Kong Admin API at KongAdminURL, once the upgrade is verified KongUpstream's targets are
+	// replaced with the new containers on KongTargetPort and KongRoute is switched to KongService.
+	// Both are restored if the upgrade is rolled back.
+	KongAdminURL     string `default:"" envconfig:"KONG_ADMIN_URL"`
+	KongAdminToken   string `default:"" envconfig:"KONG_ADMIN_TOKEN"`
+	KongUpstream     string `default:"" envconfig:"KONG_UPSTREAM"`
+	KongTargetPort   int    `default:"0" envconfig:"KONG_TARGET_PORT"`
+	KongTargetWeight int    `default:"100" envconfig:"KONG_TARGET_WEIGHT"`
+	KongRoute        string `default:"" envconfig:"KONG_ROUTE"`
+	KongService      string `default:"" envconfig:"KONG_SERVICE"`
+	// The deployed version and its metadata are written to KVPath in the KVBackend store (consul or etcd)
+	// at KVAddr after a successful upgrade.
+	KVPath    string `default:"" envconfig:"KV_PATH"`
+	KVBackend string `default:"consul" envconfig:"KV_BACKEND"`
+	KVAddr    string `default:"http://127.0.0.1:8500" envconfig:"KV_ADDR"`
+	KVToken   string `default:"" envconfig:"KV_TOKEN"`
+	// After x seconds of waiting double the check interval on each check, 0 (the default) never backs off.
+	CheckBackoffAfter int `default:"0" envconfig:"CHECK_BACKOFF_AFTER"`
+	// Never back off to more than x seconds in between status checks.
+	CheckIntervalMax int `default:"30" envconfig:"CHECK_INTERVAL_MAX"`
+	// Randomly vary each check interval by up to x percent.
+	CheckJitter int `default:"0" envconfig:"CHECK_JITTER"`
+	// Bound the entire run (upgrade, tests and finish) to x seconds, 0 means no overall deadline.
+	TotalDeadline int `default:"0" envconfig:"TOTAL_DEADLINE"`
+	// With TotalDeadline, bound the cancel or rollback of a failed upgrade to x seconds, which otherwise
+	// waits as long as the upgrade may.
+	SafeActionTimeout int `default:"300" envconfig:"SAFE_ACTION_TIMEOUT"`
+	// HealthCheck is a JSON object merged into the launchConfig healthCheck as part of the upgrade.
+	HealthCheck JSONObject `envconfig:"HEALTH_CHECK"`
+	// Resource limits for the upgraded containers, 0 leaves the current setting in place.
+	Memory              int64 `default:"0" envconfig:"MEMORY"`
+	MemoryReservation   int64 `default:"0" envconfig:"MEMORY_RESERVATION"`
+	CPUShares           int64 `default:"0" envconfig:"CPU_SHARES"`
+	MilliCPUReservation int64 `default:"0" envconfig:"MILLI_CPU_RESERVATION"`
+	// Ports replaces the published ports of the service, e.g. "8080:80/tcp,8443:443/tcp".
+	Ports []string `envconfig:"PORTS"`
+	// RotateSecrets creates a new secret for each "<name>=<file>", with the contents of the file, and points
+	// the secret reference of the service mounted as name at it as part of the upgrade, e.g.
+	// "db_password=/run/vault/db_password". The new secrets are removed when the upgrade is rolled back.
+	RotateSecrets []string `envconfig:"ROTATE_SECRETS"`
+	// DataVolumes replaces the volumes of the service, e.g. "myvolume:/data".
+	DataVolumes  []string `envconfig:"DATA_VOLUMES"`
+	VolumeDriver string   `default:"" envconfig:"VOLUME_DRIVER"`
+	// Environment and Labels are JSON objects of strings added to the launchConfig, Command replaces
+	// the container command. Their values are Go templates with .BuildTag, .GitSHA and .Date available.
+	Environment StringMap `envconfig:"ENVIRONMENT"`
+	Labels      StringMap `envconfig:"LABELS"`
+	Command     string    `default:"" envconfig:"COMMAND"`
+	// GitSHA is the commit being deployed, taken from GIT_COMMIT, GITHUB_SHA etc. when not set.
+	GitSHA string `default:"" envconfig:"GIT_SHA"`
+	// VerifyImageArch checks the registry before upgrading that the new image exists and can run on
+	// the architecture of every host the service is scheduled on.
+	VerifyImageArch  bool   `default:"false" envconfig:"VERIFY_IMAGE_ARCH"`
+	RegistryUsername string `default:"" envconfig:"REGISTRY_USERNAME"`
+	RegistryPassword string `default:"" envconfig:"REGISTRY_PASSWORD"`
+}
+
+// APIURL returns the URL of the version of the Rancher API in use, e.g. https://ops.example.com/rancher/v2-beta
+// for a Rancher behind a reverse proxy at https://ops.example.com/rancher.
+func (c Config) APIURL() string {
+	return strings.TrimSuffix(c.RancherURL, "/") + "/" + c.RancherAPIVersion
+}
+
+// APIVersionAuto is the RancherAPIVersion that has the version detected from the Rancher API.
+const APIVersionAuto = "auto"
+
+// Credentials returns the Rancher API keys to make a request with, so keys that expire or are rotated
+// can be replaced while running.
+type Credentials func() (accessKey, secretKey string, err error)
+
+// RequestObserver is told of a request to the Rancher API once it was answered with status, or failed
+// with err, after d.
+type RequestObserver func(method string, status int, err error, d time.Duration)
+
+// Finish is when an upgrade is finished once it has been verified: now (true), never (false) or
+// deferred until a later `finish`.
+type Finish string
+
+// The values of Finish.
+const (
+	FinishNow      Finish = "true"
+	FinishNever    Finish = "false"
+	FinishDeferred Finish = "deferred"
+	FinishHoldOpen Finish = "hold-open"
+)
+
+// Decode implements envconfig.Decoder.
+func (f *Finish) Decode(value string) error {
+	if value == string(FinishDeferred) || value == string(FinishHoldOpen) {
+		*f = Finish(value)
+		return nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("expected true, false, deferred or hold-open")
+	}
+	*f = FinishNever
+	if b {
+		*f = FinishNow
+	}
+	return nil
+}
+
+// FailurePolicy is what is done with the service when its upgrade fails.
+type FailurePolicy string
+
+// The values of FailurePolicy.
+const (
+	FailCancel       FailurePolicy = "cancel"
+	FailRollback     FailurePolicy = "rollback"
+	FailLeaveAsIs    FailurePolicy = "leave-as-is"
+	FailFinishAnyway FailurePolicy = "finish-anyway"
+	FailHold         FailurePolicy = "hold"
+)
+
+// Decode implements envconfig.Decoder.
+func (p *FailurePolicy) Decode(value string) error {
+	switch policy := FailurePolicy(value); policy {
+	case FailCancel, FailRollback, FailLeaveAsIs, FailFinishAnyway, FailHold:
+		*p = policy
+		return nil
+	}
+	return fmt.Errorf("expected cancel, rollback, leave-as-is, finish-anyway or hold")
+}
+
+// Shell is the shell UPGRADE_TEST_CMD is run with, none when empty.
+type Shell string
+
+// Decode implements envconfig.Decoder.
+func (s *Shell) Decode(value string) error {
+	switch value {
+	case "", "sh", "bash", "cmd", "powershell", "pwsh":
+		*s = Shell(value)
+		return nil
+	}
+	return fmt.Errorf("expected sh, bash, cmd, powershell or pwsh")
+}
+
+// AutoscalerGuard is what is done about an external autoscaler of the service during the upgrade.
+type AutoscalerGuard string
+
+// The values of AutoscalerGuard.
+const (
+	AutoscalerWarn AutoscalerGuard = "warn"
+	AutoscalerPin  AutoscalerGuard = "pin"
+	AutoscalerFail AutoscalerGuard = "fail"
+)
+
+// Decode implements envconfig.Decoder.
+func (g *AutoscalerGuard) Decode(value string) error {
+	switch guard := AutoscalerGuard(value); guard {
+	case AutoscalerWarn, AutoscalerPin, AutoscalerFail:
+		*g = guard
+		return nil
+	}
+	return fmt.Errorf("expected warn, pin or fail")
+}
+
+// ResultsFormat is the format the results of the tests of UPGRADE_TEST_CMD are read in, none when empty.
+type ResultsFormat string
+
+// The values of ResultsFormat.
+const (
+	ResultsTAP   ResultsFormat = "tap"
+	ResultsJUnit ResultsFormat = "junit"
+)
+
+// Decode implements envconfig.Decoder.
+func (f *ResultsFormat) Decode(value string) error {
+	switch format := ResultsFormat(value); format {
+	case "", ResultsTAP, ResultsJUnit:
+		*f = format
+		return nil
+	}
+	return fmt.Errorf("expected tap or junit")
+}
+
+// QueueMode is which of the upgrades requested of a service while it is being upgraded the daemon makes.
+type QueueMode string
+
+// The values of QueueMode.
+const (
+	QueueFIFO   QueueMode = "fifo"
+	QueueLatest QueueMode = "latest"
+)
+
+// Decode implements envconfig.Decoder.
+func (m *QueueMode) Decode(value string) error {
+	switch mode := QueueMode(value); mode {
+	case QueueFIFO, QueueLatest:
+		*m = mode
+		return nil
+	}
+	return fmt.Errorf("expected fifo or latest")
+}
+
+// JSONObject is a JSON object that can be decoded from an env variable.
+type JSONObject map[string]interface{}
+
+// Decode implements envconfig.Decoder.
+func (o *JSONObject) Decode(value string) error {
+	if value == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(value), o)
+}
+
+// StringMap is a JSON object of string values that can be decoded from an env variable.
+type StringMap map[string]string
+
+// Decode implements envconfig.Decoder.
+func (m *StringMap) Decode(value string) error {
+	if value == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(value), m)
+}
+
+// ServiceOverrides are the settings that differ for some services of an environment upgrade: JSON objects
+// of settings by their env variable names, by the names of the services.
+type ServiceOverrides map[string]map[string]interface{}
+
+// Decode implements envconfig.Decoder.
+func (o *ServiceOverrides) Decode(value string) error {
+	if value == "" {
+		return nil
+	}
+	// Numbers are kept as they were written, e.g. for BUILD_TAG: 20240101.
+	d := json.NewDecoder(strings.NewReader(value))
+	d.UseNumber()
+	return d.Decode(o)
 }
 
 // InServiceStrategy is the upgrade strategy that can be applied to upgrade a service
 type InServiceStrategy struct {
-	BatchSize      int                    `json:"batchSize"`
-	IntervalMillis int                    `json:"intervalMillis"`
-	LaunchConfig   map[string]interface{} `json:"launchConfig"`
-	StartFirst     bool                   `json:"startFirst"`
+	BatchSize      int          `json:"batchSize"`
+	IntervalMillis int          `json:"intervalMillis"`
+	LaunchConfig   LaunchConfig `json:"launchConfig"`
+	StartFirst     bool         `json:"startFirst"`
+	// PreviousLaunchConfig is the launchConfig of the service before the upgrade, which Rancher sets.
+	PreviousLaunchConfig *LaunchConfig `json:"previousLaunchConfig,omitempty"`
 }
 
 // Upgrade is the placeholder for the InServiceStrategy
@@ -34,20 +596,27 @@ type Upgrade struct {
 
 // Service is the full service definition complete with useful actions and links
 type Service struct {
-	Name         string                 `json:"name"`
-	State        string                 `json:"state"`
-	Actions      Actions                `json:"actions"`
-	Links        Links                  `json:"links"`
-	LaunchConfig map[string]interface{} `json:"launchConfig"`
-	Upgrade      Upgrade                `json:"upgrade"`
+	ID           string       `json:"id"`
+	Name         string       `json:"name"`
+	State        string       `json:"state"`
+	HealthState  string       `json:"healthState"`
+	Scale        int          `json:"scale"`
+	Actions      Actions      `json:"actions"`
+	Links        Links        `json:"links"`
+	LaunchConfig LaunchConfig `json:"launchConfig"`
+	Upgrade      Upgrade      `json:"upgrade"`
 }
 
 // Actions are the actions that can be performed on a resource.
 type Actions struct {
-	Upgrade  string `json:"upgrade"`
-	Restart  string `json:"restart"`
-	Start    string `json:"start"`
-	Rollback string `json:"rollback"`
+	Upgrade         string `json:"upgrade"`
+	FinishUpgrade   string `json:"finishupgrade"`
+	CancelUpgrade   string `json:"cancelupgrade"`
+	ContinueUpgrade string `json:"continueupgrade"`
+	CancelRollback  string `json:"cancelrollback"`
+	Restart         string `json:"restart"`
+	Start           string `json:"start"`
+	Rollback        string `json:"rollback"`
 }
 
 // Links are the urls that can give more information about a resource.
@@ -55,6 +624,52 @@ type Links struct {
 	Instances string `json:"instances"`
 }
 
+// LoadBalancer is a Rancher load balancer service.
+type LoadBalancer struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	State       string   `json:"state"`
+	HealthState string   `json:"healthState"`
+	LBConfig    LBConfig `json:"lbConfig"`
+}
+
+// LBConfig is the routing configuration of a load balancer.
+type LBConfig struct {
+	PortRules []PortRule `json:"portRules"`
+}
+
+// PortRule routes traffic from a source port, hostname and path to a target service.
+type PortRule struct {
+	SourcePort int    `json:"sourcePort"`
+	TargetPort int    `json:"targetPort"`
+	Protocol   string `json:"protocol"`
+	Hostname   string `json:"hostname"`
+	Path       string `json:"path"`
+	ServiceID  string `json:"serviceId"`
+}
+
+// Targets returns true if any of the load balancer rules routes to serviceID.
+func (lb LoadBalancer) Targets(serviceID string) bool {
+	for _, rule := range lb.LBConfig.PortRules {
+		if rule.ServiceID == serviceID {
+			return true
+		}
+	}
+	return false
+}
+
+// Host is a machine in the environment that containers are scheduled on.
+type Host struct {
+	ID       string            `json:"id"`
+	Hostname string            `json:"hostname"`
+	Labels   map[string]string `json:"labels"`
+}
+
+// Services is a holder for a list of services, such as the services in an environment.
+type Services struct {
+	Services []Service `json:"data"`
+}
+
 // Instances is a holder for the containers that are associated with a given service.
 type Instances struct {
 	Containers []Container `json:"data"`
@@ -62,8 +677,16 @@ type Instances struct {
 
 // Container is the container definition for an instance. Primarily so we can perform actions on it.
 type Container struct {
-	ID      string  `json:"id"`
-	Type    string  `json:"type"`
-	State   string  `json:"state"`
-	Actions Actions `json:"actions"`
+	ID                   string            `json:"id"`
+	Name                 string            `json:"name"`
+	Type                 string            `json:"type"`
+	State                string            `json:"state"`
+	HealthState          string            `json:"healthState"`
+	Transitioning        string            `json:"transitioning"`
+	TransitioningMessage string            `json:"transitioningMessage"`
+	HostID               string            `json:"hostId"`
+	PrimaryIPAddress     string            `json:"primaryIpAddress"`
+	ImageUUID            string            `json:"imageUuid"`
+	Labels               map[string]string `json:"labels"`
+	Actions              Actions           `json:"actions"`
 }
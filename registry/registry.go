@@ -0,0 +1,211 @@
+// Package registry queries Docker registries (Registry HTTP API V2) for image details
+// before an upgrade is attempted.
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// dockerHub is the registry images without a registry host are pulled from.
+const dockerHub = "registry-1.docker.io"
+
+// manifestTypes are the manifest media types we understand, manifest lists first.
+var manifestTypes = []string{
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+}
+
+// Client talks to Docker registries, authenticating with Username and Password when set.
+type Client struct {
+	HTTP     *http.Client
+	Username string
+	Password string
+}
+
+// manifest holds the fields we need from both manifest lists (Manifests) and image manifests (Config).
+type manifest struct {
+	MediaType string `json:"mediaType"`
+	Manifests []struct {
+		Platform struct {
+			Architecture string `json:"architecture"`
+			OS           string `json:"os"`
+		} `json:"platform"`
+	} `json:"manifests"`
+	Config struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+}
+
+// Architectures returns the CPU architectures image can run on, e.g. ["amd64", "arm64"].
+// image is a Docker image reference such as "org/app:1.2.3" or "registry.example.com/app@sha256:...".
+// It returns an error if the image does not exist.
+func (c *Client) Architectures(ctx context.Context, image string) ([]string, error) {
+	host, repo, ref := parseReference(image)
+	m := manifest{}
+	err := c.get(ctx, fmt.Sprintf("https://%s/v2/%s/manifests/%s", host, repo, ref), strings.Join(manifestTypes, ", "), &m)
+	if err != nil {
+		return nil, fmt.Errorf("could not get manifest for %s: %s", image, err)
+	}
+	if len(m.Manifests) > 0 {
+		var archs []string
+		for _, platform := range m.Manifests {
+			// Attestations and other non-image entries have an unknown platform.
+			if platform.Platform.Architecture != "" && platform.Platform.Architecture != "unknown" {
+				archs = append(archs, platform.Platform.Architecture)
+			}
+		}
+		return archs, nil
+	}
+	// A single image manifest only records its architecture in the image config.
+	config := struct {
+		Architecture string `json:"architecture"`
+	}{}
+	err = c.get(ctx, fmt.Sprintf("https://%s/v2/%s/blobs/%s", host, repo, m.Config.Digest), "", &config)
+	if err != nil {
+		return nil, fmt.Errorf("could not get image config for %s: %s", image, err)
+	}
+	return []string{config.Architecture}, nil
+}
+
+// get GETs url, authenticating if the registry asks us to, and decodes the JSON response into v.
+func (c *Client) get(ctx context.Context, url, accept string, v interface{}) error {
+	res, err := c.do(ctx, url, accept, "")
+	if err != nil {
+		return err
+	}
+	if res.StatusCode == http.StatusUnauthorized {
+		challenge := res.Header.Get("Www-Authenticate")
+		res.Body.Close()
+		auth, err := c.authorization(ctx, challenge)
+		if err != nil {
+			return err
+		}
+		res, err = c.do(ctx, url, accept, auth)
+		if err != nil {
+			return err
+		}
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("%s: %s", res.Status, body)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func (c *Client) do(ctx context.Context, url, accept, auth string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	return c.HTTP.Do(req.WithContext(ctx))
+}
+
+// authorization answers a WWW-Authenticate challenge with an Authorization header value,
+// fetching a bearer token from the registry's token service when required.
+func (c *Client) authorization(ctx context.Context, challenge string) (string, error) {
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if c.Username == "" {
+			return "", errors.New("registry requires credentials")
+		}
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth(c.Username, c.Password)
+		return req.Header.Get("Authorization"), nil
+	case "bearer":
+		q := url.Values{}
+		if params["service"] != "" {
+			q.Set("service", params["service"])
+		}
+		if params["scope"] != "" {
+			q.Set("scope", params["scope"])
+		}
+		req, err := http.NewRequest(http.MethodGet, params["realm"]+"?"+q.Encode(), nil)
+		if err != nil {
+			return "", err
+		}
+		if c.Username != "" {
+			req.SetBasicAuth(c.Username, c.Password)
+		}
+		res, err := c.HTTP.Do(req.WithContext(ctx))
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("registry token request failed: %s", res.Status)
+		}
+		token := struct {
+			Token       string `json:"token"`
+			AccessToken string `json:"access_token"`
+		}{}
+		if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+			return "", err
+		}
+		if token.Token == "" {
+			token.Token = token.AccessToken
+		}
+		return "Bearer " + token.Token, nil
+	}
+	return "", fmt.Errorf("unsupported registry authentication: %s", challenge)
+}
+
+// parseChallenge splits a WWW-Authenticate header such as
+// `Bearer realm="https://auth.docker.io/token",service="registry.docker.io"` into its parts.
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := map[string]string{}
+	parts := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	if len(parts) < 2 {
+		return parts[0], params
+	}
+	for _, param := range strings.Split(parts[1], ",") {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) == 2 {
+			params[strings.ToLower(kv[0])] = strings.Trim(kv[1], `"`)
+		}
+	}
+	return parts[0], params
+}
+
+// Host returns the host of the registry image is pulled from, e.g. registry-1.docker.io for Docker Hub.
+func Host(image string) string {
+	host, _, _ := parseReference(image)
+	return host
+}
+
+// parseReference splits an image reference into the registry host, repository and tag or digest.
+func parseReference(image string) (host, repo, ref string) {
+	host = dockerHub
+	if i := strings.Index(image, "/"); i >= 0 {
+		first := image[:i]
+		if strings.ContainsAny(first, ".:") || first == "localhost" {
+			host, image = first, image[i+1:]
+		}
+	}
+	ref = "latest"
+	if i := strings.Index(image, "@"); i >= 0 {
+		image, ref = image[:i], image[i+1:]
+	} else if i := strings.LastIndex(image, ":"); i >= 0 {
+		image, ref = image[:i], image[i+1:]
+	}
+	if host == dockerHub && !strings.Contains(image, "/") {
+		image = "library/" + image
+	}
+	return host, image, ref
+}
@@ -0,0 +1,47 @@
+package upgrader
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+)
+
+// AutoscalerLabels returns the labels of the launchConfig of svc matching selectors, "<key>" or
+// "<key>=<value>", as "<key>=<value>". Services with one are scaled by an external autoscaler.
+func AutoscalerLabels(svc *rancher.Service, selectors []string) []string {
+	var matched []string
+	for _, selector := range selectors {
+		parts := strings.SplitN(selector, "=", 2)
+		value, ok := svc.LaunchConfig.Labels[parts[0]]
+		if !ok {
+			continue
+		}
+		if len(parts) == 1 || value == parts[1] {
+			matched = append(matched, parts[0]+"="+value)
+		}
+	}
+	return matched
+}
+
+// PinScale scales the service serviceID back to scale when it was scaled to something else, without
+// waiting for it to settle as it may be upgrading, and returns the scale it found.
+func (r *rancherUpgrader) PinScale(ctx context.Context, serviceID string, scale int) (int, error) {
+	svcURL, err := r.resourceURL(ctx, "services", serviceID)
+	if err != nil {
+		return 0, err
+	}
+	svc := rancher.Service{}
+	if err := r.getJSON(ctx, svcURL, &svc); err != nil {
+		return 0, err
+	}
+	if svc.Scale == scale {
+		return scale, nil
+	}
+	log.Printf("Service %s was scaled to %d during the upgrade, scaling it back to %d\n", svc.Name, svc.Scale, scale)
+	if err := r.putJSON(ctx, svcURL, map[string]int{"scale": scale}); err != nil {
+		return svc.Scale, err
+	}
+	return svc.Scale, nil
+}
@@ -0,0 +1,201 @@
+package upgrader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// statusBatch is the services of an environment being waited on at once, e.g. by the upgrades of a
+// daemon, which are polled with one listing of them rather than a GET of each, so the load on Rancher
+// grows with the polls and not with the polls times the services.
+type statusBatch struct {
+	mu sync.Mutex
+	// waiting are the services being waited on and how many times, with the stacks they are in once known.
+	waiting map[string]int
+	stacks  map[string]string
+	// bodies are the services as they were last listed, at fetched.
+	bodies  map[string][]byte
+	fetched time.Time
+	// fetching is closed once the listing in flight is done.
+	fetching chan struct{}
+}
+
+// statusBatches are the batches of the environments services are being waited on in, by the URL of the
+// environment and the API key.
+var (
+	statusBatchesMu sync.Mutex
+	statusBatches   = map[string]*statusBatch{}
+)
+
+// waitingOn adds the service of the upgrader to the batch of its environment until the returned func
+// is called.
+func (r *rancherUpgrader) waitingOn() func() {
+	key := r.projectURL + " " + r.cfg.RancherAccessKey
+	id := r.cfg.RancherServiceID
+	statusBatchesMu.Lock()
+	b := statusBatches[key]
+	if b == nil {
+		b = &statusBatch{waiting: map[string]int{}, stacks: map[string]string{}}
+		statusBatches[key] = b
+	}
+	b.mu.Lock()
+	b.waiting[id]++
+	b.mu.Unlock()
+	statusBatchesMu.Unlock()
+
+	return func() {
+		statusBatchesMu.Lock()
+		defer statusBatchesMu.Unlock()
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.waiting[id]--; b.waiting[id] == 0 {
+			delete(b.waiting, id)
+			delete(b.stacks, id)
+		}
+		if len(b.waiting) == 0 {
+			delete(statusBatches, key)
+		}
+	}
+}
+
+// batch returns the batch of the environment of the upgrader if other services of it are being waited
+// on too, and nil when the service is better fetched on its own.
+func (r *rancherUpgrader) batch() *statusBatch {
+	statusBatchesMu.Lock()
+	defer statusBatchesMu.Unlock()
+	b := statusBatches[r.projectURL+" "+r.cfg.RancherAccessKey]
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.waiting) < 2 {
+		return nil
+	}
+	return b
+}
+
+// pollService returns the JSON of the service and whether it changed since it was last fetched, from
+// a listing of the services of the environment being waited on when there are others, and from a
+// conditional request for it otherwise.
+func (r *rancherUpgrader) pollService(ctx context.Context) ([]byte, bool, error) {
+	b := r.batch()
+	if b == nil {
+		return r.serviceBody(ctx, 0)
+	}
+	// Listings up to half a poll old are fresh enough, so one serves every service polled meanwhile.
+	body, err := b.body(ctx, r, time.Duration(r.cfg.CheckInterval)*time.Second/2)
+	if err != nil {
+		return nil, false, err
+	}
+	if body == nil {
+		// It wasn't listed, e.g. it moved to another stack while being waited on.
+		return r.serviceBody(ctx, 0)
+	}
+	r.mu.Lock()
+	previous := r.service.body
+	r.mu.Unlock()
+	r.remember(serviceCache{body: body, fetched: time.Now()})
+	return body, !bytes.Equal(body, previous), nil
+}
+
+// body returns the JSON of the service of r as it was listed at most maxAge ago, listing the services
+// being waited on again if it wasn't, or nil if the service isn't in the listing.
+func (b *statusBatch) body(ctx context.Context, r *rancherUpgrader, maxAge time.Duration) ([]byte, error) {
+	id := r.cfg.RancherServiceID
+	for {
+		b.mu.Lock()
+		if b.bodies != nil && time.Since(b.fetched) < maxAge {
+			body := b.bodies[id]
+			b.mu.Unlock()
+			return body, nil
+		}
+		if fetching := b.fetching; fetching != nil {
+			b.mu.Unlock()
+			select {
+			case <-fetching:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		fetching := make(chan struct{})
+		b.fetching = fetching
+		filter := b.filter(r.cfg.RancherAPIVersion)
+		b.mu.Unlock()
+
+		bodies, stacks, err := r.listServices(ctx, filter)
+		b.mu.Lock()
+		b.fetching = nil
+		close(fetching)
+		if err == nil {
+			b.bodies, b.fetched = bodies, time.Now()
+			for id := range b.waiting {
+				if stack, ok := stacks[id]; ok {
+					b.stacks[id] = stack
+				}
+			}
+		}
+		b.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// filter returns the filter of the listing of the services being waited on: the stack they are in
+// when it is the same one, or every service of the environment otherwise. It is called with b.mu held.
+func (b *statusBatch) filter(apiVersion string) url.Values {
+	filter := url.Values{"limit": {"-1"}}
+	stack := ""
+	for id := range b.waiting {
+		s := b.stacks[id]
+		if s == "" || (stack != "" && s != stack) {
+			return filter
+		}
+		stack = s
+	}
+	// Stacks were called environments before v2-beta of the API.
+	if apiVersion == "v1" {
+		filter.Set("environmentId", stack)
+	} else {
+		filter.Set("stackId", stack)
+	}
+	return filter
+}
+
+// listServices returns the JSON of each service of the environment matching filter and the stack each
+// is in, by their IDs.
+func (r *rancherUpgrader) listServices(ctx context.Context, filter url.Values) (map[string][]byte, map[string]string, error) {
+	servicesURL, err := r.collectionURL(ctx, "services")
+	if err != nil {
+		return nil, nil, err
+	}
+	var services struct {
+		Data []json.RawMessage `json:"data"`
+	}
+	if err := r.getJSON(ctx, servicesURL+"?"+filter.Encode(), &services); err != nil {
+		return nil, nil, err
+	}
+	bodies, stacks := map[string][]byte{}, map[string]string{}
+	for _, raw := range services.Data {
+		var svc struct {
+			ID            string `json:"id"`
+			StackID       string `json:"stackId"`
+			EnvironmentID string `json:"environmentId"`
+		}
+		if err := json.Unmarshal(raw, &svc); err != nil {
+			return nil, nil, err
+		}
+		bodies[svc.ID] = raw
+		stacks[svc.ID] = svc.StackID
+		if svc.EnvironmentID != "" {
+			stacks[svc.ID] = svc.EnvironmentID
+		}
+	}
+	return bodies, stacks, nil
+}
@@ -0,0 +1,109 @@
+package upgrader
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// breakerProbeInterval is how often a request is let through to a Rancher server the breaker tripped
+// for, to find out whether it is back.
+const breakerProbeInterval = 5 * time.Second
+
+// UnreachableError is the error of requests to a Rancher server that failed continuously, not
+// connecting or answering with a 5xx status, for RANCHER_BREAKER_SECONDS.
+type UnreachableError struct {
+	Since time.Time
+	// Last is why the last request failed.
+	Last error
+}
+
+func (e *UnreachableError) Error() string {
+	return fmt.Sprintf("Rancher unreachable: every request failed for %s, the last with %s",
+		time.Since(e.Since).Round(time.Second), e.Last)
+}
+
+// breaker is the circuit breaker of a Rancher server. Once every request failed for the period of the
+// breaker it trips: requests fail right away with an UnreachableError rather than each waiting to fail,
+// but for one every breakerProbeInterval, until one succeeds.
+type breaker struct {
+	mu sync.Mutex
+	// failingSince is when the requests started failing, zero when the last one succeeded, and last
+	// why the last one failed.
+	failingSince time.Time
+	last         error
+	// probed is when a request was last let through while tripped.
+	probed time.Time
+}
+
+// breakers are the breakers of the Rancher servers requests are made to, by the URL of their API,
+// shared by every upgrade of the process.
+var (
+	breakersMu sync.Mutex
+	breakers   = map[string]*breaker{}
+)
+
+// breaker returns the breaker of the Rancher server of the upgrader, nil when it is disabled.
+func (r *rancherUpgrader) breaker() *breaker {
+	if r.cfg.RancherBreakerSeconds <= 0 {
+		return nil
+	}
+	key := r.cfg.APIURL()
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	b := breakers[key]
+	if b == nil {
+		b = &breaker{}
+		breakers[key] = b
+	}
+	return b
+}
+
+// tripped returns the error requests fail with when the breaker tripped after failing for period,
+// nil otherwise. It is called with b.mu held.
+func (b *breaker) tripped(period time.Duration) *UnreachableError {
+	if b.failingSince.IsZero() || time.Since(b.failingSince) < period {
+		return nil
+	}
+	return &UnreachableError{Since: b.failingSince, Last: b.last}
+}
+
+// allow returns an UnreachableError when a request can't be made as the breaker tripped.
+func (b *breaker) allow(period time.Duration) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	err := b.tripped(period)
+	if err == nil {
+		return nil
+	}
+	if time.Since(b.probed) < breakerProbeInterval {
+		return err
+	}
+	b.probed = time.Now()
+	return nil
+}
+
+// record records the result of a request, answered with res or failed with err, and returns an
+// UnreachableError when the breaker tripped.
+func (b *breaker) record(period time.Duration, res *http.Response, err error) error {
+	if err == nil && res.StatusCode < http.StatusInternalServerError {
+		b.mu.Lock()
+		b.failingSince = time.Time{}
+		b.mu.Unlock()
+		return nil
+	}
+	if err == nil {
+		err = fmt.Errorf("%s %s: %s", res.Request.Method, res.Request.URL, res.Status)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failingSince.IsZero() {
+		b.failingSince = time.Now()
+	}
+	b.last = err
+	if tripped := b.tripped(period); tripped != nil {
+		return tripped
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package upgrader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// serviceTTL is how long the service as it was fetched is used as it is, so reading it again right
+// away, e.g. to check it can be upgraded and then to upgrade it, doesn't fetch it again.
+const serviceTTL = time.Second
+
+// serviceCache is the service as it was last fetched, kept to answer back-to-back reads and to make
+// conditional requests for it while polling.
+type serviceCache struct {
+	body    []byte
+	etag    string
+	fetched time.Time
+}
+
+// serviceBody returns the JSON of the service, fetching it again unless it was fetched within maxAge,
+// and whether it changed since it was last fetched. The service is only sent again by Rancher when its
+// ETag changed, and otherwise unchanged responses are told apart from changed ones by their bodies.
+func (r *rancherUpgrader) serviceBody(ctx context.Context, maxAge time.Duration) ([]byte, bool, error) {
+	svcURL, err := r.serviceURL(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	r.mu.Lock()
+	cached := r.service
+	r.mu.Unlock()
+	if cached.body != nil && time.Since(cached.fetched) < maxAge {
+		return cached.body, false, nil
+	}
+	req, err := r.newRequest(ctx, http.MethodGet, svcURL, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if cached.etag != "" {
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+	res, err := r.do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotModified && cached.body != nil {
+		cached.fetched = time.Now()
+		r.remember(cached)
+		return cached.body, false, nil
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	if res.StatusCode >= http.StatusBadRequest {
+		return nil, false, fmt.Errorf("GET %s: %s: %s", svcURL, res.Status, body)
+	}
+	r.remember(serviceCache{body: body, etag: res.Header.Get("ETag"), fetched: time.Now()})
+	return body, !bytes.Equal(body, cached.body), nil
+}
+
+// remember keeps the service as it was fetched.
+func (r *rancherUpgrader) remember(s serviceCache) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.service = s
+}
+
+// forgetService drops the service as it was fetched, as a change was made that can change it.
+func (r *rancherUpgrader) forgetService() {
+	r.remember(serviceCache{})
+}
@@ -0,0 +1,83 @@
+package upgrader
+
+import (
+	"context"
+	"log"
+)
+
+// CreateCertificate uploads the PEM certificate cert, its key and its chain of intermediate
+// certificates, which may be empty, as a certificate of the environment named name and returns its ID.
+func (r *rancherUpgrader) CreateCertificate(ctx context.Context, name, cert, key, chain string) (string, error) {
+	certificate := map[string]string{"name": name, "cert": cert, "key": key}
+	if chain != "" {
+		certificate["certChain"] = chain
+	}
+	id, err := r.create(ctx, "certificates", certificate)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Created certificate %s (%s)\n", name, id)
+	return id, nil
+}
+
+// RemoveCertificate removes the certificate id of the environment.
+func (r *rancherUpgrader) RemoveCertificate(ctx context.Context, id string) error {
+	if err := r.remove(ctx, "certificates", id); err != nil {
+		return err
+	}
+	log.Printf("Removed certificate %s\n", id)
+	return nil
+}
+
+// lbCertificates are the certificates a load balancer serves: the default one and the others, picked by SNI.
+// Load balancers have them in their lbConfig, and those of v1 of the API on the service itself.
+type lbCertificates struct {
+	DefaultCertificateID string   `json:"defaultCertificateId,omitempty"`
+	CertificateIDs       []string `json:"certificateIds,omitempty"`
+}
+
+// LoadBalancerCertificates returns the ID of the default certificate of the load balancer service
+// lbServiceID and the IDs of its other certificates.
+func (r *rancherUpgrader) LoadBalancerCertificates(ctx context.Context, lbServiceID string) (string, []string, error) {
+	lbURL, err := r.resourceURL(ctx, "loadBalancerServices", lbServiceID)
+	if err != nil {
+		return "", nil, err
+	}
+	lb := struct {
+		lbCertificates
+		LBConfig *lbCertificates `json:"lbConfig"`
+	}{}
+	if err := r.getJSON(ctx, lbURL, &lb); err != nil {
+		return "", nil, err
+	}
+	if lb.LBConfig != nil {
+		return lb.LBConfig.DefaultCertificateID, lb.LBConfig.CertificateIDs, nil
+	}
+	return lb.DefaultCertificateID, lb.CertificateIDs, nil
+}
+
+// SetLoadBalancerCertificates replaces the certificates of the load balancer service lbServiceID and
+// blocks until it is active again.
+func (r *rancherUpgrader) SetLoadBalancerCertificates(ctx context.Context, lbServiceID, defaultID string, ids []string) error {
+	lbURL, err := r.resourceURL(ctx, "loadBalancerServices", lbServiceID)
+	if err != nil {
+		return err
+	}
+	lb := map[string]interface{}{}
+	if err := r.getJSON(ctx, lbURL, &lb); err != nil {
+		return err
+	}
+	if ids == nil {
+		ids = []string{}
+	}
+	log.Printf("Pointing load balancer %s at certificate %s and %v\n", lbServiceID, defaultID, ids)
+	update := map[string]interface{}{"defaultCertificateId": defaultID, "certificateIds": ids}
+	if lbConfig, ok := lb["lbConfig"].(map[string]interface{}); ok {
+		lbConfig["defaultCertificateId"], lbConfig["certificateIds"] = defaultID, ids
+		update = map[string]interface{}{"lbConfig": lbConfig}
+	}
+	if err := r.putJSON(ctx, lbURL, update); err != nil {
+		return err
+	}
+	return r.waitForServiceSettled(ctx, lbURL)
+}
@@ -0,0 +1,62 @@
+package upgrader
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+)
+
+// ServiceRef is a service of Rancher, by the ID of its environment and its own.
+type ServiceRef struct {
+	EnvID     string
+	ServiceID string
+}
+
+// Client upgrades any service of a Rancher server with one configuration, e.g. for a program making
+// many upgrades at once. It is safe to use from several goroutines: the upgraders it returns each keep
+// the state of their own service, and share the links of their environments, the rate limit and the
+// breaker of the server.
+type Client struct {
+	client *http.Client
+	cfg    rancher.Config
+
+	mu    sync.Mutex
+	links map[string]*projectLinks
+}
+
+// NewClient returns a Client of the Rancher server of cfg. The environment and service of cfg are
+// ignored, each call names its own.
+func NewClient(c *http.Client, cfg rancher.Config) *Client {
+	return &Client{client: c, cfg: cfg, links: map[string]*projectLinks{}}
+}
+
+// Service returns the upgrader of the service ref.
+func (c *Client) Service(ref ServiceRef) Upgrader {
+	cfg := c.cfg
+	cfg.RancherEnvID, cfg.RancherServiceID = ref.EnvID, ref.ServiceID
+	c.mu.Lock()
+	links := c.links[ref.EnvID]
+	if links == nil {
+		links = &projectLinks{}
+		c.links[ref.EnvID] = links
+	}
+	c.mu.Unlock()
+	return newUpgrader(c.client, cfg, links)
+}
+
+// UpgradeService kicks off the upgrade of the service ref with options, see Upgrader.Upgrade.
+func (c *Client) UpgradeService(ctx context.Context, ref ServiceRef, options ...Option) error {
+	return c.Service(ref).Upgrade(ctx, options...)
+}
+
+// FinishService finishes the upgrade of the service ref, see Upgrader.FinishUpgrade.
+func (c *Client) FinishService(ctx context.Context, ref ServiceRef) (*rancher.Service, error) {
+	return c.Service(ref).FinishUpgrade(ctx)
+}
+
+// RollbackService rolls the service ref back, see Upgrader.Rollback.
+func (c *Client) RollbackService(ctx context.Context, ref ServiceRef) error {
+	return c.Service(ref).Rollback(ctx)
+}
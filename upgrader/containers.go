@@ -0,0 +1,230 @@
+package upgrader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+)
+
+// stuckError describes why the containers of a service stuck upgrading for d aren't progressing.
+func (r *rancherUpgrader) stuckError(ctx context.Context, svc *rancher.Service, d time.Duration) error {
+	d = d.Round(time.Second)
+	instances := rancher.Instances{}
+	if err := r.getJSON(ctx, svc.Links.Instances, &instances); err != nil {
+		return fmt.Errorf("%s stuck upgrading for %s, could not get its containers: %s", svc.Name, d, err)
+	}
+	return fmt.Errorf("%s stuck upgrading for %s:\n%s", svc.Name, d, containerReport(instances.Containers))
+}
+
+// containerReport describes the state of each container on its own line.
+func containerReport(containers []rancher.Container) string {
+	lines := make([]string, 0, len(containers))
+	for _, c := range containers {
+		name := c.ID
+		if c.Name != "" {
+			name = fmt.Sprintf("%s (%s)", c.Name, c.ID)
+		}
+		line := fmt.Sprintf("  %s %s: %s", c.Type, name, c.State)
+		if c.HealthState != "" {
+			line += ", " + c.HealthState
+		}
+		if c.TransitioningMessage != "" {
+			line += ": " + c.TransitioningMessage
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// primaryLaunchConfigLabel marks containers created from the primary launchConfig rather than a sidekick.
+const primaryLaunchConfigLabel = "io.rancher.service.primary.launch.config"
+
+// WaitForHealthy blocks until every primary container running the service's current image is running
+// and healthy, for at most timeout. Containers without a health check only need to be running.
+func (r *rancherUpgrader) WaitForHealthy(ctx context.Context, timeout time.Duration) error {
+	svc, err := r.GetServiceConfig(ctx)
+	if err != nil {
+		return err
+	}
+	image := svc.LaunchConfig.ImageUUID
+	log.Printf("Waiting for the %s containers of %s to be healthy\n", image, svc.Name)
+	containers, err := r.waitForInstances(ctx, svc, timeout, AllHealthy(image))
+	if err != nil {
+		return fmt.Errorf("%s containers not healthy: %s\n%s", svc.Name, err, containerReport(containers))
+	}
+	log.Printf("All %s containers of %s are healthy\n", image, svc.Name)
+	return nil
+}
+
+// NewContainers returns the primary containers running the service's current image.
+func (r *rancherUpgrader) NewContainers(ctx context.Context) ([]rancher.Container, error) {
+	svc, err := r.GetServiceConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	image := svc.LaunchConfig.ImageUUID
+	instances := rancher.Instances{}
+	if err := r.getJSON(ctx, svc.Links.Instances, &instances); err != nil {
+		return nil, err
+	}
+	var containers []rancher.Container
+	for _, c := range instances.Containers {
+		if isPrimary(c) && c.ImageUUID == image {
+			containers = append(containers, c)
+		}
+	}
+	return containers, nil
+}
+
+// Containers returns all the containers of the service, including sidekicks and old containers.
+func (r *rancherUpgrader) Containers(ctx context.Context) ([]rancher.Container, error) {
+	svc, err := r.GetServiceConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	instances := rancher.Instances{}
+	if err := r.getJSON(ctx, svc.Links.Instances, &instances); err != nil {
+		return nil, err
+	}
+	return instances.Containers, nil
+}
+
+// ContainerPredicate is a condition on the containers of a service, e.g. that they are all healthy.
+type ContainerPredicate func(containers []rancher.Container) bool
+
+// WaitForInstances blocks until predicate holds for the containers of the service and returns them.
+// When ctx is done first it returns the containers of the last poll with the error of ctx.
+func (r *rancherUpgrader) WaitForInstances(ctx context.Context, predicate ContainerPredicate) ([]rancher.Container, error) {
+	svc, err := r.GetServiceConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return r.pollInstances(ctx, svc, time.Time{}, predicate)
+}
+
+// waitForInstances polls the containers of svc until done returns true for them, for at most timeout.
+func (r *rancherUpgrader) waitForInstances(ctx context.Context, svc *rancher.Service, timeout time.Duration, done ContainerPredicate) ([]rancher.Container, error) {
+	return r.pollInstances(ctx, svc, time.Now().Add(timeout), done)
+}
+
+// pollInstances polls the containers of svc until done returns true for them, until deadline unless it
+// is zero.
+func (r *rancherUpgrader) pollInstances(ctx context.Context, svc *rancher.Service, deadline time.Time, done ContainerPredicate) ([]rancher.Container, error) {
+	start := time.Now()
+	var waitInterval time.Duration
+	instances := rancher.Instances{}
+	for {
+		instances = rancher.Instances{}
+		if err := r.getJSON(ctx, svc.Links.Instances, &instances); err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			// Probably a network error
+			log.Println(err.Error())
+		} else if done(instances.Containers) {
+			return instances.Containers, nil
+		}
+		waitInterval = pollInterval(r.cfg, time.Since(start), waitInterval)
+		select {
+		case <-ctx.Done():
+			return instances.Containers, ctx.Err()
+		case <-time.After(jitter(waitInterval, r.cfg.CheckJitter)):
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return instances.Containers, errors.New("Timed out waiting for containers")
+		}
+	}
+}
+
+// AllRunning returns a predicate that is true when there are primary containers running image and they
+// are all running. An empty image matches the containers of any image.
+func AllRunning(image string) ContainerPredicate {
+	return allPrimaries(image, func(c rancher.Container) bool {
+		return c.State == "running"
+	})
+}
+
+// AllHealthy returns a predicate that is true when there are primary containers running image and
+// they are all running and healthy. Containers without a health check only need to be running.
+// An empty image matches the containers of any image.
+func AllHealthy(image string) ContainerPredicate {
+	return allPrimaries(image, func(c rancher.Container) bool {
+		return c.State == "running" && (c.HealthState == "" || c.HealthState == "healthy")
+	})
+}
+
+// AllOnImage returns a predicate that is true when there are primary containers and they all run image,
+// e.g. once the old containers of an upgrade are gone.
+func AllOnImage(image string) ContainerPredicate {
+	return allPrimaries("", func(c rancher.Container) bool {
+		return c.ImageUUID == image
+	})
+}
+
+// RunningAtLeast returns a predicate that is true when at least n primary containers are running.
+func RunningAtLeast(n int) ContainerPredicate {
+	return func(containers []rancher.Container) bool {
+		return runningPrimaries(containers) >= n
+	}
+}
+
+// Replaced returns a predicate that is true once n of the scale primary containers of a service were
+// replaced by ones running image: n of them are running image, and at most scale-n of them are running
+// another image.
+func Replaced(image string, n, scale int) ContainerPredicate {
+	return func(containers []rancher.Container) bool {
+		replaced, old := 0, 0
+		for _, c := range containers {
+			if !isPrimary(c) || c.State != "running" {
+				continue
+			}
+			if c.ImageUUID == image {
+				replaced++
+			} else {
+				old++
+			}
+		}
+		return replaced >= n && old <= scale-n
+	}
+}
+
+// All returns a predicate that is true when all of predicates are.
+func All(predicates ...ContainerPredicate) ContainerPredicate {
+	return func(containers []rancher.Container) bool {
+		for _, p := range predicates {
+			if !p(containers) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// allPrimaries returns a predicate that is true when there are primary containers running image, any
+// image when it is empty, and ok is true for all of them.
+func allPrimaries(image string, ok func(rancher.Container) bool) ContainerPredicate {
+	return func(containers []rancher.Container) bool {
+		primaries := 0
+		for _, c := range containers {
+			if !isPrimary(c) || (image != "" && c.ImageUUID != image) {
+				continue
+			}
+			primaries++
+			if !ok(c) {
+				return false
+			}
+		}
+		return primaries > 0
+	}
+}
+
+// isPrimary returns true for containers of the primary launchConfig rather than a sidekick.
+func isPrimary(c rancher.Container) bool {
+	launchConfig, ok := c.Labels["io.rancher.service.launch.config"]
+	return !ok || launchConfig == primaryLaunchConfigLabel
+}
@@ -0,0 +1,107 @@
+package upgrader
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+)
+
+// Event is something Rancher reported about the service or one of its containers that explains a slow
+// or failed upgrade, e.g. a container that could not be allocated to a host.
+type Event struct {
+	// Key identifies the event, so it is reported once however often it is seen.
+	Key string
+	// Time is when the event happened, zero when Rancher doesn't say.
+	Time        time.Time
+	Resource    string
+	Description string
+}
+
+func (e Event) String() string {
+	if e.Time.IsZero() {
+		return fmt.Sprintf("%s: %s", e.Resource, e.Description)
+	}
+	return fmt.Sprintf("%s %s: %s", e.Time.Format(time.RFC3339), e.Resource, e.Description)
+}
+
+// processInstance is a process Rancher ran on a resource, e.g. service.upgrade.
+type processInstance struct {
+	ID          string `json:"id"`
+	ProcessName string `json:"processName"`
+	StartTime   string `json:"startTime"`
+	ExitReason  string `json:"exitReason"`
+	Result      string `json:"result"`
+}
+
+// uneventfulExits are the exit reasons of processes that went as they should.
+var uneventfulExits = map[string]bool{"": true, "DONE": true, "ALREADY_DONE": true, "CHAIN": true, "DELEGATE": true}
+
+// Events returns the events of the service since since: the processes of the service that failed or had
+// to be retried, and its containers that are in error, e.g. as they could not be allocated, or whose
+// health checks are failing or reinitializing. The containers are returned when the processes can't be,
+// e.g. as the API keys aren't allowed to list them, with the error.
+func (r *rancherUpgrader) Events(ctx context.Context, since time.Time) ([]Event, error) {
+	svc, err := r.GetServiceConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	instances := rancher.Instances{}
+	if err := r.getJSON(ctx, svc.Links.Instances, &instances); err != nil {
+		return nil, err
+	}
+	events := containerEvents(instances.Containers)
+	processes, err := r.processEvents(ctx, svc, since)
+	return append(processes, events...), err
+}
+
+// processEvents returns the processes of svc since since that failed or had to be retried.
+func (r *rancherUpgrader) processEvents(ctx context.Context, svc *rancher.Service, since time.Time) ([]Event, error) {
+	processesURL, err := r.collectionURL(ctx, "processInstances")
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{"resourceType": {"service"}, "resourceId": {svc.ID}, "sort": {"startTime"}, "limit": {"100"}}
+	processes := struct {
+		Data []processInstance `json:"data"`
+	}{}
+	if err := r.getJSON(ctx, processesURL+"?"+query.Encode(), &processes); err != nil {
+		return nil, err
+	}
+	var events []Event
+	for _, p := range processes.Data {
+		started, _ := time.Parse(time.RFC3339, p.StartTime)
+		if uneventfulExits[p.ExitReason] || started.Before(since) {
+			continue
+		}
+		description := fmt.Sprintf("%s exited with %s", p.ProcessName, p.ExitReason)
+		if p.Result != "" {
+			description += ", " + strings.ToLower(p.Result)
+		}
+		events = append(events, Event{Key: "process " + p.ID, Time: started, Resource: svc.Name, Description: description})
+	}
+	return events, nil
+}
+
+// containerEvents returns the containers that are in error, e.g. as they could not be allocated, or whose
+// health checks are failing or reinitializing.
+func containerEvents(containers []rancher.Container) []Event {
+	var events []Event
+	for _, c := range containers {
+		resource := c.Type + " " + c.ID
+		if c.Name != "" {
+			resource = fmt.Sprintf("%s %s (%s)", c.Type, c.Name, c.ID)
+		}
+		if c.Transitioning == "error" && c.TransitioningMessage != "" {
+			events = append(events, Event{Key: resource + " " + c.TransitioningMessage, Resource: resource, Description: c.TransitioningMessage})
+		}
+		switch c.HealthState {
+		case "unhealthy", "reinitializing", "updating-unhealthy":
+			events = append(events, Event{Key: resource + " " + c.HealthState, Resource: resource, Description: "health check " + c.HealthState})
+		}
+	}
+	return events
+}
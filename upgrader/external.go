@@ -2,31 +2,122 @@ package upgrader
 
 import (
 	"bufio"
+	"context"
 	"fmt"
+	"io"
 	"log"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// StreamingExternalCmd takes a command string with a list of string args and runs the command.
-// It streams the command output to stdout and stderr (to stderr) and returns an error if the command
-// exits with a non-zero status code.
-func StreamingExternalCmd(command string, args ...string) error {
-	cmd := exec.Command(command, args...)
-	cmdReader, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Println("Error creating StdoutPipe for external command", err)
+// CmdOptions are how an external command is run: in Dir, with the variables of EnvFile and then Env
+// (KEY=VALUE) added to the environment, and as User (a name or uid[:gid]) when set. Its output is
+// written to Output too when set. With an Image the command runs in a container of it instead, see
+// dockerArgs. A command line is run with Shell when set, see RunCommandLine.
+type CmdOptions struct {
+	Dir        string
+	EnvFile    string
+	Env        []string
+	User       string
+	Output     io.Writer
+	Image      string
+	Workspace  string
+	DockerArgs []string
+	Shell      string
+
+	// cmdLine is the command line of the process as Windows gets it, built from the arguments when empty.
+	cmdLine string
+}
+
+// shells are the commands that run a command line given as their last argument, by name.
+var shells = map[string][]string{
+	"sh":         {"sh", "-c"},
+	"bash":       {"bash", "-c"},
+	"cmd":        {"cmd", "/S", "/C"},
+	"powershell": {"powershell", "-NoProfile", "-NonInteractive", "-ExecutionPolicy", "Bypass", "-Command"},
+	"pwsh":       {"pwsh", "-NoProfile", "-NonInteractive", "-Command"},
+}
+
+// RunCommandLine runs the command line line as opts say, with opts.Shell when it is set. Without a shell
+// line is split into the command and its arguments as the shell of the OS would, see splitArgs, so it
+// runs the same on runners without sh, e.g. Windows ones.
+func RunCommandLine(ctx context.Context, opts CmdOptions, line string) error {
+	if opts.Shell == "" {
+		args, err := splitArgs(line)
+		if err == nil && len(args) == 0 {
+			err = fmt.Errorf("empty command")
+		}
+		if err != nil {
+			log.Println("Error with external command", err)
+			return err
+		}
+		return StreamingExternalCmd(ctx, opts, args[0], args[1:]...)
+	}
+	shell, ok := shells[opts.Shell]
+	if !ok {
+		err := fmt.Errorf("unknown shell %s, expected sh, bash, cmd, powershell or pwsh", opts.Shell)
+		log.Println("Error with external command", err)
 		return err
 	}
-	// Asyncify the output from the command and print it out.
-	scanner := bufio.NewScanner(cmdReader)
-	go func() {
-		for scanner.Scan() {
-			fmt.Printf(scanner.Text())
+	// cmd doesn't unquote its arguments as other programs do, so it gets the command line as it is.
+	if opts.Shell == "cmd" {
+		opts.cmdLine = `cmd /S /C "` + line + `"`
+	}
+	return StreamingExternalCmd(ctx, opts, shell[0], append(shell[1:len(shell):len(shell)], line)...)
+}
+
+// StreamingExternalCmd takes a command string with a list of string args and runs the command as opts say.
+// It streams the command output, stdout and stderr, to stderr with the logs so stdout is left for
+// results, and returns an error if the command exits with a non-zero status code. The command is
+// killed if ctx is done before it exits.
+func StreamingExternalCmd(ctx context.Context, opts CmdOptions, command string, args ...string) error {
+	env := opts.Env
+	if opts.EnvFile != "" {
+		fileEnv, err := readEnvFile(opts.EnvFile)
+		if err != nil {
+			return err
+		}
+		env = append(fileEnv, env...)
+	}
+	var cmd *exec.Cmd
+	container := ""
+	if opts.Image != "" {
+		container = fmt.Sprintf("rancher-upgrader-cmd-%d-%d", os.Getpid(), time.Now().UnixNano())
+		dockerArgs, err := dockerArgs(opts, container, env, command, args)
+		if err != nil {
+			return err
 		}
-	}()
+		cmd = exec.CommandContext(ctx, "docker", dockerArgs...)
+		// The variables are passed on by name so their values aren't in the arguments for all to see.
+		cmd.Env = append(os.Environ(), env...)
+	} else {
+		cmd = exec.CommandContext(ctx, command, args...)
+		cmd.Dir = opts.Dir
+		if opts.cmdLine != "" {
+			setCmdLine(cmd, opts.cmdLine)
+		}
+		if len(env) > 0 || opts.User != "" {
+			cmd.Env = append(os.Environ(), env...)
+		}
+		if opts.User != "" {
+			if err := runAs(cmd, opts.User); err != nil {
+				return err
+			}
+		}
+	}
+	var output io.Writer = os.Stderr
+	if opts.Output != nil {
+		output = io.MultiWriter(os.Stderr, opts.Output)
+	}
+	cmd.Stdout = output
+	cmd.Stderr = output
 
 	log.Println("Starting external command")
-	err = cmd.Start()
+	err := cmd.Start()
 	if err != nil {
 		log.Println("Error with external command", err)
 		return err
@@ -34,8 +125,82 @@ func StreamingExternalCmd(command string, args ...string) error {
 
 	err = cmd.Wait()
 	if err != nil {
+		if container != "" && ctx.Err() != nil {
+			// Killing the docker client leaves the container running.
+			exec.Command("docker", "rm", "-f", container).Run()
+		}
 		log.Println("Error waiting for external command", err)
 		return err
 	}
 	return nil
 }
+
+// dockerArgs returns the arguments of docker to run command with args in a container of opts.Image named
+// container. The workspace, opts.Workspace or else the working directory, is mounted at the same path,
+// as containerPath has it, and the command runs in opts.Dir, the workspace by default, so paths are the
+// same in the container as out of it. The variables of env are set in the container and it runs as
+// opts.User when set.
+func dockerArgs(opts CmdOptions, container string, env []string, command string, args []string) ([]string, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	workspace, dir := opts.Workspace, opts.Dir
+	if workspace == "" {
+		workspace = wd
+	}
+	if !filepath.IsAbs(workspace) {
+		workspace = filepath.Join(wd, workspace)
+	}
+	if dir == "" {
+		dir = workspace
+	} else if !filepath.IsAbs(dir) {
+		dir = filepath.Join(wd, dir)
+	}
+	dockerArgs := []string{"run", "--rm", "--init", "--name", container, "-v", workspace + ":" + containerPath(workspace), "-w", containerPath(dir)}
+	for _, v := range env {
+		dockerArgs = append(dockerArgs, "-e", strings.SplitN(v, "=", 2)[0])
+	}
+	if opts.User != "" {
+		dockerArgs = append(dockerArgs, "--user", opts.User)
+	}
+	dockerArgs = append(dockerArgs, opts.DockerArgs...)
+	dockerArgs = append(dockerArgs, opts.Image, command)
+	return append(dockerArgs, args...), nil
+}
+
+// readEnvFile returns the variables of the env file path as KEY=VALUE, one per line as Docker and
+// Compose read them. Blank lines and lines starting with # are skipped, an "export " prefix is
+// dropped and quotes around a value are removed.
+func readEnvFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var env []string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		i := strings.Index(line, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, n)
+		}
+		key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			if value[0] == '"' {
+				if unquoted, err := strconv.Unquote(value); err == nil {
+					value = unquoted
+				}
+			} else {
+				value = value[1 : len(value)-1]
+			}
+		}
+		env = append(env, key+"="+value)
+	}
+	return env, scanner.Err()
+}
@@ -0,0 +1,106 @@
+//go:build !windows
+// +build !windows
+
+package upgrader
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// runAs makes cmd run as u, a user name or uid[:gid], with the HOME and USER of the user. Only root can
+// run commands as another user.
+func runAs(cmd *exec.Cmd, u string) error {
+	name, group := u, ""
+	if i := strings.Index(u, ":"); i >= 0 {
+		name, group = u[:i], u[i+1:]
+	}
+	usr, err := user.Lookup(name)
+	if _, ok := err.(user.UnknownUserError); ok {
+		usr, err = user.LookupId(name)
+	}
+	if err != nil {
+		return fmt.Errorf("could not run the command as %s: %s", u, err)
+	}
+	if group == "" {
+		group = usr.Gid
+	}
+	uid, err := strconv.ParseUint(usr.Uid, 10, 32)
+	if err != nil {
+		return fmt.Errorf("could not run the command as %s: %s", u, err)
+	}
+	gid, err := strconv.ParseUint(group, 10, 32)
+	if err != nil {
+		g, lerr := user.LookupGroup(group)
+		if lerr != nil {
+			return fmt.Errorf("could not run the command as %s: %s", u, lerr)
+		}
+		gid, _ = strconv.ParseUint(g.Gid, 10, 32)
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}}
+	cmd.Env = append(cmd.Env, "HOME="+usr.HomeDir, "USER="+usr.Username)
+	return nil
+}
+
+// splitArgs splits the command line line into arguments as a POSIX shell would, without expanding
+// anything: at unquoted whitespace, with single quotes keeping everything, double quotes keeping all but
+// backslashes before ", \, $ and ` and a backslash outside of quotes keeping the character after it.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, c := range line {
+		switch {
+		case escaped:
+			if quote == '"' && !strings.ContainsRune("\"\\$`", c) {
+				arg.WriteRune('\\')
+			}
+			arg.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped, inArg = true, true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				arg.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote, inArg = c, true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(c)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if escaped {
+		return nil, errors.New("trailing backslash")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// setCmdLine does nothing, as processes get their arguments one by one outside Windows.
+func setCmdLine(cmd *exec.Cmd, line string) {}
+
+// containerPath returns the path p of the host in a container, the same path.
+func containerPath(p string) string {
+	return p
+}
@@ -0,0 +1,76 @@
+package upgrader
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// runAs fails, as Windows can't run a command as another user without their password.
+func runAs(cmd *exec.Cmd, u string) error {
+	return fmt.Errorf("could not run the command as %s: not supported on Windows", u)
+}
+
+// splitArgs splits the command line line into arguments as Windows programs do (CommandLineToArgvW):
+// at whitespace outside of double quotes, with backslashes kept as they are, as in paths, but before a
+// double quote, where each pair of them is one backslash and an odd one out makes the quote a literal
+// one. Single quotes are nothing special.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg, quoted := false, false
+	backslashes := 0
+	for _, c := range line {
+		if c == '\\' {
+			backslashes++
+			inArg = true
+			continue
+		}
+		if c == '"' {
+			arg.WriteString(strings.Repeat(`\`, backslashes/2))
+			if backslashes%2 == 1 {
+				arg.WriteRune('"')
+			} else {
+				quoted = !quoted
+			}
+			backslashes, inArg = 0, true
+			continue
+		}
+		arg.WriteString(strings.Repeat(`\`, backslashes))
+		backslashes = 0
+		if !quoted && (c == ' ' || c == '\t') {
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+			continue
+		}
+		arg.WriteRune(c)
+		inArg = true
+	}
+	arg.WriteString(strings.Repeat(`\`, backslashes))
+	if quoted {
+		return nil, fmt.Errorf("unterminated \" quote")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// setCmdLine makes cmd get the command line line as it is rather than one built from its arguments.
+func setCmdLine(cmd *exec.Cmd, line string) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CmdLine: line}
+}
+
+// containerPath returns the path p of the host in a Linux container as Docker Desktop mounts it,
+// C:\work\app as /c/work/app.
+func containerPath(p string) string {
+	if vol := filepath.VolumeName(p); len(vol) == 2 && vol[1] == ':' {
+		p = "/" + strings.ToLower(vol[:1]) + p[2:]
+	}
+	return strings.ReplaceAll(p, `\`, "/")
+}
@@ -0,0 +1,261 @@
+package upgrader
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// FixtureRancherURL is the RANCHER_URL of the Rancher server fixtures are recorded against, whatever it
+// was, so they don't give away where it runs and can be replayed with any RANCHER_URL.
+const FixtureRancherURL = "http://rancher.invalid"
+
+// redacted replaces the values fixtures are sanitized of.
+const redacted = "REDACTED"
+
+// sensitiveKeys are the keys of JSON objects whose string values are left out of fixtures.
+var sensitiveKeys = map[string]bool{"secretValue": true, "password": true, "token": true, "key": true, "privateKey": true}
+
+// exchange is a request to the Rancher API and its response, or why it failed, as a line of a fixture.
+type exchange struct {
+	Method      string            `json:"method"`
+	URL         string            `json:"url"`
+	RequestBody string            `json:"requestBody,omitempty"`
+	Status      int               `json:"status,omitempty"`
+	Header      map[string]string `json:"header,omitempty"`
+	Body        string            `json:"body,omitempty"`
+	Error       string            `json:"error,omitempty"`
+}
+
+// recordedHeaders are the response headers recorded in fixtures.
+var recordedHeaders = []string{"Content-Type", "ETag", "Location"}
+
+// fixture is a file of the exchanges with the Rancher API of a run, which is being recorded to it or
+// replayed from it.
+type fixture struct {
+	mu   sync.Mutex
+	file *os.File
+	// replay are the exchanges left to replay by request, the last of each is replayed for good, e.g.
+	// for polls that take longer than when they were recorded. err is why the fixture can't be replayed.
+	replay map[string][]exchange
+	err    error
+}
+
+// fixtures are the fixtures being recorded or replayed, by path, shared by every upgrade of the process.
+var (
+	fixturesMu sync.Mutex
+	fixtures   = map[string]*fixture{}
+)
+
+// fixture returns the fixture the requests of the upgrader are recorded to or replayed from, nil when
+// they are made to Rancher as usual.
+func (r *rancherUpgrader) fixture() *fixture {
+	path := r.cfg.RancherRecordFile
+	if r.cfg.RancherReplayFile != "" {
+		path = r.cfg.RancherReplayFile
+	}
+	if path == "" {
+		return nil
+	}
+	fixturesMu.Lock()
+	defer fixturesMu.Unlock()
+	f := fixtures[path]
+	if f == nil {
+		f = &fixture{}
+		if r.cfg.RancherReplayFile != "" {
+			f.replay, f.err = readFixture(path)
+		} else {
+			f.file, f.err = os.Create(path)
+		}
+		fixtures[path] = f
+	}
+	return f
+}
+
+// readFixture reads the exchanges of the fixture at path by request.
+func readFixture(path string) (map[string][]exchange, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	exchanges := map[string][]exchange{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var e exchange
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("invalid fixture %s, line %d: %s", path, line, err)
+		}
+		key := e.Method + " " + e.URL
+		exchanges[key] = append(exchanges[key], e)
+	}
+	return exchanges, scanner.Err()
+}
+
+// fixtureTransport records the exchanges made through base with the Rancher server at rancherURL to
+// its fixture, or replays them from it without making them.
+type fixtureTransport struct {
+	base       http.RoundTripper
+	fixture    *fixture
+	rancherURL string
+}
+
+// RoundTrip records or replays the exchange of req.
+func (t *fixtureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.fixture.err != nil {
+		return nil, fmt.Errorf("Rancher API fixture: %s", t.fixture.err)
+	}
+	url := strings.Replace(req.URL.String(), t.rancherURL, FixtureRancherURL, 1)
+	if t.fixture.replay != nil {
+		return t.replay(req, url)
+	}
+	e := exchange{Method: req.Method, URL: url}
+	if req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			b, _ := ioutil.ReadAll(body)
+			e.RequestBody = t.sanitize(b)
+		}
+	}
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	res, err := base.RoundTrip(req)
+	if err != nil {
+		e.Error = err.Error()
+		t.record(e)
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	res.Body = ioutil.NopCloser(bytes.NewReader(b))
+	if err != nil {
+		return res, nil
+	}
+	e.Status = res.StatusCode
+	e.Header = map[string]string{}
+	for _, name := range recordedHeaders {
+		if v := res.Header.Get(name); v != "" {
+			e.Header[name] = t.sanitize([]byte(v))
+		}
+	}
+	// Fixtures are recorded decompressed, so they can be read and sanitized.
+	if res.Header.Get("Content-Encoding") == "gzip" && len(b) > 0 {
+		if zr, err := gzip.NewReader(bytes.NewReader(b)); err == nil {
+			if unzipped, err := ioutil.ReadAll(zr); err == nil {
+				b = unzipped
+			}
+		}
+	}
+	e.Body = t.sanitize(b)
+	t.record(e)
+	return res, nil
+}
+
+// record appends e to the fixture.
+func (t *fixtureTransport) record(e exchange) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	t.fixture.mu.Lock()
+	defer t.fixture.mu.Unlock()
+	t.fixture.file.Write(append(b, '\n'))
+}
+
+// replay answers req, for url, with the next exchange the fixture has for it.
+func (t *fixtureTransport) replay(req *http.Request, url string) (*http.Response, error) {
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+	key := req.Method + " " + url
+	t.fixture.mu.Lock()
+	exchanges := t.fixture.replay[key]
+	if len(exchanges) == 0 {
+		t.fixture.mu.Unlock()
+		return nil, fmt.Errorf("Rancher API fixture: no exchange recorded for %s", key)
+	}
+	e := exchanges[0]
+	if len(exchanges) > 1 {
+		t.fixture.replay[key] = exchanges[1:]
+	}
+	t.fixture.mu.Unlock()
+	if e.Error != "" {
+		return nil, errors.New(e.Error)
+	}
+	body := strings.Replace(e.Body, FixtureRancherURL, t.rancherURL, -1)
+	res := &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status)),
+		StatusCode:    e.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+	for name, v := range e.Header {
+		res.Header.Set(name, strings.Replace(v, FixtureRancherURL, t.rancherURL, -1))
+	}
+	return res, nil
+}
+
+// sanitize returns b with the RANCHER_URL replaced by FixtureRancherURL and, when it is JSON, the
+// environment variables, secrets, passwords, tokens and keys it has redacted.
+func (t *fixtureTransport) sanitize(b []byte) string {
+	s := strings.Replace(string(b), t.rancherURL, FixtureRancherURL, -1)
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil || dec.More() {
+		return s
+	}
+	sanitized, err := json.Marshal(redact(v))
+	if err != nil {
+		return s
+	}
+	return string(sanitized)
+}
+
+// redact returns v with the values of its sensitive keys, environment variables and secrets redacted.
+func redact(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, value := range v {
+			switch value := value.(type) {
+			case string:
+				if sensitiveKeys[k] || k == "value" && v["type"] == "secret" {
+					v[k] = redacted
+				}
+			case map[string]interface{}:
+				if k == "environment" {
+					for name := range value {
+						value[name] = redacted
+					}
+					continue
+				}
+				redact(value)
+			default:
+				redact(value)
+			}
+		}
+	case []interface{}:
+		for _, value := range v {
+			redact(value)
+		}
+	}
+	return v
+}
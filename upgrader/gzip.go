@@ -0,0 +1,42 @@
+package upgrader
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+)
+
+// gunzipped returns res with its body decompressed when Rancher gzipped it. Requests to the Rancher API
+// ask for gzip themselves, as listings of large services run to hundreds of KB on every poll, so they
+// are compressed whatever the transport of the client, which then leaves decompressing them to us.
+func gunzipped(res *http.Response) (*http.Response, error) {
+	if res.Header.Get("Content-Encoding") != "gzip" || res.StatusCode == http.StatusNotModified || res.ContentLength == 0 {
+		return res, nil
+	}
+	zr, err := gzip.NewReader(res.Body)
+	if err == io.EOF {
+		return res, nil
+	}
+	if err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	res.Body = gzipBody{Reader: zr, body: res.Body}
+	res.Header.Del("Content-Encoding")
+	res.Header.Del("Content-Length")
+	res.ContentLength = -1
+	res.Uncompressed = true
+	return res, nil
+}
+
+// gzipBody is a gzipped response body being decompressed.
+type gzipBody struct {
+	*gzip.Reader
+	body io.Closer
+}
+
+// Close closes the response body.
+func (b gzipBody) Close() error {
+	b.Reader.Close()
+	return b.body.Close()
+}
@@ -0,0 +1,44 @@
+package upgrader
+
+import (
+	"context"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+)
+
+// hostArchLabel is the host label holding the CPU architecture of the host.
+// Hosts without it are assumed to be amd64, the only architecture Rancher 1.x supports out of the box.
+const hostArchLabel = "io.rancher.host.arch"
+
+// HostArchitectures returns the CPU architecture of each host the service is scheduled on, by hostname.
+func (r *rancherUpgrader) HostArchitectures(ctx context.Context) (map[string]string, error) {
+	svc, err := r.GetServiceConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	hostIDs, err := r.serviceHosts(ctx, svc)
+	if err != nil {
+		return nil, err
+	}
+	archs := map[string]string{}
+	for id := range hostIDs {
+		hostURL, err := r.resourceURL(ctx, "hosts", id)
+		if err != nil {
+			return nil, err
+		}
+		host := rancher.Host{}
+		if err := r.getJSON(ctx, hostURL, &host); err != nil {
+			return nil, err
+		}
+		arch := host.Labels[hostArchLabel]
+		if arch == "" {
+			arch = "amd64"
+		}
+		name := host.Hostname
+		if name == "" {
+			name = host.ID
+		}
+		archs[name] = arch
+	}
+	return archs, nil
+}
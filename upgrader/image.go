@@ -0,0 +1,45 @@
+package upgrader
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// ReplaceTag rewrites the tag of imageUUID to buildTag. The part of imageUUID matching tagRegex
+// is replaced with tagTemplate, a text/template rendered with .BuildTag whose result may also refer
+// to submatches of tagRegex as $1, ${name} etc. A $ of buildTag is kept as it is.
+//
+// For an imageUuid of "docker:org/app:prod-20240101", tagRegex ":(prod)-[0-9]+$" with tagTemplate
+// ":$1-{{.BuildTag}}" keeps the environment prefix of the tag.
+func ReplaceTag(imageUUID, tagRegex, tagTemplate, buildTag string) (string, error) {
+	re, err := regexp.Compile(tagRegex)
+	if err != nil {
+		return "", fmt.Errorf("invalid tag regex: %s", err)
+	}
+	tmpl, err := template.New("tag").Parse(tagTemplate)
+	if err != nil {
+		return "", fmt.Errorf("invalid tag template: %s", err)
+	}
+	replacement := bytes.Buffer{}
+	err = tmpl.Execute(&replacement, struct{ BuildTag string }{strings.Replace(buildTag, "$", "$$", -1)})
+	if err != nil {
+		return "", fmt.Errorf("invalid tag template: %s", err)
+	}
+	return re.ReplaceAllString(imageUUID, replacement.String()), nil
+}
+
+// ImageRepository returns the repository of imageUUID without its tag or digest,
+// e.g. "registry.example.com:5000/org/app" for "docker:registry.example.com:5000/org/app:1.2.3".
+func ImageRepository(imageUUID string) string {
+	repo := strings.TrimPrefix(imageUUID, "docker:")
+	if i := strings.Index(repo, "@"); i >= 0 {
+		repo = repo[:i]
+	}
+	if i := strings.LastIndex(repo, ":"); i > strings.LastIndex(repo, "/") {
+		repo = repo[:i]
+	}
+	return repo
+}
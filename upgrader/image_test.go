@@ -0,0 +1,24 @@
+package upgrader
+
+import "testing"
+
+func TestReplaceTag(t *testing.T) {
+	tests := []struct {
+		imageUUID, tagRegex, tagTemplate, buildTag string
+		expected                                   string
+	}{
+		{"docker:org/app:1.0.0", ":[^:/]+$", ":{{.BuildTag}}", "1.2.3", "docker:org/app:1.2.3"},
+		{"docker:org/app:prod-20240101", ":(prod)-[0-9]+$", ":$1-{{.BuildTag}}", "20240102", "docker:org/app:prod-20240102"},
+		{"docker:org/app:prod-20240101", ":(?P<env>prod)-[0-9]+$", ":${env}-{{.BuildTag}}", "20240102", "docker:org/app:prod-20240102"},
+		{"docker:org/app:1.0.0", ":[^:/]+$", ":{{.BuildTag}}", "$1", "docker:org/app:$1"},
+		{"docker:org/app:prod-20240101", ":(prod)-[0-9]+$", ":$1-{{.BuildTag}}", "${1}x$", "docker:org/app:prod-${1}x$"},
+	}
+	for _, test := range tests {
+		image, err := ReplaceTag(test.imageUUID, test.tagRegex, test.tagTemplate, test.buildTag)
+		if err != nil {
+			t.Errorf("%s with %s: unexpected error %s", test.imageUUID, test.buildTag, err)
+		} else if image != test.expected {
+			t.Errorf("%s with %s: expected %s, got %s", test.imageUUID, test.buildTag, test.expected, image)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package upgrader
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+)
+
+// KeyScope is what the Rancher API keys of a config can act on.
+type KeyScope struct {
+	// AccountID is the account the keys belong to: a user for account API keys, or the environment itself
+	// for environment API keys, as environments are accounts to Rancher. It is empty when Rancher doesn't say.
+	AccountID string
+	// Environment is set for environment API keys, which can only act on the environment AccountID.
+	Environment bool
+	// Projects are the IDs of the environments the keys can act on.
+	Projects []string
+}
+
+// CanAccess returns true if the keys can act on the environment envID.
+func (s KeyScope) CanAccess(envID string) bool {
+	for _, id := range s.Projects {
+		if id == envID {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckKeys returns the scope of the Rancher API keys of cfg, failing when Rancher rejects them.
+func CheckKeys(ctx context.Context, c *http.Client, cfg rancher.Config) (KeyScope, error) {
+	r := New(c, cfg).(*rancherUpgrader)
+	u := cfg.APIURL() + "/projects?limit=-1"
+	req, err := r.newRequest(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return KeyScope{}, err
+	}
+	res, err := r.do(req)
+	if err != nil {
+		return KeyScope{}, err
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden:
+		return KeyScope{}, fmt.Errorf("Rancher rejected the API key %s: %s, check RANCHER_ACCESS_KEY and RANCHER_SECRET_KEY", cfg.RancherAccessKey, res.Status)
+	case res.StatusCode >= http.StatusBadRequest:
+		body, _ := ioutil.ReadAll(res.Body)
+		return KeyScope{}, fmt.Errorf("GET %s: %s: %s", u, res.Status, strings.TrimSpace(string(body)))
+	}
+	var projects struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&projects); err != nil {
+		return KeyScope{}, err
+	}
+	scope := KeyScope{AccountID: res.Header.Get("X-Api-Account-Id")}
+	for _, p := range projects.Data {
+		scope.Projects = append(scope.Projects, p.ID)
+		if p.ID == scope.AccountID {
+			scope.Environment = true
+		}
+	}
+	return scope, nil
+}
@@ -0,0 +1,53 @@
+package upgrader
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// projectLinks are the links of an environment, fetched once.
+type projectLinks struct {
+	mu    sync.Mutex
+	links map[string]string
+}
+
+// collectionURL returns the URL of the collection name of the environment, e.g. services or
+// loadBalancerServices, from the links of the environment rather than building it, as where Rancher
+// serves collections differs between its versions. The links are fetched once.
+func (r *rancherUpgrader) collectionURL(ctx context.Context, name string) (string, error) {
+	r.links.mu.Lock()
+	defer r.links.mu.Unlock()
+	if r.links.links == nil {
+		var project struct {
+			Links map[string]string `json:"links"`
+		}
+		if err := r.getJSON(ctx, r.projectURL, &project); err != nil {
+			return "", err
+		}
+		if project.Links == nil {
+			project.Links = map[string]string{}
+		}
+		r.links.links = project.Links
+	}
+	if u := r.links.links[name]; u != "" {
+		return u, nil
+	}
+	// Without a link, e.g. through a proxy that strips them, the collection is where Rancher has
+	// always served it.
+	return r.projectURL + "/" + strings.ToLower(name), nil
+}
+
+// resourceURL returns the URL of the resource id of the collection name of the environment.
+func (r *rancherUpgrader) resourceURL(ctx context.Context, name, id string) (string, error) {
+	u, err := r.collectionURL(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	return u + "/" + id, nil
+}
+
+// serviceURL returns the URL of the service of the upgrader.
+func (r *rancherUpgrader) serviceURL(ctx context.Context) (string, error) {
+	return r.resourceURL(ctx, "services", r.cfg.RancherServiceID)
+}
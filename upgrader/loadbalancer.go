@@ -0,0 +1,61 @@
+package upgrader
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+)
+
+// WaitForLoadBalancer blocks, for at most timeout, until the load balancer service lbServiceID is
+// active and healthy, routes to this service, and the new containers of this service are healthy.
+// Rancher load balancers check targets with the target service's health check, so healthy containers
+// are the ones the load balancer sends traffic to.
+func (r *rancherUpgrader) WaitForLoadBalancer(ctx context.Context, lbServiceID string, timeout time.Duration) error {
+	svc, err := r.GetServiceConfig(ctx)
+	if err != nil {
+		return err
+	}
+	image := svc.LaunchConfig.ImageUUID
+	newHealthy := AllHealthy(image)
+	lbURL, err := r.resourceURL(ctx, "loadBalancerServices", lbServiceID)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Waiting for load balancer %s to route to the new containers of %s\n", lbServiceID, svc.Name)
+	start := time.Now()
+	var waitInterval time.Duration
+	status := "not checked yet"
+	for {
+		lb := rancher.LoadBalancer{}
+		instances := rancher.Instances{}
+		if err := r.getJSON(ctx, lbURL, &lb); err != nil {
+			status = err.Error()
+		} else if lb.State != "active" || (lb.HealthState != "" && lb.HealthState != "healthy") {
+			status = fmt.Sprintf("load balancer %s is %s, %s", lb.Name, lb.State, lb.HealthState)
+		} else if !lb.Targets(svc.ID) {
+			status = fmt.Sprintf("load balancer %s has no rules for %s", lb.Name, svc.Name)
+		} else if err := r.getJSON(ctx, svc.Links.Instances, &instances); err != nil {
+			status = err.Error()
+		} else if !newHealthy(instances.Containers) {
+			status = fmt.Sprintf("new containers are not healthy yet:\n%s", containerReport(instances.Containers))
+		} else {
+			log.Printf("Load balancer %s is routing to the new containers of %s\n", lb.Name, svc.Name)
+			return nil
+		}
+		r.progress(status)
+
+		waitInterval = pollInterval(r.cfg, time.Since(start), waitInterval)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(jitter(waitInterval, r.cfg.CheckJitter)):
+		}
+		if time.Since(start) > timeout {
+			return fmt.Errorf("timed out waiting for load balancer %s: %s", lbServiceID, status)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package upgrader
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+)
+
+// ProjectID returns the ID (e.g. 1a5) of the environment with uuid.
+func ProjectID(ctx context.Context, c *http.Client, cfg rancher.Config, uuid string) (string, error) {
+	r := New(c, cfg).(*rancherUpgrader)
+	return r.lookupID(ctx, cfg.APIURL()+"/projects", url.Values{"uuid": {uuid}})
+}
+
+// ServiceID returns the ID (e.g. 1s123) of the service with uuid in the environment of cfg.
+func ServiceID(ctx context.Context, c *http.Client, cfg rancher.Config, uuid string) (string, error) {
+	r := New(c, cfg).(*rancherUpgrader)
+	servicesURL, err := r.collectionURL(ctx, "services")
+	if err != nil {
+		return "", err
+	}
+	return r.lookupID(ctx, servicesURL, url.Values{"uuid": {uuid}})
+}
+
+// ResolveTarget returns the IDs of the environment named env and of its service named service in the
+// stack named stack.
+func ResolveTarget(ctx context.Context, c *http.Client, cfg rancher.Config, env, stack, service string) (string, string, error) {
+	r := New(c, cfg).(*rancherUpgrader)
+	envID, err := r.lookupID(ctx, cfg.APIURL()+"/projects", url.Values{"name": {env}})
+	if err != nil {
+		return "", "", err
+	}
+	cfg.RancherEnvID = envID
+	r = New(c, cfg).(*rancherUpgrader)
+	// Stacks were called environments before v2-beta of the API.
+	stacks, stackIDField := "stacks", "stackId"
+	if cfg.RancherAPIVersion == "v1" {
+		stacks, stackIDField = "environments", "environmentId"
+	}
+	stacksURL, err := r.collectionURL(ctx, stacks)
+	if err != nil {
+		return "", "", err
+	}
+	stackID, err := r.lookupID(ctx, stacksURL, url.Values{"name": {stack}})
+	if err != nil {
+		return "", "", err
+	}
+	servicesURL, err := r.collectionURL(ctx, "services")
+	if err != nil {
+		return "", "", err
+	}
+	serviceID, err := r.lookupID(ctx, servicesURL, url.Values{"name": {service}, stackIDField: {stackID}})
+	if err != nil {
+		return "", "", err
+	}
+	return envID, serviceID, nil
+}
+
+// lookupID returns the ID of the only resource of the collection at collectionURL matching filter.
+func (r *rancherUpgrader) lookupID(ctx context.Context, collectionURL string, filter url.Values) (string, error) {
+	var resources struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	u := collectionURL + "?" + filter.Encode()
+	if err := r.getJSON(ctx, u, &resources); err != nil {
+		return "", err
+	}
+	switch len(resources.Data) {
+	case 0:
+		return "", fmt.Errorf("nothing in %s matches %s", collectionURL, filter.Encode())
+	case 1:
+		return resources.Data[0].ID, nil
+	default:
+		return "", fmt.Errorf("%d resources in %s match %s", len(resources.Data), collectionURL, filter.Encode())
+	}
+}
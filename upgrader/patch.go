@@ -0,0 +1,132 @@
+package upgrader
+
+import "github.com/richardbolt/rancher-upgrader/rancher"
+
+// Patch merges patch into the launchConfig of the upgrade following JSON merge patch (RFC 7386)
+// semantics: objects are merged recursively, a null value removes the key and any other value
+// replaces what was there.
+func Patch(patch map[string]interface{}) Option {
+	return func(s *rancher.Service) {
+		if len(patch) == 0 {
+			return
+		}
+		launchConfig := s.Upgrade.InServiceStrategy.LaunchConfig.Map()
+		mergePatch(launchConfig, patch)
+		s.Upgrade.InServiceStrategy.LaunchConfig = rancher.NewLaunchConfig(launchConfig)
+	}
+}
+
+// HealthCheck patches the launchConfig healthCheck (port, requestLine, intervals, strategy etc.)
+// so health check changes ship with the image that requires them.
+func HealthCheck(healthCheck map[string]interface{}) Option {
+	if len(healthCheck) == 0 {
+		return Patch(nil)
+	}
+	return Patch(map[string]interface{}{"healthCheck": healthCheck})
+}
+
+// mergePatch applies patch onto target in place.
+func mergePatch(target, patch map[string]interface{}) {
+	for k, v := range patch {
+		if v == nil {
+			delete(target, k)
+			continue
+		}
+		patchObj, ok := v.(map[string]interface{})
+		if !ok {
+			target[k] = v
+			continue
+		}
+		targetObj, ok := target[k].(map[string]interface{})
+		if !ok {
+			targetObj = map[string]interface{}{}
+		}
+		mergePatch(targetObj, patchObj)
+		target[k] = targetObj
+	}
+}
+
+// Memory sets the memory limit, in bytes, of the upgraded containers. Values <= 0 leave it unchanged.
+func Memory(bytes int64) Option {
+	return setPositive("memory", bytes)
+}
+
+// MemoryReservation sets the memory reservation, in bytes, of the upgraded containers.
+// Values <= 0 leave it unchanged.
+func MemoryReservation(bytes int64) Option {
+	return setPositive("memoryReservation", bytes)
+}
+
+// CPUShares sets the relative CPU shares of the upgraded containers. Values <= 0 leave it unchanged.
+func CPUShares(shares int64) Option {
+	return setPositive("cpuShares", shares)
+}
+
+// MilliCPUReservation sets the CPU reservation, in thousandths of a CPU, of the upgraded containers.
+// Values <= 0 leave it unchanged.
+func MilliCPUReservation(milliCPU int64) Option {
+	return setPositive("milliCpuReservation", milliCPU)
+}
+
+// setPositive patches key in the launchConfig to v when v is positive.
+func setPositive(key string, v int64) Option {
+	if v <= 0 {
+		return Patch(nil)
+	}
+	return Patch(map[string]interface{}{key: v})
+}
+
+// DataVolumes replaces the dataVolumes of the service, e.g. "/data" or "myvolume:/data".
+// An empty list leaves the volumes unchanged.
+func DataVolumes(volumes []string) Option {
+	if len(volumes) == 0 {
+		return Patch(nil)
+	}
+	v := make([]interface{}, len(volumes))
+	for i, volume := range volumes {
+		v[i] = volume
+	}
+	return Patch(map[string]interface{}{"dataVolumes": v})
+}
+
+// VolumeDriver sets the volume driver of the service. An empty driver leaves it unchanged.
+func VolumeDriver(driver string) Option {
+	if driver == "" {
+		return Patch(nil)
+	}
+	return Patch(map[string]interface{}{"volumeDriver": driver})
+}
+
+// Environment adds or replaces environment variables of the upgraded containers.
+func Environment(env map[string]string) Option {
+	return mergeStrings("environment", env)
+}
+
+// Labels adds or replaces labels of the upgraded containers.
+func Labels(labels map[string]string) Option {
+	return mergeStrings("labels", labels)
+}
+
+// Command replaces the command of the upgraded containers. An empty command leaves it unchanged.
+func Command(command []string) Option {
+	if len(command) == 0 {
+		return Patch(nil)
+	}
+	c := make([]interface{}, len(command))
+	for i, arg := range command {
+		c[i] = arg
+	}
+	return Patch(map[string]interface{}{"command": c})
+}
+
+// mergeStrings patches the entries of m into the launchConfig object named key.
+func mergeStrings(key string, m map[string]string) Option {
+	if len(m) == 0 {
+		return Patch(nil)
+	}
+	obj := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		obj[k] = v
+	}
+	return Patch(map[string]interface{}{key: obj})
+}
@@ -0,0 +1,54 @@
+package upgrader
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+)
+
+// pollInterval returns how long to sleep before the next status check of a wait that has been
+// running for elapsed, given the previous interval.
+// Once a wait has run for longer than cfg.CheckBackoffAfter seconds the interval doubles on every
+// check up to cfg.CheckIntervalMax seconds.
+func pollInterval(cfg rancher.Config, elapsed, previous time.Duration) time.Duration {
+	interval := time.Duration(cfg.CheckInterval) * time.Second
+	backoffAfter := time.Duration(cfg.CheckBackoffAfter) * time.Second
+	if cfg.CheckBackoffAfter > 0 && elapsed > backoffAfter && previous > 0 {
+		interval = previous * 2
+		if max := time.Duration(cfg.CheckIntervalMax) * time.Second; max > 0 && interval > max {
+			interval = max
+		}
+	}
+	return interval
+}
+
+// jitter spreads d by up to percent percent in either direction so that many concurrent
+// pipelines don't poll Rancher in lockstep. percent is capped at 100, so d never goes negative.
+func jitter(d time.Duration, percent int) time.Duration {
+	if percent <= 0 || d <= 0 {
+		return d
+	}
+	if percent > 100 {
+		percent = 100
+	}
+	spread := int64(d) * int64(percent) / 100
+	if spread <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Int63n(2*spread+1)-spread)
+}
+
+// PollError is the error of waiting for the service when it couldn't be fetched MAX_CONSECUTIVE_POLL_ERRORS
+// times in a row, e.g. as the name of the Rancher server no longer resolves, rather than a timeout waiting
+// for its state.
+type PollError struct {
+	Errors int
+	// Last is why the last poll failed.
+	Last error
+}
+
+func (e *PollError) Error() string {
+	return fmt.Sprintf("could not poll the service %d times in a row, the last with %s", e.Errors, e.Last)
+}
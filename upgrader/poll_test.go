@@ -0,0 +1,28 @@
+package upgrader
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJitter(t *testing.T) {
+	d := 10 * time.Second
+	tests := []struct {
+		percent  int
+		min, max time.Duration
+	}{
+		{0, d, d},
+		{-10, d, d},
+		{20, 8 * time.Second, 12 * time.Second},
+		{100, 0, 2 * d},
+		{500, 0, 2 * d},
+	}
+	for _, test := range tests {
+		for i := 0; i < 100; i++ {
+			if j := jitter(d, test.percent); j < test.min || j > test.max {
+				t.Errorf("jitter(%s, %d) = %s, expected from %s to %s", d, test.percent, j, test.min, test.max)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package upgrader
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+)
+
+// Ports replaces the published ports of the service, in Rancher "[ip:]hostPort:containerPort[/protocol]"
+// form. An empty list leaves the ports unchanged.
+func Ports(ports []string) Option {
+	if len(ports) == 0 {
+		return Patch(nil)
+	}
+	p := make([]interface{}, len(ports))
+	for i, port := range ports {
+		p[i] = port
+	}
+	return Patch(map[string]interface{}{"ports": p})
+}
+
+// CheckPorts returns an error if any host port in ports is already published by another service
+// with containers on the hosts this service runs on.
+func (r *rancherUpgrader) CheckPorts(ctx context.Context, ports []string) error {
+	wanted := hostPorts(ports)
+	if len(wanted) == 0 {
+		return nil
+	}
+	svc, err := r.GetServiceConfig(ctx)
+	if err != nil {
+		return err
+	}
+	hosts, err := r.serviceHosts(ctx, svc)
+	if err != nil {
+		return err
+	}
+
+	services, err := r.Services(ctx)
+	if err != nil {
+		return err
+	}
+	for _, other := range services {
+		if other.ID == svc.ID {
+			continue
+		}
+		var conflicts []string
+		for port := range hostPorts(other.LaunchConfig.Ports) {
+			if _, ok := wanted[port]; ok {
+				conflicts = append(conflicts, port)
+			}
+		}
+		if len(conflicts) == 0 {
+			continue
+		}
+		otherHosts, err := r.serviceHosts(ctx, &other)
+		if err != nil {
+			return err
+		}
+		for host := range otherHosts {
+			if _, ok := hosts[host]; ok {
+				return fmt.Errorf("host port(s) %s already bound by service %s on host %s",
+					strings.Join(conflicts, ", "), other.Name, host)
+			}
+		}
+	}
+	return nil
+}
+
+// serviceHosts returns the set of host IDs the containers of svc are running on.
+func (r *rancherUpgrader) serviceHosts(ctx context.Context, svc *rancher.Service) (map[string]struct{}, error) {
+	hosts := map[string]struct{}{}
+	if svc.Links.Instances == "" {
+		return hosts, nil
+	}
+	instances := rancher.Instances{}
+	if err := r.getJSON(ctx, svc.Links.Instances, &instances); err != nil {
+		return nil, err
+	}
+	for _, c := range instances.Containers {
+		if c.HostID != "" {
+			hosts[c.HostID] = struct{}{}
+		}
+	}
+	return hosts, nil
+}
+
+// hostPorts returns the set of published "hostPort/protocol" pairs from Rancher port specs.
+// Ports without a host port are published on a random port and can't conflict.
+func hostPorts(ports []string) map[string]struct{} {
+	set := map[string]struct{}{}
+	for _, port := range ports {
+		protocol := "tcp"
+		if i := strings.LastIndex(port, "/"); i >= 0 {
+			port, protocol = port[:i], port[i+1:]
+		}
+		parts := strings.Split(port, ":")
+		if len(parts) < 2 {
+			continue
+		}
+		set[parts[len(parts)-2]+"/"+protocol] = struct{}{}
+	}
+	return set
+}
@@ -0,0 +1,91 @@
+package upgrader
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket limiting the requests made to a Rancher server, so upgrading many
+// services at once, e.g. a whole environment or stack, can't overwhelm a small one. Requests over the
+// limit are queued in the order they were made.
+type rateLimiter struct {
+	mu    sync.Mutex
+	rate  float64
+	burst float64
+	// tokens are the requests that can be made right away as of last, negative when requests are queued.
+	tokens float64
+	last   time.Time
+	queued int
+}
+
+// rateLimiters are the limiters of the Rancher servers requests are made to, by the URL of their API,
+// shared by every upgrade of the process.
+var (
+	rateLimitersMu sync.Mutex
+	rateLimiters   = map[string]*rateLimiter{}
+)
+
+// limiter returns the limiter of the Rancher server of the upgrader, nil when requests aren't limited.
+func (r *rancherUpgrader) limiter() *rateLimiter {
+	if r.cfg.RancherRateLimit <= 0 {
+		return nil
+	}
+	key := r.cfg.APIURL()
+	rateLimitersMu.Lock()
+	defer rateLimitersMu.Unlock()
+	l := rateLimiters[key]
+	if l == nil {
+		burst := math.Max(float64(r.cfg.RancherRateBurst), 1)
+		l = &rateLimiter{rate: r.cfg.RancherRateLimit, burst: burst, tokens: burst, last: time.Now()}
+		rateLimiters[key] = l
+	}
+	return l
+}
+
+// wait waits until a request can be made and returns how long that was.
+func (l *rateLimiter) wait(ctx context.Context) (time.Duration, error) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		l.mu.Unlock()
+		return 0, nil
+	}
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.queued++
+	l.mu.Unlock()
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		l.mu.Lock()
+		l.queued--
+		l.mu.Unlock()
+		return delay, nil
+	case <-ctx.Done():
+		// Give the request's turn back to those queued after it.
+		l.mu.Lock()
+		l.queued--
+		l.tokens++
+		l.mu.Unlock()
+		return time.Since(now), ctx.Err()
+	}
+}
+
+// RateLimitQueued returns how many requests to the Rancher API are waiting for RANCHER_RATE_LIMIT.
+func RateLimitQueued() int {
+	rateLimitersMu.Lock()
+	defer rateLimitersMu.Unlock()
+	queued := 0
+	for _, l := range rateLimiters {
+		l.mu.Lock()
+		queued += l.queued
+		l.mu.Unlock()
+	}
+	return queued
+}
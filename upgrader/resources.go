@@ -0,0 +1,68 @@
+package upgrader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// create creates a resource of the collection of the environment with the fields of v and returns its ID.
+func (r *rancherUpgrader) create(ctx context.Context, collection string, v interface{}) (string, error) {
+	collectionURL, err := r.collectionURL(ctx, collection)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	req, err := r.newRequest(ctx, http.MethodPost, collectionURL, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := r.do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode >= http.StatusBadRequest {
+		return "", fmt.Errorf("POST %s: %s: %s", collectionURL, res.Status, body)
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(body, &created); err != nil {
+		return "", err
+	}
+	return created.ID, nil
+}
+
+// remove removes the resource id of the collection of the environment.
+func (r *rancherUpgrader) remove(ctx context.Context, collection, id string) error {
+	resourceURL, err := r.resourceURL(ctx, collection, id)
+	if err != nil {
+		return err
+	}
+	req, err := r.newRequest(ctx, http.MethodDelete, resourceURL, nil)
+	if err != nil {
+		return err
+	}
+	res, err := r.do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= http.StatusBadRequest {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("DELETE %s: %s: %s", resourceURL, res.Status, body)
+	}
+	return nil
+}
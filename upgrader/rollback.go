@@ -0,0 +1,237 @@
+package upgrader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+)
+
+// rollback rolls svc back using its rollback action and makes sure containers are restarted.
+// A rollback that fails is retried with backoff, and once the retries run out a rollback stuck in
+// progress is cancelled and tried once more, or the service is restarted so it is at least running.
+func (r *rancherUpgrader) rollback(ctx context.Context, svc *rancher.Service) error {
+	// A rollback in progress, e.g. started from the Rancher UI, has no rollback action and is waited for.
+	if svc.State != "rolling-back" && svc.Actions.Rollback == "" {
+		return fmt.Errorf("can't roll back %s while it is %s", svc.Name, svc.State)
+	}
+	err := r.rollbackOnce(ctx, svc)
+	backoff := time.Duration(r.cfg.RollbackRetryBackoff) * time.Second
+	for retry := 1; err != nil && retry <= r.cfg.RollbackRetries; retry++ {
+		log.Printf("Rollback of %s failed, retrying in %s (%d/%d): %s\n", svc.Name, backoff, retry, r.cfg.RollbackRetries, err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s, and gave up retrying: %s", err, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		// The rollback may have been made after all, or still be in progress.
+		current, gerr := r.GetServiceConfig(ctx)
+		if gerr != nil {
+			err = gerr
+			continue
+		}
+		svc = current
+		err = r.rollbackOnce(ctx, svc)
+	}
+	if err != nil {
+		return r.recoverRollback(ctx, svc, err)
+	}
+	log.Println("Rollback successful")
+	return nil
+}
+
+// rollbackOnce rolls svc back, or waits for a rollback already in progress, and restarts its containers.
+func (r *rancherUpgrader) rollbackOnce(ctx context.Context, svc *rancher.Service) error {
+	switch {
+	case svc.State == "rolling-back":
+		log.Printf("%s is being rolled back already, waiting for it\n", svc.Name)
+	case svc.Actions.Rollback != "":
+		// NB: state becomes "rolling-back" then "active"
+		if err := r.postAction(ctx, svc.Actions.Rollback); err != nil {
+			return err
+		}
+	case svc.State == "active":
+	default:
+		return fmt.Errorf("can't roll back %s while it is %s", svc.Name, svc.State)
+	}
+	svc, err := r.WaitFor(ctx, "active")
+	if err != nil {
+		return err
+	}
+	// Now restart the service containers (if any are not running) to make sure we've left things in a running state.
+	return r.startContainers(ctx, svc)
+}
+
+// recoverRollback tries to get svc running after its rollback failed with err for good. A rollback that
+// is stuck is cancelled and tried once more, otherwise the service is restarted. Unless the last rollback
+// succeeds it returns an error, as the service isn't running the previous version for sure.
+func (r *rancherUpgrader) recoverRollback(ctx context.Context, svc *rancher.Service, err error) error {
+	if svc.Actions.CancelRollback != "" {
+		log.Printf("Cancelling the stuck rollback of %s to try it once more\n", svc.Name)
+		if cerr := r.postAction(ctx, svc.Actions.CancelRollback); cerr != nil {
+			return fmt.Errorf("%s, and cancelling the rollback failed: %s", err, cerr)
+		}
+		cancelled, cerr := r.WaitFor(ctx, "canceled-rollback", "upgraded", "active")
+		if cerr != nil {
+			return fmt.Errorf("%s, and cancelling the rollback failed: %s", err, cerr)
+		}
+		if rerr := r.rollbackOnce(ctx, cancelled); rerr != nil {
+			return fmt.Errorf("%s, and rolling back after cancelling the rollback failed: %s", err, rerr)
+		}
+		log.Println("Rollback successful")
+		return nil
+	}
+	if svc.Actions.Restart != "" {
+		log.Printf("Restarting %s as it could not be rolled back\n", svc.Name)
+		restart := map[string]interface{}{"rollingRestartStrategy": map[string]interface{}{}}
+		if rerr := r.postActionJSON(ctx, svc.Actions.Restart, restart); rerr != nil {
+			return fmt.Errorf("%s, and restarting it failed: %s", err, rerr)
+		}
+		if _, rerr := r.WaitFor(ctx, "active"); rerr != nil {
+			return fmt.Errorf("%s, and restarting it failed: %s", err, rerr)
+		}
+		return fmt.Errorf("%s, restarted it instead", err)
+	}
+	return err
+}
+
+// postActionJSON POSTs v as JSON to a resource action url.
+func (r *rancherUpgrader) postActionJSON(ctx context.Context, url string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := r.newRequest(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := r.do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	response, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("POST %s: %s: %s", url, res.Status, response)
+	}
+	r.progress(string(response))
+	return nil
+}
+
+// startAttempts is how many times startContainers tries to get the containers of a service running.
+const startAttempts = 3
+
+// startContainers makes sure the containers of svcConfig are running once it is active: stopped containers
+// are started, those that can only be restarted are restarted, and those still stopping or starting are
+// waited for and tried again. It then waits for the service to be running at its full scale, returning
+// an error describing the containers that aren't running otherwise.
+func (r *rancherUpgrader) startContainers(ctx context.Context, svcConfig *rancher.Service) error {
+	timeout := time.Duration(r.cfg.StartWaitTimeout) * time.Second
+	for attempt := 1; ; attempt++ {
+		instances := rancher.Instances{}
+		if err := r.getJSON(ctx, svcConfig.Links.Instances, &instances); err != nil {
+			return err
+		}
+		waiting := map[string]struct{}{}
+		for _, container := range instances.Containers {
+			var err error
+			switch {
+			case container.State == "running":
+				continue
+			case container.Actions.Start != "":
+				log.Printf("Starting %s %s which was in a %s state", container.Type, container.ID, container.State)
+				err = r.postAction(ctx, container.Actions.Start)
+			case container.Actions.Restart != "":
+				log.Printf("Restarting %s %s which was in a %s state", container.Type, container.ID, container.State)
+				err = r.postAction(ctx, container.Actions.Restart)
+			case !settled(container):
+				log.Printf("Waiting for %s %s which is %s", container.Type, container.ID, container.State)
+			default:
+				log.Printf("%s %s was in a %s state and could not be started", container.Type, container.ID, container.State)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			waiting[container.ID] = struct{}{}
+		}
+		if len(waiting) == 0 {
+			break
+		}
+
+		containers, err := r.waitForInstances(ctx, svcConfig, timeout, func(containers []rancher.Container) bool {
+			for _, c := range notRunning(containers, waiting) {
+				if !settled(c) {
+					return false
+				}
+			}
+			return true
+		})
+		pending := notRunning(containers, waiting)
+		if err == nil && len(pending) == 0 {
+			log.Printf("Started %d containers of %s\n", len(waiting), svcConfig.Name)
+			break
+		}
+		if attempt == startAttempts {
+			if err == nil {
+				err = errors.New("they stopped or went into the error state")
+			}
+			return fmt.Errorf("%d containers of %s did not start: %s\n%s", len(pending), svcConfig.Name, err, containerReport(pending))
+		}
+		log.Printf("%d containers of %s aren't running yet, trying again\n", len(pending), svcConfig.Name)
+	}
+	return r.waitForScale(ctx, svcConfig, timeout)
+}
+
+// waitForScale waits for as many primary containers of svc to be running as its scale, for at most timeout.
+// Global services, which run a container on every host rather than to a scale, aren't checked.
+func (r *rancherUpgrader) waitForScale(ctx context.Context, svc *rancher.Service, timeout time.Duration) error {
+	if svc.LaunchConfig.Labels["io.rancher.scheduler.global"] == "true" || svc.Scale == 0 {
+		return nil
+	}
+	containers, err := r.waitForInstances(ctx, svc, timeout, RunningAtLeast(svc.Scale))
+	if err != nil {
+		return fmt.Errorf("%s is running %d of %d containers: %s\n%s", svc.Name, runningPrimaries(containers), svc.Scale, err, containerReport(containers))
+	}
+	return nil
+}
+
+// runningPrimaries returns how many of containers are running primary containers.
+func runningPrimaries(containers []rancher.Container) int {
+	n := 0
+	for _, c := range containers {
+		if isPrimary(c) && c.State == "running" {
+			n++
+		}
+	}
+	return n
+}
+
+// settled returns true for a container that isn't in the middle of changing state, e.g. stopping.
+func settled(c rancher.Container) bool {
+	switch c.State {
+	case "running", "stopped", "error", "removed", "purged":
+		return true
+	}
+	return false
+}
+
+// notRunning returns the containers with the IDs in ids that aren't running.
+func notRunning(containers []rancher.Container, ids map[string]struct{}) []rancher.Container {
+	var pending []rancher.Container
+	for _, c := range containers {
+		if _, ok := ids[c.ID]; ok && c.State != "running" {
+			pending = append(pending, c)
+		}
+	}
+	return pending
+}
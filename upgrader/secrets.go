@@ -0,0 +1,78 @@
+package upgrader
+
+import (
+	"context"
+	"encoding/base64"
+	"log"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+)
+
+// CreateSecret creates a secret of the environment named name with value and returns its ID. Rancher
+// secrets can't be changed, so rotating one is creating a new one and pointing the service at it.
+func (r *rancherUpgrader) CreateSecret(ctx context.Context, name string, value []byte) (string, error) {
+	id, err := r.create(ctx, "secrets", map[string]string{"name": name, "value": base64.StdEncoding.EncodeToString(value)})
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Created secret %s (%s)\n", name, id)
+	return id, nil
+}
+
+// RemoveSecret removes the secret id of the environment, e.g. one created for an upgrade that was rolled back.
+func (r *rancherUpgrader) RemoveSecret(ctx context.Context, id string) error {
+	if err := r.remove(ctx, "secrets", id); err != nil {
+		return err
+	}
+	log.Printf("Removed secret %s\n", id)
+	return nil
+}
+
+// SecretIDs points the secret references of the launchConfig of the upgrade named as the keys of ids,
+// the files the secrets are mounted as, at the secrets of the values instead. Rolling back the upgrade
+// points them back at the secrets they referenced before.
+func SecretIDs(ids map[string]string) Option {
+	return func(s *rancher.Service) {
+		launchConfig := &s.Upgrade.InServiceStrategy.LaunchConfig
+		refs, _ := launchConfig.Other["secrets"].([]interface{})
+		if len(refs) == 0 {
+			return
+		}
+		updated := make([]interface{}, len(refs))
+		for i, ref := range refs {
+			updated[i] = ref
+			m, ok := ref.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			name, _ := m["name"].(string)
+			id, ok := ids[name]
+			if !ok {
+				continue
+			}
+			copied := map[string]interface{}{}
+			for k, v := range m {
+				copied[k] = v
+			}
+			copied["secretId"] = id
+			updated[i] = copied
+		}
+		launchConfig.Other["secrets"] = updated
+	}
+}
+
+// SecretReferences returns the IDs of the secrets the launchConfig references by the names of the files
+// they are mounted as.
+func SecretReferences(launchConfig rancher.LaunchConfig) map[string]string {
+	ids := map[string]string{}
+	refs, _ := launchConfig.Other["secrets"].([]interface{})
+	for _, ref := range refs {
+		m, _ := ref.(map[string]interface{})
+		name, _ := m["name"].(string)
+		id, _ := m["secretId"].(string)
+		if name != "" {
+			ids[name] = id
+		}
+	}
+	return ids
+}
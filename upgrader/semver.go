@@ -0,0 +1,86 @@
+package upgrader
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// semverRegex matches semantic versions, https://semver.org, with an optional v prefix as image tags often have.
+var semverRegex = regexp.MustCompile(`^v?(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)(?:-([0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*))?(?:\+[0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*)?$`)
+
+// Version is the semantic version of an image tag, e.g. 1.4.0-rc.1 of "v1.4.0-rc.1". Build metadata is
+// left out as it doesn't order versions.
+type Version struct {
+	Major, Minor, Patch int
+	Prerelease          []string
+}
+
+// ParseVersion returns the semantic version of tag, false when tag isn't one, e.g. "latest" or a Git SHA.
+func ParseVersion(tag string) (Version, bool) {
+	m := semverRegex.FindStringSubmatch(tag)
+	if m == nil {
+		return Version{}, false
+	}
+	var v Version
+	var err error
+	for i, n := range []*int{&v.Major, &v.Minor, &v.Patch} {
+		if *n, err = strconv.Atoi(m[i+1]); err != nil {
+			return Version{}, false
+		}
+	}
+	if m[4] != "" {
+		v.Prerelease = strings.Split(m[4], ".")
+	}
+	return v, true
+}
+
+// Compare returns -1 when v is older than o, 1 when it is newer and 0 when they are the same version.
+func (v Version) Compare(o Version) int {
+	for _, d := range []int{v.Major - o.Major, v.Minor - o.Minor, v.Patch - o.Patch} {
+		if d != 0 {
+			return sign(d)
+		}
+	}
+	// A pre-release comes before its release.
+	switch {
+	case len(v.Prerelease) == 0 && len(o.Prerelease) == 0:
+		return 0
+	case len(v.Prerelease) == 0:
+		return 1
+	case len(o.Prerelease) == 0:
+		return -1
+	}
+	for i := 0; i < len(v.Prerelease) && i < len(o.Prerelease); i++ {
+		if c := comparePrerelease(v.Prerelease[i], o.Prerelease[i]); c != 0 {
+			return c
+		}
+	}
+	return sign(len(v.Prerelease) - len(o.Prerelease))
+}
+
+// comparePrerelease compares identifiers of pre-releases: numbers numerically and before the others,
+// which are compared in ASCII order.
+func comparePrerelease(a, b string) int {
+	na, aerr := strconv.Atoi(a)
+	nb, berr := strconv.Atoi(b)
+	switch {
+	case aerr == nil && berr == nil:
+		return sign(na - nb)
+	case aerr == nil:
+		return -1
+	case berr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,55 @@
+package upgrader
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+)
+
+// StackServices returns the services of the stack the service is in, the service among them, by name.
+func (r *rancherUpgrader) StackServices(ctx context.Context) ([]rancher.Service, error) {
+	body, _, err := r.serviceBody(ctx, serviceTTL)
+	if err != nil {
+		return nil, err
+	}
+	var svc struct {
+		Name          string `json:"name"`
+		StackID       string `json:"stackId"`
+		EnvironmentID string `json:"environmentId"`
+	}
+	if err := json.Unmarshal(body, &svc); err != nil {
+		return nil, err
+	}
+	stack := svc.StackID
+	if svc.EnvironmentID != "" {
+		stack = svc.EnvironmentID
+	}
+	if stack == "" {
+		return nil, fmt.Errorf("the stack of %s is unknown", svc.Name)
+	}
+	// Stacks were called environments before v2-beta of the API.
+	filter := url.Values{"limit": {"-1"}}
+	if r.cfg.RancherAPIVersion == "v1" {
+		filter.Set("environmentId", stack)
+	} else {
+		filter.Set("stackId", stack)
+	}
+	bodies, _, err := r.listServices(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	services := make([]rancher.Service, 0, len(bodies))
+	for _, b := range bodies {
+		s := rancher.Service{}
+		if err := json.Unmarshal(b, &s); err != nil {
+			return nil, err
+		}
+		services = append(services, s)
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	return services, nil
+}
@@ -0,0 +1,137 @@
+package upgrader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+)
+
+// LoadBalancerRules returns the port rules of the load balancer service lbServiceID.
+// Rules are kept as decoded JSON so that fields this package doesn't know about survive an update.
+func (r *rancherUpgrader) LoadBalancerRules(ctx context.Context, lbServiceID string) ([]map[string]interface{}, error) {
+	lb := struct {
+		LBConfig struct {
+			PortRules []map[string]interface{} `json:"portRules"`
+		} `json:"lbConfig"`
+	}{}
+	lbURL, err := r.resourceURL(ctx, "loadBalancerServices", lbServiceID)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.getJSON(ctx, lbURL, &lb); err != nil {
+		return nil, err
+	}
+	return lb.LBConfig.PortRules, nil
+}
+
+// SetLoadBalancerRules replaces the port rules of the load balancer service lbServiceID and blocks
+// until it is active again.
+func (r *rancherUpgrader) SetLoadBalancerRules(ctx context.Context, lbServiceID string, rules []map[string]interface{}) error {
+	lbURL, err := r.resourceURL(ctx, "loadBalancerServices", lbServiceID)
+	if err != nil {
+		return err
+	}
+	lb := map[string]interface{}{}
+	if err := r.getJSON(ctx, lbURL, &lb); err != nil {
+		return err
+	}
+	lbConfig, _ := lb["lbConfig"].(map[string]interface{})
+	if lbConfig == nil {
+		lbConfig = map[string]interface{}{}
+	}
+	lbConfig["portRules"] = rules
+	if err := r.putJSON(ctx, lbURL, map[string]interface{}{"lbConfig": lbConfig}); err != nil {
+		return err
+	}
+	return r.waitForServiceSettled(ctx, lbURL)
+}
+
+// Scale returns the number of containers the service serviceID is scaled to.
+func (r *rancherUpgrader) Scale(ctx context.Context, serviceID string) (int, error) {
+	svcURL, err := r.resourceURL(ctx, "services", serviceID)
+	if err != nil {
+		return 0, err
+	}
+	svc := rancher.Service{}
+	if err := r.getJSON(ctx, svcURL, &svc); err != nil {
+		return 0, err
+	}
+	return svc.Scale, nil
+}
+
+// SetScale scales the service serviceID to scale containers and blocks until it has settled.
+func (r *rancherUpgrader) SetScale(ctx context.Context, serviceID string, scale int) error {
+	svcURL, err := r.resourceURL(ctx, "services", serviceID)
+	if err != nil {
+		return err
+	}
+	log.Printf("Scaling service %s to %d\n", serviceID, scale)
+	if err := r.putJSON(ctx, svcURL, map[string]int{"scale": scale}); err != nil {
+		return err
+	}
+	return r.waitForServiceSettled(ctx, svcURL)
+}
+
+// waitForServiceSettled blocks, for at most UPGRADE_WAIT_TIMEOUT, until the service at svcURL has
+// finished applying an update.
+func (r *rancherUpgrader) waitForServiceSettled(ctx context.Context, svcURL string) error {
+	timeout := time.Duration(r.cfg.UpgradeWaitTimeout) * time.Second
+	start := time.Now()
+	var waitInterval time.Duration
+	status := "not checked yet"
+	for {
+		svc := struct {
+			Name          string `json:"name"`
+			State         string `json:"state"`
+			Transitioning string `json:"transitioning"`
+		}{}
+		if err := r.getJSON(ctx, svcURL, &svc); err != nil {
+			status = err.Error()
+		} else if svc.Transitioning != "yes" && (svc.State == "active" || svc.State == "upgraded") {
+			return nil
+		} else {
+			status = fmt.Sprintf("%s is %s", svc.Name, svc.State)
+		}
+		r.progress(status)
+
+		waitInterval = pollInterval(r.cfg, time.Since(start), waitInterval)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(jitter(waitInterval, r.cfg.CheckJitter)):
+		}
+		if time.Since(start) > timeout {
+			return fmt.Errorf("timed out waiting for the update of %s to settle: %s", svcURL, status)
+		}
+	}
+}
+
+// putJSON PUTs v as JSON to url on the Rancher API.
+func (r *rancherUpgrader) putJSON(ctx context.Context, url string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := r.newRequest(ctx, http.MethodPut, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := r.do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= http.StatusBadRequest {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("PUT %s: %s: %s", url, res.Status, body)
+	}
+	return nil
+}
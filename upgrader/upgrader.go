@@ -2,48 +2,87 @@ package upgrader
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/richardbolt/rancher-upgrader/rancher"
 )
 
 type rancherUpgrader struct {
-	svcURL string
-	client *http.Client
-	cfg    rancher.Config
+	projectURL string
+	client     *http.Client
+	cfg        rancher.Config
+
+	// links are the links of the environment, which may be shared with other upgraders of it.
+	links *projectLinks
+
+	mu      sync.Mutex
+	service serviceCache
 }
 
-// New returns an implementation of the Upgrader interface.
+// New returns an implementation of the Upgrader interface for the service RANCHER_SERVICE_ID of the
+// environment RANCHER_ENV_ID of cfg. Use a Client to upgrade several services with one configuration.
 func New(c *http.Client, cfg rancher.Config) Upgrader {
-	// serviceURL is the Rancher url to make requests to for the service upgrade.
-	svcURL := fmt.Sprintf("%s/%s/projects/%s/services/%s",
-		cfg.RancherURL,
-		cfg.RancherAPIVersion,
-		cfg.RancherEnvID,
-		cfg.RancherServiceID,
-	)
+	return newUpgrader(c, cfg, &projectLinks{})
+}
+
+// newUpgrader returns the upgrader of the service of cfg that gets the links of its environment from links.
+func newUpgrader(c *http.Client, cfg rancher.Config, links *projectLinks) *rancherUpgrader {
+	// projectURL is the Rancher url of the environment the service lives in. Everything else is
+	// reached through the links and actions of the API from there.
+	projectURL := fmt.Sprintf("%s/projects/%s", cfg.APIURL(), cfg.RancherEnvID)
 
 	return &rancherUpgrader{
-		svcURL: svcURL,
-		client: c,
-		cfg:    cfg,
+		projectURL: projectURL,
+		client:     c,
+		cfg:        cfg,
+		links:      links,
 	}
 }
 
 // Upgrader defines methods for service upgrading.
+// Every method honours the cancellation and deadline of the given context.
 type Upgrader interface {
-	Upgrade(options ...Option) error
-	WaitFor(desiredStates ...string) (*rancher.Service, error)
-	GetServiceConfig() (*rancher.Service, error)
-	FinishUpgrade() (*rancher.Service, error)
-	Cancel() error
-	Rollback() error
+	Upgrade(ctx context.Context, options ...Option) error
+	WaitFor(ctx context.Context, desiredStates ...string) (*rancher.Service, error)
+	WaitForStates(ctx context.Context, desiredStates, abortStates []string) (*rancher.Service, error)
+	GetServiceConfig(ctx context.Context) (*rancher.Service, error)
+	Services(ctx context.Context) ([]rancher.Service, error)
+	StackServices(ctx context.Context) ([]rancher.Service, error)
+	FinishUpgrade(ctx context.Context) (*rancher.Service, error)
+	Cancel(ctx context.Context) error
+	HoldUpgrade(ctx context.Context) (bool, error)
+	ContinueUpgrade(ctx context.Context) error
+	Rollback(ctx context.Context) error
+	CheckPorts(ctx context.Context, ports []string) error
+	HostArchitectures(ctx context.Context) (map[string]string, error)
+	WaitForHealthy(ctx context.Context, timeout time.Duration) error
+	WaitForInstances(ctx context.Context, predicate ContainerPredicate) ([]rancher.Container, error)
+	Events(ctx context.Context, since time.Time) ([]Event, error)
+	WaitForLoadBalancer(ctx context.Context, lbServiceID string, timeout time.Duration) error
+	NewContainers(ctx context.Context) ([]rancher.Container, error)
+	Containers(ctx context.Context) ([]rancher.Container, error)
+	LoadBalancerRules(ctx context.Context, lbServiceID string) ([]map[string]interface{}, error)
+	SetLoadBalancerRules(ctx context.Context, lbServiceID string, rules []map[string]interface{}) error
+	Scale(ctx context.Context, serviceID string) (int, error)
+	SetScale(ctx context.Context, serviceID string, scale int) error
+	PinScale(ctx context.Context, serviceID string, scale int) (int, error)
+	CreateSecret(ctx context.Context, name string, value []byte) (string, error)
+	RemoveSecret(ctx context.Context, id string) error
+	CreateCertificate(ctx context.Context, name, cert, key, chain string) (string, error)
+	RemoveCertificate(ctx context.Context, id string) error
+	LoadBalancerCertificates(ctx context.Context, lbServiceID string) (string, []string, error)
+	SetLoadBalancerCertificates(ctx context.Context, lbServiceID, defaultID string, ids []string) error
 }
 
 // Option will allow for modifying the Service definition for upgrading.
@@ -52,8 +91,15 @@ type Option func(*rancher.Service)
 // ImageUUID allows for updating the Service's image UUID when calling Upgrade
 func ImageUUID(uuid string) Option {
 	return func(s *rancher.Service) {
-		s.LaunchConfig["imageUuid"] = uuid
-		s.Upgrade.InServiceStrategy.LaunchConfig["imageUuid"] = uuid
+		s.LaunchConfig.ImageUUID = uuid
+		s.Upgrade.InServiceStrategy.LaunchConfig.ImageUUID = uuid
+	}
+}
+
+// LaunchConfig replaces the whole launchConfig of the upgrade, e.g. with one from a reviewed plan.
+func LaunchConfig(launchConfig rancher.LaunchConfig) Option {
+	return func(s *rancher.Service) {
+		s.Upgrade.InServiceStrategy.LaunchConfig = launchConfig
 	}
 }
 
@@ -64,75 +110,305 @@ func StartFirst(startFirst bool) Option {
 	}
 }
 
+// newRequest creates a request bound to ctx with the Rancher API credentials set.
+func (r *rancherUpgrader) newRequest(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, r.apiURL(url), body)
+	if err != nil {
+		return nil, err
+	}
+	accessKey, secretKey := r.cfg.RancherAccessKey, r.cfg.RancherSecretKey
+	if r.cfg.Credentials != nil {
+		if accessKey, secretKey, err = r.cfg.Credentials(); err != nil {
+			return nil, fmt.Errorf("could not get the Rancher API keys: %s", err)
+		}
+	}
+	req.SetBasicAuth(accessKey, secretKey)
+	req.Header.Set("Accept-Encoding", "gzip")
+	return req.WithContext(ctx), nil
+}
+
+// apiURL returns u, a URL of the Rancher API as Rancher sees itself, e.g. a link or action of a resource,
+// as it is reached through RancherURL. Behind a reverse proxy Rancher's links name its own host and leave
+// out the path prefix of the proxy, e.g. http://rancher:8080/v1/projects for
+// https://ops.example.com/rancher/v1/projects.
+func (r *rancherUpgrader) apiURL(u string) string {
+	apiURL := r.cfg.APIURL()
+	if u == apiURL || strings.HasPrefix(u, apiURL+"/") || strings.HasPrefix(u, apiURL+"?") {
+		return u
+	}
+	parsed, err := url.Parse(u)
+	if err != nil || !parsed.IsAbs() {
+		return u
+	}
+	path := parsed.EscapedPath()
+	i := strings.Index(path+"/", "/"+r.cfg.RancherAPIVersion+"/")
+	if i < 0 {
+		return u
+	}
+	rebased := apiURL + path[i+len(r.cfg.RancherAPIVersion)+1:]
+	if parsed.RawQuery != "" {
+		rebased += "?" + parsed.RawQuery
+	}
+	return rebased
+}
+
+// maxRedirects is how many redirects a request to the Rancher API follows, as many as net/http would.
+const maxRedirects = 10
+
+// do sends req to the Rancher API. It follows redirects itself, e.g. of a proxy from http to https,
+// keeping the method, body and API keys of req, which net/http would change or drop. The keys are only
+// sent on to the host req was sent to. Requests are held to RANCHER_RATE_LIMIT and fail right away while
+// the breaker of the Rancher server is tripped. With RANCHER_RECORD_FILE they are recorded to a fixture,
+// with RANCHER_REPLAY_FILE answered from one.
+func (r *rancherUpgrader) do(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		defer r.forgetService()
+	}
+	client := *r.client
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	if f := r.fixture(); f != nil {
+		client.Transport = &fixtureTransport{base: client.Transport, fixture: f, rancherURL: strings.TrimSuffix(r.cfg.RancherURL, "/")}
+	}
+	limiter, breaker := r.limiter(), r.breaker()
+	period := time.Duration(r.cfg.RancherBreakerSeconds) * time.Second
+	for redirects := 0; ; redirects++ {
+		if breaker != nil {
+			if err := breaker.allow(period); err != nil {
+				return nil, err
+			}
+		}
+		if limiter != nil {
+			waited, err := limiter.wait(req.Context())
+			if r.cfg.ObserveRateLimit != nil {
+				r.cfg.ObserveRateLimit(waited)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		start := time.Now()
+		res, err := client.Do(req)
+		if r.cfg.ObserveRequest != nil {
+			status := 0
+			if res != nil {
+				status = res.StatusCode
+			}
+			r.cfg.ObserveRequest(req.Method, status, err, time.Since(start))
+		}
+		// Requests given up on aren't Rancher failing.
+		if breaker != nil && req.Context().Err() == nil {
+			if tripped := breaker.record(period, res, err); tripped != nil {
+				if err == nil {
+					res.Body.Close()
+				}
+				return nil, tripped
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch res.StatusCode {
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		default:
+			return gunzipped(res)
+		}
+		location, err := res.Location()
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %s without a location: %s", req.Method, req.URL, res.Status, err)
+		}
+		if redirects == maxRedirects {
+			return nil, fmt.Errorf("%s %s: stopped after %d redirects", req.Method, req.URL, maxRedirects)
+		}
+		if location.Hostname() != req.URL.Hostname() {
+			return nil, fmt.Errorf("%s %s: redirected to %s, another host the API keys aren't sent to", req.Method, req.URL, location)
+		}
+		next := req.Clone(req.Context())
+		next.URL, next.Host = location, ""
+		if res.StatusCode == http.StatusSeeOther {
+			next.Method, next.Body, next.GetBody, next.ContentLength = http.MethodGet, nil, nil, 0
+		} else if req.GetBody != nil {
+			if next.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		req = next
+	}
+}
+
+// getJSON GETs url from the Rancher API and decodes the JSON response into v.
+func (r *rancherUpgrader) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := r.newRequest(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := r.do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= http.StatusBadRequest {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("GET %s: %s: %s", url, res.Status, body)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
 // WaitFor blocks until the service "state" goes to desiredState.
-func (r *rancherUpgrader) WaitFor(desiredState ...string) (*rancher.Service, error) {
-	waitInterval, _ := time.ParseDuration(fmt.Sprintf("%ds", r.cfg.CheckInterval))
+// It gives up early if ctx is cancelled or its deadline passes.
+func (r *rancherUpgrader) WaitFor(ctx context.Context, desiredState ...string) (*rancher.Service, error) {
+	return r.WaitForStates(ctx, desiredState, nil)
+}
+
+// WaitForStates blocks until the service "state" or "healthState" goes to one of desiredState,
+// e.g. "inactive" or "healthy", and fails if it goes to one of abortState instead.
+// It gives up early if ctx is cancelled or its deadline passes.
+func (r *rancherUpgrader) WaitForStates(ctx context.Context, desiredState, abortState []string) (*rancher.Service, error) {
+	var waitInterval time.Duration
 	waitTimeout, _ := time.ParseDuration(fmt.Sprintf("%ds", r.cfg.UpgradeWaitTimeout))
 	desiredStates := map[string]struct{}{}
 	for _, state := range desiredState {
 		desiredStates[state] = struct{}{}
 	}
+	abortStates := map[string]struct{}{}
+	for _, state := range abortState {
+		abortStates[state] = struct{}{}
+	}
 	log.Printf("Waiting for service to reach '%s' state\n", desiredState)
+	defer r.waitingOn()()
 	start := time.Now()
+	service := rancher.Service{}
+	decoded := false
+	stateSince := start
+	pollErrors := 0
+	// pause blocks for cfg.CheckInterval seconds each loop cycle, backing off on long waits, and fails
+	// once the wait timed out.
+	pause := func() error {
+		waitInterval = pollInterval(r.cfg, time.Since(start), waitInterval)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(jitter(waitInterval, r.cfg.CheckJitter)):
+		}
+		if time.Since(start) > waitTimeout {
+			log.Printf("Timed out waiting for '%s'", desiredState)
+			return errors.New("Timed out waiting for desiredState")
+		}
+		return nil
+	}
 	for {
-		// Check the service status
-		req, err := http.NewRequest(http.MethodGet, r.svcURL, nil)
-		req.SetBasicAuth(r.cfg.RancherAccessKey, r.cfg.RancherSecretKey)
-		res, err := r.client.Do(req)
+		if err := ctx.Err(); err != nil {
+			log.Printf("Stopped waiting for '%s': %s", desiredState, err)
+			return &service, err
+		}
+		// Check the service status, only decoding it again when it changed.
+		body, changed, err := r.pollService(ctx)
 		if err != nil {
+			if unreachable, ok := err.(*UnreachableError); ok {
+				log.Printf("Stopped waiting for '%s': %s", desiredState, err)
+				return &service, unreachable
+			}
 			// Probably a network error
 			log.Println(err.Error())
+			if pollErrors++; r.cfg.MaxConsecutivePollErrors > 0 && pollErrors >= r.cfg.MaxConsecutivePollErrors {
+				log.Printf("Stopped waiting for '%s' after %d failed polls in a row", desiredState, pollErrors)
+				return &service, &PollError{Errors: pollErrors, Last: err}
+			}
+			if err := pause(); err != nil {
+				return &service, err
+			}
 			continue
 		}
-		defer res.Body.Close()
-		service := rancher.Service{}
-		json.NewDecoder(res.Body).Decode(&service)
-		log.Println("State", service.State)
-		if _, ok := desiredStates[service.State]; ok {
+		pollErrors = 0
+		previousState := service.State
+		if changed || !decoded {
+			service = rancher.Service{}
+			json.Unmarshal(body, &service)
+			decoded = true
+		}
+		r.progress("State", service.State, service.HealthState)
+		if inStates(desiredStates, &service) {
 			// state was one of the desiredStates
 			return &service, nil
 		}
-		// Block for cfg.CheckInterval seconds each loop cycle.
-		time.Sleep(waitInterval)
-		if time.Since(start) > waitTimeout {
-			log.Printf("Timed out waiting for '%s'", desiredState)
-			return &service, errors.New("Timed out waiting for desiredState")
+		if inStates(abortStates, &service) {
+			log.Printf("Stopped waiting for '%s'", desiredState)
+			return &service, fmt.Errorf("%s went to %s (%s) while waiting for %s", service.Name, service.State, service.HealthState, desiredState)
+		}
+		if service.State != previousState {
+			stateSince = time.Now()
+		}
+		if service.State == "upgrading" && r.cfg.StuckUpgradeThreshold > 0 &&
+			time.Since(stateSince) > time.Duration(r.cfg.StuckUpgradeThreshold)*time.Second {
+			return &service, r.stuckError(ctx, &service, time.Since(stateSince))
+		}
+		if err := pause(); err != nil {
+			return &service, err
 		}
 	}
 }
 
+// inStates returns true if the state or healthState of svc is one of states.
+func inStates(states map[string]struct{}, svc *rancher.Service) bool {
+	if _, ok := states[svc.State]; ok {
+		return true
+	}
+	_, ok := states[svc.HealthState]
+	return ok && svc.HealthState != ""
+}
+
 // GetServiceConfig gets the service configuration for the given environment cfg and serviceURL.
-func (r *rancherUpgrader) GetServiceConfig() (*rancher.Service, error) {
+func (r *rancherUpgrader) GetServiceConfig(ctx context.Context) (*rancher.Service, error) {
 	// Get the launchConfig for the given service. what we're after is the imageUuid from the launchConfig.
-	req, err := http.NewRequest(http.MethodGet, r.svcURL, nil)
-	req.SetBasicAuth(r.cfg.RancherAccessKey, r.cfg.RancherSecretKey)
-	res, err := r.client.Do(req)
+	// A service the API keys can't see is an error rather than an empty service.
+	// Reads in quick succession share a fetch, each decoding its own copy to change.
+	body, _, err := r.serviceBody(ctx, serviceTTL)
 	if err != nil {
-		log.Println(err.Error())
 		return nil, err
 	}
-	defer res.Body.Close()
 	svcConfig := rancher.Service{}
-	err = json.NewDecoder(res.Body).Decode(&svcConfig)
-	if err != nil {
+	if err := json.Unmarshal(body, &svcConfig); err != nil {
 		return nil, err
 	}
 	return &svcConfig, nil
 }
 
-// Upgrade kicks off the upgrade process with the given environment cfg and svcConfig.
-func (r *rancherUpgrader) Upgrade(options ...Option) error {
-	svcConfig, err := r.GetServiceConfig()
+// Services gets every service in the environment.
+func (r *rancherUpgrader) Services(ctx context.Context) ([]rancher.Service, error) {
+	servicesURL, err := r.collectionURL(ctx, "services")
 	if err != nil {
-		return err
+		return nil, err
 	}
+	services := rancher.Services{}
+	if err := r.getJSON(ctx, servicesURL+"?limit=-1", &services); err != nil {
+		return nil, err
+	}
+	return services.Services, nil
+}
+
+// Preview returns the upgrade that Upgrade would request for svc with options, leaving svc as it is.
+func Preview(svc *rancher.Service, options ...Option) (rancher.Upgrade, error) {
+	b, err := json.Marshal(svc)
+	if err != nil {
+		return rancher.Upgrade{}, err
+	}
+	copied := rancher.Service{}
+	if err := json.Unmarshal(b, &copied); err != nil {
+		return rancher.Upgrade{}, err
+	}
+	return prepare(&copied, options...), nil
+}
 
+// prepare sets the upgrade of svcConfig from its launchConfig and options and returns it.
+func prepare(svcConfig *rancher.Service, options ...Option) rancher.Upgrade {
 	// Set the Upgrade on the svcConfig.
 	svcConfig.Upgrade = rancher.Upgrade{
 		InServiceStrategy: rancher.InServiceStrategy{
 			BatchSize:      svcConfig.Upgrade.InServiceStrategy.BatchSize,
 			IntervalMillis: svcConfig.Upgrade.InServiceStrategy.IntervalMillis,
-			LaunchConfig:   svcConfig.LaunchConfig,
+			LaunchConfig:   svcConfig.LaunchConfig.Copy(),
 		},
 	}
 
@@ -148,19 +424,32 @@ func (r *rancherUpgrader) Upgrade(options ...Option) error {
 	if svcConfig.Upgrade.InServiceStrategy.IntervalMillis <= 0 {
 		svcConfig.Upgrade.InServiceStrategy.IntervalMillis = 2000 // Default to a 2 second upgrade interval.
 	}
+	return svcConfig.Upgrade
+}
+
+// Upgrade kicks off the upgrade process with the given environment cfg and svcConfig.
+func (r *rancherUpgrader) Upgrade(ctx context.Context, options ...Option) error {
+	svcConfig, err := r.GetServiceConfig(ctx)
+	if err != nil {
+		return err
+	}
 
-	log.Printf("Upgrading %s in env %s to version tag '%s'\n", svcConfig.Name, r.cfg.RancherEnvID, r.cfg.BuildTag)
-	data, err := json.Marshal(svcConfig.Upgrade)
+	if svcConfig.Actions.Upgrade == "" {
+		return fmt.Errorf("can't upgrade %s while it is %s", svcConfig.Name, svcConfig.State)
+	}
+	upgrade := prepare(svcConfig, options...)
+	log.Printf("Upgrading %s in env %s to '%s'\n", svcConfig.Name, r.cfg.RancherEnvID,
+		upgrade.InServiceStrategy.LaunchConfig.ImageUUID)
+	data, err := json.Marshal(upgrade)
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequest(http.MethodPost, svcConfig.Actions.Upgrade, bytes.NewBuffer(data))
+	req, err := r.newRequest(ctx, http.MethodPost, svcConfig.Actions.Upgrade, bytes.NewBuffer(data))
 	if err != nil {
 		return err
 	}
 	req.Header.Add("Content-Type", "application/json")
-	req.SetBasicAuth(r.cfg.RancherAccessKey, r.cfg.RancherSecretKey)
-	res, err := r.client.Do(req)
+	res, err := r.do(req)
 	if err == nil && res.StatusCode >= http.StatusBadRequest {
 		// Errors can also be if the given setup is no good
 		// and we get a 400 or higher response code.
@@ -175,118 +464,160 @@ func (r *rancherUpgrader) Upgrade(options ...Option) error {
 }
 
 // FinishUpgrade finishes the upgrade and blocks until the service is in an active state before returning.
-func (r *rancherUpgrader) FinishUpgrade() (*rancher.Service, error) {
-	req, err := http.NewRequest(http.MethodPost, r.svcURL+"?action=finishupgrade", nil)
+func (r *rancherUpgrader) FinishUpgrade(ctx context.Context) (*rancher.Service, error) {
+	svcConfig, err := r.GetServiceConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if svcConfig.Actions.FinishUpgrade == "" {
+		return nil, fmt.Errorf("can't finish the upgrade of %s while it is %s", svcConfig.Name, svcConfig.State)
+	}
+	req, err := r.newRequest(ctx, http.MethodPost, svcConfig.Actions.FinishUpgrade, nil)
 	if err != nil {
 		return nil, err
 	}
-	req.SetBasicAuth(r.cfg.RancherAccessKey, r.cfg.RancherSecretKey)
 	// NB: state becomes "finishing-upgrade" then "active"
-	res, err := r.client.Do(req)
+	res, err := r.do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer res.Body.Close()
+	if res.StatusCode >= http.StatusBadRequest {
+		body, _ := ioutil.ReadAll(res.Body)
+		return nil, fmt.Errorf("finishupgrade was rejected: %s: %s", res.Status, body)
+	}
 	svc := rancher.Service{}
 	err = json.NewDecoder(res.Body).Decode(&svc)
 	if err != nil {
 		return nil, err
 	}
+	if svc.State != "finishing-upgrade" && svc.State != "active" {
+		return nil, fmt.Errorf("finishupgrade was not started, %s is %s", svc.Name, svc.State)
+	}
 	log.Printf("Finishing upgrade of %s", svc.Name)
-	svcCfg, err := r.WaitFor("active")
+	// Stop waiting if the service leaves finishing-upgrade for anything other than active.
+	svcCfg, err := r.WaitFor(ctx, "active", "upgraded", "error")
 	if err != nil {
 		return nil, err
 	}
+	if svcCfg.State != "active" {
+		return nil, fmt.Errorf("finishing the upgrade of %s failed, it went to %s", svcCfg.Name, svcCfg.State)
+	}
 	return svcCfg, nil
 }
 
 // Cancel cancels the service upgrade and rolls back.
-func (r *rancherUpgrader) Cancel() error {
-	req, err := http.NewRequest(http.MethodPost, r.svcURL+"?action=cancelupgrade", nil)
+// Once the upgrade can no longer be cancelled (e.g. it is already upgraded) it only rolls back.
+func (r *rancherUpgrader) Cancel(ctx context.Context) error {
+	svc, err := r.GetServiceConfig(ctx)
 	if err != nil {
 		return err
 	}
-	req.SetBasicAuth(r.cfg.RancherAccessKey, r.cfg.RancherSecretKey)
-	// NB: state becomes "finishing-upgrade" then "active"
-	res, err := r.client.Do(req)
+	if svc.Actions.CancelUpgrade == "" {
+		if svc.Actions.Rollback != "" || svc.State == "rolling-back" {
+			log.Printf("The upgrade of %s can't be cancelled while %s, rolling back instead", svc.Name, svc.State)
+			return r.rollback(ctx, svc)
+		}
+		return fmt.Errorf("can't cancel or roll back the upgrade of %s while it is %s", svc.Name, svc.State)
+	}
+	// NB: state becomes "canceling-upgrade" then "canceled-upgrade"
+	err = r.postAction(ctx, svc.Actions.CancelUpgrade)
 	if err != nil {
 		log.Println(err.Error())
 		return err
 	}
-	defer res.Body.Close()
-	response, err := ioutil.ReadAll(res.Body)
-	log.Println(string(response))
-	svc, err := r.WaitFor("upgraded", "canceled-upgrade", "active")
+	svc, err = r.WaitFor(ctx, "upgraded", "canceled-upgrade", "active")
 	if err != nil {
 		log.Println(err.Error())
 		return err
 	}
-	if svc != nil {
-		// Now we've cancelled the upgrade we need to rollback (and restart containers as necessary)
-		err = r.Rollback()
-		if err != nil {
-			return err
-		}
-	} else {
-		return errors.New("No updated service config available")
+	if svc.State == "active" {
+		// Nothing was upgraded yet so there is nothing to roll back, just make sure we're running.
+		log.Println("Upgrade cancelled")
+		return r.startContainers(ctx, svc)
 	}
-	return nil
+	// Now we've cancelled the upgrade we need to rollback (and restart containers as necessary)
+	return r.rollback(ctx, svc)
 }
 
-// Rollback rolls the service back and makes sure containers are restarted.
-func (r *rancherUpgrader) Rollback() error {
-	req, err := http.NewRequest(http.MethodPost, r.svcURL+"?action=rollback", nil)
-	req.SetBasicAuth(r.cfg.RancherAccessKey, r.cfg.RancherSecretKey)
-	// NB: state becomes "finishing-upgrade" then "active"
-	res, err := r.client.Do(req)
+// HoldUpgrade holds the upgrade of the service between its batches by cancelling it, which leaves the
+// containers it replaced in place, and returns whether it was held: an upgrade Rancher made already
+// can't be. ContinueUpgrade carries on with it.
+func (r *rancherUpgrader) HoldUpgrade(ctx context.Context) (bool, error) {
+	svc, err := r.GetServiceConfig(ctx)
 	if err != nil {
-		return err
+		return false, err
 	}
-	defer res.Body.Close()
-	response, err := ioutil.ReadAll(res.Body)
-	log.Println(string(response))
+	if svc.State == "upgraded" {
+		return false, nil
+	}
+	if svc.Actions.CancelUpgrade == "" {
+		return false, fmt.Errorf("can't hold the upgrade of %s while it is %s", svc.Name, svc.State)
+	}
+	// NB: state becomes "canceling-upgrade" then "canceled-upgrade", or "upgraded" when the last batch
+	// was made meanwhile.
+	if err := r.postAction(ctx, svc.Actions.CancelUpgrade); err != nil {
+		return false, err
+	}
+	svc, err = r.WaitFor(ctx, "canceled-upgrade", "upgraded")
+	if err != nil {
+		return false, err
+	}
+	return svc.State == "canceled-upgrade", nil
+}
 
-	svc, err := r.WaitFor("active")
+// ContinueUpgrade carries on with an upgrade HoldUpgrade held, blocking until it is upgrading again.
+func (r *rancherUpgrader) ContinueUpgrade(ctx context.Context) error {
+	svc, err := r.GetServiceConfig(ctx)
 	if err != nil {
 		return err
 	}
-	// Now restart the service containers (if any are not running) to make sure we've left things in a running state.
-	err = startContainers(r.client, r.cfg, svc)
+	if svc.Actions.ContinueUpgrade == "" {
+		return fmt.Errorf("can't continue the upgrade of %s while it is %s", svc.Name, svc.State)
+	}
+	if err := r.postAction(ctx, svc.Actions.ContinueUpgrade); err != nil {
+		return err
+	}
+	_, err = r.WaitFor(ctx, "upgrading", "upgraded")
+	return err
+}
+
+// Rollback rolls the service back and makes sure containers are restarted.
+// An upgrade that is still in progress is cancelled first.
+func (r *rancherUpgrader) Rollback(ctx context.Context) error {
+	svc, err := r.GetServiceConfig(ctx)
 	if err != nil {
 		return err
 	}
-	log.Println("Rollback successful")
-	return nil
+	if svc.Actions.Rollback == "" && svc.Actions.CancelUpgrade != "" {
+		log.Printf("The upgrade of %s can't be rolled back while %s, cancelling it first", svc.Name, svc.State)
+		return r.Cancel(ctx)
+	}
+	return r.rollback(ctx, svc)
 }
 
-// startContainers starts the service containers if they were in a startable state.
-func startContainers(client *http.Client, cfg rancher.Config, svcConfig *rancher.Service) error {
-	// Get the instances to make sure are running:
-	req, err := http.NewRequest(http.MethodGet, svcConfig.Links.Instances, nil)
-	req.SetBasicAuth(cfg.RancherAccessKey, cfg.RancherSecretKey)
-	res, err := client.Do(req)
+// postAction POSTs to a resource action url and logs the response.
+func (r *rancherUpgrader) postAction(ctx context.Context, url string) error {
+	req, err := r.newRequest(ctx, http.MethodPost, url, nil)
 	if err != nil {
 		return err
 	}
-	defer res.Body.Close()
-	instances := rancher.Instances{}
-	err = json.NewDecoder(res.Body).Decode(&instances)
+	res, err := r.do(req)
 	if err != nil {
 		return err
 	}
-	// Make sure to start the instances if they can be started:
-	for _, container := range instances.Containers {
-		if container.Actions.Start == "" {
-			log.Printf("%s %s was in a %s state and could not be started", container.Type, container.ID, container.State)
-			continue
-		}
-		log.Printf("Starting %s %s which was in a %s state", container.Type, container.ID, container.State)
-		req, err := http.NewRequest(http.MethodPost, container.Actions.Start, nil)
-		req.SetBasicAuth(cfg.RancherAccessKey, cfg.RancherSecretKey)
-		res, err = client.Do(req)
-		if err != nil {
-			return err
-		}
+	defer res.Body.Close()
+	response, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("POST %s: %s: %s", url, res.Status, response)
 	}
+	r.progress(string(response))
 	return nil
 }
+
+// progress logs a line of the progress of a wait or action, unless QUIET is set.
+func (r *rancherUpgrader) progress(v ...interface{}) {
+	if !r.cfg.Quiet {
+		log.Println(v...)
+	}
+}
@@ -0,0 +1,71 @@
+package upgrader
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/richardbolt/rancher-upgrader/rancher"
+)
+
+// apiVersions are the versions of the Rancher API that are supported, the preferred first.
+var apiVersions = []string{"v2-beta", "v1"}
+
+// DetectAPIVersion returns the preferred version of the Rancher API of cfg that Rancher serves. The API
+// root lists them, and when it can't be read, e.g. because a proxy serves the UI there, each version
+// is tried in turn.
+func DetectAPIVersion(ctx context.Context, c *http.Client, cfg rancher.Config) (string, error) {
+	r := New(c, cfg).(*rancherUpgrader)
+	root := strings.TrimSuffix(cfg.RancherURL, "/")
+	var versions struct {
+		ResourceType string `json:"resourceType"`
+		Data         []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := r.getJSON(ctx, root+"/", &versions); err == nil && versions.ResourceType == "apiVersion" {
+		served := map[string]struct{}{}
+		for _, v := range versions.Data {
+			served[v.ID] = struct{}{}
+		}
+		for _, v := range apiVersions {
+			if _, ok := served[v]; ok {
+				return v, nil
+			}
+		}
+	}
+	for _, v := range apiVersions {
+		ok, err := r.serves(ctx, root+"/"+v)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return v, nil
+		}
+	}
+	return "", fmt.Errorf("%s serves none of the Rancher API versions %s, set RANCHER_API_VERSION", root, strings.Join(apiVersions, ", "))
+}
+
+// serves returns true if the API version at versionURL exists. Rancher rejecting the API keys is an
+// error, as no version can be told from that.
+func (r *rancherUpgrader) serves(ctx context.Context, versionURL string) (bool, error) {
+	req, err := r.newRequest(ctx, http.MethodGet, versionURL, nil)
+	if err != nil {
+		return false, err
+	}
+	res, err := r.do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden:
+		body, _ := ioutil.ReadAll(res.Body)
+		return false, fmt.Errorf("GET %s: %s: %s", versionURL, res.Status, strings.TrimSpace(string(body)))
+	case res.StatusCode >= http.StatusBadRequest:
+		return false, nil
+	}
+	return strings.HasPrefix(res.Header.Get("Content-Type"), "application/json"), nil
+}
@@ -0,0 +1,65 @@
+package verify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// Certificate passes once every one of Addresses ("host:port") serves the certificate Cert (DER) over
+// TLS to ServerName, retrying each every Interval for at most Timeout. The certificate served is only
+// compared with Cert, not verified, as it may be signed by a CA the upgrader doesn't trust.
+type Certificate struct {
+	Addresses  []string
+	ServerName string
+	Cert       []byte
+	Timeout    time.Duration
+	Interval   time.Duration
+}
+
+// Verify implements Verifier.
+func (v Certificate) Verify(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, v.Timeout)
+	defer cancel()
+	for _, addr := range v.Addresses {
+		for {
+			err := v.check(ctx, addr)
+			if err == nil {
+				log.Printf("Certificate check of %s succeeded\n", addr)
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("certificate check of %s failed: %s", addr, err)
+			case <-time.After(v.Interval):
+			}
+		}
+	}
+	return nil
+}
+
+// check connects to addr once and compares the certificate it serves with Cert.
+func (v Certificate) check(ctx context.Context, addr string) error {
+	dialer := net.Dialer{Timeout: 10 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: v.ServerName, InsecureSkipVerify: true})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return err
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return fmt.Errorf("no certificate served")
+	}
+	if !bytes.Equal(certs[0].Raw, v.Cert) {
+		return fmt.Errorf("serving %s (serial %s) rather than the new certificate", certs[0].Subject, certs[0].SerialNumber)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package verify
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/aws"
+)
+
+// CloudWatchAlarms passes if every one of AlarmNames stays in the OK state for Soak,
+// checking every Interval.
+type CloudWatchAlarms struct {
+	Client      *http.Client
+	Region      string
+	Credentials aws.Credentials
+	AlarmNames  []string
+	Soak        time.Duration
+	Interval    time.Duration
+}
+
+// Verify implements Verifier.
+func (v CloudWatchAlarms) Verify(ctx context.Context) error {
+	log.Printf("Checking CloudWatch alarms %v stay OK for %s\n", v.AlarmNames, v.Soak)
+	start := time.Now()
+	for {
+		states, err := v.describeAlarms(ctx)
+		if err != nil {
+			return fmt.Errorf("could not check CloudWatch alarms: %s", err)
+		}
+		for _, name := range v.AlarmNames {
+			state, ok := states[name]
+			if !ok {
+				return fmt.Errorf("CloudWatch alarm %s does not exist", name)
+			}
+			if state != "OK" {
+				return fmt.Errorf("CloudWatch alarm %s is %s", name, state)
+			}
+		}
+		if time.Since(start) >= v.Soak {
+			log.Printf("CloudWatch alarms %v stayed OK for %s\n", v.AlarmNames, v.Soak)
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(v.Interval):
+		}
+	}
+}
+
+// describeAlarms returns the state of each alarm in AlarmNames that exists, by name.
+func (v CloudWatchAlarms) describeAlarms(ctx context.Context) (map[string]string, error) {
+	form := url.Values{
+		"Action":  {"DescribeAlarms"},
+		"Version": {"2010-08-01"},
+	}
+	for i, name := range v.AlarmNames {
+		form.Set("AlarmNames.member."+strconv.Itoa(i+1), name)
+	}
+	body := []byte(form.Encode())
+	req, err := http.NewRequest(http.MethodPost, "https://monitoring."+v.Region+".amazonaws.com/", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	aws.Sign(req, body, v.Credentials, v.Region, "monitoring", time.Now())
+	res, err := v.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(b)))
+	}
+	result := struct {
+		MetricAlarms []struct {
+			AlarmName  string `xml:"AlarmName"`
+			StateValue string `xml:"StateValue"`
+		} `xml:"DescribeAlarmsResult>MetricAlarms>member"`
+		CompositeAlarms []struct {
+			AlarmName  string `xml:"AlarmName"`
+			StateValue string `xml:"StateValue"`
+		} `xml:"DescribeAlarmsResult>CompositeAlarms>member"`
+	}{}
+	if err := xml.Unmarshal(b, &result); err != nil {
+		return nil, err
+	}
+	states := map[string]string{}
+	for _, a := range result.MetricAlarms {
+		states[a.AlarmName] = a.StateValue
+	}
+	for _, a := range result.CompositeAlarms {
+		states[a.AlarmName] = a.StateValue
+	}
+	return states, nil
+}
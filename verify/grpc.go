@@ -0,0 +1,146 @@
+package verify
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+// grpcServing is the SERVING value of grpc.health.v1.HealthCheckResponse.ServingStatus.
+const grpcServing = 1
+
+// GRPCHealth passes once the standard grpc.health.v1.Health/Check of every one of Addresses
+// ("host:port", plaintext) reports Service as SERVING, retrying each every Interval for at most Timeout.
+// An empty Service checks the overall health of the server.
+type GRPCHealth struct {
+	Addresses []string
+	Service   string
+	Timeout   time.Duration
+	Interval  time.Duration
+}
+
+// Verify implements Verifier.
+func (v GRPCHealth) Verify(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, v.Timeout)
+	defer cancel()
+	// gRPC is HTTP/2, without TLS that needs prior knowledge (h2c).
+	protocols := http.Protocols{}
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: &protocols}}
+	for _, addr := range v.Addresses {
+		for {
+			err := v.check(ctx, client, addr)
+			if err == nil {
+				log.Printf("gRPC health check of %s succeeded\n", addr)
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("gRPC health check of %s failed: %s", addr, err)
+			case <-time.After(v.Interval):
+			}
+		}
+	}
+	return nil
+}
+
+// check makes a single Health/Check call to addr.
+func (v GRPCHealth) check(ctx context.Context, client *http.Client, addr string) error {
+	// HealthCheckRequest has a single string field, service = 1.
+	msg := []byte{}
+	if v.Service != "" {
+		l := make([]byte, binary.MaxVarintLen64)
+		msg = append([]byte{0x0a}, l[:binary.PutUvarint(l, uint64(len(v.Service)))]...)
+		msg = append(msg, v.Service...)
+	}
+	req, err := http.NewRequest(http.MethodPost, "http://"+addr+"/grpc.health.v1.Health/Check", bytes.NewReader(grpcFrame(msg)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("got HTTP status %s", res.Status)
+	}
+	// The gRPC status is in the trailers, or the headers for responses without a body.
+	status, message := res.Trailer.Get("Grpc-Status"), res.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, message = res.Header.Get("Grpc-Status"), res.Header.Get("Grpc-Message")
+	}
+	if status != "0" {
+		return fmt.Errorf("got gRPC status %s: %s", status, message)
+	}
+	servingStatus, err := parseHealthCheckResponse(body)
+	if err != nil {
+		return err
+	}
+	if servingStatus != grpcServing {
+		return fmt.Errorf("service is not SERVING, got status %d", servingStatus)
+	}
+	return nil
+}
+
+// grpcFrame prefixes an uncompressed message with the gRPC length-prefixed message header.
+func grpcFrame(msg []byte) []byte {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+// parseHealthCheckResponse returns the status (field 1, an enum) of a framed HealthCheckResponse.
+func parseHealthCheckResponse(frame []byte) (uint64, error) {
+	if len(frame) < 5 {
+		return 0, errors.New("short gRPC response")
+	}
+	if frame[0] != 0 {
+		return 0, errors.New("compressed gRPC responses are not supported")
+	}
+	msg := frame[5:]
+	if n := binary.BigEndian.Uint32(frame[1:5]); int(n) <= len(msg) {
+		msg = msg[:n]
+	}
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return 0, errors.New("invalid gRPC response")
+		}
+		msg = msg[n:]
+		field, wireType := key>>3, key&7
+		switch wireType {
+		case 0: // varint
+			value, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return 0, errors.New("invalid gRPC response")
+			}
+			if field == 1 {
+				return value, nil
+			}
+			msg = msg[n:]
+		case 2: // length-delimited
+			l, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < l {
+				return 0, errors.New("invalid gRPC response")
+			}
+			msg = msg[n+int(l):]
+		default:
+			return 0, fmt.Errorf("unexpected protobuf wire type %d in gRPC response", wireType)
+		}
+	}
+	// An unset enum is its zero value, UNKNOWN.
+	return 0, nil
+}
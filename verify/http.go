@@ -0,0 +1,80 @@
+package verify
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// HTTP requests each of URLs Requests times and passes if at least Threshold percent of the
+// responses have the expected Status and a body matching BodyRegex.
+type HTTP struct {
+	Client    *http.Client
+	URLs      []string
+	Status    int
+	BodyRegex *regexp.Regexp
+	Requests  int
+	Threshold int
+	// Interval is the pause between requests to the same URL.
+	Interval time.Duration
+}
+
+// Verify implements Verifier.
+func (v HTTP) Verify(ctx context.Context) error {
+	for _, url := range v.URLs {
+		succeeded := 0
+		var lastErr error
+		for i := 0; i < v.Requests; i++ {
+			if i > 0 {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(v.Interval):
+				}
+			}
+			if err := v.check(ctx, url); err != nil {
+				lastErr = err
+				continue
+			}
+			succeeded++
+		}
+		percent := 100
+		if v.Requests > 0 {
+			percent = succeeded * 100 / v.Requests
+		}
+		log.Printf("HTTP check of %s: %d/%d requests succeeded\n", url, succeeded, v.Requests)
+		if percent < v.Threshold {
+			return fmt.Errorf("HTTP check of %s: %d/%d requests succeeded, %d%% required, last error: %s",
+				url, succeeded, v.Requests, v.Threshold, lastErr)
+		}
+	}
+	return nil
+}
+
+// check makes a single request to url.
+func (v HTTP) check(ctx context.Context, url string) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := v.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != v.Status {
+		return fmt.Errorf("got status %d, expected %d", res.StatusCode, v.Status)
+	}
+	if v.BodyRegex != nil && !v.BodyRegex.Match(body) {
+		return fmt.Errorf("body did not match %s", v.BodyRegex)
+	}
+	return nil
+}
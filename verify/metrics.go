@@ -0,0 +1,83 @@
+package verify
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/richardbolt/rancher-upgrader/metrics"
+)
+
+// Threshold compares a metric against a value, e.g. `sum(rate(http_errors_total[5m])) < 0.05`.
+type Threshold struct {
+	Expr  string
+	Op    string
+	Value float64
+}
+
+var thresholdRegex = regexp.MustCompile(`^(.+)\s(<=|>=|==|!=|<|>)\s*([-+]?[0-9.]+(?:[eE][-+]?[0-9]+)?)$`)
+
+// ParseThreshold parses an "expr op value" threshold. The last comparison in s is the threshold
+// so the expression itself may contain comparisons.
+func ParseThreshold(s string) (Threshold, error) {
+	m := thresholdRegex.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return Threshold{}, fmt.Errorf("invalid threshold %q, expected \"<expr> <op> <number>\"", s)
+	}
+	value, err := strconv.ParseFloat(m[3], 64)
+	if err != nil {
+		return Threshold{}, fmt.Errorf("invalid threshold %q: %s", s, err)
+	}
+	return Threshold{Expr: strings.TrimSpace(m[1]), Op: m[2], Value: value}, nil
+}
+
+// Passes returns true if v satisfies the threshold.
+func (t Threshold) Passes(v float64) bool {
+	switch t.Op {
+	case "<":
+		return v < t.Value
+	case "<=":
+		return v <= t.Value
+	case ">":
+		return v > t.Value
+	case ">=":
+		return v >= t.Value
+	case "==":
+		return v == t.Value
+	case "!=":
+		return v != t.Value
+	}
+	return false
+}
+
+func (t Threshold) String() string {
+	return fmt.Sprintf("%s %s %g", t.Expr, t.Op, t.Value)
+}
+
+// Metrics evaluates each of Thresholds with Provider over Window and passes if every value
+// satisfies its threshold. An expression returning no data fails.
+type Metrics struct {
+	Provider   metrics.Provider
+	Name       string
+	Thresholds []Threshold
+	Window     time.Duration
+}
+
+// Verify implements Verifier.
+func (v Metrics) Verify(ctx context.Context) error {
+	for _, t := range v.Thresholds {
+		value, err := v.Provider.Query(ctx, t.Expr, v.Window)
+		if err != nil {
+			return fmt.Errorf("%s query %s failed: %s", v.Name, t.Expr, err)
+		}
+		if !t.Passes(value) {
+			return fmt.Errorf("%s check failed: %s, got %g", v.Name, t, value)
+		}
+		log.Printf("%s check passed: %s, got %g\n", v.Name, t, value)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package verify
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// TestResults are the results of a test suite as the test command reported them in TAP or JUnit XML.
+type TestResults struct {
+	Passed  int `json:"passed"`
+	Failed  int `json:"failed"`
+	Skipped int `json:"skipped"`
+	// Failures are the names of the tests that failed.
+	Failures []string `json:"failures,omitempty"`
+}
+
+// Total returns how many tests ran, skipped ones left out.
+func (r TestResults) Total() int {
+	return r.Passed + r.Failed
+}
+
+func (r TestResults) String() string {
+	s := fmt.Sprintf("%d/%d tests passed", r.Passed, r.Total())
+	if r.Skipped > 0 {
+		s += fmt.Sprintf(", %d skipped", r.Skipped)
+	}
+	if len(r.Failures) > 0 {
+		s += ", failed: " + strings.Join(r.Failures, ", ")
+	}
+	return s
+}
+
+// ParseResults parses the results of a test suite in format, tap or junit.
+func ParseResults(format string, r io.Reader) (TestResults, error) {
+	switch format {
+	case "tap":
+		return ParseTAP(r)
+	case "junit":
+		return ParseJUnit(r)
+	}
+	return TestResults{}, fmt.Errorf("unknown test results format %s, expected tap or junit", format)
+}
+
+// tapLine is a test line of TAP: "ok" or "not ok", its number, its description and its directive.
+var tapLine = regexp.MustCompile(`^(not )?ok\b\s*(\d+)?\s*(?:-\s*)?([^#]*?)\s*(?:#\s*(\w+).*)?$`)
+
+// ParseTAP parses the results of a test suite in the Test Anything Protocol. Output that isn't TAP, e.g.
+// logs of the tests, and indented subtests are skipped. Tests with a SKIP directive are skipped and those
+// with a TODO directive aren't failures. Tests of the plan ("1..N") that didn't report are failures.
+func ParseTAP(r io.Reader) (TestResults, error) {
+	var results TestResults
+	planned, seen, tap := -1, 0, false
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		switch {
+		case strings.HasPrefix(line, "Bail out!"):
+			return results, fmt.Errorf("the tests bailed out: %s", strings.TrimSpace(strings.TrimPrefix(line, "Bail out!")))
+		case strings.HasPrefix(line, "1.."):
+			n, err := strconv.Atoi(strings.Fields(line[3:] + " ")[0])
+			if err == nil {
+				planned, tap = n, true
+			}
+			continue
+		}
+		m := tapLine.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		tap = true
+		seen++
+		name := m[3]
+		if name == "" {
+			name = "test " + strconv.Itoa(seen)
+		}
+		switch directive := strings.ToUpper(m[4]); {
+		case directive == "SKIP":
+			results.Skipped++
+		case m[1] == "" || directive == "TODO":
+			results.Passed++
+		default:
+			results.Failed++
+			results.Failures = append(results.Failures, name)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return results, err
+	}
+	if !tap {
+		return results, fmt.Errorf("no TAP test results")
+	}
+	for n := seen + 1; n <= planned; n++ {
+		results.Failed++
+		results.Failures = append(results.Failures, fmt.Sprintf("test %d (did not report)", n))
+	}
+	return results, nil
+}
+
+// junitSuite is a <testsuites> or <testsuite> element of JUnit XML.
+type junitSuite struct {
+	Suites []junitSuite `xml:"testsuite"`
+	Cases  []junitCase  `xml:"testcase"`
+}
+
+// junitCase is a <testcase> element of JUnit XML.
+type junitCase struct {
+	Name      string    `xml:"name,attr"`
+	Classname string    `xml:"classname,attr"`
+	Failure   *struct{} `xml:"failure"`
+	Error     *struct{} `xml:"error"`
+	Skipped   *struct{} `xml:"skipped"`
+}
+
+// ParseJUnit parses the results of a test suite in JUnit XML, with <testsuites> or a <testsuite> at its
+// root. Test cases with errors are failures.
+func ParseJUnit(r io.Reader) (TestResults, error) {
+	var root junitSuite
+	if err := xml.NewDecoder(r).Decode(&root); err != nil {
+		return TestResults{}, fmt.Errorf("invalid JUnit XML: %s", err)
+	}
+	var results TestResults
+	var add func(s junitSuite)
+	add = func(s junitSuite) {
+		for _, c := range s.Cases {
+			switch {
+			case c.Failure != nil || c.Error != nil:
+				name := c.Name
+				if c.Classname != "" {
+					name = c.Classname + "." + name
+				}
+				results.Failed++
+				results.Failures = append(results.Failures, name)
+			case c.Skipped != nil:
+				results.Skipped++
+			default:
+				results.Passed++
+			}
+		}
+		for _, child := range s.Suites {
+			add(child)
+		}
+	}
+	add(root)
+	return results, nil
+}
@@ -0,0 +1,40 @@
+package verify
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// TCP passes once every one of Addresses ("host:port") accepts a connection, retrying each
+// every Interval for at most Timeout.
+type TCP struct {
+	Addresses []string
+	Timeout   time.Duration
+	Interval  time.Duration
+}
+
+// Verify implements Verifier.
+func (v TCP) Verify(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, v.Timeout)
+	defer cancel()
+	dialer := net.Dialer{}
+	for _, addr := range v.Addresses {
+		for {
+			conn, err := dialer.DialContext(ctx, "tcp", addr)
+			if err == nil {
+				conn.Close()
+				log.Printf("TCP check of %s succeeded\n", addr)
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("TCP check of %s failed: %s", addr, err)
+			case <-time.After(v.Interval):
+			}
+		}
+	}
+	return nil
+}
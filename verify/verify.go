@@ -0,0 +1,10 @@
+// Package verify has the built-in verifiers that check an upgraded service before the upgrade is finished,
+// so simple checks don't need an external test command.
+package verify
+
+import "context"
+
+// Verifier checks the upgraded service, returning an error if it isn't working.
+type Verifier interface {
+	Verify(ctx context.Context) error
+}